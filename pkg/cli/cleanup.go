@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/woliveiras/klon/pkg/clone"
+)
+
+// runCleanup implements `klon cleanup`: it unmounts, in reverse order, the
+// filesystems a crashed or killed run left mounted, such as /mnt/clone and
+// the temporary klon-src-* mounts, releases the snapshots it left behind and
+// brings back the systemd units it quiesced, using the mount registry runs
+// keep.
+func runCleanup(args []string, ui UI) error {
+	fs := flag.NewFlagSet("klon cleanup", flag.ContinueOnError)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: klon cleanup")
+	}
+
+	unmounted, released, resumed, err := clone.CleanupMounts(defaultMountRegistry)
+	for _, m := range unmounted {
+		ui.Printf("Unmounted %s from %s.\n", m.Device, m.Target)
+	}
+	for _, s := range released {
+		ui.Printf("Released the %s.\n", s)
+	}
+	for _, u := range resumed {
+		if u.Mode == clone.QuiesceFreeze {
+			ui.Printf("Thawed %s.\n", u.Unit)
+		} else {
+			ui.Printf("Started %s again.\n", u.Unit)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot clean up the mounts left by Klon: %w", err)
+	}
+	if len(unmounted) == 0 && len(released) == 0 && len(resumed) == 0 {
+		ui.Println("Nothing left mounted by Klon.")
+	}
+	return nil
+}
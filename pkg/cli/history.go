@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/woliveiras/klon/pkg/clone"
+)
+
+// runHistory implements `klon history [--journal path] [run-id]` and
+// `klon history --last-success <disk>`: it lists the runs recorded in the
+// state journal, shows one run step by step, or tells when a disk was last
+// cloned successfully.
+func runHistory(args []string, ui UI) error {
+	fs := flag.NewFlagSet("klon history", flag.ContinueOnError)
+	path := fs.String("journal", defaultJournalPath, "state journal to read")
+	lastSuccess := fs.String("last-success", "", "show the last successful clone onto this disk or image")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || (fs.NArg() == 1 && *lastSuccess != "") {
+		return fmt.Errorf("usage: klon history [--journal path] [run-id | --last-success <disk>]")
+	}
+
+	records, err := clone.ReadJournal(*path)
+	if err != nil {
+		return fmt.Errorf("cannot read the state journal %s: %w", *path, err)
+	}
+	runs := clone.SummarizeRuns(records)
+
+	switch {
+	case *lastSuccess != "":
+		r, ok := clone.LastSuccess(runs, *lastSuccess)
+		if !ok {
+			return fmt.Errorf("no successful clone onto %s in %s", *lastSuccess, *path)
+		}
+		ui.Printf("%s was last cloned successfully on %s from %s (run %s).\n", r.Destination, formatTime(r.Finished), r.Source, r.RunID)
+	case fs.NArg() == 1:
+		r, err := clone.FindRun(runs, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		ui.Printf("%s", formatRun(r))
+	case len(runs) == 0:
+		ui.Printf("No runs recorded in %s.\n", *path)
+	default:
+		ui.Printf("%s", formatRuns(runs))
+	}
+	return nil
+}
+
+// formatRuns renders one line per run, oldest first.
+func formatRuns(runs []clone.RunSummary) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tSTARTED\tRESULT\tSOURCE\tDESTINATION\tSTEPS\tDURATION")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.RunID, formatTime(r.Started), r.Result(), r.Source, r.Destination, stepCount(r), r.Duration().Round(time.Second))
+	}
+	w.Flush()
+	return b.String()
+}
+
+// formatRun renders a run with the result and timing of every step.
+func formatRun(r clone.RunSummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run %s\n", r.RunID)
+	fmt.Fprintf(&b, "  started:     %s\n", formatTime(r.Started))
+	fmt.Fprintf(&b, "  finished:    %s (%s)\n", formatTime(r.Finished), r.Duration().Round(time.Second))
+	result := r.Result()
+	if r.Error != "" {
+		result += ": " + r.Error
+	}
+	fmt.Fprintf(&b, "  result:      %s\n", result)
+	fmt.Fprintf(&b, "  source:      %s\n", r.Source)
+	fmt.Fprintf(&b, "  destination: %s\n", r.Destination)
+	if r.Strategy != "" {
+		fmt.Fprintf(&b, "  strategy:    %s (initialize: %v)\n", r.Strategy, r.Initialize)
+	}
+	if len(r.Steps) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  steps (%s):\n", stepCount(r))
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, s := range r.Steps {
+		status := "ok"
+		if s.Error != "" {
+			status = "FAILED"
+		}
+		fmt.Fprintf(w, "    %s\t%s\t%s\t%s\n", s.ID, status, (time.Duration(s.DurationMS) * time.Millisecond).Round(time.Second/10), s.Description)
+	}
+	w.Flush()
+	for _, s := range r.Steps {
+		if s.Error != "" {
+			fmt.Fprintf(&b, "  %s failed: %s\n", s.ID, s.Error)
+		}
+	}
+	return b.String()
+}
+
+// stepCount renders the steps a run finished out of those it planned.
+func stepCount(r clone.RunSummary) string {
+	if r.Planned == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d", len(r.Steps), r.Planned)
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05")
+}
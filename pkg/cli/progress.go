@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/woliveiras/klon/pkg/clone"
+)
+
+const (
+	// barInterval and logInterval throttle the progress bar and the
+	// progress log lines.
+	barInterval = 200 * time.Millisecond
+	logInterval = 30 * time.Second
+	barWidth    = 30
+)
+
+// progressRenderer shows the progress of the copy steps: as a bar redrawn in
+// place on a terminal, or as a log line every logInterval otherwise.
+type progressRenderer struct {
+	mu   sync.Mutex
+	out  io.Writer // nil: log lines instead of a bar
+	last time.Time
+	now  func() time.Time
+}
+
+// newProgressRenderer draws a bar on stderr when it is a terminal and the
+// run is not quiet.
+func newProgressRenderer(opts Options) *progressRenderer {
+	r := &progressRenderer{now: time.Now}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && !opts.Quiet {
+		r.out = os.Stderr
+	}
+	return r
+}
+
+func (r *progressRenderer) render(p clone.ProgressReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if r.out == nil {
+		// The summary of a finished step is logged by the runner.
+		if p.Final || now.Sub(r.last) < logInterval {
+			return
+		}
+		r.last = now
+		log.Printf("klon: PROGRESS: %s", p)
+		return
+	}
+	if !p.Final && now.Sub(r.last) < barInterval {
+		return
+	}
+	r.last = now
+	fmt.Fprintf(r.out, "\r\033[K%s %s", progressBar(p.Percent()), p)
+	if p.Final {
+		fmt.Fprintln(r.out)
+	}
+}
+
+// progressBar renders e.g. "[#########---------------------]  30%", or an
+// empty bar when the percentage is unknown.
+func progressBar(percent int) string {
+	if percent < 0 {
+		return "[" + strings.Repeat("-", barWidth) + "]"
+	}
+	filled := barWidth * percent / 100
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), percent)
+}
+
+// applyEvents returns the event handler the CLI uses while applying: it
+// announces every step and renders the copy progress.
+func applyEvents(ui UI, opts Options) func(clone.Event) {
+	progress := newProgressRenderer(opts)
+	return func(e clone.Event) {
+		switch e.Kind {
+		case clone.EventStepStarted:
+			if !opts.Quiet {
+				ui.Printf("[%d/%d] %s\n", e.StepIndex, e.StepCount, e.Step.Description)
+			}
+		case clone.EventProgress:
+			progress.render(*e.Progress)
+		}
+	}
+}
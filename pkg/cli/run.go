@@ -2,13 +2,19 @@ package cli
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/woliveiras/klon/pkg/clone"
 )
@@ -44,7 +50,30 @@ type Options struct {
 	ExcludeFromFiles     []string
 	Hostname             string
 	LogFile              string
-	NoopRunner           bool // --noop-runner (CI safe)
+	LogFormat            string // --log-format
+	JournalPath          string // --journal
+	CheckpointDir        string // --checkpoint-dir
+	NoopRunner           bool   // --noop-runner (CI safe)
+	PlanOutput           string // -o (write plan JSON)
+	ShrinkMarginPercent  int    // --shrink-margin
+	LayoutFile           string // --layout
+	Layout               *clone.LayoutSpec
+	ImageSizeArg         string // --image-size
+	ImageSizeBytes       int64
+	Source               string // --source
+	Format               string // --format
+	Mode                 string // --mode
+	Snapshot             bool   // --snapshot
+	QuiesceList          string // --quiesce
+	QuiesceSecondPass    bool   // --quiesce-second-pass
+	TwoPass              bool   // --two-pass
+	HooksDir             string // --hooks-dir
+	Quiesce              []clone.QuiesceUnit
+	// SourceRoot is where a --source disk or image is mounted while it is
+	// planned and cloned.
+	SourceRoot string
+	// RunID identifies this run in the logs and the state journal.
+	RunID string
 }
 
 // UI abstracts user interaction so we can support both interactive
@@ -101,30 +130,66 @@ func (u *stdUI) Confirm(prompt string) (bool, error) {
 // It validates arguments and, in plan mode, prints the planned clone
 // operations without touching any disks. When no destination is given
 // it will start an interactive wizard to help the user choose safe options.
+//
+// An interrupt, SIGTERM or SIGHUP cancels the run instead of killing Klon:
+// the running command is stopped and everything Klon mounted is unmounted
+// before Run returns.
 func Run(args []string) error {
-	return run(args, NewStdUI())
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	defer stop()
+	return runContext(ctx, args, NewStdUI())
 }
 
+// stopSignals cancel a run.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
 // run is the internal implementation that allows injecting a custom UI
 // (useful for tests and, later, different front-ends).
 func run(args []string, ui UI) error {
+	return runContext(context.Background(), args, ui)
+}
+
+// runContext runs the command given by args until ctx is cancelled. The
+// filesystems still mounted when it returns, because of an error, a panic
+// or a cancellation, are unmounted in reverse order.
+func runContext(ctx context.Context, args []string, ui UI) (err error) {
 	if len(args) == 0 {
 		return fmt.Errorf("no arguments provided")
 	}
 
+	clone.SetMountRegistry(defaultMountRegistry)
+	defer func() {
+		if unmountErr := clone.UnmountAll(); unmountErr != nil {
+			err = errors.Join(err, fmt.Errorf("%w; run klon cleanup once they are no longer busy", unmountErr))
+		}
+		clone.SetMountRegistry("")
+	}()
+
+	if len(args) > 1 {
+		switch args[1] {
+		case "plan":
+			return runPlan(ctx, args[1:], ui)
+		case "apply":
+			return runApply(ctx, args[1:], ui)
+		case "history":
+			return runHistory(args[1:], ui)
+		case "resume":
+			return runResume(ctx, args[1:], ui)
+		case "cleanup":
+			return runCleanup(args[1:], ui)
+		}
+	}
+
 	opts, rest, err := parseFlags(args)
 	if err != nil {
 		return err
 	}
 
-	if opts.LogFile != "" {
-		f, err := os.OpenFile(opts.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
-		if err != nil {
-			return fmt.Errorf("cannot open log file %s: %w", opts.LogFile, err)
-		}
-		defer f.Close()
-		log.SetOutput(f)
+	closeLog, err := setupLogFile(opts)
+	if err != nil {
+		return err
 	}
+	defer closeLog()
 
 	if len(rest) < 1 {
 		// No destination given: start interactive wizard.
@@ -135,9 +200,19 @@ func run(args []string, ui UI) error {
 		// Preserve non-interactive options like DestRoot and logging settings.
 		wizardOpts.DestRoot = opts.DestRoot
 		wizardOpts.LogFile = opts.LogFile
+		wizardOpts.LogFormat = opts.LogFormat
+		wizardOpts.JournalPath = opts.JournalPath
+		wizardOpts.CheckpointDir = opts.CheckpointDir
+		wizardOpts.RunID = opts.RunID
+		wizardOpts.Source = opts.Source
+		wizardOpts.Format = opts.Format
+		wizardOpts.HooksDir = opts.HooksDir
 		opts = wizardOpts
-	} else {
-		opts.Destination = rest[0]
+		if err := setDestination(&opts, opts.Destination); err != nil {
+			return err
+		}
+	} else if err := setDestination(&opts, rest[0]); err != nil {
+		return err
 	}
 
 	if opts.UseGPT && (opts.PartitionStrategy == "" || opts.PartitionStrategy == "new-layout") {
@@ -145,14 +220,411 @@ func run(args []string, ui UI) error {
 	}
 
 	if !opts.NoopRunner {
-		if err := clone.CheckPrerequisites(); err != nil {
+		if err := clone.CheckPrerequisites(buildPlanOptions(opts)); err != nil {
 			return fmt.Errorf("prerequisite check failed: %w", err)
 		}
 	} else if !opts.Quiet {
 		ui.Println("Skipping prerequisite checks because --noop-runner is enabled (no system commands will run).")
 	}
 
-	planOpts := clone.PlanOptions{
+	if clone.ImageFormatOf(opts.Source).Compressed() {
+		return runRestore(ctx, ui, opts)
+	}
+
+	if err := runPrePlanHooks(ctx, opts); err != nil {
+		return err
+	}
+	sys, closeSource, err := openSource(ctx, ui, &opts)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	planOpts := buildPlanOptions(opts)
+
+	plan, err := clone.PlanWithSystem(sys, planOpts)
+	if err != nil {
+		return err
+	}
+
+	// Always plan first: show the plan (unless quiet), write a state log, and
+	// then optionally apply after confirmation.
+	steps := clone.BuildExecutionSteps(plan, planOpts)
+
+	recordState(opts, plan, planOpts, steps, clone.PhasePlan, nil)
+
+	if err := writePlanOutput(ui, opts, plan, planOpts); err != nil {
+		return err
+	}
+	showPlan(ui, opts, plan, steps)
+
+	return applyPlan(ctx, ui, opts, plan, planOpts, steps, nil)
+}
+
+// runPlan implements `klon plan [flags] <destination>`: it computes and shows
+// the plan, optionally writes it to the file given with -o, and stops without
+// touching any disk.
+func runPlan(ctx context.Context, args []string, ui UI) error {
+	opts, rest, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 {
+		return fmt.Errorf("usage: klon plan [flags] -o plan.json <destination>")
+	}
+	if err := setDestination(&opts, rest[0]); err != nil {
+		return err
+	}
+	if opts.UseGPT && (opts.PartitionStrategy == "" || opts.PartitionStrategy == "new-layout") {
+		opts.PartitionStrategy = "new-layout-gpt"
+	}
+
+	closeLog, err := setupLogFile(opts)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	if err := runPrePlanHooks(ctx, opts); err != nil {
+		return err
+	}
+	sys, closeSource, err := openSource(ctx, ui, &opts)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	planOpts := buildPlanOptions(opts)
+	plan, err := clone.PlanWithSystem(sys, planOpts)
+	if err != nil {
+		return err
+	}
+	steps := clone.BuildExecutionSteps(plan, planOpts)
+
+	recordState(opts, plan, planOpts, steps, clone.PhasePlan, nil)
+
+	if err := writePlanOutput(ui, opts, plan, planOpts); err != nil {
+		return err
+	}
+	showPlan(ui, opts, plan, steps)
+	return nil
+}
+
+// runApply implements `klon apply [flags] plan.json`: it loads a plan written
+// by `klon plan -o`, re-inspects the system to make sure nothing drifted, and
+// then follows the normal safety/confirmation/apply flow. Planning options
+// come from the file; only execution flags (e.g. --dest-root, --auto-approve)
+// are taken from the command line.
+func runApply(ctx context.Context, args []string, ui UI) error {
+	opts, rest, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 {
+		return fmt.Errorf("usage: klon apply [flags] plan.json")
+	}
+
+	closeLog, err := setupLogFile(opts)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	pf, err := clone.ReadPlanFile(rest[0])
+	if err != nil {
+		return err
+	}
+	planOpts := pf.Options
+	opts.Destination = planOpts.Destination
+	opts.Initialize = planOpts.Initialize
+	opts.Source = planOpts.Source
+
+	if !opts.NoopRunner {
+		if err := clone.CheckPrerequisites(planOpts); err != nil {
+			return fmt.Errorf("prerequisite check failed: %w", err)
+		}
+	}
+
+	if err := runPrePlanHooks(ctx, opts); err != nil {
+		return err
+	}
+	sys, closeSource, err := openSource(ctx, ui, &opts)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	// The system is only re-planned to detect drift; what runs is the plan
+	// that was reviewed.
+	if pf, err = clone.CheckPlanFile(sys, pf); err != nil {
+		return fmt.Errorf("refusing to apply %s: the system no longer matches the plan: %w", rest[0], err)
+	}
+
+	showPlan(ui, opts, pf.Plan, pf.Steps)
+
+	return applyPlan(ctx, ui, opts, pf.Plan, planOpts, pf.Steps, nil)
+}
+
+// runResume implements `klon resume [flags] <destination>`: it continues a
+// clone onto destination that was interrupted, from the checkpoint it left.
+// The destination must still be the disk the clone wrote to and the system
+// must still produce the same plan; partitioning and formatting steps that
+// completed are skipped, everything else runs again. Like klon apply, the
+// planning options come from the checkpoint.
+func runResume(ctx context.Context, args []string, ui UI) error {
+	opts, rest, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 {
+		return fmt.Errorf("usage: klon resume [flags] <destination>")
+	}
+
+	closeLog, err := setupLogFile(opts)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	cp, err := clone.LoadCheckpoint(opts.CheckpointDir, rest[0])
+	if err != nil {
+		return err
+	}
+	if err := cp.Verify(); err != nil {
+		return fmt.Errorf("refusing to resume onto %s: %w", rest[0], err)
+	}
+	pf := cp.Plan
+	if cp.DoneOperation(clone.OpPrepareDisk) {
+		// The destination now has the partition table the interrupted run
+		// wrote, which Verify checked against the checkpoint.
+		pf.Plan.DestinationTableID = cp.Disk.TableID
+	}
+	planOpts := pf.Options
+	opts.Destination = planOpts.Destination
+	opts.Initialize = planOpts.Initialize
+	opts.Source = planOpts.Source
+
+	if !opts.NoopRunner {
+		if err := clone.CheckPrerequisites(planOpts); err != nil {
+			return fmt.Errorf("prerequisite check failed: %w", err)
+		}
+	}
+
+	if err := runPrePlanHooks(ctx, opts); err != nil {
+		return err
+	}
+	sys, closeSource, err := openSource(ctx, ui, &opts)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	if pf, err = clone.CheckPlanFile(sys, pf); err != nil {
+		return fmt.Errorf("refusing to resume onto %s: the system no longer matches the interrupted plan: %w", rest[0], err)
+	}
+
+	showPlan(ui, opts, pf.Plan, pf.Steps)
+	if !opts.Quiet {
+		ui.Printf("Resuming run %s: %d of %d steps completed before it was interrupted.\n", cp.RunID, len(cp.Completed), len(pf.Steps))
+	}
+
+	return applyPlan(ctx, ui, opts, pf.Plan, planOpts, pf.Steps, cp)
+}
+
+// hooks returns the hooks to run; --noop-runner runs none.
+func hooks(opts Options) clone.Hooks {
+	if opts.NoopRunner {
+		return clone.Hooks{}
+	}
+	return clone.Hooks{Dir: opts.HooksDir}
+}
+
+// runHooks runs the hooks of event for the whole run. Cancelling ctx kills
+// a hook that hangs.
+func runHooks(ctx context.Context, opts Options, event clone.HookEvent, operation string, err error) error {
+	env := clone.HookEnv{
+		Operation:       operation,
+		SourceDevice:    opts.Source,
+		DestinationDisk: opts.Destination,
+		DestRoot:        opts.DestRoot,
+	}
+	if event != clone.HookPrePlan && event != clone.HookPreApply {
+		env = env.WithResult(err)
+	}
+	return hooks(opts).Run(ctx, event, env)
+}
+
+// stateLogPath is the human-readable state log each run appends to; tests
+// point it elsewhere.
+var stateLogPath = "kln.state"
+
+// defaultJournalPath is the default of --journal; tests point it elsewhere.
+var defaultJournalPath = clone.DefaultJournalPath
+
+// defaultCheckpointDir is the default of --checkpoint-dir; tests point it
+// elsewhere.
+var defaultCheckpointDir = clone.DefaultCheckpointDir
+
+// defaultMountRegistry is where runs record their mounts for klon cleanup;
+// tests point it elsewhere.
+var defaultMountRegistry = clone.DefaultMountRegistryDir
+
+// journal returns the state journal of this run.
+func journal(opts Options) *clone.Journal {
+	return &clone.Journal{Path: opts.JournalPath, RunID: opts.RunID}
+}
+
+// recordState records phase in the kln.state log and the state journal.
+func recordState(opts Options, plan clone.PlanResult, planOpts clone.PlanOptions, steps []clone.ExecutionStep, phase string, err error) {
+	_ = clone.AppendStateLog(stateLogPath, plan, planOpts, steps, phase, err)
+	if jErr := journal(opts).Record(plan, planOpts, steps, phase, err); jErr != nil {
+		log.Printf("klon: WARNING: cannot write the state journal %s: %v", opts.JournalPath, jErr)
+	}
+}
+
+// runPrePlanHooks runs the pre-plan hooks and records their failure.
+func runPrePlanHooks(ctx context.Context, opts Options) error {
+	if err := runHooks(ctx, opts, clone.HookPrePlan, "plan", nil); err != nil {
+		recordState(opts, clone.PlanResult{}, buildPlanOptions(opts), nil, clone.PhasePlanFailed, err)
+		return err
+	}
+	return nil
+}
+
+// setDestination sets the destination, adding the --format suffix to an
+// image file name. Compressed images are always written from scratch.
+func setDestination(opts *Options, dest string) error {
+	if opts.Format != "" {
+		var err error
+		if dest, err = clone.WithImageFormat(dest, clone.ImageFormat(opts.Format)); err != nil {
+			return err
+		}
+	}
+	opts.Destination = dest
+	if clone.IsImageDestination(dest) && clone.ImageFormatOf(dest).Compressed() {
+		opts.Initialize = true
+	}
+	return nil
+}
+
+// runRestore writes a compressed image given with --source onto the
+// destination disk, decompressing it on the fly.
+func runRestore(ctx context.Context, ui UI, opts Options) error {
+	image, dest := opts.Source, opts.Destination
+	if clone.IsImageDestination(dest) {
+		return fmt.Errorf("compressed image %s can only be restored onto a disk, not onto %s", image, dest)
+	}
+	dest = "/dev/" + strings.TrimPrefix(dest, "/dev/")
+	if opts.NoopRunner {
+		if !opts.Quiet {
+			ui.Printf("Noop runner enabled: not restoring %s onto %s.\n", image, dest)
+		}
+		return nil
+	}
+	format := clone.ImageFormatOf(image)
+	if _, err := exec.LookPath(format.Tool()); err != nil {
+		return fmt.Errorf("restoring %s images needs %s; please install it", format, format.Tool())
+	}
+	if err := clone.ValidateRestoreSafety(image, dest); err != nil {
+		return fmt.Errorf("safety check failed: %w", err)
+	}
+	if !opts.Quiet && !opts.AutoApprove && !opts.UnattendedInit {
+		ok, err := ui.Confirm(fmt.Sprintf("WARNING: this will ERASE ALL DATA on %s and write the image %s onto it. Type yes to continue.", dest, image))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("restore cancelled by user")
+		}
+	}
+
+	plan := clone.PlanResult{SourceDisk: image, DestinationDisk: dest}
+	planOpts := clone.PlanOptions{Destination: dest, Initialize: true, Source: image}
+	err := clone.VerifyImageChecksum(image)
+	if err == nil {
+		if !opts.Quiet {
+			ui.Printf("Restoring %s onto %s...\n", image, dest)
+		}
+		err = clone.RestoreImage(ctx, image, dest)
+	}
+	if err != nil {
+		recordState(opts, plan, planOpts, nil, clone.PhaseApplyFailed, err)
+		return err
+	}
+	recordState(opts, plan, planOpts, nil, clone.PhaseApplySuccess, nil)
+	ui.Printf("Restored %s onto %s.\n", image, dest)
+	return nil
+}
+
+// setupLogFile redirects the stdlib logger to --log-file when given. With
+// --log-format, every log line and every command and step becomes a text or
+// JSON record carrying the run's ID. The returned function restores the
+// logger, closes the file and must always be called.
+func setupLogFile(opts Options) (func(), error) {
+	var out io.Writer = os.Stderr
+	prevOutput, prevFlags := log.Writer(), log.Flags()
+	closeFile := func() {}
+	if opts.LogFile != "" {
+		f, err := os.OpenFile(opts.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open log file %s: %w", opts.LogFile, err)
+		}
+		log.SetOutput(f)
+		out, closeFile = f, func() {
+			log.SetOutput(prevOutput)
+			f.Close()
+		}
+	}
+	if opts.LogFormat == "" {
+		return closeFile, nil
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(out, nil)
+	if opts.LogFormat == "json" {
+		handler = slog.NewJSONHandler(out, nil)
+	}
+	logger := slog.New(handler).With("run_id", opts.RunID)
+	prevLogger := slog.Default()
+	slog.SetDefault(logger)
+	clone.SetStructuredLogger(logger)
+	return func() {
+		clone.SetStructuredLogger(nil)
+		slog.SetDefault(prevLogger)
+		log.SetOutput(prevOutput)
+		log.SetFlags(prevFlags)
+		closeFile()
+	}, nil
+}
+
+// openSource mounts the --source disk or image read-only and returns the
+// System to plan with; without --source it returns the running system. The
+// returned function releases the source and must always be called.
+func openSource(ctx context.Context, ui UI, opts *Options) (clone.System, func(), error) {
+	if opts.Source == "" {
+		return clone.DefaultSystem, func() {}, nil
+	}
+	if opts.NoopRunner {
+		return nil, nil, fmt.Errorf("--source has to be mounted to be planned and cannot be used with --noop-runner")
+	}
+	src, err := clone.OpenSource(ctx, opts.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.SourceRoot = src.Root
+	if !opts.Quiet {
+		ui.Printf("Source %s (%s) mounted read-only on %s.\n", opts.Source, src.Disk, src.Root)
+	}
+	return src.System(), func() {
+		if err := src.Close(context.Background()); err != nil {
+			log.Printf("klon: WARNING: cannot release source %s: %v", opts.Source, err)
+		}
+	}, nil
+}
+
+// buildPlanOptions maps CLI options to the options understood by the clone
+// package.
+func buildPlanOptions(opts Options) clone.PlanOptions {
+	return clone.PlanOptions{
 		Destination:         opts.Destination,
 		Initialize:          opts.Initialize,
 		ForceTwoPartitions:  opts.ForceTwoPartitions,
@@ -174,39 +646,64 @@ func run(args []string, ui UI) error {
 		Unattended:          opts.Unattended,
 		UnattendedInit:      opts.UnattendedInit,
 		Verbose:             opts.Verbose,
-		PartitionStrategy:   opts.PartitionStrategy,
+		PartitionStrategy:   clone.PartitionStrategy(opts.PartitionStrategy),
 		ExcludePatterns:     opts.ExcludePatterns,
 		ExcludeFromFiles:    opts.ExcludeFromFiles,
 		Hostname:            opts.Hostname,
+		ShrinkMarginPercent: &opts.ShrinkMarginPercent,
+		LayoutSpec:          opts.Layout,
+		ImageSizeBytes:      opts.ImageSizeBytes,
+		Source:              opts.Source,
+		CopyMode:            clone.CopyMode(opts.Mode),
+		Snapshot:            opts.Snapshot,
+		Quiesce:             opts.Quiesce,
+		TwoPass:             opts.TwoPass,
+		QuiesceSecondPass:   opts.QuiesceSecondPass,
 	}
+}
 
-	plan, err := clone.Plan(planOpts)
-	if err != nil {
+// writePlanOutput writes the plan to the -o file, if one was requested.
+func writePlanOutput(ui UI, opts Options, plan clone.PlanResult, planOpts clone.PlanOptions) error {
+	if opts.PlanOutput == "" {
+		return nil
+	}
+	if err := clone.WritePlanFile(opts.PlanOutput, clone.NewPlanFile(plan, planOpts)); err != nil {
 		return err
 	}
-
-	// Always plan first: show the plan (unless quiet), write a state log, and
-	// then optionally apply after confirmation.
-	steps := clone.BuildExecutionSteps(plan, planOpts)
-
-	_ = clone.AppendStateLog("kln.state", plan, planOpts, steps, "PLAN", nil)
-
 	if !opts.Quiet {
-		ui.Println(plan.String())
+		ui.Printf("Plan written to %s. Apply it later with: klon apply %s\n", opts.PlanOutput, opts.PlanOutput)
+	}
+	return nil
+}
 
-		if opts.Verbose {
-			ui.Println("Planned execution steps:")
-			for _, step := range steps {
-				ui.Println("  -", step.Operation, ":", step.Description)
-			}
+// showPlan prints the plan and, in verbose mode, the execution steps.
+func showPlan(ui UI, opts Options, plan clone.PlanResult, steps []clone.ExecutionStep) {
+	if opts.Quiet {
+		return
+	}
+	ui.Println(plan.String())
+
+	if opts.Verbose {
+		ui.Println("Planned execution steps:")
+		for _, step := range steps {
+			ui.Println("  -", step.Operation, ":", step.Description)
 		}
 	}
+}
 
+// applyPlan runs safety checks, asks for confirmation and then applies,
+// adjusts and verifies the clone, recording the outcome in the state log.
+// Completed steps are checkpointed until the clone is done; resume is the
+// checkpoint of an interrupted clone to continue, or nil to start over.
+func applyPlan(ctx context.Context, ui UI, opts Options, plan clone.PlanResult, planOpts clone.PlanOptions, steps []clone.ExecutionStep, resume *clone.Checkpoint) error {
 	if opts.NoopRunner {
 		if !opts.Quiet {
 			ui.Println("Skipping safety checks because --noop-runner is enabled (no system commands will run).")
 		}
 	} else {
+		if err := clone.CheckPlanPrerequisites(plan); err != nil {
+			return fmt.Errorf("prerequisite check failed: %w", err)
+		}
 		if err := clone.ValidateCloneSafety(plan, planOpts); err != nil {
 			return fmt.Errorf("safety check failed: %w", err)
 		}
@@ -237,11 +734,25 @@ func run(args []string, ui UI) error {
 		if !strings.HasPrefix(destDev, "/dev/") {
 			destDev = "/dev/" + destDev
 		}
+		source := plan.SourceDisk
+		if opts.Source != "" {
+			source = opts.Source
+		}
 		msg := fmt.Sprintf(
 			"WARNING: this will ERASE ALL DATA on %s and recreate partitions cloned from %s. Type yes to continue.",
 			destDev,
-			plan.SourceDisk,
+			source,
 		)
+		if resume != nil {
+			msg = fmt.Sprintf("This will resume the interrupted clone of %s onto %s, skipping the %d steps that completed. Type yes to continue.", source, opts.Destination, len(resume.Completed))
+		} else if clone.IsImageDestination(opts.Destination) {
+			msg = fmt.Sprintf("This will write a clone of %s to the image file %s, replacing it if it exists. Type yes to continue.", source, opts.Destination)
+			if format := clone.ImageFormatOf(opts.Destination); format.Compressed() {
+				msg = fmt.Sprintf("This will write a %s-compressed clone of %s to %s, replacing it if it exists. Type yes to continue.", format.Tool(), source, opts.Destination)
+			} else if !planOpts.Initialize {
+				msg = fmt.Sprintf("This will sync %s into the existing image file %s. Type yes to continue.", source, opts.Destination)
+			}
+		}
 		ok, err := ui.Confirm(msg)
 		if err != nil {
 			return err
@@ -251,39 +762,149 @@ func run(args []string, ui UI) error {
 		}
 	}
 
-	var runner clone.Runner
-	if opts.NoopRunner {
-		runner = clone.NewNoopRunner()
-	} else {
-		runner = clone.NewCommandRunner(opts.DestRoot, opts.PartitionStrategy, planOpts.ExcludePatterns, planOpts.ExcludeFromFiles, opts.Destination, opts.DeleteDest, opts.DeleteRoot)
-	}
-	if err := clone.Apply(plan, planOpts, runner); err != nil {
-		_ = clone.AppendStateLog("kln.state", plan, planOpts, steps, "APPLY_FAILED", err)
+	// Failures run the on-failure hooks before they are recorded, also
+	// after an interrupt: until the next one.
+	fail := func(err error) error {
+		hookCtx, stop := ctx, func() {}
+		if ctx.Err() != nil {
+			hookCtx, stop = signal.NotifyContext(context.WithoutCancel(ctx), stopSignals...)
+		}
+		defer stop()
+		if hookErr := runHooks(hookCtx, opts, clone.HookOnFailure, "apply", err); hookErr != nil {
+			err = errors.Join(err, hookErr)
+		}
+		recordState(opts, plan, planOpts, steps, clone.PhaseApplyFailed, err)
 		return err
 	}
+	if err := runHooks(ctx, opts, clone.HookPreApply, "apply", nil); err != nil {
+		return fail(err)
+	}
 
-	if err := clone.AdjustSystem(plan, planOpts, opts.DestRoot); err != nil {
-		_ = clone.AppendStateLog("kln.state", plan, planOpts, steps, "APPLY_FAILED", err)
-		return err
+	// Image files are attached to a loop device and cloned like a disk.
+	// Compressed images are cloned into a raw image next to them first.
+	target, targetOpts := plan, planOpts
+	var img *clone.AttachedImage
+	format := clone.ImageFormatOf(planOpts.Destination)
+	if clone.IsImageDestination(planOpts.Destination) {
+		imagePath := planOpts.Destination
+		if format.Compressed() {
+			imagePath = clone.ExportImagePath(imagePath)
+			defer os.Remove(imagePath)
+		}
+		var err error
+		create := planOpts.Initialize && !resume.DoneOperation(clone.OpPrepareDisk)
+		img, err = clone.AttachImage(ctx, imagePath, plan.DestinationSizeBytes, create)
+		if err != nil {
+			return fail(err)
+		}
+		if !opts.Quiet {
+			ui.Printf("Image %s attached as %s.\n", img.Path, img.LoopDevice)
+		}
+		target, targetOpts = img.Target(plan, planOpts)
 	}
 
-	if err := clone.VerifyClone(plan, planOpts, opts.DestRoot); err != nil {
-		_ = clone.AppendStateLog("kln.state", plan, planOpts, steps, "APPLY_FAILED", err)
-		return err
+	if jErr := journal(opts).Record(plan, planOpts, steps, clone.PhaseApplyStarted, nil); jErr != nil {
+		log.Printf("klon: WARNING: cannot write the state journal %s: %v", opts.JournalPath, jErr)
+	}
+
+	// Compressed images are written from a temporary raw image that is
+	// removed on failure, so there is nothing to resume.
+	cp := resume
+	if cp == nil && !format.Compressed() {
+		var cpErr error
+		if cp, cpErr = clone.NewCheckpoint(opts.CheckpointDir, opts.RunID, clone.NewPlanFile(plan, planOpts)); cpErr != nil {
+			log.Printf("klon: WARNING: cannot write a checkpoint; an interrupted clone cannot be resumed: %v", cpErr)
+		}
+	}
+
+	var quiescer *clone.Quiescer
+	if len(planOpts.Quiesce) > 0 && planOpts.Source == "" {
+		quiescer = clone.NewQuiescer(planOpts.Quiesce)
+	}
+	secondPass, err := runPipeline(ctx, ui, opts, target, targetOpts, quiescer, cp)
+	if quiescer != nil {
+		plan.Quiesce = quiescer.Units()
+	}
+	plan.SecondPass = secondPass
+	if err == nil && format.Compressed() {
+		err = clone.DiscardFreeBlocks(ctx, target, opts.DestRoot)
+	}
+	if img != nil {
+		if detachErr := img.Detach(context.Background()); detachErr != nil && err == nil {
+			err = detachErr
+		}
+	}
+	if err == nil && format.Compressed() {
+		if !opts.Quiet {
+			ui.Printf("Compressing %s into %s...\n", img.Path, planOpts.Destination)
+		}
+		var sum string
+		if sum, err = clone.ExportImage(ctx, img.Path, planOpts.Destination, format); err == nil && !opts.Quiet {
+			ui.Printf("Wrote %s (sha256 %s).\n", planOpts.Destination, sum)
+		}
+	}
+	if err != nil {
+		if cp != nil {
+			ui.Printf("Run klon resume %s to continue from the last completed step.\n", planOpts.Destination)
+		}
+		return fail(err)
 	}
 
-	_ = clone.AppendStateLog("kln.state", plan, planOpts, steps, "APPLY_SUCCESS", nil)
+	recordState(opts, plan, planOpts, steps, clone.PhaseApplySuccess, nil)
+	if err := cp.Remove(); err != nil {
+		log.Printf("klon: WARNING: cannot remove the checkpoint %s: %v", cp.Path(), err)
+	}
 
 	ui.Println(plan.String())
 	return nil
 }
 
+// runPipeline prepares, syncs, adjusts and verifies the destination, and
+// returns what the second sync pass changed, if there was one. Cancelling
+// ctx (an interrupt, see Run) stops the running step instead of killing
+// Klon, so the quiesced services are always brought back and the
+// destination is unmounted. Completed steps are recorded in cp.
+func runPipeline(ctx context.Context, ui UI, opts Options, plan clone.PlanResult, planOpts clone.PlanOptions, quiescer *clone.Quiescer, cp *clone.Checkpoint) ([]clone.SyncChanges, error) {
+	show, j := applyEvents(ui, opts), journal(opts)
+	ctx = clone.WithEventHandler(ctx, func(e clone.Event) {
+		show(e)
+		j.Event(e)
+	})
+	runner := clone.NewCommandRunnerWithContext(ctx, opts.DestRoot, planOpts.PartitionStrategy, planOpts.ExcludePatterns, planOpts.ExcludeFromFiles, planOpts.Destination, planOpts.DeleteDest, planOpts.DeleteRoot)
+	runner.SourceRoot = opts.SourceRoot
+	runner.Progress = clone.NewProgressTracker(plan, nil)
+	hooked := clone.HookRunner{Runner: runner, Hooks: hooks(opts), DestRoot: opts.DestRoot, Ctx: ctx}
+	err := clone.ApplyCheckpointed(ctx, plan, planOpts, hooked, quiescer, cp)
+	interrupted := ctx.Err() != nil
+	if err != nil {
+		return runner.SecondPass, err
+	}
+	if interrupted {
+		return runner.SecondPass, fmt.Errorf("interrupted while applying the plan")
+	}
+	if err := runHooks(ctx, opts, clone.HookPostSync, "sync", nil); err != nil {
+		return runner.SecondPass, err
+	}
+	if err := clone.AdjustSystemWithContext(ctx, plan, planOpts, opts.DestRoot); err != nil {
+		return runner.SecondPass, err
+	}
+	if err := runHooks(ctx, opts, clone.HookPostAdjust, "adjust", nil); err != nil {
+		return runner.SecondPass, err
+	}
+	if err := clone.VerifyCloneWithContext(ctx, plan, planOpts, opts.DestRoot); err != nil {
+		return runner.SecondPass, err
+	}
+	return runner.SecondPass, runHooks(ctx, opts, clone.HookPostVerify, "verify", nil)
+}
+
 // parseFlags parses command-line flags into Options and returns the remaining
 // non-flag arguments (typically the destination disk).
 func parseFlags(args []string) (Options, []string, error) {
 	fs := flag.NewFlagSet("klon", flag.ContinueOnError)
 	opts := Options{
 		DestRoot: "/mnt/clone",
+		HooksDir: clone.DefaultHooksDir,
+		RunID:    clone.NewRunID(),
 	}
 	var excludeList string
 	var excludeFromList string
@@ -315,8 +936,24 @@ fs.BoolVar(&opts.NoopRunner, "noop-runner", false, "do not run any system comman
 	fs.StringVar(&excludeFromList, "exclude-from", "", "comma-separated files with rsync exclude patterns")
 	fs.StringVar(&mountList, "mountdir", "", "comma-separated list of mountpoints to sync instead of all")
 	fs.BoolVar(&opts.UseGPT, "gpt", false, "when using new-layout, create a GPT with FAT32 boot and ext root")
+	fs.StringVar(&opts.PartitionStrategy, "strategy", "", "partition strategy when initializing: clone-table (default), new-layout, new-layout-gpt or shrink-table")
+	fs.IntVar(&opts.ShrinkMarginPercent, "shrink-margin", 10, "with shrink-table, free space to keep on the shrunken partition, in percent of its used bytes")
 	fs.StringVar(&opts.Hostname, "hostname", "", "set hostname on cloned system")
 	fs.StringVar(&opts.LogFile, "log-file", "", "append logs to this file instead of stderr")
+	fs.StringVar(&opts.LogFormat, "log-format", "", "write logs as structured text or json records with run and step IDs")
+	fs.StringVar(&opts.JournalPath, "journal", defaultJournalPath, "append the runs and the results of their steps to this JSONL state journal (empty disables it)")
+	fs.StringVar(&opts.CheckpointDir, "checkpoint-dir", defaultCheckpointDir, "keep the checkpoints of unfinished clones, used by klon resume, in this directory")
+	fs.StringVar(&opts.LayoutFile, "layout", "", "create the destination partitions described in this layout file (requires -f)")
+	fs.StringVar(&opts.ImageSizeArg, "image-size", "", "size of a new image file destination (e.g. 16G); default fits the source partitions")
+	fs.StringVar(&opts.Source, "source", "", "clone this disk or image file (mounted read-only) instead of the running system; a compressed image is restored onto the destination disk")
+	fs.StringVar(&opts.Mode, "mode", "", "how partitions are copied: rsync (default) or block (allocated blocks of unmounted or read-only ext/FAT filesystems, rsync for the rest)")
+	fs.BoolVar(&opts.Snapshot, "snapshot", false, "sync mounted partitions from LVM or btrfs snapshots, or freeze small ones such as /boot, for a crash-consistent copy")
+	fs.StringVar(&opts.QuiesceList, "quiesce", "", "comma-separated systemd units to stop while syncing and start again afterwards; add :freeze to freeze a unit instead (e.g. postgresql,docker:freeze)")
+	fs.BoolVar(&opts.TwoPass, "two-pass", false, "sync the mounted partitions a second time after the first pass to catch files that changed meanwhile")
+	fs.BoolVar(&opts.QuiesceSecondPass, "quiesce-second-pass", false, "with --two-pass, stop the --quiesce units only during the second pass")
+	fs.StringVar(&opts.HooksDir, "hooks-dir", clone.DefaultHooksDir, "directory with pre-plan, pre-apply, pre-step, post-step, post-sync, post-adjust, post-verify and on-failure hooks (empty disables hooks)")
+	fs.StringVar(&opts.Format, "format", "", "image file format: img (raw, sparse), img.zst, img.gz or img.xz (compressed, with a .sha256 checksum; needs free space for twice the used data, as the raw clone is kept until it is compressed)")
+	fs.StringVar(&opts.PlanOutput, "o", "", "write the computed plan to this JSON file (apply it later with klon apply)")
 	fs.StringVar(&opts.EditFstabName, "edit-fstab", "", "edit destination fstab to change device names to this disk prefix (e.g. sda)")
 	fs.StringVar(&opts.LabelPartitions, "label-partitions", "", "label ext partitions (suffix # applies numbering)")
 
@@ -326,6 +963,30 @@ fs.BoolVar(&opts.NoopRunner, "noop-runner", false, "do not run any system comman
 
 	opts.SetupArgs = setupList
 
+	switch clone.PartitionStrategy(opts.PartitionStrategy) {
+	case "", clone.StrategyCloneTable, clone.StrategyNewLayout, clone.StrategyNewLayoutGPT, clone.StrategyShrinkTable:
+	default:
+		return Options{}, nil, fmt.Errorf("invalid --strategy %q", opts.PartitionStrategy)
+	}
+	if opts.ShrinkMarginPercent < 0 {
+		return Options{}, nil, fmt.Errorf("invalid --shrink-margin %d: must not be negative", opts.ShrinkMarginPercent)
+	}
+
+	if opts.LayoutFile != "" {
+		if !opts.Initialize {
+			return Options{}, nil, fmt.Errorf("--layout re-partitions the destination and requires -f")
+		}
+		if opts.PartitionStrategy != "" || opts.UseGPT {
+			return Options{}, nil, fmt.Errorf("--layout cannot be combined with --strategy or --gpt; set table: gpt in the layout file instead")
+		}
+		spec, err := clone.ReadLayoutSpec(opts.LayoutFile)
+		if err != nil {
+			return Options{}, nil, err
+		}
+		opts.Layout = spec
+		opts.PartitionStrategy = string(clone.StrategyLayoutFile)
+	}
+
 	if opts.BootPartitionSizeArg != "" {
 		sizeBytes, err := parseSizeToBytes(opts.BootPartitionSizeArg)
 		if err != nil {
@@ -333,6 +994,45 @@ fs.BoolVar(&opts.NoopRunner, "noop-runner", false, "do not run any system comman
 		}
 		opts.P1SizeBytes = sizeBytes
 	}
+	if opts.ImageSizeArg != "" {
+		sizeBytes, err := parseSizeToBytes(opts.ImageSizeArg)
+		if err != nil {
+			return Options{}, nil, fmt.Errorf("invalid --image-size: %w", err)
+		}
+		opts.ImageSizeBytes = sizeBytes
+	}
+	if opts.Mode != "" {
+		if _, err := clone.ParseCopyMode(opts.Mode); err != nil {
+			return Options{}, nil, err
+		}
+	}
+	if opts.Snapshot && opts.Source != "" {
+		return Options{}, nil, fmt.Errorf("--snapshot cannot be combined with --source, which is already mounted read-only")
+	}
+	if opts.QuiesceList != "" {
+		if opts.Source != "" {
+			return Options{}, nil, fmt.Errorf("--quiesce stops services of the running system and cannot be combined with --source")
+		}
+		units, err := clone.ParseQuiesceUnits(opts.QuiesceList)
+		if err != nil {
+			return Options{}, nil, fmt.Errorf("invalid --quiesce: %w", err)
+		}
+		opts.Quiesce = units
+	}
+	if opts.TwoPass && opts.Source != "" {
+		return Options{}, nil, fmt.Errorf("--two-pass cannot be combined with --source, which does not change while it is cloned")
+	}
+	if opts.QuiesceSecondPass && (!opts.TwoPass || len(opts.Quiesce) == 0) {
+		return Options{}, nil, fmt.Errorf("--quiesce-second-pass requires --two-pass and --quiesce")
+	}
+	if opts.LogFormat != "" && opts.LogFormat != "text" && opts.LogFormat != "json" {
+		return Options{}, nil, fmt.Errorf("invalid --log-format %q: use text or json", opts.LogFormat)
+	}
+	if opts.Format != "" {
+		if _, err := clone.ParseImageFormat(opts.Format); err != nil {
+			return Options{}, nil, err
+		}
+	}
 
 	// Apply implied semantics.
 	if opts.Quiet {
@@ -437,7 +1137,7 @@ func interactiveWizard(ui UI) (Options, error) {
 
 	strategy := ""
 	if init {
-		answer, err := ui.Ask("Partition strategy: [c]lone existing layout or [n]ew layout? (default: c): ")
+		answer, err := ui.Ask("Partition strategy: [c]lone existing layout, [n]ew layout or [s]hrink existing layout to fit a smaller disk? (default: c): ")
 		if err != nil {
 			return Options{}, err
 		}
@@ -447,6 +1147,8 @@ func interactiveWizard(ui UI) (Options, error) {
 			strategy = "clone-table"
 		case "n", "new":
 			strategy = "new-layout"
+		case "s", "shrink":
+			strategy = "shrink-table"
 		default:
 			strategy = "clone-table"
 		}
@@ -1,11 +1,36 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/woliveiras/klon/pkg/clone"
 )
 
+func TestMain(m *testing.M) {
+	// Keep the runs of the tests out of the source tree and the real state
+	// journal, checkpoints and mount registry.
+	dir, err := os.MkdirTemp("", "klon-journal-")
+	if err != nil {
+		panic(err)
+	}
+	defaultJournalPath = filepath.Join(dir, "journal.jsonl")
+	defaultCheckpointDir = filepath.Join(dir, "checkpoints")
+	defaultMountRegistry = filepath.Join(dir, "mounts")
+	stateLogPath = filepath.Join(dir, "kln.state")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type fakeUI struct {
 	lines            []string
 	askResponses     []string
@@ -213,3 +238,404 @@ func TestParseFlags_ParsesCoreOptions(t *testing.T) {
 		t.Fatalf("expected DestRoot to be /custom/clone, got %q", opts.DestRoot)
 	}
 }
+
+func TestParseFlags_ShrinkStrategy(t *testing.T) {
+	opts, _, err := parseFlags([]string{"klon", "-f", "--strategy", "shrink-table", "--shrink-margin", "25", "sda"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.PartitionStrategy != "shrink-table" {
+		t.Fatalf("expected PartitionStrategy 'shrink-table', got %q", opts.PartitionStrategy)
+	}
+	if opts.ShrinkMarginPercent != 25 {
+		t.Fatalf("expected ShrinkMarginPercent 25, got %d", opts.ShrinkMarginPercent)
+	}
+
+	opts, _, err = parseFlags([]string{"klon", "-f", "--strategy", "shrink-table", "--shrink-margin", "0", "sda"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if margin := buildPlanOptions(opts).ShrinkMarginPercent; margin == nil || *margin != 0 {
+		t.Fatalf("expected an explicit zero margin to reach the plan options, got %v", margin)
+	}
+
+	if _, _, err := parseFlags([]string{"klon", "--strategy", "bogus", "sda"}); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestParseFlags_LayoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layout.yaml")
+	doc := "partitions:\n  - size: 256MiB\n    fs: vfat\n    mount: /boot\n  - size: rest\n    fs: ext4\n    mount: /\n"
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatalf("cannot write layout: %v", err)
+	}
+
+	if _, _, err := parseFlags([]string{"klon", "--layout", path, "sda"}); err == nil {
+		t.Fatalf("expected --layout without -f to fail")
+	}
+
+	opts, _, err := parseFlags([]string{"klon", "-f", "--layout", path, "sda"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.PartitionStrategy != "layout-file" || opts.Layout == nil || len(opts.Layout.Partitions) != 2 {
+		t.Fatalf("expected layout-file strategy with 2 partitions, got %q %+v", opts.PartitionStrategy, opts.Layout)
+	}
+}
+
+func TestParseFlags_ImageSize(t *testing.T) {
+	opts, rest, err := parseFlags([]string{"klon", "-f", "--image-size", "16G", "/mnt/nas/pi.img"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.ImageSizeBytes != 16<<30 {
+		t.Fatalf("expected ImageSizeBytes %d, got %d", int64(16<<30), opts.ImageSizeBytes)
+	}
+	if len(rest) != 1 || rest[0] != "/mnt/nas/pi.img" {
+		t.Fatalf("expected image destination in rest, got %#v", rest)
+	}
+
+	if _, _, err := parseFlags([]string{"klon", "--image-size", "lots", "/mnt/nas/pi.img"}); err == nil {
+		t.Fatalf("expected error for invalid --image-size")
+	}
+}
+
+func TestParseFlags_Source(t *testing.T) {
+	opts, rest, err := parseFlags([]string{"klon", "-f", "--source", "/srv/images/golden.img", "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Source != "/srv/images/golden.img" {
+		t.Fatalf("expected Source to be set, got %q", opts.Source)
+	}
+	if planOpts := buildPlanOptions(opts); planOpts.Source != opts.Source {
+		t.Fatalf("expected the source in the plan options, got %q", planOpts.Source)
+	}
+	if len(rest) != 1 || rest[0] != "sdb" {
+		t.Fatalf("expected destination in rest, got %#v", rest)
+	}
+
+	err = run([]string{"klon", "--noop-runner", "--source", "sdc", "sdb"}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "--noop-runner") {
+		t.Fatalf("expected --source with --noop-runner to fail, got %v", err)
+	}
+}
+
+func TestParseFlags_Format(t *testing.T) {
+	if _, _, err := parseFlags([]string{"klon", "--format", "zip", "/mnt/nas/pi"}); err == nil {
+		t.Fatalf("expected an unknown --format to fail")
+	}
+	opts, rest, err := parseFlags([]string{"klon", "--format", "img.zst", "/mnt/nas/pi"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := setDestination(&opts, rest[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Destination != "/mnt/nas/pi.img.zst" || !opts.Initialize {
+		t.Fatalf("expected a new compressed image destination, got %q (initialize %v)", opts.Destination, opts.Initialize)
+	}
+	if err := setDestination(&opts, "sdb"); err == nil {
+		t.Fatalf("expected --format with a disk destination to fail")
+	}
+
+	err = run([]string{"klon", "--noop-runner", "--source", "/mnt/nas/pi.img.zst", "/mnt/nas/copy.img"}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "only be restored onto a disk") {
+		t.Fatalf("expected restoring a compressed image into a file to fail, got %v", err)
+	}
+}
+
+func TestParseFlags_Mode(t *testing.T) {
+	opts, _, err := parseFlags([]string{"klon", "-f", "--mode", "block", "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if planOpts := buildPlanOptions(opts); planOpts.CopyMode != clone.CopyBlocks {
+		t.Fatalf("expected block copies in the plan options, got %q", planOpts.CopyMode)
+	}
+	if _, _, err := parseFlags([]string{"klon", "--mode", "dd", "sdb"}); err == nil {
+		t.Fatalf("expected an unknown --mode to fail")
+	}
+}
+
+func TestParseFlags_Snapshot(t *testing.T) {
+	opts, _, err := parseFlags([]string{"klon", "--snapshot", "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !buildPlanOptions(opts).Snapshot {
+		t.Fatalf("expected snapshots in the plan options")
+	}
+	if _, _, err := parseFlags([]string{"klon", "--snapshot", "--source", "/srv/pi.img", "sdb"}); err == nil {
+		t.Fatalf("expected --snapshot with --source to fail")
+	}
+}
+
+func TestParseFlags_Quiesce(t *testing.T) {
+	opts, _, err := parseFlags([]string{"klon", "--quiesce", "postgresql,docker:freeze", "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []clone.QuiesceUnit{{Unit: "postgresql", Mode: clone.QuiesceStop}, {Unit: "docker", Mode: clone.QuiesceFreeze}}
+	if got := buildPlanOptions(opts).Quiesce; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected units %+v", got)
+	}
+	if _, _, err := parseFlags([]string{"klon", "--quiesce", "docker:pause", "sdb"}); err == nil {
+		t.Fatalf("expected an unknown mode to fail")
+	}
+	if _, _, err := parseFlags([]string{"klon", "--quiesce", "docker", "--source", "sdc", "sdb"}); err == nil {
+		t.Fatalf("expected --quiesce with --source to fail")
+	}
+}
+
+func TestParseFlags_TwoPass(t *testing.T) {
+	opts, _, err := parseFlags([]string{"klon", "--two-pass", "--quiesce", "postgresql", "--quiesce-second-pass", "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if planOpts := buildPlanOptions(opts); !planOpts.TwoPass || !planOpts.QuiesceSecondPass {
+		t.Fatalf("expected two passes in the plan options, got %+v", planOpts)
+	}
+	if _, _, err := parseFlags([]string{"klon", "--quiesce-second-pass", "--quiesce", "postgresql", "sdb"}); err == nil {
+		t.Fatalf("expected --quiesce-second-pass without --two-pass to fail")
+	}
+	if _, _, err := parseFlags([]string{"klon", "--two-pass", "--source", "sdc", "sdb"}); err == nil {
+		t.Fatalf("expected --two-pass with --source to fail")
+	}
+}
+
+func TestSetupLogFile_JSON(t *testing.T) {
+	if _, _, err := parseFlags([]string{"klon", "--log-format", "yaml", "sdb"}); err == nil {
+		t.Fatalf("expected an unknown --log-format to fail")
+	}
+	opts, _, err := parseFlags([]string{"klon", "--log-format", "json", "--log-file", filepath.Join(t.TempDir(), "klon.log"), "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closeLog, err := setupLogFile(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	log.Printf("klon: source mounted")
+	closeLog()
+
+	data, err := os.ReadFile(opts.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("expected a JSON record, got %q: %v", data, err)
+	}
+	if record["msg"] != "klon: source mounted" || record["run_id"] == "" || record["run_id"] == nil {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestRunHooks_StopsWithTheRun(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pre-apply"), []byte("#!/bin/sh\nsleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := runHooks(ctx, Options{HooksDir: dir}, clone.HookPreApply, "apply", nil)
+	if err == nil || time.Since(start) > 10*time.Second {
+		t.Fatalf("expected the hung hook to be killed with the run, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestRunPlan_PrePlanHookAborts(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pre-plan"), []byte("#!/bin/sh\n[ \"$KLON_DESTINATION_DISK\" != sdb ]\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := run([]string{"klon", "plan", "--hooks-dir", dir, "sdb"}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "pre-plan hook") {
+		t.Fatalf("expected the pre-plan hook to abort planning, got %v", err)
+	}
+	if opts, _, _ := parseFlags([]string{"klon", "sdb"}); opts.HooksDir != clone.DefaultHooksDir {
+		t.Fatalf("unexpected default hooks dir %q", opts.HooksDir)
+	}
+}
+
+// fakeSystem is a clone.System with a Pi booting from an SD card and a
+// destination disk of a fixed size.
+type fakeSystem struct {
+	destSize int64
+}
+
+func (f fakeSystem) BootDisk() (string, error) {
+	return "/dev/mmcblk0p2", nil
+}
+
+func (f fakeSystem) MountedPartitions(disk string) ([]clone.MountedPartition, error) {
+	return []clone.MountedPartition{
+		{Device: "/dev/mmcblk0p1", Mountpoint: "/boot"},
+		{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+	}, nil
+}
+
+func (f fakeSystem) DiskSize(disk string) (int64, error) {
+	if disk == "/dev/sda" {
+		return f.destSize, nil
+	}
+	return 32 << 30, nil
+}
+
+// useSystem makes the CLI plan against sys for the rest of the test.
+func useSystem(t *testing.T, sys clone.System) {
+	t.Helper()
+	orig := clone.DefaultSystem
+	clone.DefaultSystem = sys
+	t.Cleanup(func() { clone.DefaultSystem = orig })
+}
+
+func TestRun_PlanWritesFileAndApplyReloadsIt(t *testing.T) {
+	useSystem(t, fakeSystem{destSize: 64 << 30})
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	ui := &fakeUI{}
+	if err := run([]string{"klon", "plan", "-o", path, "sda"}, ui); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	pf, err := clone.ReadPlanFile(path)
+	if err != nil {
+		t.Fatalf("expected plan file to be written: %v", err)
+	}
+	if pf.Plan.SourceDisk != "/dev/mmcblk0" || pf.Plan.DestinationSizeBytes != 64<<30 || len(pf.Steps) != 2 {
+		t.Fatalf("unexpected plan file %+v", pf)
+	}
+
+	ui = &fakeUI{}
+	if err := run([]string{"klon", "apply", "--noop-runner", path}, ui); err != nil {
+		t.Fatalf("expected unchanged plan to apply in noop mode, got %v", err)
+	}
+	foundPlan := false
+	for _, line := range ui.lines {
+		if strings.Contains(line, "Clone plan") {
+			foundPlan = true
+			break
+		}
+	}
+	if !foundPlan {
+		t.Fatalf("expected Clone plan output when applying a plan file, got: %#v", ui.lines)
+	}
+
+	// Another disk of another size is plugged in.
+	useSystem(t, fakeSystem{destSize: 16 << 30})
+	err = run([]string{"klon", "apply", "--noop-runner", path}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "no longer matches the plan") || !strings.Contains(err.Error(), "changed size") {
+		t.Fatalf("expected the drifted plan to be refused, got %v", err)
+	}
+}
+
+func TestRun_ApplyRequiresPlanFile(t *testing.T) {
+	err := run([]string{"klon", "apply"}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+}
+
+func TestProgressRenderer_Bar(t *testing.T) {
+	var out strings.Builder
+	clock := time.Unix(0, 0)
+	r := &progressRenderer{out: &out, now: func() time.Time { return clock }}
+	p := clone.ProgressReport{Step: "sync-filesystem partition 2", StepDone: 1 << 30, Done: 1 << 30, Total: 4 << 30}
+	r.render(p)
+	r.render(p) // throttled
+	clock = clock.Add(time.Second)
+	p.Final = true
+	r.render(p)
+	want := "\r\033[K[#######-----------------------]  25% sync-filesystem partition 2: 1.0 GiB, 25% overall"
+	if out.String() != want+want+"\n" {
+		t.Fatalf("unexpected bar %q", out.String())
+	}
+	if bar := progressBar(-1); bar != "["+strings.Repeat("-", barWidth)+"]" {
+		t.Fatalf("unexpected bar for an unknown total %q", bar)
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	plan := clone.PlanResult{SourceDisk: "/dev/mmcblk0", Partitions: []clone.PartitionPlan{
+		{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: clone.PartitionAction{Sync: true}},
+	}}
+	planOpts := clone.PlanOptions{Destination: "sdb"}
+	steps := clone.BuildExecutionSteps(plan, planOpts)
+	j := &clone.Journal{Path: path, RunID: "5f0c2a9e41d7b3c8"}
+	j.Record(plan, planOpts, steps, clone.PhaseApplyStarted, nil)
+	j.Append(clone.JournalRecord{Phase: clone.PhaseStep, Step: &clone.StepResult{ID: "01-sync-filesystem-p2", Operation: clone.OpSyncFilesystem, Description: "sync /", DurationMS: 61000}})
+	j.Record(plan, planOpts, steps, clone.PhaseApplySuccess, nil)
+
+	ui := &fakeUI{}
+	if err := run([]string{"klon", "history", "--journal", path}, ui); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := strings.Join(ui.lines, ""); !strings.Contains(out, "5f0c2a9e41d7b3c8") || !strings.Contains(out, "success") || !strings.Contains(out, "1/1") {
+		t.Fatalf("unexpected run list:\n%s", out)
+	}
+
+	ui = &fakeUI{}
+	if err := run([]string{"klon", "history", "--journal", path, "5f0c"}, ui); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := strings.Join(ui.lines, ""); !strings.Contains(out, "01-sync-filesystem-p2  ok  1m1s  sync /") {
+		t.Fatalf("unexpected run details:\n%s", out)
+	}
+
+	ui = &fakeUI{}
+	if err := run([]string{"klon", "history", "--journal", path, "--last-success", "/dev/sdb"}, ui); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := strings.Join(ui.lines, ""); !strings.HasPrefix(out, "sdb was last cloned successfully on ") {
+		t.Fatalf("unexpected last success: %q", out)
+	}
+	if err := run([]string{"klon", "history", "--journal", path, "--last-success", "sdc"}, &fakeUI{}); err == nil {
+		t.Fatalf("expected no successful clone onto sdc")
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	if err := run([]string{"klon", "resume"}, &fakeUI{}); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "pi.img")
+	err := run([]string{"klon", "resume", "--noop-runner", "--checkpoint-dir", dir, image}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "no unfinished clone") {
+		t.Fatalf("expected no checkpoint to resume, got %v", err)
+	}
+
+	if err := os.WriteFile(image, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plan := clone.PlanResult{SourceDisk: "/dev/mmcblk0", Partitions: []clone.PartitionPlan{
+		{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: clone.PartitionAction{Sync: true}},
+	}}
+	if _, err := clone.NewCheckpoint(dir, "run1", clone.NewPlanFile(plan, clone.PlanOptions{Destination: image})); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	err = run([]string{"klon", "resume", "--noop-runner", "--checkpoint-dir", dir, image}, &fakeUI{})
+	if err == nil || !strings.Contains(err.Error(), "refusing to resume") {
+		t.Fatalf("expected a resized destination to be refused, got %v", err)
+	}
+}
+
+func TestRunCleanup(t *testing.T) {
+	ui := &fakeUI{}
+	if err := run([]string{"klon", "cleanup"}, ui); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := strings.Join(ui.lines, ""); out != "Nothing left mounted by Klon.\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if err := run([]string{"klon", "cleanup", "sdb"}, &fakeUI{}); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+}
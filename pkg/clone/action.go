@@ -0,0 +1,147 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PartitionStrategy selects how the destination partition table is prepared
+// when initializing.
+type PartitionStrategy string
+
+const (
+	// StrategyCloneTable copies the source partition table, with new disk and
+	// partition identifiers.
+	StrategyCloneTable PartitionStrategy = "clone-table"
+	// StrategyNewLayout creates a DOS label with a FAT32 boot and an ext root.
+	StrategyNewLayout PartitionStrategy = "new-layout"
+	// StrategyNewLayoutGPT creates a GPT label with a FAT32 boot and an ext root.
+	StrategyNewLayoutGPT PartitionStrategy = "new-layout-gpt"
+	// StrategyShrinkTable keeps the source layout but shrinks the last data
+	// partition so the table fits on a smaller destination.
+	StrategyShrinkTable PartitionStrategy = "shrink-table"
+	// StrategyLayoutFile creates the partitions described by a layout file
+	// (PlanOptions.LayoutSpec).
+	StrategyLayoutFile PartitionStrategy = "layout-file"
+)
+
+// orDefault returns the strategy, or StrategyCloneTable when it is empty.
+func (s PartitionStrategy) orDefault() PartitionStrategy {
+	if s == "" {
+		return StrategyCloneTable
+	}
+	return s
+}
+
+// CopyMode selects how the data of a partition reaches the destination.
+type CopyMode string
+
+const (
+	// CopyFiles syncs files with rsync (the default).
+	CopyFiles CopyMode = "rsync"
+	// CopyBlocks copies only the allocated blocks of unmounted or read-only
+	// ext2/3/4 and FAT filesystems, falling back to CopyFiles per partition.
+	CopyBlocks CopyMode = "block"
+)
+
+// ParseCopyMode validates a --mode value.
+func ParseCopyMode(s string) (CopyMode, error) {
+	switch m := CopyMode(s); m {
+	case CopyFiles, CopyBlocks:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown copy mode %q (use rsync or block)", s)
+}
+
+// Operation identifies the kind of work an ExecutionStep performs.
+type Operation string
+
+const (
+	OpPrepareDisk         Operation = "prepare-disk"
+	OpInitializePartition Operation = "initialize-partition"
+	OpSyncFilesystem      Operation = "sync-filesystem"
+	OpGrowPartition       Operation = "grow-partition"
+	OpResizeP1            Operation = "resize-p1"
+	OpCopyBlocks          Operation = "copy-blocks"
+)
+
+// ActionKind is the enum-like summary of a PartitionAction, convenient for
+// exhaustive switches.
+type ActionKind int
+
+const (
+	// ActionSkip leaves the partition untouched.
+	ActionSkip ActionKind = iota
+	// ActionSync syncs files into the existing destination filesystem.
+	ActionSync
+	// ActionInitialize creates a fresh filesystem without syncing (e.g. swap).
+	ActionInitialize
+	// ActionInitializeSync creates a fresh filesystem and then syncs into it.
+	ActionInitializeSync
+)
+
+func (k ActionKind) String() string {
+	switch k {
+	case ActionSkip:
+		return "skip"
+	case ActionSync:
+		return "sync"
+	case ActionInitialize:
+		return "initialize"
+	case ActionInitializeSync:
+		return "initialize+sync"
+	default:
+		return fmt.Sprintf("ActionKind(%d)", int(k))
+	}
+}
+
+// PartitionAction is the typed decision the planner makes for a partition.
+// Strategy is only meaningful together with Initialize. Resize means the
+// destination partition and its filesystem are grown to fill the remaining
+// space after syncing. Block replaces the initialize and sync of a partition
+// by a copy of its allocated blocks (see CopyBlocks).
+type PartitionAction struct {
+	Strategy   PartitionStrategy `json:"strategy,omitempty"`
+	Initialize bool              `json:"initialize,omitempty"`
+	Resize     bool              `json:"resize,omitempty"`
+	Sync       bool              `json:"sync,omitempty"`
+	Skip       bool              `json:"skip,omitempty"`
+	Block      bool              `json:"block,omitempty"`
+}
+
+// Kind summarizes the action as an ActionKind.
+func (a PartitionAction) Kind() ActionKind {
+	switch {
+	case a.Skip:
+		return ActionSkip
+	case a.Initialize && a.Sync:
+		return ActionInitializeSync
+	case a.Initialize:
+		return ActionInitialize
+	case a.Sync:
+		return ActionSync
+	default:
+		return ActionSkip
+	}
+}
+
+// String renders the action the way it is shown in plans and logs, for
+// example "sync", "initialize+sync+grow[clone-table]" or "block-copy".
+func (a PartitionAction) String() string {
+	kind := a.Kind()
+	if kind == ActionSkip {
+		return kind.String()
+	}
+	parts := []string{kind.String()}
+	if a.Block {
+		parts = []string{"block-copy"}
+	}
+	if a.Resize {
+		parts = append(parts, "grow")
+	}
+	out := strings.Join(parts, "+")
+	if a.Initialize && a.Strategy != "" {
+		out = fmt.Sprintf("%s[%s]", out, a.Strategy)
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package clone
+
+import "testing"
+
+func TestPartitionAction_KindAndString(t *testing.T) {
+	cases := []struct {
+		action PartitionAction
+		kind   ActionKind
+		str    string
+	}{
+		{PartitionAction{Sync: true}, ActionSync, "sync"},
+		{PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true}, ActionInitializeSync, "initialize+sync[clone-table]"},
+		{PartitionAction{Strategy: StrategyNewLayout, Initialize: true, Sync: true, Resize: true}, ActionInitializeSync, "initialize+sync+grow[new-layout]"},
+		{PartitionAction{Strategy: StrategyCloneTable, Initialize: true}, ActionInitialize, "initialize[clone-table]"},
+		{PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true, Resize: true, Block: true}, ActionInitializeSync, "block-copy+grow[clone-table]"},
+		{PartitionAction{Skip: true, Sync: true}, ActionSkip, "skip"},
+		{PartitionAction{}, ActionSkip, "skip"},
+	}
+	for _, tc := range cases {
+		if got := tc.action.Kind(); got != tc.kind {
+			t.Fatalf("%+v.Kind() = %v, want %v", tc.action, got, tc.kind)
+		}
+		if got := tc.action.String(); got != tc.str {
+			t.Fatalf("%+v.String() = %q, want %q", tc.action, got, tc.str)
+		}
+	}
+}
+
+func TestBuildExecutionSteps_FollowsTypedActions(t *testing.T) {
+	plan := PlanResult{
+		SourceDisk:      "/dev/mmcblk0",
+		DestinationDisk: "sda",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true, Resize: true}},
+			{Index: 3, Device: "/dev/mmcblk0p3", Action: PartitionAction{Strategy: StrategyCloneTable, Initialize: true}},
+			{Index: 4, Device: "/dev/mmcblk0p4", Action: PartitionAction{Skip: true}},
+		},
+	}
+	opts := PlanOptions{Destination: "sda", Initialize: true, ExpandLastPartition: true}
+
+	steps := BuildExecutionSteps(plan, opts)
+
+	var ops []Operation
+	for _, s := range steps {
+		ops = append(ops, s.Operation)
+	}
+	want := []Operation{
+		OpPrepareDisk,
+		OpInitializePartition, OpSyncFilesystem,
+		OpInitializePartition, OpSyncFilesystem,
+		OpInitializePartition,
+		OpGrowPartition,
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("unexpected operations: %v", ops)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("unexpected operations: %v", ops)
+		}
+	}
+	if steps[0].Action.Strategy != StrategyCloneTable {
+		t.Fatalf("expected prepare-disk to carry the strategy, got %+v", steps[0])
+	}
+	if grow := steps[len(steps)-1]; grow.PartitionIndex != 2 {
+		t.Fatalf("expected grow step for partition 2, got %+v", grow)
+	}
+}
+
+func TestPlanWithSystem_ExpandAndSwapActions(t *testing.T) {
+	sys := detailedFakeSystem{
+		fakeSystem: fakeSystem{
+			bootDisk: "/dev/sda2",
+			mountedParts: []MountedPartition{
+				{Device: "/dev/sda1", Mountpoint: "/boot"},
+				{Device: "/dev/sda2", Mountpoint: "/"},
+				{Device: "/dev/sda3", Mountpoint: "[SWAP]"},
+			},
+		},
+		details: map[string]PartitionDetails{"/dev/sda3": {FSType: "swap"}},
+	}
+
+	plan, err := PlanWithSystem(sys, PlanOptions{Destination: "sdb"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.Partitions[2].Action.Kind() != ActionSkip {
+		t.Fatalf("expected swap to be skipped on sync-only runs, got %+v", plan.Partitions[2])
+	}
+
+	plan, err = PlanWithSystem(sys, PlanOptions{Destination: "sdb", Initialize: true, ExpandLastPartition: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.Partitions[2].Action.Kind() != ActionInitialize || plan.Partitions[2].Action.Resize {
+		t.Fatalf("expected swap to be initialized but not grown, got %+v", plan.Partitions[2])
+	}
+	if !plan.Partitions[1].Action.Resize {
+		t.Fatalf("expected root to be the grown data partition, got %+v", plan.Partitions[1])
+	}
+}
@@ -16,12 +16,17 @@ import (
 // It mounts the destination root (and boot, if present) under destRoot and
 // unmounts them when done.
 func AdjustSystem(plan PlanResult, opts PlanOptions, destRoot string) error {
+	return AdjustSystemWithContext(context.Background(), plan, opts, destRoot)
+}
+
+// AdjustSystemWithContext is AdjustSystem with the commands it runs bound to
+// ctx: cancelling ctx stops them, and the destination is still unmounted.
+func AdjustSystemWithContext(ctx context.Context, plan PlanResult, opts PlanOptions, destRoot string) error {
 	if destRoot == "" {
 		return fmt.Errorf("AdjustSystem: destRoot is empty")
 	}
 
 	useChroot := !opts.SetupNoChroot
-	ctx := context.Background()
 
 	rootIdx := -1
 	bootIdx := -1
@@ -47,22 +52,21 @@ func AdjustSystem(plan PlanResult, opts PlanOptions, destRoot string) error {
 		return fmt.Errorf("AdjustSystem: cannot create destRoot %s: %w", destRoot, err)
 	}
 
-	rootPart := partitionDevice(dstDisk, rootIdx)
-	if err := shellExec(ctx, fmt.Sprintf("mount %s %s", rootPart, destRoot)); err != nil {
+	rootPart := hostDevices.partition(dstDisk, rootIdx)
+	if err := mountFS(ctx, "", rootPart, destRoot, false); err != nil {
 		return fmt.Errorf("AdjustSystem: failed to mount root %s on %s: %w", rootPart, destRoot, err)
 	}
-	defer shellExec(ctx, fmt.Sprintf("umount %s", destRoot))
+	defer unmountFS(ctx, destRoot)
 
 	if bootIdx != -1 {
 		bootDir := filepath.Join(destRoot, "boot")
 		if err := os.MkdirAll(bootDir, 0o755); err != nil {
 			return fmt.Errorf("AdjustSystem: cannot create boot dir %s: %w", bootDir, err)
 		}
-		bootPart := partitionDevice(dstDisk, bootIdx)
-		if err := shellExec(ctx, fmt.Sprintf("mount %s %s", bootPart, bootDir)); err != nil {
+		bootPart := hostDevices.partition(dstDisk, bootIdx)
+		if err := mountFS(ctx, "", bootPart, bootDir, false); err != nil {
 			return fmt.Errorf("AdjustSystem: failed to mount boot %s on %s: %w", bootPart, bootDir, err)
 		}
-		defer shellExec(ctx, fmt.Sprintf("umount %s", bootDir))
 	}
 
 	if err := adjustFstab(plan, opts, destRoot); err != nil {
@@ -129,7 +133,7 @@ func adjustFstab(plan PlanResult, opts PlanOptions, destRoot string) error {
 			continue
 		}
 		srcDev := ensureDevPrefix(p.Device)
-		dstDev := partitionDevice(opts.Destination, p.Index)
+		dstDev := hostDevices.partition(opts.Destination, p.Index)
 		srcToDstDev[srcDev] = dstDev
 
 		srcPU, _ := partUUID(srcDev)
@@ -145,7 +149,7 @@ func adjustFstab(plan PlanResult, opts PlanOptions, destRoot string) error {
 		}
 	} else if opts.EditFstabName != "" {
 		for src, dst := range srcToDstDev {
-			newDev := destDeviceWithPrefix(opts.EditFstabName, partitionIndexFromDevice(dst))
+			newDev := destDeviceWithPrefix(opts.EditFstabName, hostDevices.partitionIndex(dst))
 			content = strings.ReplaceAll(content, src, newDev)
 		}
 		for srcPU, dstPU := range srcPUToDstPU {
@@ -160,9 +164,90 @@ func adjustFstab(plan PlanResult, opts PlanOptions, destRoot string) error {
 		}
 	}
 
+	// A filesystem that was on an LVM volume is on a plain partition now.
+	for _, p := range plan.Partitions {
+		if p.Mapper == "" {
+			continue
+		}
+		dst := hostDevices.partition(opts.Destination, p.Index)
+		spec := dst
+		if opts.EditFstabName != "" {
+			spec = destDeviceWithPrefix(opts.EditFstabName, p.Index)
+		} else if pu, _ := partUUID(dst); pu != "" && opts.ConvertToPartuuid {
+			spec = "PARTUUID=" + pu
+		}
+		for _, name := range mapperNames(p.Mapper) {
+			content = strings.ReplaceAll(content, name, spec)
+		}
+	}
+
+	if plan.DestinationLayout != nil {
+		content = layoutFstab(content, plan, func(index int) string {
+			dst := hostDevices.partition(opts.Destination, index)
+			if opts.EditFstabName != "" {
+				return destDeviceWithPrefix(opts.EditFstabName, index)
+			}
+			if pu, _ := partUUID(dst); pu != "" {
+				return "PARTUUID=" + pu
+			}
+			return dst
+		})
+		for _, lp := range plan.DestinationLayout.Partitions {
+			if lp.Mountpoint != "" && lp.Mountpoint != "/" {
+				// Best effort: the mountpoint must exist in the clone.
+				_ = os.MkdirAll(filepath.Join(destRoot, strings.TrimPrefix(lp.Mountpoint, "/")), 0o755)
+			}
+		}
+	}
+
 	return os.WriteFile(path, []byte(content), 0o644)
 }
 
+// layoutFstab updates fstab content for a layout file: entries whose
+// mountpoint is the source path of a partition that moved are pointed at the
+// new mountpoint, and partitions that have no entry yet (new partitions, or
+// swap when fstab has none) are appended using devSpec to name the device.
+func layoutFstab(content string, plan PlanResult, devSpec func(index int) string) string {
+	moved := make(map[string]string)
+	for _, p := range plan.Partitions {
+		if p.SourcePath != "" && p.Device != "" {
+			moved[p.SourcePath] = p.Mountpoint
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	mounted := make(map[string]bool)
+	hasSwap := false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if to, ok := moved[fields[1]]; ok {
+			fields[1] = to
+			lines[i] = strings.Join(fields, " ")
+		}
+		mounted[fields[1]] = true
+		if fields[2] == "swap" {
+			hasSwap = true
+		}
+	}
+
+	for _, lp := range plan.DestinationLayout.Partitions {
+		switch {
+		case lp.FSType == "swap" && !hasSwap:
+			lines = append(lines, fmt.Sprintf("%s none swap sw 0 0", devSpec(lp.Index)))
+		case lp.Mountpoint != "" && !mounted[lp.Mountpoint]:
+			pass := 2
+			if lp.Mountpoint == "/" {
+				pass = 1
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %s defaults 0 %d", devSpec(lp.Index), lp.Mountpoint, lp.FSType, pass))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
 func adjustCmdline(plan PlanResult, opts PlanOptions, destRoot string) error {
 	path := filepath.Join(destRoot, "boot", "cmdline.txt")
 	data, err := os.ReadFile(path)
@@ -174,11 +259,12 @@ func adjustCmdline(plan PlanResult, opts PlanOptions, destRoot string) error {
 	}
 	content := string(data)
 
-	var srcRootDev string
+	var srcRootDev, rootMapper string
 	var rootIdx int
 	for _, p := range plan.Partitions {
 		if p.Mountpoint == "/" {
 			srcRootDev = ensureDevPrefix(p.Device)
+			rootMapper = p.Mapper
 			rootIdx = p.Index
 			break
 		}
@@ -186,7 +272,7 @@ func adjustCmdline(plan PlanResult, opts PlanOptions, destRoot string) error {
 	if srcRootDev == "" || rootIdx == 0 {
 		return nil
 	}
-	dstRootDev := partitionDevice(opts.Destination, rootIdx)
+	dstRootDev := hostDevices.partition(opts.Destination, rootIdx)
 
 	if opts.ConvertToPartuuid {
 		if dstPU, _ := partUUID(dstRootDev); dstPU != "" {
@@ -194,6 +280,9 @@ func adjustCmdline(plan PlanResult, opts PlanOptions, destRoot string) error {
 		}
 	} else {
 		content = strings.ReplaceAll(content, srcRootDev, dstRootDev)
+		for _, name := range mapperNames(rootMapper) {
+			content = strings.ReplaceAll(content, name, dstRootDev)
+		}
 		srcPU, _ := partUUID(srcRootDev)
 		dstPU, _ := partUUID(dstRootDev)
 		if srcPU != "" && dstPU != "" {
@@ -204,6 +293,19 @@ func adjustCmdline(plan PlanResult, opts PlanOptions, destRoot string) error {
 	return os.WriteFile(path, []byte(content), 0o644)
 }
 
+// mapperNames returns the device names an LVM volume is known by, e.g.
+// /dev/mapper/vg0-root and /dev/vg0/root.
+func mapperNames(mapper string) []string {
+	if mapper == "" {
+		return nil
+	}
+	names := []string{mapper}
+	if vg, lv, ok := splitDMName(strings.TrimPrefix(mapper, "/dev/mapper/")); ok {
+		names = append(names, "/dev/"+vg+"/"+lv)
+	}
+	return names
+}
+
 func replaceRootParam(content, prefix, value string) string {
 	fields := strings.Fields(content)
 	for i, f := range fields {
@@ -216,12 +318,11 @@ func replaceRootParam(content, prefix, value string) string {
 
 func destDeviceWithPrefix(prefix string, idx int) string {
 	if idx <= 0 {
-		return "/dev/" + prefix
-	}
-	if strings.HasPrefix(prefix, "mmcblk") || strings.HasPrefix(prefix, "nvme") {
-		return fmt.Sprintf("/dev/%sp%d", prefix, idx)
+		return ensureDevPrefix(prefix)
 	}
-	return fmt.Sprintf("/dev/%s%d", prefix, idx)
+	// The prefix names the disk as the clone will see it once booted, so only
+	// the kernel naming rules apply, not the local sysfs.
+	return deviceNames{}.partition(prefix, idx)
 }
 
 func adjustHostname(newHost, destRoot string) error {
@@ -266,7 +367,7 @@ func applyLabels(ctx context.Context, plan PlanResult, opts PlanOptions, destRoo
 	}
 	for _, p := range plan.Partitions {
 		// Only label ext* partitions (best-effort).
-		dstDev := partitionDevice(opts.Destination, p.Index)
+		dstDev := hostDevices.partition(opts.Destination, p.Index)
 		// Determine label to apply.
 		lbl := ""
 		if suffixAll {
@@ -0,0 +1,322 @@
+package clone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// planBlockCopies marks the partitions that can be copied block by block
+// when opts.CopyMode is CopyBlocks. Only freshly initialized ext2/3/4 and
+// FAT partitions whose source is unmounted or mounted read-only qualify, and
+// only when the destination partition is at least as large as the source
+// one. Every other synced partition keeps using rsync, with the reason
+// recorded in CopyNote.
+func planBlockCopies(sys System, result *PlanResult, opts PlanOptions) {
+	if opts.CopyMode != CopyBlocks {
+		return
+	}
+	ds, _ := sys.(DeviceSystem)
+	for i := range result.Partitions {
+		p := &result.Partitions[i]
+		if !p.Action.Sync || p.Action.Skip {
+			continue
+		}
+		if reason := blockCopyObstacle(ds, *p, result.DestinationLayout, opts); reason != "" {
+			p.CopyNote = reason
+			continue
+		}
+		p.Action.Block = true
+	}
+}
+
+// blockCopyObstacle returns why partition p cannot be block copied, or ""
+// when it can.
+func blockCopyObstacle(ds DeviceSystem, p PartitionPlan, layout *DiskLayout, opts PlanOptions) string {
+	switch {
+	case !p.Action.Initialize:
+		return "the destination filesystem is kept and only synced (use -f to recreate it)"
+	case !strings.HasPrefix(p.FSType, "ext") && p.FSType != "vfat":
+		if p.FSType == "" {
+			return "the source filesystem is unknown"
+		}
+		return fmt.Sprintf("block copies support ext2/3/4 and vfat, not %s", p.FSType)
+	case p.Device == "":
+		return "the source device is unknown"
+	case p.Mapper != "":
+		return fmt.Sprintf("the filesystem is on LVM volume %s", p.Mapper)
+	case p.SourcePath != "" || len(p.Excludes) > 0:
+		return "the layout file splits or moves its data"
+	case len(opts.ExcludePatterns) > 0 || len(opts.ExcludeFromFiles) > 0:
+		return "--exclude and --exclude-from only apply to rsync"
+	case p.Mountpoint != "" && !mountedReadOnly(ds, p.Device):
+		return fmt.Sprintf("the source is mounted read-write on %s", p.Mountpoint)
+	case p.SizeBytes <= 0:
+		return "the size of the source partition is unknown"
+	}
+
+	if layout != nil {
+		lp, ok := layout.Partition(p.Index)
+		switch {
+		case !ok:
+			return "the destination layout has no such partition"
+		case lp.FSType != "" && lp.FSType != p.FSType:
+			return fmt.Sprintf("the layout file asks for %s", lp.FSType)
+		case lp.SizeBytes < p.SizeBytes:
+			return fmt.Sprintf("the destination partition (%s) is smaller than the source (%s)", formatBytes(lp.SizeBytes), formatBytes(p.SizeBytes))
+		}
+		return ""
+	}
+	switch strategy := opts.PartitionStrategy.orDefault(); strategy {
+	case StrategyNewLayout, StrategyNewLayoutGPT:
+		return fmt.Sprintf("the %s strategy creates new partitions and filesystems", strategy)
+	}
+	if p.Index == 1 && opts.P1SizeBytes > 0 && opts.P1SizeBytes < p.SizeBytes {
+		return "-p1-size makes the destination partition smaller than the source"
+	}
+	return ""
+}
+
+// mountedReadOnly reports whether every mount of device is read-only. It
+// is false when the mounts cannot be read.
+func mountedReadOnly(ds DeviceSystem, device string) bool {
+	if ds == nil {
+		return false
+	}
+	dev, err := ds.BlockDevice(device)
+	if err != nil {
+		return false
+	}
+	mounts, err := ds.Mounts()
+	if err != nil {
+		return false
+	}
+	for _, m := range mounts {
+		if m.MajMin == dev.MajMin && !hasMountOption(m.Options, "ro") {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMountOption reports whether a comma-separated option list contains
+// opt.
+func hasMountOption(options, opt string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// runCopyBlocks copies the allocated blocks of a source filesystem onto the
+// destination partition: with e2image for ext2/3/4, with copyFATBlocks for
+// FAT. The filesystem keeps its UUID and label.
+func (r *CommandRunner) runCopyBlocks(step ExecutionStep) error {
+	if step.SourceDevice == "" || step.DestinationDisk == "" || step.PartitionIndex <= 0 {
+		return fmt.Errorf("copy-blocks on %s: missing source, destination or partition index", step.DestinationDisk)
+	}
+	src := ensureDevPrefix(step.SourceDevice)
+	dst := hostDevices.partition(step.DestinationDisk, step.PartitionIndex)
+
+	switch {
+	case strings.HasPrefix(step.FSType, "ext"):
+		sp := r.Progress.StartStep(r.ctx, step)
+		defer sp.Finish()
+		w := &progressWriter{parse: e2imageProgress(sp)}
+		if err := shellStream(r.ctx, fmt.Sprintf("e2image -rap %s %s", src, dst), w); err != nil {
+			return fmt.Errorf("copy-blocks on %s: e2image failed for %s: %w", step.DestinationDisk, src, err)
+		}
+		return nil
+	case step.FSType == "vfat":
+		sp := r.Progress.StartStep(r.ctx, step)
+		defer sp.Finish()
+		n, err := copyFATDevice(src, dst, sp)
+		if err != nil {
+			return fmt.Errorf("copy-blocks on %s: %w", step.DestinationDisk, err)
+		}
+		logSink.Printf("klon: copied %s of FAT metadata and allocated clusters from %s to %s", formatBytes(n), src, dst)
+		return nil
+	default:
+		return fmt.Errorf("copy-blocks on %s: unsupported filesystem type %q", step.DestinationDisk, step.FSType)
+	}
+}
+
+// copyFATDevice runs copyFATBlocks between two devices, reporting the bytes
+// written to sp, and flushes the destination.
+func copyFATDevice(src, dst string, sp *StepProgress) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	size, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	n, err := copyFATBlocks(in, &progressWriterAt{w: out, s: sp}, size)
+	if err != nil {
+		out.Close()
+		return n, fmt.Errorf("cannot copy FAT filesystem %s to %s: %w", src, dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// fatGeometry is the layout of a FAT12/16/32 filesystem, read from its boot
+// sector. Offsets and sizes are in bytes.
+type fatGeometry struct {
+	bits         int
+	clusterBytes int64
+	fatOffset    int64
+	fatBytes     int64
+	dataOffset   int64
+	clusters     int64
+	totalBytes   int64
+}
+
+// readFATGeometry parses the BIOS parameter block of a FAT filesystem.
+func readFATGeometry(bs []byte) (fatGeometry, error) {
+	if len(bs) < 512 || bs[510] != 0x55 || bs[511] != 0xaa {
+		return fatGeometry{}, fmt.Errorf("no FAT boot sector signature")
+	}
+	le := binary.LittleEndian
+	sectorBytes := int64(le.Uint16(bs[11:]))
+	perCluster := int64(bs[13])
+	reserved := int64(le.Uint16(bs[14:]))
+	fats := int64(bs[16])
+	rootEntries := int64(le.Uint16(bs[17:]))
+	total := int64(le.Uint16(bs[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(bs[32:]))
+	}
+	fatSectors := int64(le.Uint16(bs[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(le.Uint32(bs[36:]))
+	}
+	switch sectorBytes {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fatGeometry{}, fmt.Errorf("invalid FAT sector size %d", sectorBytes)
+	}
+	if perCluster == 0 || perCluster&(perCluster-1) != 0 || reserved == 0 || fats == 0 || fatSectors == 0 {
+		return fatGeometry{}, fmt.Errorf("invalid FAT boot sector")
+	}
+	rootSectors := (rootEntries*32 + sectorBytes - 1) / sectorBytes
+	dataSector := reserved + fats*fatSectors + rootSectors
+	if total <= dataSector {
+		return fatGeometry{}, fmt.Errorf("invalid FAT boot sector: %d sectors but data starts at sector %d", total, dataSector)
+	}
+	g := fatGeometry{
+		clusterBytes: perCluster * sectorBytes,
+		fatOffset:    reserved * sectorBytes,
+		fatBytes:     fatSectors * sectorBytes,
+		dataOffset:   dataSector * sectorBytes,
+		clusters:     (total - dataSector) / perCluster,
+		totalBytes:   total * sectorBytes,
+	}
+	// The cluster count alone decides the FAT type.
+	switch {
+	case g.clusters < 4085:
+		g.bits = 12
+	case g.clusters < 65525:
+		g.bits = 16
+	default:
+		g.bits = 32
+	}
+	if g.fatBytes*8 < (g.clusters+2)*int64(g.bits) {
+		return fatGeometry{}, fmt.Errorf("invalid FAT boot sector: the FAT is too small for %d clusters", g.clusters)
+	}
+	return g, nil
+}
+
+// fatEntry returns the FAT entry of cluster c; zero means the cluster is
+// free.
+func (g fatGeometry) fatEntry(fat []byte, c int64) uint32 {
+	switch g.bits {
+	case 12:
+		v := binary.LittleEndian.Uint16(fat[c+c/2:])
+		if c&1 == 1 {
+			return uint32(v >> 4)
+		}
+		return uint32(v & 0xfff)
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(fat[2*c:]))
+	default:
+		return binary.LittleEndian.Uint32(fat[4*c:]) & 0x0fffffff
+	}
+}
+
+// copyFATBlocks copies a FAT filesystem from src to dst, which is dstSize
+// bytes long: the boot sector, FATs and root directory, and then only the
+// clusters the first FAT marks as in use. It returns the bytes copied.
+func copyFATBlocks(src io.ReaderAt, dst io.WriterAt, dstSize int64) (int64, error) {
+	bs := make([]byte, 512)
+	if _, err := src.ReadAt(bs, 0); err != nil {
+		return 0, err
+	}
+	g, err := readFATGeometry(bs)
+	if err != nil {
+		return 0, err
+	}
+	if g.totalBytes > dstSize {
+		return 0, fmt.Errorf("destination holds %s, the filesystem needs %s", formatBytes(dstSize), formatBytes(g.totalBytes))
+	}
+	// One spare byte lets fatEntry read the last FAT12 entry as a uint16.
+	fat := make([]byte, g.fatBytes+1)
+	if _, err := src.ReadAt(fat[:g.fatBytes], g.fatOffset); err != nil {
+		return 0, fmt.Errorf("cannot read the FAT: %w", err)
+	}
+
+	copied, err := copyRange(src, dst, 0, g.dataOffset)
+	if err != nil {
+		return copied, err
+	}
+	// Copy runs of allocated clusters in one go.
+	for c := int64(2); c < g.clusters+2; {
+		if g.fatEntry(fat, c) == 0 {
+			c++
+			continue
+		}
+		start := c
+		for c < g.clusters+2 && g.fatEntry(fat, c) != 0 {
+			c++
+		}
+		n, err := copyRange(src, dst, g.dataOffset+(start-2)*g.clusterBytes, (c-start)*g.clusterBytes)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// copyRange copies length bytes at offset from src to the same offset in
+// dst.
+func copyRange(src io.ReaderAt, dst io.WriterAt, offset, length int64) (int64, error) {
+	const chunk = 4 << 20
+	buf := make([]byte, min(length, chunk))
+	var copied int64
+	for copied < length {
+		b := buf[:min(length-copied, chunk)]
+		if _, err := src.ReadAt(b, offset+copied); err != nil {
+			return copied, err
+		}
+		if _, err := dst.WriteAt(b, offset+copied); err != nil {
+			return copied, err
+		}
+		copied += int64(len(b))
+	}
+	return copied, nil
+}
@@ -0,0 +1,262 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanBlockCopies(t *testing.T) {
+	f := sourceTree(t)
+	fakeMounts(t, "/dev/sda2", sourceFstab)
+	src, err := f.system().openSource(context.Background(), "sda")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Nothing is really mounted, so the fake root stays behind.
+	t.Cleanup(func() { os.RemoveAll(src.Root) })
+	f.write("/proc/self/mountinfo", "21 1 179:2 / / rw - ext4 /dev/root rw\n"+
+		"40 21 8:2 / "+src.Root+" ro,relatime - ext4 /dev/sda2 ro\n"+
+		"41 40 8:1 / "+src.Root+"/boot ro - ext2 /dev/sda1 ro\n"+
+		"42 40 8:10 / "+src.Root+"/srv rw - ext4 /dev/sda10 rw\n")
+
+	// Usage is measured on the host temp dir, so skip the capacity check.
+	opts := PlanOptions{Destination: "nvme0n1", Initialize: true, ForceSync: true, CopyMode: CopyBlocks}
+	plan, err := PlanWithSystem(src.System(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range plan.Partitions {
+		got = append(got, p.Action.String()+" "+p.CopyNote)
+	}
+	want := []string{
+		"block-copy[clone-table] ",
+		"block-copy[clone-table] ",
+		"initialize+sync[clone-table] the source is mounted read-write on /srv",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected actions:\n%s", strings.Join(got, "\n"))
+	}
+	if !strings.Contains(plan.String(), "rsync instead of block copy: the source is mounted read-write on /srv") {
+		t.Fatalf("expected the fallback in the plan output:\n%s", plan.String())
+	}
+
+	var ops []string
+	for _, s := range BuildExecutionSteps(plan, opts) {
+		ops = append(ops, string(s.Operation))
+	}
+	wantOps := []string{"prepare-disk", "copy-blocks", "copy-blocks", "initialize-partition", "sync-filesystem"}
+	if strings.Join(ops, " ") != strings.Join(wantOps, " ") {
+		t.Fatalf("unexpected steps: %v", ops)
+	}
+
+	opts.ExcludePatterns = []string{"/srv/cache"}
+	plan, err = PlanWithSystem(src.System(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range plan.Partitions {
+		if p.Action.Block {
+			t.Fatalf("expected --exclude to disable block copies, got %+v", p)
+		}
+	}
+}
+
+func TestBlockCopyObstacle(t *testing.T) {
+	base := PartitionPlan{
+		Index:            2,
+		Device:           "/dev/sda2",
+		Action:           PartitionAction{Initialize: true, Sync: true},
+		PartitionDetails: PartitionDetails{FSType: "ext4", SizeBytes: 10 << 30},
+	}
+	cases := []struct {
+		name   string
+		modify func(p *PartitionPlan, layout **DiskLayout, opts *PlanOptions)
+		want   string
+	}{
+		{name: "unmounted ext4", modify: func(*PartitionPlan, **DiskLayout, *PlanOptions) {}},
+		{name: "sync only", modify: func(p *PartitionPlan, _ **DiskLayout, _ *PlanOptions) { p.Action.Initialize = false }, want: "only synced"},
+		{name: "btrfs", modify: func(p *PartitionPlan, _ **DiskLayout, _ *PlanOptions) { p.FSType = "btrfs" }, want: "not btrfs"},
+		{name: "mounted without mount info", modify: func(p *PartitionPlan, _ **DiskLayout, _ *PlanOptions) { p.Mountpoint = "/" }, want: "read-write on /"},
+		{name: "new layout", modify: func(_ *PartitionPlan, _ **DiskLayout, o *PlanOptions) { o.PartitionStrategy = StrategyNewLayout }, want: "new-layout strategy"},
+		{
+			name: "shrunken partition",
+			modify: func(_ *PartitionPlan, l **DiskLayout, _ *PlanOptions) {
+				*l = &DiskLayout{Partitions: []LayoutPartition{{Index: 2, SizeBytes: 8 << 30}}}
+			},
+			want: "smaller than the source",
+		},
+		{
+			name: "grown partition",
+			modify: func(_ *PartitionPlan, l **DiskLayout, _ *PlanOptions) {
+				*l = &DiskLayout{Partitions: []LayoutPartition{{Index: 2, SizeBytes: 12 << 30}}}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, opts := base, PlanOptions{}
+			var layout *DiskLayout
+			tc.modify(&p, &layout, &opts)
+			got := blockCopyObstacle(nil, p, layout, opts)
+			if (tc.want == "") != (got == "") || !strings.Contains(got, tc.want) {
+				t.Fatalf("expected obstacle containing %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// fat16Image builds a FAT16 filesystem of 5073 sectors whose clusters 2, 3
+// and 10 are in use. Every data cluster is filled with a marker byte, so
+// copying a free cluster is detectable.
+func fat16Image(t *testing.T) []byte {
+	t.Helper()
+	const (
+		reserved   = 1
+		fatSectors = 20
+		rootDir    = 32
+		clusters   = 5000
+		total      = reserved + 2*fatSectors + rootDir + clusters
+	)
+	img := make([]byte, total*512)
+	bs := img[:512]
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], reserved)
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], 512)
+	binary.LittleEndian.PutUint16(bs[19:], total)
+	binary.LittleEndian.PutUint16(bs[22:], fatSectors)
+	copy(bs[54:], "FAT16   ")
+	bs[510], bs[511] = 0x55, 0xaa
+
+	for _, fat := range []int{reserved, reserved + fatSectors} {
+		entries := img[fat*512:]
+		binary.LittleEndian.PutUint16(entries[0:], 0xfff8)
+		binary.LittleEndian.PutUint16(entries[2:], 0xffff)
+		binary.LittleEndian.PutUint16(entries[4:], 3)      // cluster 2 -> 3
+		binary.LittleEndian.PutUint16(entries[6:], 0xffff) // end of chain
+		binary.LittleEndian.PutUint16(entries[20:], 0xffff)
+	}
+	data := (reserved + 2*fatSectors + rootDir) * 512
+	for c := 0; c < clusters; c++ {
+		for i := 0; i < 512; i++ {
+			img[data+c*512+i] = byte(c%250 + 1)
+		}
+	}
+	return img
+}
+
+func TestCheckPlanPrerequisites(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	plan := PlanResult{Partitions: []PartitionPlan{
+		{Index: 1, Action: PartitionAction{Initialize: true, Sync: true, Block: true}, PartitionDetails: PartitionDetails{FSType: "vfat"}},
+		{Index: 2, Action: PartitionAction{Initialize: true, Sync: true}, PartitionDetails: PartitionDetails{FSType: "ext4"}},
+	}}
+	if err := CheckPlanPrerequisites(plan); err != nil {
+		t.Fatalf("expected a plan without ext block copies to need nothing, got %v", err)
+	}
+	plan.Partitions[1].Action.Block = true
+	if err := CheckPlanPrerequisites(plan); err == nil || !strings.Contains(err.Error(), "e2image") {
+		t.Fatalf("expected e2image to be required, got %v", err)
+	}
+}
+
+func TestCopyFATBlocks(t *testing.T) {
+	img := fat16Image(t)
+	dir := t.TempDir()
+	srcPath, dstPath := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(srcPath, img, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dstPath, make([]byte, len(img)+4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := copyFATDevice(srcPath, dstPath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const data = (1 + 40 + 32) * 512
+	if n != data+3*512 {
+		t.Fatalf("expected metadata and 3 clusters to be copied, got %d bytes", n)
+	}
+	got, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:data], img[:data]) {
+		t.Fatalf("boot sector, FATs or root directory differ")
+	}
+	cluster := func(b []byte, c int) []byte { return b[data+(c-2)*512 : data+(c-1)*512] }
+	for _, c := range []int{2, 3, 10} {
+		if !bytes.Equal(cluster(got, c), cluster(img, c)) {
+			t.Fatalf("allocated cluster %d was not copied", c)
+		}
+	}
+	for _, c := range []int{4, 9, 11, 5001} {
+		if !bytes.Equal(cluster(got, c), make([]byte, 512)) {
+			t.Fatalf("free cluster %d was copied", c)
+		}
+	}
+
+	small := filepath.Join(dir, "small")
+	if err := os.WriteFile(small, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyFATDevice(srcPath, small, nil); err == nil || !strings.Contains(err.Error(), "needs") {
+		t.Fatalf("expected a small destination to fail, got %v", err)
+	}
+	if _, err := copyFATDevice(small, dstPath, nil); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected a source without FAT to fail, got %v", err)
+	}
+}
+
+func TestFATEntry12(t *testing.T) {
+	// Entries 2 and 3 packed as FAT12: 0x003 and 0xfff.
+	fat := []byte{0xf8, 0xff, 0xff, 0x03, 0xf0, 0xff, 0}
+	g := fatGeometry{bits: 12}
+	if got := g.fatEntry(fat, 2); got != 0x003 {
+		t.Fatalf("entry 2 = %#x", got)
+	}
+	if got := g.fatEntry(fat, 3); got != 0xfff {
+		t.Fatalf("entry 3 = %#x", got)
+	}
+}
+
+func TestCommandRunner_CopyBlocks(t *testing.T) {
+	origStream := shellStream
+	defer func() { shellStream = origStream }()
+	var cmds []string
+	shellStream = func(ctx context.Context, cmdStr string, w *progressWriter) error {
+		cmds = append(cmds, cmdStr)
+		_, err := io.WriteString(w, "Copying 0 / 100 blocks (0%)\rCopying 50 / 100 blocks (50%)\r\n")
+		return err
+	}
+
+	r := NewCommandRunner("/mnt/clone", StrategyCloneTable, nil, nil, "nvme0n1", false, false)
+	var reports []ProgressReport
+	plan := PlanResult{Partitions: []PartitionPlan{{Index: 2, Action: PartitionAction{Sync: true, Block: true}, PartitionDetails: PartitionDetails{UsedBytes: 1000}}}}
+	r.Progress = NewProgressTracker(plan, func(p ProgressReport) { reports = append(reports, p) })
+	step := ExecutionStep{Operation: OpCopyBlocks, SourceDevice: "sda2", DestinationDisk: "nvme0n1", PartitionIndex: 2, FSType: "ext4"}
+	if err := r.Run(step); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cmds) != 1 || cmds[0] != "e2image -rap /dev/sda2 /dev/nvme0n1p2" {
+		t.Fatalf("unexpected commands: %q", cmds)
+	}
+	if len(reports) != 3 || reports[1].StepDone != 500 || !reports[2].Final {
+		t.Fatalf("unexpected progress %+v", reports)
+	}
+
+	step.FSType = "xfs"
+	if err := r.Run(step); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("expected xfs to be refused, got %v", err)
+	}
+}
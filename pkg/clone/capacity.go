@@ -0,0 +1,181 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultBootSizeBytes is the boot partition size used by the new-layout
+// strategies when -p1-size is not given.
+const defaultBootSizeBytes = 256 * 1024 * 1024
+
+// layoutAlignBytes is the offset of the first partition created by the
+// new-layout strategies, and the alignment of their partitions.
+const layoutAlignBytes = 1024 * 1024
+
+// excludeMeasurer is implemented by System values that can tell how many
+// bytes of a mounted filesystem are covered by rsync exclude patterns, so the
+// capacity analysis does not count data that will not be copied.
+type excludeMeasurer interface {
+	ExcludedBytes(mountpoint string, patterns []string) int64
+}
+
+// PartitionCapacity compares the data that will be synced into a destination
+// partition with the size that partition will have after preparing the disk.
+// DestSizeBytes is zero when the destination size cannot be known at plan
+// time (for example when syncing into an existing partition).
+type PartitionCapacity struct {
+	UsedBytes     int64 `json:"used_bytes"`
+	ExcludedBytes int64 `json:"excluded_bytes,omitempty"`
+	DestSizeBytes int64 `json:"dest_size_bytes,omitempty"`
+}
+
+// RequiredBytes is the amount of data that will be copied.
+func (c PartitionCapacity) RequiredBytes() int64 {
+	if c.ExcludedBytes >= c.UsedBytes {
+		return 0
+	}
+	return c.UsedBytes - c.ExcludedBytes
+}
+
+// HeadroomBytes is the free space left on the destination partition after
+// the sync. It is negative when the data does not fit.
+func (c PartitionCapacity) HeadroomBytes() int64 {
+	return c.DestSizeBytes - c.RequiredBytes()
+}
+
+// Fits reports whether the data fits, treating an unknown destination size as
+// fitting.
+func (c PartitionCapacity) Fits() bool {
+	return c.DestSizeBytes == 0 || c.HeadroomBytes() >= 0
+}
+
+func (c PartitionCapacity) String() string {
+	if c.DestSizeBytes == 0 {
+		return fmt.Sprintf("%s to copy (destination size unknown)", formatBytes(c.RequiredBytes()))
+	}
+	if !c.Fits() {
+		return fmt.Sprintf("%s to copy into %s: DOES NOT FIT (%s short)", formatBytes(c.RequiredBytes()), formatBytes(c.DestSizeBytes), formatBytes(-c.HeadroomBytes()))
+	}
+	return fmt.Sprintf("%s to copy into %s (%s headroom)", formatBytes(c.RequiredBytes()), formatBytes(c.DestSizeBytes), formatBytes(c.HeadroomBytes()))
+}
+
+// analyzeCapacity fills PartitionPlan.Capacity for every partition that will
+// be synced and returns one problem description per partition that is
+// guaranteed to run out of space.
+func analyzeCapacity(sys System, plan *PlanResult, opts PlanOptions) []string {
+	em, _ := sys.(excludeMeasurer)
+	var problems []string
+	for i := range plan.Partitions {
+		part := &plan.Partitions[i]
+		if !part.Action.Sync || part.Action.Skip {
+			continue
+		}
+		if opts.Initialize && !destinationHasPartition(part.Index, *plan, opts) {
+			problems = append(problems, fmt.Sprintf("partition %d (%s) does not exist in the %s layout", part.Index, part.Mountpoint, opts.PartitionStrategy.orDefault()))
+			continue
+		}
+		if part.UsedBytes <= 0 {
+			continue
+		}
+		c := PartitionCapacity{
+			UsedBytes:     part.UsedBytes,
+			DestSizeBytes: plannedDestinationSize(*part, *plan, opts),
+		}
+		if src := part.syncSource(); em != nil && src != "" {
+			c.ExcludedBytes = em.ExcludedBytes(src, capacityExcludes(*part, opts))
+		}
+		part.Capacity = &c
+		if !c.Fits() {
+			problems = append(problems, fmt.Sprintf("partition %d (%s): %s", part.Index, part.Mountpoint, c))
+		}
+	}
+	return problems
+}
+
+// destinationHasPartition reports whether the destination will have a
+// partition with the given index after prepare-disk.
+func destinationHasPartition(index int, plan PlanResult, opts PlanOptions) bool {
+	if plan.DestinationLayout != nil {
+		_, ok := plan.DestinationLayout.Partition(index)
+		return ok
+	}
+	switch opts.PartitionStrategy.orDefault() {
+	case StrategyNewLayout, StrategyNewLayoutGPT:
+		return index <= 2
+	default:
+		return true
+	}
+}
+
+// plannedDestinationSize returns the size destination partition part.Index
+// will have after prepare-disk (and grow-partition), or the size of the
+// existing partition a sync-only plan updates, or 0 when unknown.
+func plannedDestinationSize(part PartitionPlan, plan PlanResult, opts PlanOptions) int64 {
+	if !opts.Initialize {
+		if part.Destination != nil {
+			return part.Destination.SizeBytes
+		}
+		return 0
+	}
+	diskSize := plan.DestinationSizeBytes
+	bootSize := opts.P1SizeBytes
+
+	if plan.DestinationLayout != nil {
+		if part.Index == 1 && bootSize > 0 {
+			return bootSize
+		}
+		lp, _ := plan.DestinationLayout.Partition(part.Index)
+		if part.Action.Resize && diskSize > 0 && lp.StartBytes > 0 {
+			return diskSize - lp.StartBytes
+		}
+		return lp.SizeBytes
+	}
+
+	switch opts.PartitionStrategy.orDefault() {
+	case StrategyNewLayout, StrategyNewLayoutGPT:
+		if bootSize <= 0 {
+			bootSize = defaultBootSizeBytes
+		}
+		if part.Index == 1 {
+			return bootSize
+		}
+		if diskSize <= 0 {
+			return 0
+		}
+		return diskSize - layoutAlignBytes - bootSize
+	default:
+		if part.Index == 1 && bootSize > 0 {
+			return bootSize
+		}
+		if part.Action.Resize && diskSize > 0 && part.StartBytes > 0 {
+			return diskSize - part.StartBytes
+		}
+		return part.SizeBytes
+	}
+}
+
+// capacityExcludes returns the absolute paths, relative to the directory
+// synced into part, that rsync will skip for that partition. Patterns that
+// are not anchored with "/" cannot be measured and are ignored.
+func capacityExcludes(part PartitionPlan, opts PlanOptions) []string {
+	patterns := append([]string{}, opts.ExcludePatterns...)
+	patterns = append(patterns, part.Excludes...)
+	if part.Mountpoint == "/" {
+		patterns = append(patterns, defaultRootExcludes...)
+	}
+	var res []string
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "/") {
+			continue
+		}
+		p = strings.TrimSuffix(p, "/**")
+		p = strings.TrimSuffix(p, "/*")
+		p = strings.TrimSuffix(p, "/")
+		if p == "" {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
@@ -0,0 +1,108 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+)
+
+type capacityFakeSystem struct {
+	detailedFakeSystem
+	sizes    map[string]int64
+	excluded map[string]int64
+}
+
+func (f capacityFakeSystem) DiskSize(disk string) (int64, error) {
+	return f.sizes[disk], nil
+}
+
+func (f capacityFakeSystem) ExcludedBytes(mountpoint string, patterns []string) int64 {
+	return f.excluded[mountpoint]
+}
+
+func newCapacityFakeSystem(destSize int64) capacityFakeSystem {
+	return capacityFakeSystem{
+		detailedFakeSystem: detailedFakeSystem{
+			fakeSystem: fakeSystem{
+				bootDisk: "/dev/mmcblk0p2",
+				mountedParts: []MountedPartition{
+					{Device: "/dev/mmcblk0p1", Mountpoint: "/boot"},
+					{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+				},
+			},
+			details: map[string]PartitionDetails{
+				"/dev/mmcblk0p1": {FSType: "vfat", StartBytes: 4 << 20, SizeBytes: 512 << 20, UsedBytes: 64 << 20},
+				"/dev/mmcblk0p2": {FSType: "ext4", StartBytes: 516 << 20, SizeBytes: 60 << 30, UsedBytes: 10 << 30},
+			},
+		},
+		sizes:    map[string]int64{"/dev/mmcblk0": 64 << 30, "/dev/sda": destSize},
+		excluded: map[string]int64{"/": 1 << 30},
+	}
+}
+
+func TestPlanWithSystem_CapacityHeadroomWithExpandRoot(t *testing.T) {
+	sys := newCapacityFakeSystem(32 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, ExpandLastPartition: true, ForceSync: true}
+
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root := plan.Partitions[1].Capacity
+	if root == nil {
+		t.Fatalf("expected capacity for root, got %+v", plan.Partitions[1])
+	}
+	if root.DestSizeBytes != 32<<30-516<<20 {
+		t.Fatalf("expected grown root to span the rest of the disk, got %d", root.DestSizeBytes)
+	}
+	if root.RequiredBytes() != 9<<30 {
+		t.Fatalf("expected excluded bytes to be subtracted, got %d", root.RequiredBytes())
+	}
+	if len(plan.Warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", plan.Warnings)
+	}
+	if !strings.Contains(plan.String(), "capacity: 9.0 GiB to copy into") {
+		t.Fatalf("expected capacity in plan output, got:\n%s", plan.String())
+	}
+}
+
+func TestPlanWithSystem_CapacityRefusesWhenDataDoesNotFit(t *testing.T) {
+	sys := newCapacityFakeSystem(8 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyNewLayout}
+
+	_, err := PlanWithSystem(sys, opts)
+	if err == nil || !strings.Contains(err.Error(), "too small") || !strings.Contains(err.Error(), "partition 2 (/)") {
+		t.Fatalf("expected capacity error for root, got %v", err)
+	}
+
+	opts.ForceSync = true
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("expected -F to downgrade the capacity error, got %v", err)
+	}
+	if len(plan.Warnings) != 1 || !strings.Contains(plan.Warnings[0], "DOES NOT FIT") {
+		t.Fatalf("expected one capacity warning, got %v", plan.Warnings)
+	}
+}
+
+func TestPlanWithSystem_CapacityFlagsPartitionsMissingFromNewLayout(t *testing.T) {
+	sys := newCapacityFakeSystem(64 << 30)
+	sys.mountedParts = append(sys.mountedParts, MountedPartition{Device: "/dev/mmcblk0p3", Mountpoint: "/data"})
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyNewLayoutGPT}
+
+	_, err := PlanWithSystem(sys, opts)
+	if err == nil || !strings.Contains(err.Error(), "does not exist in the new-layout-gpt layout") {
+		t.Fatalf("expected missing partition error, got %v", err)
+	}
+}
+
+func TestPlanWithSystem_CapacityUnknownWhenSyncOnly(t *testing.T) {
+	sys := newCapacityFakeSystem(1 << 30)
+
+	plan, err := PlanWithSystem(sys, PlanOptions{Destination: "sda"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := plan.Partitions[1].Capacity; c == nil || c.DestSizeBytes != 0 || !c.Fits() {
+		t.Fatalf("expected unknown destination size on sync-only runs, got %+v", c)
+	}
+}
@@ -0,0 +1,267 @@
+package clone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// DefaultCheckpointDir is where Klon keeps the checkpoints of unfinished
+// clones.
+const DefaultCheckpointDir = "/var/lib/klon/checkpoints"
+
+// CheckpointVersion is the version of the checkpoint document.
+// LoadCheckpoint refuses checkpoints with a different version.
+const CheckpointVersion = 1
+
+// DiskIdentity tells whether a destination is still the disk or image a
+// checkpoint was written for.
+type DiskIdentity struct {
+	SizeBytes int64 `json:"size_bytes"`
+	// Serial is the WWID or serial number sysfs reports for the disk, if
+	// any. Image files have none.
+	Serial string `json:"serial,omitempty"`
+	// TableID is the GPT disk GUID or the MBR disk signature of the
+	// partition table, e.g. "dos:1a2b3c4d".
+	TableID string `json:"table_id,omitempty"`
+}
+
+// ReadDiskIdentity describes the destination disk or image file dest as it
+// is now.
+func ReadDiskIdentity(dest string) (DiskIdentity, error) {
+	return localSystem{}.DiskIdentity(dest)
+}
+
+// DiskIdentity reads the size, serial number and partition table identifier
+// of a destination disk or image file.
+func (s localSystem) DiskIdentity(dest string) (DiskIdentity, error) {
+	var id DiskIdentity
+	path := dest
+	if IsImageDestination(dest) {
+		info, err := os.Stat(dest)
+		if err != nil {
+			return id, err
+		}
+		id.SizeBytes = info.Size()
+	} else {
+		dev, err := s.BlockDevice(ensureDevPrefix(dest))
+		if err != nil {
+			return id, err
+		}
+		id.SizeBytes = dev.SizeBytes
+		dir := s.hostPath(filepath.Join("/sys/class/block", dev.Name))
+		for _, name := range []string{"wwid", "device/wwid", "device/serial"} {
+			if id.Serial = readSysfsString(dir, name); id.Serial != "" {
+				break
+			}
+		}
+		path = s.hostPath(dev.Path)
+	}
+	table, err := parttable.ReadFile(path)
+	switch {
+	case errors.Is(err, parttable.ErrNoTable):
+	case err != nil:
+		return id, err
+	case table.Type == parttable.GPT:
+		id.TableID = "gpt:" + table.DiskGUID.String()
+	default:
+		id.TableID = fmt.Sprintf("dos:%08x", table.DiskSignature)
+	}
+	return id, nil
+}
+
+// PlanFingerprint identifies a plan by its execution steps: two plans with
+// the same fingerprint do exactly the same thing.
+func PlanFingerprint(steps []ExecutionStep) string {
+	data, _ := json.Marshal(steps)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Checkpoint records the steps of a plan that completed on a destination,
+// so that an interrupted clone can be resumed with `klon resume` instead of
+// starting over. It is keyed by the plan's fingerprint and the identity of
+// the destination: a checkpoint only applies to the same plan on the same
+// disk.
+type Checkpoint struct {
+	Version     int          `json:"version"`
+	RunID       string       `json:"run_id"`
+	Fingerprint string       `json:"fingerprint"`
+	Disk        DiskIdentity `json:"disk"`
+	Plan        PlanFile     `json:"plan"`
+	// Completed are the StepIDs of the steps that finished successfully.
+	Completed []string  `json:"completed,omitempty"`
+	Updated   time.Time `json:"updated"`
+
+	path string
+}
+
+// CheckpointPath returns the checkpoint file of a destination in dir.
+func CheckpointPath(dir, dest string) string {
+	name := strings.TrimPrefix(ensureDevPrefix(dest), "/dev/")
+	if IsImageDestination(dest) {
+		if abs, err := filepath.Abs(dest); err == nil {
+			dest = abs
+		}
+		name = strings.ReplaceAll(strings.TrimPrefix(filepath.Clean(dest), "/"), "/", "_")
+	}
+	return filepath.Join(dir, name+".json")
+}
+
+// NewCheckpoint starts the checkpoint of pf, replacing any previous one for
+// the same destination in dir.
+func NewCheckpoint(dir, runID string, pf PlanFile) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		Version:     CheckpointVersion,
+		RunID:       runID,
+		Fingerprint: PlanFingerprint(pf.Steps),
+		Plan:        pf,
+		path:        CheckpointPath(dir, pf.Options.Destination),
+	}
+	if err := cp.save(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// LoadCheckpoint reads the checkpoint left in dir by an unfinished clone
+// onto dest.
+func LoadCheckpoint(dir, dest string) (*Checkpoint, error) {
+	path := CheckpointPath(dir, dest)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no unfinished clone onto %s to resume (no checkpoint %s)", dest, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint %s: %w", path, err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %s: %w", path, err)
+	}
+	if cp.Version != CheckpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has version %d; this Klon understands version %d", path, cp.Version, CheckpointVersion)
+	}
+	cp.path = path
+	return &cp, nil
+}
+
+// Path is the file the checkpoint is kept in.
+func (cp *Checkpoint) Path() string {
+	return cp.path
+}
+
+// Verify makes sure the checkpoint still describes its plan and the
+// destination: the steps must match the fingerprint, and the destination
+// must have the same size and serial number. Once the destination was
+// partitioned (or if the plan never partitions it) its partition table
+// must also be the one the completed steps left behind.
+func (cp *Checkpoint) Verify() error {
+	if PlanFingerprint(cp.Plan.Steps) != cp.Fingerprint {
+		return fmt.Errorf("the steps in checkpoint %s do not match its fingerprint", cp.path)
+	}
+	dest := cp.Plan.Options.Destination
+	got, err := ReadDiskIdentity(dest)
+	if err != nil {
+		return fmt.Errorf("cannot identify %s: %w", dest, err)
+	}
+	want := cp.Disk
+	if want.SizeBytes != got.SizeBytes {
+		return fmt.Errorf("%s has %d bytes but the interrupted clone wrote to one of %d bytes. Is it the same disk?", dest, got.SizeBytes, want.SizeBytes)
+	}
+	if want.Serial != got.Serial {
+		return fmt.Errorf("%s has serial number %q but the interrupted clone wrote to %q. Is it the same disk?", dest, got.Serial, want.Serial)
+	}
+	prepared := true
+	for i, step := range cp.Plan.Steps {
+		if step.Operation == OpPrepareDisk && !cp.Done(StepID(step, i+1)) {
+			prepared = false
+		}
+	}
+	if prepared && want.TableID != got.TableID {
+		return fmt.Errorf("the partition table of %s changed since the clone was interrupted (%s, was %s)", dest, got.TableID, want.TableID)
+	}
+	return nil
+}
+
+// Done reports whether the step with the given StepID completed. A nil
+// checkpoint has no completed steps.
+func (cp *Checkpoint) Done(id string) bool {
+	return cp != nil && slices.Contains(cp.Completed, id)
+}
+
+// DoneOperation reports whether a step of operation op completed.
+func (cp *Checkpoint) DoneOperation(op Operation) bool {
+	if cp == nil {
+		return false
+	}
+	for i, step := range cp.Plan.Steps {
+		if step.Operation == op && cp.Done(StepID(step, i+1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete records that the step with the given StepID finished, together
+// with the identity of the destination it left behind.
+func (cp *Checkpoint) Complete(id string) error {
+	if cp == nil {
+		return nil
+	}
+	if !cp.Done(id) {
+		cp.Completed = append(cp.Completed, id)
+	}
+	return cp.save()
+}
+
+// Remove deletes the checkpoint once the clone is finished.
+func (cp *Checkpoint) Remove() error {
+	if cp == nil {
+		return nil
+	}
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// save refreshes the destination identity and writes the checkpoint
+// atomically, so a crash never leaves half of one behind.
+func (cp *Checkpoint) save() error {
+	id, err := ReadDiskIdentity(cp.Plan.Options.Destination)
+	if err != nil {
+		return fmt.Errorf("cannot identify %s: %w", cp.Plan.Options.Destination, err)
+	}
+	cp.Disk = id
+	cp.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cp.path), 0o755); err != nil {
+		return err
+	}
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("cannot write checkpoint %s: %w", cp.path, err)
+	}
+	return os.Rename(tmp, cp.path)
+}
+
+// skipOnResume reports whether a step that already completed is skipped
+// when a clone is resumed. Partitioning and formatting again would wipe the
+// data copied so far; syncs are cheap to repeat and catch up with the
+// source, and the steps after them run again anyway.
+func skipOnResume(step ExecutionStep) bool {
+	return step.Operation == OpPrepareDisk || step.Operation == OpInitializePartition
+}
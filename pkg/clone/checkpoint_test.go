@@ -0,0 +1,140 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// partitioningRunner writes a partition table to an image file for
+// prepare-disk steps and fails the step with the StepID failOn.
+type partitioningRunner struct {
+	image  string
+	failOn string
+	ran    []string
+}
+
+func (r *partitioningRunner) Run(step ExecutionStep) error {
+	id := StepID(step, len(r.ran)+1)
+	r.ran = append(r.ran, step.Description)
+	if step.Operation == OpPrepareDisk {
+		return parttable.WriteFile(r.image, &parttable.Table{
+			Type:       parttable.DOS,
+			Partitions: []parttable.Partition{{Index: 1, StartLBA: 2048, Sectors: 8192, Type: "83"}},
+		})
+	}
+	if id == r.failOn {
+		return errors.New("rsync died")
+	}
+	return nil
+}
+
+func TestCheckpoint_Resume(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "pi.img")
+	if err := os.WriteFile(image, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 16<<20); err != nil {
+		t.Fatal(err)
+	}
+	plan := PlanResult{
+		SourceDisk: "/dev/mmcblk0",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Initialize: true, Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Initialize: true, Sync: true}},
+		},
+	}
+	opts := PlanOptions{Destination: image, Initialize: true}
+	pf := NewPlanFile(plan, opts)
+
+	cp, err := NewCheckpoint(filepath.Join(dir, "checkpoints"), "run1", pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &partitioningRunner{image: image, failOn: "05-sync-filesystem-p2"}
+	if err := ApplyCheckpointed(context.Background(), plan, opts, first, nil, cp); err == nil {
+		t.Fatalf("expected the second sync to fail")
+	}
+
+	cp, err = LoadCheckpoint(filepath.Join(dir, "checkpoints"), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"01-prepare-disk", "02-initialize-partition-p1", "03-sync-filesystem-p1", "04-initialize-partition-p2"}
+	if strings.Join(cp.Completed, ",") != strings.Join(want, ",") || cp.RunID != "run1" || !strings.HasPrefix(cp.Disk.TableID, "dos:") {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+	if err := cp.Verify(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Resuming skips partitioning and formatting but syncs everything again.
+	second := &partitioningRunner{image: image}
+	if err := ApplyCheckpointed(context.Background(), plan, opts, second, nil, cp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(second.ran) != 2 || !strings.HasPrefix(second.ran[0], "sync ") || !strings.HasPrefix(second.ran[1], "sync ") {
+		t.Fatalf("unexpected steps on resume: %v", second.ran)
+	}
+	if err := cp.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCheckpoint(filepath.Join(dir, "checkpoints"), image); err == nil || !strings.Contains(err.Error(), "no unfinished clone") {
+		t.Fatalf("expected no checkpoint after Remove, got %v", err)
+	}
+}
+
+func TestCheckpoint_Verify(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "pi.img")
+	backupDisk(t, image, 4<<30)
+	plan := syncOnlyPlan()
+	pf := NewPlanFile(plan, PlanOptions{Destination: image})
+
+	cp, err := NewCheckpoint(dir, "run1", pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Verify(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The partition table of a destination that was not re-partitioned
+	// must not change.
+	if err := parttable.WriteFile(image, &parttable.Table{Type: parttable.DOS, DiskSignature: 0x1234}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Verify(); err == nil || !strings.Contains(err.Error(), "partition table") {
+		t.Fatalf("expected a new partition table to be refused, got %v", err)
+	}
+
+	if err := os.Truncate(image, 5<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Verify(); err == nil || !strings.Contains(err.Error(), "same disk") {
+		t.Fatalf("expected a different size to be refused, got %v", err)
+	}
+
+	cp.Plan.Steps[0].Excludes = []string{"/home"}
+	if err := cp.Verify(); err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("expected edited steps to be refused, got %v", err)
+	}
+}
+
+func TestCheckpointPath(t *testing.T) {
+	for dest, want := range map[string]string{
+		"sdb":             "/c/sdb.json",
+		"/dev/nvme0n1":    "/c/nvme0n1.json",
+		"/srv/backup.img": "/c/srv_backup.img.json",
+	} {
+		if got := CheckpointPath("/c", dest); got != want {
+			t.Errorf("CheckpointPath(%q) = %q, want %q", dest, got, want)
+		}
+	}
+}
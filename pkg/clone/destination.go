@@ -0,0 +1,129 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// DestinationPartition is an existing destination partition that a
+// sync-only run updates in place.
+type DestinationPartition struct {
+	Device string `json:"device"`
+	PartitionDetails
+}
+
+// destinationInspector is implemented by System values that can describe
+// the partitions already on a destination disk or image file.
+type destinationInspector interface {
+	DestinationPartitions(dest string) (map[int]DestinationPartition, error)
+}
+
+// DestinationPartitions reads the partition table of a destination disk or
+// image file and probes the filesystem at the start of every partition.
+func (s localSystem) DestinationPartitions(dest string) (map[int]DestinationPartition, error) {
+	path := dest
+	if !IsImageDestination(dest) {
+		path = s.hostPath(ensureDevPrefix(dest))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	table, err := parttable.Read(f, size)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[int]DestinationPartition, len(table.Partitions))
+	for _, p := range table.Partitions {
+		device := fmt.Sprintf("%s partition %d", dest, p.Index)
+		if !IsImageDestination(dest) {
+			device = hostDevices.partition(dest, p.Index)
+		}
+		d := DestinationPartition{
+			Device: device,
+			PartitionDetails: PartitionDetails{
+				StartBytes: p.StartBytes(),
+				SizeBytes:  p.SizeBytes(),
+			},
+		}
+		d.PartUUID, d.PartType = tableIdentity(table, p)
+		info, err := probeFilesystem(io.NewSectionReader(f, p.StartBytes(), p.SizeBytes()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot probe %s: %w", device, err)
+		}
+		d.FSType, d.FSUUID, d.Label = info.Type, info.UUID, info.Label
+		parts[p.Index] = d
+	}
+	return parts, nil
+}
+
+// checkSyncDestination makes sure a sync-only plan writes into partitions
+// that match the source: every synced partition must exist on the
+// destination and hold a compatible filesystem. It records what each
+// partition will update in PartitionPlan.Destination, so the capacity check
+// can use the real destination sizes. Systems that cannot inspect the
+// destination are not checked.
+func checkSyncDestination(sys System, plan *PlanResult, opts PlanOptions) error {
+	di, ok := sys.(destinationInspector)
+	if !ok || opts.Initialize {
+		return nil
+	}
+	dest, err := di.DestinationPartitions(opts.Destination)
+	if errors.Is(err, os.ErrNotExist) {
+		// ValidateCloneSafety reports missing destinations.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read the partitions of %s to update it: %w. Use -f to re-create it from the source (this erases it)", opts.Destination, err)
+	}
+
+	var problems []string
+	for i := range plan.Partitions {
+		part := &plan.Partitions[i]
+		if !part.Action.Sync || part.Action.Skip {
+			continue
+		}
+		name := fmt.Sprintf("partition %d", part.Index)
+		if part.Mountpoint != "" {
+			name += " (" + part.Mountpoint + ")"
+		}
+		d, ok := dest[part.Index]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s does not exist on %s", name, opts.Destination))
+			continue
+		case d.FSType == "":
+			problems = append(problems, fmt.Sprintf("%s: %s holds no filesystem Klon recognizes", name, d.Device))
+			continue
+		case !compatibleFilesystems(part.FSType, d.FSType):
+			problems = append(problems, fmt.Sprintf("%s is %s on the source but %s holds %s", name, part.FSType, d.Device, d.FSType))
+			continue
+		}
+		part.Destination = &d
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("destination %s does not match the source layout, so it cannot be updated in place:\n  - %s\nUse -f to re-create it from the source (this erases it)", opts.Destination, strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// compatibleFilesystems reports whether files of a source filesystem can be
+// synced into a destination one. The ext family is interchangeable, and an
+// unknown source filesystem accepts anything.
+func compatibleFilesystems(src, dst string) bool {
+	if src == "" || src == dst {
+		return true
+	}
+	return strings.HasPrefix(src, "ext") && strings.HasPrefix(dst, "ext")
+}
@@ -0,0 +1,110 @@
+package clone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// backupDisk writes a Raspberry Pi style layout to path: a FAT boot
+// partition and an ext4 root.
+func backupDisk(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := parttable.WriteFile(path, &parttable.Table{
+		Type:          parttable.DOS,
+		DiskSignature: 0xb4c4,
+		Partitions: []parttable.Partition{
+			{Index: 1, StartLBA: 8192, Sectors: 524288, Type: "c"},
+			{Index: 2, StartLBA: 532480, Sectors: 4194304, Type: "83"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeFileAt(t, path, 8192*512, fat16Image(t)[:512])
+	writeFileAt(t, path, 532480*512+extSuperblockOffset, extSuperblock(0x4, 0x2c2, 0x1))
+}
+
+func syncOnlyPlan() PlanResult {
+	return PlanResult{Partitions: []PartitionPlan{
+		{Index: 1, Mountpoint: "/boot", Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{FSType: "vfat", UsedBytes: 60 << 20}},
+		{Index: 2, Mountpoint: "/", Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{FSType: "ext4", UsedBytes: 1 << 30}},
+	}}
+}
+
+func TestCheckSyncDestination(t *testing.T) {
+	f := standardTree(t)
+	backupDisk(t, filepath.Join(f.root, "dev", "nvme0n1"), 4<<30)
+	sys := f.system()
+
+	plan := syncOnlyPlan()
+	if err := checkSyncDestination(sys, &plan, PlanOptions{Destination: "nvme0n1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	boot, root := plan.Partitions[0].Destination, plan.Partitions[1].Destination
+	if boot == nil || boot.Device != "/dev/nvme0n1p1" || boot.FSType != "vfat" {
+		t.Fatalf("unexpected boot destination %+v", boot)
+	}
+	if root == nil || root.Device != "/dev/nvme0n1p2" || root.FSType != "ext4" || root.SizeBytes != 2<<30 || root.PartUUID != "0000b4c4-02" {
+		t.Fatalf("unexpected root destination %+v", root)
+	}
+	if problems := analyzeCapacity(sys, &plan, PlanOptions{}); len(problems) != 0 || plan.Partitions[1].Capacity.DestSizeBytes != 2<<30 {
+		t.Fatalf("expected the capacity check to use the existing partition, got %v %+v", problems, plan.Partitions[1].Capacity)
+	}
+	if out := plan.String(); !strings.Contains(out, "will update /dev/nvme0n1p2 (ext4, 2.0 GiB at 260.0 MiB") {
+		t.Fatalf("expected a will-update line, got:\n%s", out)
+	}
+
+	// Initializing plans and missing destinations are not inspected.
+	plan = syncOnlyPlan()
+	if err := checkSyncDestination(sys, &plan, PlanOptions{Destination: "nvme0n1", Initialize: true}); err != nil || plan.Partitions[0].Destination != nil {
+		t.Fatalf("expected -f to skip the check, got %v", err)
+	}
+	if err := checkSyncDestination(sys, &plan, PlanOptions{Destination: "sdz"}); err != nil {
+		t.Fatalf("expected a missing destination to be left to the safety check, got %v", err)
+	}
+}
+
+func TestCheckSyncDestination_Mismatch(t *testing.T) {
+	f := standardTree(t)
+	backupDisk(t, filepath.Join(f.root, "dev", "nvme0n1"), 4<<30)
+
+	plan := syncOnlyPlan()
+	plan.Partitions[0].FSType = "ext4"
+	plan.Partitions = append(plan.Partitions, PartitionPlan{Index: 3, Mountpoint: "/srv", Action: PartitionAction{Sync: true}})
+	err := checkSyncDestination(f.system(), &plan, PlanOptions{Destination: "nvme0n1"})
+	if err == nil {
+		t.Fatalf("expected a layout mismatch to be refused")
+	}
+	for _, want := range []string{
+		"does not match the source layout",
+		"partition 1 (/boot) is ext4 on the source but /dev/nvme0n1p1 holds vfat",
+		"partition 3 (/srv) does not exist on nvme0n1",
+		"Use -f",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error:\n%v", want, err)
+		}
+	}
+}
+
+func TestDestinationPartitions_Image(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "pi.img")
+	backupDisk(t, img, 4<<30)
+
+	parts, err := localSystem{}.DestinationPartitions(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parts) != 2 || parts[2].Device != img+" partition 2" || parts[2].FSType != "ext4" || parts[1].FSType != "vfat" {
+		t.Fatalf("unexpected partitions: %+v", parts)
+	}
+}
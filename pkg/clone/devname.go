@@ -0,0 +1,121 @@
+package clone
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// deviceNames maps between whole disks, partition numbers and partition
+// device nodes. With a DeviceSystem it asks sysfs, so any device the kernel
+// knows works, including loop, nbd and md devices and symlinks such as
+// /dev/disk/by-id/...; without one, or for devices sysfs does not list yet
+// (partitions of a table that is about to be written), it applies the
+// kernel's naming rules.
+type deviceNames struct {
+	sys DeviceSystem
+}
+
+// hostDevices resolves names on the running system.
+var hostDevices = deviceNames{sys: localSystem{}}
+
+// namesFor returns the resolver matching a System: sysfs-backed when the
+// System can describe block devices, naming rules only otherwise (fake
+// Systems in tests).
+func namesFor(sys System) deviceNames {
+	ds, _ := sys.(DeviceSystem)
+	return deviceNames{sys: ds}
+}
+
+var (
+	// Kernel rule: a partition of a disk whose name ends in a digit gets a
+	// "p" before its number (mmcblk0p1, nvme0n1p1, loop0p1, md0p1).
+	digitDiskPartition = regexp.MustCompile(`^(.*[0-9])p([0-9]+)$`)
+	// Letter-suffixed disk families (sda1, vdb2, xvda3, hdc1). Other names
+	// ending in digits (loop0, nbd0, md0) are whole disks.
+	letterDiskPartition = regexp.MustCompile(`^((?:sd|vd|hd|xvd)[a-z]+)([0-9]+)$`)
+	// udev's stable links name partitions "<disk link>-part<n>".
+	linkPartition = regexp.MustCompile(`^(/dev/disk/by-[^/]+/.+)-part([0-9]+)$`)
+)
+
+// partition returns the device node of partition index on disk.
+func (n deviceNames) partition(disk string, index int) string {
+	disk = ensureDevPrefix(disk)
+	if disk == "" {
+		return ""
+	}
+	if n.sys != nil {
+		if parts, err := n.sys.Partitions(disk); err == nil {
+			for _, p := range parts {
+				if p.Partition == index {
+					return p.Path
+				}
+			}
+		}
+		// Not partitioned yet: name it after the kernel device the
+		// (possibly symlinked) disk resolves to.
+		if dev, err := n.sys.BlockDevice(disk); err == nil {
+			disk = "/dev/" + dev.Name
+		}
+	}
+	if strings.HasPrefix(disk, "/dev/disk/") {
+		return fmt.Sprintf("%s-part%d", disk, index)
+	}
+	last := disk[len(disk)-1]
+	if last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", disk, index)
+	}
+	return fmt.Sprintf("%s%d", disk, index)
+}
+
+// split returns the whole disk a device belongs to and its partition number,
+// which is 0 when the device is a whole disk.
+func (n deviceNames) split(device string) (disk string, index int) {
+	device = ensureDevPrefix(device)
+	if n.sys != nil {
+		if dev, err := n.sys.BlockDevice(device); err == nil {
+			if dev.Type == DevicePartition && dev.Parent != "" {
+				return "/dev/" + dev.Parent, dev.Partition
+			}
+			return dev.Path, 0
+		}
+	}
+	if m := linkPartition.FindStringSubmatch(device); m != nil {
+		idx, _ := strconv.Atoi(m[2])
+		return m[1], idx
+	}
+	dir, name := filepath.Split(device)
+	for _, re := range []*regexp.Regexp{digitDiskPartition, letterDiskPartition} {
+		if m := re.FindStringSubmatch(name); m != nil {
+			idx, _ := strconv.Atoi(m[2])
+			return dir + m[1], idx
+		}
+	}
+	return device, 0
+}
+
+// disk returns the whole disk a device belongs to.
+func (n deviceNames) disk(device string) string {
+	disk, _ := n.split(device)
+	return disk
+}
+
+// partitionIndex returns the partition number of a device, or 0 for a whole
+// disk.
+func (n deviceNames) partitionIndex(device string) int {
+	_, idx := n.split(device)
+	return idx
+}
+
+// isPartition reports whether device is a partition rather than a whole disk.
+func (n deviceNames) isPartition(device string) bool {
+	return device != "" && n.partitionIndex(device) > 0
+}
+
+// sameDisk reports whether two devices are, or are partitions of, the same
+// disk.
+func (n deviceNames) sameDisk(a, b string) bool {
+	return n.disk(a) == n.disk(b)
+}
@@ -0,0 +1,117 @@
+package clone
+
+import (
+	"testing"
+)
+
+func TestDeviceNames_NamingRules(t *testing.T) {
+	var names deviceNames
+
+	splits := []struct {
+		dev   string
+		disk  string
+		index int
+	}{
+		{"/dev/sda1", "/dev/sda", 1},
+		{"/dev/sda", "/dev/sda", 0},
+		{"/dev/vdb12", "/dev/vdb", 12},
+		{"/dev/mmcblk0p2", "/dev/mmcblk0", 2},
+		{"/dev/mmcblk0", "/dev/mmcblk0", 0},
+		{"/dev/nvme0n1p3", "/dev/nvme0n1", 3},
+		{"/dev/nvme0n1", "/dev/nvme0n1", 0},
+		{"/dev/loop0", "/dev/loop0", 0},
+		{"/dev/loop0p1", "/dev/loop0", 1},
+		{"/dev/nbd0p1", "/dev/nbd0", 1},
+		{"/dev/md0p1", "/dev/md0", 1},
+		{"md0", "/dev/md0", 0},
+		{"/dev/disk/by-id/usb-SanDisk_Ultra-0:0-part2", "/dev/disk/by-id/usb-SanDisk_Ultra-0:0", 2},
+		{"/dev/disk/by-id/usb-SanDisk_Ultra-0:0", "/dev/disk/by-id/usb-SanDisk_Ultra-0:0", 0},
+	}
+	for _, tc := range splits {
+		disk, index := names.split(tc.dev)
+		if disk != tc.disk || index != tc.index {
+			t.Fatalf("split(%q) = %q, %d; want %q, %d", tc.dev, disk, index, tc.disk, tc.index)
+		}
+		if got := names.isPartition(tc.dev); got != (tc.index > 0) {
+			t.Fatalf("isPartition(%q) = %v", tc.dev, got)
+		}
+		if tc.index > 0 {
+			if got := names.partition(tc.disk, tc.index); got != ensureDevPrefix(tc.dev) {
+				t.Fatalf("partition(%q, %d) = %q, want %q", tc.disk, tc.index, got, tc.dev)
+			}
+		}
+	}
+
+	sameDisk := []struct {
+		a, b string
+		want bool
+	}{
+		{"/dev/sda", "/dev/sda", true},
+		{"/dev/sda1", "/dev/sda", true},
+		{"/dev/sda1", "/dev/sdb1", false},
+		{"/dev/mmcblk0p1", "/dev/mmcblk0", true},
+		{"/dev/mmcblk0p1", "/dev/mmcblk1p1", false},
+		{"/dev/nvme0n1p1", "/dev/nvme0n1", true},
+		{"/dev/loop0p1", "/dev/loop1", false},
+	}
+	for _, tc := range sameDisk {
+		if got := names.sameDisk(tc.a, tc.b); got != tc.want {
+			t.Fatalf("sameDisk(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceNames_Sysfs(t *testing.T) {
+	f := standardTree(t)
+	// A stable name for the USB disk, and for one of its partitions.
+	f.device("sda", 0)
+	f.device("sda2", 0)
+	f.symlink("../../sda", "/dev/disk/by-id/usb-Samsung_T7-0:0")
+	f.symlink("../../sda2", "/dev/disk/by-id/usb-Samsung_T7-0:0-part2")
+	// A blank disk whose partitions do not exist yet.
+	f.disk("nbd0", "43:0", 2097152)
+	f.device("nbd0", 0)
+	f.symlink("../../nbd0", "/dev/disk/by-id/nbd-blank")
+	names := deviceNames{sys: f.system()}
+
+	cases := []struct {
+		disk  string
+		index int
+		want  string
+	}{
+		{"/dev/disk/by-id/usb-Samsung_T7-0:0", 10, "/dev/sda10"},
+		{"sda", 2, "/dev/sda2"},
+		{"/dev/loop0", 1, "/dev/loop0p1"},
+		{"/dev/disk/by-id/nbd-blank", 1, "/dev/nbd0p1"},
+	}
+	for _, tc := range cases {
+		if got := names.partition(tc.disk, tc.index); got != tc.want {
+			t.Fatalf("partition(%q, %d) = %q, want %q", tc.disk, tc.index, got, tc.want)
+		}
+	}
+
+	splits := []struct {
+		dev   string
+		disk  string
+		index int
+	}{
+		{"/dev/disk/by-id/usb-Samsung_T7-0:0-part2", "/dev/sda", 2},
+		{"/dev/disk/by-id/usb-Samsung_T7-0:0", "/dev/sda", 0},
+		{"/dev/nvme0n1", "/dev/nvme0n1", 0},
+		{"/dev/loop0", "/dev/loop0", 0},
+		{"/dev/mapper/vg0-root", "/dev/mapper/vg0-root", 0},
+	}
+	for _, tc := range splits {
+		disk, index := names.split(tc.dev)
+		if disk != tc.disk || index != tc.index {
+			t.Fatalf("split(%q) = %q, %d; want %q, %d", tc.dev, disk, index, tc.disk, tc.index)
+		}
+	}
+
+	if !names.sameDisk("/dev/disk/by-id/usb-Samsung_T7-0:0", "/dev/sda1") {
+		t.Fatalf("expected a by-id link and its kernel name to be the same disk")
+	}
+	if names.isPartition("/dev/disk/by-id/usb-Samsung_T7-0:0") {
+		t.Fatalf("a by-id link to a whole disk is not a partition")
+	}
+}
@@ -0,0 +1,327 @@
+package clone
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// Block device types reported in BlockDevice.Type.
+const (
+	DeviceDisk      = "disk"
+	DevicePartition = "part"
+	DeviceLoop      = "loop"
+	DeviceMapper    = "dm"
+)
+
+// BlockDevice describes a kernel block device as seen in sysfs.
+type BlockDevice struct {
+	// Name is the kernel name, e.g. "mmcblk0p2" or "dm-0".
+	Name string
+	// Path is the device node: /dev/<name>, or /dev/mapper/<name> for
+	// device-mapper devices.
+	Path string
+	// Type is one of DeviceDisk, DevicePartition, DeviceLoop or DeviceMapper.
+	Type string
+	// MajMin is the "major:minor" device number, as used in mountinfo.
+	MajMin    string
+	SizeBytes int64
+	ReadOnly  bool
+	Removable bool
+	// Parent, Partition and StartBytes are set for partitions: the kernel
+	// name of the whole disk, the partition number and its offset.
+	Parent     string
+	Partition  int
+	StartBytes int64
+	// BackingFile is the file behind a loop device.
+	BackingFile string
+	// DMName is the device-mapper name (e.g. "vg0-root") and DMUUID its
+	// UUID, which starts with "LVM-" for LVM logical volumes.
+	DMName string
+	DMUUID string
+	// Slaves are the kernel names of the devices a stacked device (dm, md)
+	// is built on, and Holders those of the stacked devices built on this
+	// one.
+	Slaves  []string
+	Holders []string
+}
+
+// MountInfo is one line of /proc/self/mountinfo.
+type MountInfo struct {
+	MajMin string
+	// Root is the directory of the filesystem that is mounted; it is not "/"
+	// for bind mounts of subdirectories and btrfs subvolumes.
+	Root       string
+	Mountpoint string
+	FSType     string
+	Source     string
+	// Options are the per-mount options; SuperOptions are the filesystem's
+	// own (e.g. lowerdir= for overlays).
+	Options      string
+	SuperOptions string
+}
+
+// DeviceSystem is a System that can also enumerate block devices, mounts and
+// filesystem signatures. The local implementation reads sysfs, procfs and
+// the devices themselves instead of parsing the output of lsblk or blkid.
+type DeviceSystem interface {
+	System
+	BlockDevice(device string) (BlockDevice, error)
+	Partitions(disk string) ([]BlockDevice, error)
+	Mounts() ([]MountInfo, error)
+	ProbeFilesystem(device string) (FilesystemInfo, error)
+}
+
+// hostPath maps an absolute path of the running system into the tree the
+// localSystem reads from.
+func (s localSystem) hostPath(p string) string {
+	if s.root == "" {
+		return p
+	}
+	return filepath.Join(s.root, p)
+}
+
+// kernelName returns the sysfs name of a device given as a kernel name or a
+// /dev path. Symlinks such as /dev/mapper/vg0-root or /dev/disk/by-id/... are
+// resolved to the node they point at.
+func (s localSystem) kernelName(device string) string {
+	if !strings.HasPrefix(device, "/dev/") {
+		return device
+	}
+	if real, err := filepath.EvalSymlinks(s.hostPath(device)); err == nil {
+		return filepath.Base(real)
+	}
+	return filepath.Base(device)
+}
+
+// BlockDevice describes a disk, partition, loop or device-mapper device using
+// /sys/class/block.
+func (s localSystem) BlockDevice(device string) (BlockDevice, error) {
+	name := s.kernelName(device)
+	dir := s.hostPath(filepath.Join("/sys/class/block", name))
+	if _, err := os.Stat(dir); err != nil {
+		return BlockDevice{}, fmt.Errorf("block device %s not found in sysfs: %w", device, err)
+	}
+
+	dev := BlockDevice{
+		Name:      name,
+		Path:      "/dev/" + name,
+		Type:      DeviceDisk,
+		MajMin:    readSysfsString(dir, "dev"),
+		SizeBytes: readSysfsInt(dir, "size") * parttable.SectorSize,
+		ReadOnly:  readSysfsInt(dir, "ro") == 1,
+		Removable: readSysfsInt(dir, "removable") == 1,
+	}
+	switch {
+	case fileExists(filepath.Join(dir, "partition")):
+		dev.Type = DevicePartition
+		dev.Partition = int(readSysfsInt(dir, "partition"))
+		dev.StartBytes = readSysfsInt(dir, "start") * parttable.SectorSize
+		// A partition's sysfs directory lives inside its disk's directory.
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dev.Parent = filepath.Base(filepath.Dir(real))
+		}
+	case fileExists(filepath.Join(dir, "dm")):
+		dev.Type = DeviceMapper
+		dev.DMName = readSysfsString(dir, "dm/name")
+		dev.DMUUID = readSysfsString(dir, "dm/uuid")
+		if dev.DMName != "" {
+			dev.Path = "/dev/mapper/" + dev.DMName
+		}
+	case fileExists(filepath.Join(dir, "loop")):
+		dev.Type = DeviceLoop
+		dev.BackingFile = readSysfsString(dir, "loop/backing_file")
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "slaves")); err == nil {
+		for _, e := range entries {
+			dev.Slaves = append(dev.Slaves, e.Name())
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "holders")); err == nil {
+		for _, e := range entries {
+			dev.Holders = append(dev.Holders, e.Name())
+		}
+	}
+	return dev, nil
+}
+
+// Partitions lists the partitions of a whole disk, ordered by partition
+// number, from the subdirectories of /sys/block/<disk>.
+func (s localSystem) Partitions(disk string) ([]BlockDevice, error) {
+	name := s.kernelName(ensureDevPrefix(disk))
+	entries, err := os.ReadDir(s.hostPath(filepath.Join("/sys/block", name)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list partitions of %s: %w", disk, err)
+	}
+	var parts []BlockDevice
+	for _, e := range entries {
+		if !fileExists(s.hostPath(filepath.Join("/sys/block", name, e.Name(), "partition"))) {
+			continue
+		}
+		part, err := s.BlockDevice(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Partition < parts[j].Partition })
+	return parts, nil
+}
+
+// Mounts parses /proc/self/mountinfo.
+func (s localSystem) Mounts() ([]MountInfo, error) {
+	data, err := os.ReadFile(s.hostPath("/proc/self/mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(data))
+}
+
+// ProbeFilesystem reads the superblock of a device to find its filesystem
+// type, UUID and label.
+func (s localSystem) ProbeFilesystem(device string) (FilesystemInfo, error) {
+	f, err := os.Open(s.hostPath(ensureDevPrefix(device)))
+	if err != nil {
+		return FilesystemInfo{}, err
+	}
+	defer f.Close()
+	info, err := probeFilesystem(f)
+	if err != nil {
+		return FilesystemInfo{}, fmt.Errorf("cannot probe %s: %w", device, err)
+	}
+	return info, nil
+}
+
+// partitionIdentity returns the PARTUUID and partition type of a partition
+// from the partition table of its disk, formatted the way blkid and lsblk
+// print them ("6c586e13-02" and "0x83" for dos, GUIDs for gpt).
+func (s localSystem) partitionIdentity(device string) (partUUID, partType string, err error) {
+	part, err := s.BlockDevice(device)
+	if err != nil {
+		return "", "", err
+	}
+	if part.Type != DevicePartition || part.Parent == "" {
+		return "", "", fmt.Errorf("%s is not a partition", device)
+	}
+	table, err := parttable.ReadFile(s.hostPath("/dev/" + part.Parent))
+	if err != nil {
+		return "", "", err
+	}
+	entry, ok := table.Partition(part.Partition)
+	if !ok {
+		return "", "", fmt.Errorf("partition %d of %s is not in its partition table", part.Partition, part.Parent)
+	}
+	partUUID, partType = tableIdentity(table, entry)
+	return partUUID, partType, nil
+}
+
+// tableIdentity returns the PARTUUID and partition type of a partition
+// table entry, in the form blkid reports them.
+func tableIdentity(table *parttable.Table, entry parttable.Partition) (partUUID, partType string) {
+	if table.Type == parttable.GPT {
+		return entry.GUID.String(), entry.Type
+	}
+	return fmt.Sprintf("%08x-%02x", table.DiskSignature, entry.Index), "0x" + entry.Type
+}
+
+// mountpointsByDevice maps device numbers to where they are mounted. When a
+// filesystem is mounted several times, the first mount of its root wins over
+// bind mounts of subdirectories.
+func mountpointsByDevice(mounts []MountInfo) map[string]string {
+	res := make(map[string]string)
+	for _, m := range mounts {
+		if m.Root == "/" {
+			if _, ok := res[m.MajMin]; !ok {
+				res[m.MajMin] = m.Mountpoint
+			}
+		}
+	}
+	return res
+}
+
+// parseMountInfo parses the content of /proc/<pid>/mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Optional fields end at the "-" separator. Paths have spaces, tabs,
+// newlines and backslashes escaped as octal.
+func parseMountInfo(content string) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("malformed mountinfo line %q", scanner.Text())
+		}
+		m := MountInfo{
+			MajMin:     fields[2],
+			Root:       unescapeMountPath(fields[3]),
+			Mountpoint: unescapeMountPath(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		}
+		if len(fields) > sep+3 {
+			m.SuperOptions = fields[sep+3]
+		}
+		mounts = append(mounts, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the \ooo octal escapes the kernel uses in mount
+// tables.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readSysfsString(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysfsInt(dir, name string) int64 {
+	n, _ := strconv.ParseInt(readSysfsString(dir, name), 10, 64)
+	return n
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,421 @@
+package clone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// fakeSysfs builds a sysfs/procfs/dev tree laid out like the kernel's:
+// device directories live under /sys/devices, partitions inside their disk's
+// directory, and /sys/block and /sys/class/block hold symlinks to them.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	t.Helper()
+	return &fakeSysfs{t: t, root: t.TempDir()}
+}
+
+func (f *fakeSysfs) system() localSystem {
+	return localSystem{root: f.root}
+}
+
+func (f *fakeSysfs) write(path, content string) {
+	f.t.Helper()
+	full := filepath.Join(f.root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) symlink(target, link string) {
+	f.t.Helper()
+	full := filepath.Join(f.root, link)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.Symlink(target, full); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// disk adds a whole disk of the given size in sectors and returns its sysfs
+// directory.
+func (f *fakeSysfs) disk(name, majmin string, sectors int64) string {
+	dir := "/sys/devices/platform/block/" + name
+	f.write(dir+"/dev", majmin+"\n")
+	f.write(dir+"/size", fmt.Sprintf("%d\n", sectors))
+	f.write(dir+"/ro", "0\n")
+	f.write(dir+"/removable", "0\n")
+	f.symlink("../devices/platform/block/"+name, "/sys/block/"+name)
+	f.symlink("../../devices/platform/block/"+name, "/sys/class/block/"+name)
+	f.symlink("../../devices/platform/block/"+name, "/sys/dev/block/"+majmin)
+	return dir
+}
+
+func (f *fakeSysfs) partition(disk, name, majmin string, number int, start, sectors int64) {
+	dir := "/sys/devices/platform/block/" + disk + "/" + name
+	f.write(dir+"/dev", majmin+"\n")
+	f.write(dir+"/partition", fmt.Sprintf("%d\n", number))
+	f.write(dir+"/start", fmt.Sprintf("%d\n", start))
+	f.write(dir+"/size", fmt.Sprintf("%d\n", sectors))
+	f.symlink("../../devices/platform/block/"+disk+"/"+name, "/sys/class/block/"+name)
+	f.symlink("../../devices/platform/block/"+disk+"/"+name, "/sys/dev/block/"+majmin)
+}
+
+// device creates the /dev node of a device as a sparse file of the given
+// size, so superblocks and partition tables can be written into it.
+func (f *fakeSysfs) device(name string, size int64) string {
+	f.t.Helper()
+	path := filepath.Join(f.root, "dev", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		f.t.Fatal(err)
+	}
+	return path
+}
+
+// standardTree has an SD card, an NVMe drive, a USB disk, a partitioned
+// loop device and an LVM volume on the USB disk.
+func standardTree(t *testing.T) *fakeSysfs {
+	f := newFakeSysfs(t)
+	f.disk("mmcblk0", "179:0", 62333952)
+	f.partition("mmcblk0", "mmcblk0p1", "179:1", 1, 8192, 524288)
+	f.partition("mmcblk0", "mmcblk0p2", "179:2", 2, 532480, 61801472)
+
+	f.disk("nvme0n1", "259:0", 1000215216)
+	f.partition("nvme0n1", "nvme0n1p1", "259:1", 1, 2048, 1048576)
+	f.partition("nvme0n1", "nvme0n1p2", "259:2", 2, 1050624, 999164592)
+
+	f.disk("sda", "8:0", 120127488)
+	f.partition("sda", "sda2", "8:2", 2, 1050624, 20971520)
+	f.partition("sda", "sda10", "8:10", 10, 22022144, 2097152)
+	f.partition("sda", "sda1", "8:1", 1, 2048, 1048576)
+
+	loop := f.disk("loop0", "7:0", 8388608)
+	f.write(loop+"/loop/backing_file", "/var/tmp/my image.img\n")
+	f.partition("loop0", "loop0p1", "259:3", 1, 2048, 8386560)
+
+	dm := f.disk("dm-0", "253:0", 20971520)
+	f.write(dm+"/dm/name", "vg0-root\n")
+	f.write(dm+"/slaves/sda2/dev", "8:2\n")
+	f.device("dm-0", 0)
+	f.symlink("../dm-0", "/dev/mapper/vg0-root")
+	return f
+}
+
+func TestLocalSystemPartitions(t *testing.T) {
+	sys := standardTree(t).system()
+
+	cases := map[string][]string{
+		"/dev/mmcblk0": {"/dev/mmcblk0p1", "/dev/mmcblk0p2"},
+		"nvme0n1":      {"/dev/nvme0n1p1", "/dev/nvme0n1p2"},
+		"/dev/sda":     {"/dev/sda1", "/dev/sda2", "/dev/sda10"},
+		"/dev/loop0":   {"/dev/loop0p1"},
+		"/dev/dm-0":    nil,
+	}
+	for disk, want := range cases {
+		parts, err := sys.Partitions(disk)
+		if err != nil {
+			t.Fatalf("Partitions(%s): %v", disk, err)
+		}
+		var got []string
+		for _, p := range parts {
+			got = append(got, p.Path)
+			if p.Type != DevicePartition || p.Parent != strings.TrimPrefix(ensureDevPrefix(disk), "/dev/") {
+				t.Fatalf("unexpected partition of %s: %+v", disk, p)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Partitions(%s) = %v, want %v", disk, got, want)
+		}
+	}
+
+	if _, err := sys.Partitions("/dev/sdz"); err == nil {
+		t.Fatalf("expected an error for a disk that is not in sysfs")
+	}
+}
+
+func TestLocalSystemBlockDevice(t *testing.T) {
+	sys := standardTree(t).system()
+
+	p2, err := sys.BlockDevice("/dev/mmcblk0p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BlockDevice{
+		Name: "mmcblk0p2", Path: "/dev/mmcblk0p2", Type: DevicePartition, MajMin: "179:2",
+		SizeBytes: 61801472 * 512, Parent: "mmcblk0", Partition: 2, StartBytes: 532480 * 512,
+	}
+	if !reflect.DeepEqual(p2, want) {
+		t.Fatalf("unexpected partition:\n got %+v\nwant %+v", p2, want)
+	}
+
+	loop, err := sys.BlockDevice("loop0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loop.Type != DeviceLoop || loop.BackingFile != "/var/tmp/my image.img" {
+		t.Fatalf("unexpected loop device: %+v", loop)
+	}
+
+	// Device-mapper nodes are usually named through /dev/mapper symlinks.
+	dm, err := sys.BlockDevice("/dev/mapper/vg0-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.Name != "dm-0" || dm.Type != DeviceMapper || dm.Path != "/dev/mapper/vg0-root" || dm.MajMin != "253:0" {
+		t.Fatalf("unexpected dm device: %+v", dm)
+	}
+	if !reflect.DeepEqual(dm.Slaves, []string{"sda2"}) {
+		t.Fatalf("expected dm-0 to sit on sda2, got %v", dm.Slaves)
+	}
+
+	nvme, err := sys.BlockDevice("/dev/nvme0n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nvme.Type != DeviceDisk || nvme.SizeBytes != 1000215216*512 {
+		t.Fatalf("unexpected nvme disk: %+v", nvme)
+	}
+}
+
+func TestLocalSystemMountedPartitions(t *testing.T) {
+	f := standardTree(t)
+	// The root filesystem shows up as /dev/root, /boot/firmware through a
+	// by-uuid symlink and a USB stick under a path with a space; a bind
+	// mount of a subdirectory must not hide the real mountpoint.
+	f.write("/proc/self/mountinfo", `21 1 179:2 / / rw,noatime shared:1 - ext4 /dev/root rw
+22 21 0:5 / /dev rw,relatime shared:2 - devtmpfs udev rw
+30 21 179:1 / /boot/firmware rw,relatime shared:3 - vfat /dev/disk/by-uuid/1234-ABCD rw
+31 21 8:1 /data /srv/data rw,relatime shared:4 - ext4 /dev/sda1 rw
+32 21 8:1 / /media/pi/my\040disk rw,relatime shared:5 - ext4 /dev/sda1 rw
+33 21 253:0 / /mnt/lvm rw,relatime - ext4 /dev/mapper/vg0-root rw
+`)
+	sys := f.system()
+
+	got, err := sys.MountedPartitions("/dev/mmcblk0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MountedPartition{
+		{Device: "/dev/mmcblk0p1", Mountpoint: "/boot/firmware"},
+		{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MountedPartitions(mmcblk0) = %+v, want %+v", got, want)
+	}
+
+	all := sys.AllParts("/dev/sda")
+	wantAll := []MountedPartition{
+		{Device: "/dev/sda1", Mountpoint: "/media/pi/my disk"},
+		{Device: "/dev/sda2"},
+		{Device: "/dev/sda10"},
+	}
+	if !reflect.DeepEqual(all, wantAll) {
+		t.Fatalf("AllParts(sda) = %+v, want %+v", all, wantAll)
+	}
+
+	if got, _ := sys.MountedPartitions("/dev/sdz"); len(got) != 0 {
+		t.Fatalf("expected no partitions for an unknown disk, got %+v", got)
+	}
+}
+
+// lvmRootTree has the root filesystem on LVM volume vg0-root, whose only
+// physical volume is sda2, and /boot on sda1.
+func lvmRootTree(t *testing.T, dmUUID string) *fakeSysfs {
+	f := standardTree(t)
+	f.write("/sys/devices/platform/block/dm-0/dm/uuid", dmUUID+"\n")
+	f.write("/sys/devices/platform/block/sda/sda2/holders/dm-0", "")
+	f.write("/proc/self/mountinfo", "21 1 253:0 / / rw,relatime - ext4 /dev/mapper/vg0-root rw\n"+
+		"22 21 8:1 / /boot rw,relatime - vfat /dev/sda1 rw\n")
+	return f
+}
+
+func TestLocalSystemMountedPartitions_DeviceMapperRoot(t *testing.T) {
+	f := lvmRootTree(t, "LVM-Zq0fDkX1")
+	got, err := f.system().MountedPartitions("/dev/sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MountedPartition{
+		{Device: "/dev/sda1", Mountpoint: "/boot"},
+		{Device: "/dev/sda2", Mountpoint: "/", Mapper: "/dev/mapper/vg0-root"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MountedPartitions(sda) = %+v, want %+v", got, want)
+	}
+
+	// The root filesystem is synced from the volume onto a plain partition,
+	// never dropped from the plan.
+	plan, err := PlanWithSystem(f.system(), PlanOptions{Destination: "nvme0n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root *PartitionPlan
+	for i := range plan.Partitions {
+		if plan.Partitions[i].Mountpoint == "/" {
+			root = &plan.Partitions[i]
+		}
+	}
+	if root == nil || !root.Action.Sync || root.Device != "/dev/sda2" || root.Mapper != "/dev/mapper/vg0-root" {
+		t.Fatalf("expected / to be synced from the LVM volume, got %+v", plan.Partitions)
+	}
+
+	cases := map[string]func(f *fakeSysfs){
+		"encrypted with LUKS": func(f *fakeSysfs) {
+			f.write("/sys/devices/platform/block/dm-0/dm/uuid", "CRYPT-LUKS2-5f2a\n")
+		},
+		"holds the LVM volumes /dev/dm-0, /dev/dm-1": func(f *fakeSysfs) {
+			dm := f.disk("dm-1", "253:1", 2097152)
+			f.write(dm+"/dm/name", "vg0-home\n")
+			f.write(dm+"/dm/uuid", "LVM-Zq0fDkX2\n")
+			f.write(dm+"/slaves/sda2/dev", "8:2\n")
+			f.write("/sys/devices/platform/block/sda/sda2/holders/dm-1", "")
+		},
+	}
+	for wantErr, setup := range cases {
+		f := lvmRootTree(t, "LVM-Zq0fDkX1")
+		setup(f)
+		_, err := PlanWithSystem(f.system(), PlanOptions{Destination: "nvme0n1"})
+		if err == nil || !strings.Contains(err.Error(), "cannot clone /") || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("expected the plan to refuse / with %q, got %v", wantErr, err)
+		}
+	}
+}
+
+func TestLocalSystemPartitionDetails(t *testing.T) {
+	f := standardTree(t)
+
+	// A dos table on the SD card and a gpt one on the NVMe drive.
+	if err := parttable.WriteFile(f.device("mmcblk0", 64<<20), &parttable.Table{
+		Type:          parttable.DOS,
+		DiskSignature: 0x6c586e13,
+		Partitions: []parttable.Partition{
+			{Index: 1, StartLBA: 8192, Sectors: 524288 / 16, Type: "c"},
+			{Index: 2, StartLBA: 8192 + 524288/16, Sectors: 65536, Type: "83"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	guid, _ := parttable.ParseGUID("0b1c7c1a-34e1-4c64-9b10-6b2c4bcd1b54")
+	if err := parttable.WriteFile(f.device("nvme0n1", 64<<20), &parttable.Table{
+		Type: parttable.GPT,
+		Partitions: []parttable.Partition{
+			{Index: 1, StartLBA: 2048, Sectors: 4096, Type: linuxFilesystemGUID, GUID: guid},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	root := f.device("mmcblk0p2", probeSize)
+	sb := extSuperblock(0x4, 0x2c2, 0x1)
+	copy(sb[104:120], []byte{0xde, 0xad, 0xbe, 0xef, 0, 1, 0, 2, 0, 3, 0, 4, 5, 6, 7, 8})
+	copy(sb[120:], "my root")
+	writeFileAt(t, root, extSuperblockOffset, sb)
+	f.device("nvme0n1p1", probeSize)
+
+	sys := f.system()
+	d, err := sys.PartitionDetails("/dev/mmcblk0p2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PartitionDetails{
+		FSType:     "ext4",
+		StartBytes: 532480 * 512,
+		SizeBytes:  61801472 * 512,
+		FSUUID:     "deadbeef-0001-0002-0003-000405060708",
+		PartUUID:   "6c586e13-02",
+		Label:      "my root",
+		PartType:   "0x83",
+	}
+	if d != want {
+		t.Fatalf("unexpected details:\n got %+v\nwant %+v", d, want)
+	}
+
+	d, err = sys.PartitionDetails("nvme0n1p1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.PartUUID != "0b1c7c1a-34e1-4c64-9b10-6b2c4bcd1b54" || d.PartType != linuxFilesystemGUID || d.FSType != "" {
+		t.Fatalf("unexpected gpt details: %+v", d)
+	}
+}
+
+func TestLocalSystemDiskSize(t *testing.T) {
+	sys := standardTree(t).system()
+	size, err := sys.DiskSize("mmcblk0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 62333952*512 {
+		t.Fatalf("unexpected size %d", size)
+	}
+	if _, err := sys.DiskSize("/dev/sdz"); err == nil {
+		t.Fatalf("expected an error for a missing disk")
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	content := `36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+37 21 8:1 / /media/a\040b\011c\134d rw - vfat /dev/sda1 rw
+38 21 0:40 / /run/user/1000 rw,nosuid shared:7 master:2 - tmpfs tmpfs rw
+`
+	mounts, err := parseMountInfo(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MountInfo{
+		{MajMin: "98:0", Root: "/mnt1", Mountpoint: "/mnt2", FSType: "ext3", Source: "/dev/root", Options: "rw,noatime", SuperOptions: "rw,errors=continue"},
+		{MajMin: "8:1", Root: "/", Mountpoint: "/media/a b\tc\\d", FSType: "vfat", Source: "/dev/sda1", Options: "rw", SuperOptions: "rw"},
+		{MajMin: "0:40", Root: "/", Mountpoint: "/run/user/1000", FSType: "tmpfs", Source: "tmpfs", Options: "rw,nosuid", SuperOptions: "rw"},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Fatalf("unexpected mounts:\n got %+v\nwant %+v", mounts, want)
+	}
+
+	if _, err := parseMountInfo("36 35 98:0 / /mnt rw ext4\n"); err == nil {
+		t.Fatalf("expected an error for a line without separator")
+	}
+}
+
+// extSuperblock returns an ext superblock with the given feature flags.
+func extSuperblock(compat, incompat, roCompat uint32) []byte {
+	sb := make([]byte, 1024)
+	binary.LittleEndian.PutUint16(sb[56:58], extMagic)
+	binary.LittleEndian.PutUint32(sb[92:96], compat)
+	binary.LittleEndian.PutUint32(sb[extIncompatOffset:], incompat)
+	binary.LittleEndian.PutUint32(sb[extROCompatOffset:], roCompat)
+	return sb
+}
+
+func writeFileAt(t *testing.T, path string, off int64, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+}
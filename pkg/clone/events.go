@@ -0,0 +1,168 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventKind is the type of an Event.
+type EventKind string
+
+const (
+	// EventPlanStarted is sent when Apply starts running a plan.
+	EventPlanStarted EventKind = "plan-started"
+	// EventStepStarted and EventStepFinished surround every execution step.
+	EventStepStarted  EventKind = "step-started"
+	EventStepFinished EventKind = "step-finished"
+	// EventCommand is sent for every system command that is run, EventOutput
+	// for every line it prints and EventCommandFinished when it exits.
+	EventCommand         EventKind = "command"
+	EventOutput          EventKind = "output"
+	EventCommandFinished EventKind = "command-finished"
+	// EventProgress carries the bytes copied by a sync or copy-blocks step.
+	EventProgress EventKind = "progress"
+	// EventWarning is a problem Klon works around and continues.
+	EventWarning EventKind = "warning"
+	// EventApplyFinished is sent when Apply returns.
+	EventApplyFinished EventKind = "apply-finished"
+)
+
+// Event describes something that happened while applying a plan. Only the
+// fields that make sense for its Kind are set.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// Step is the step of step events. StepIndex counts the steps from 1 to
+	// StepCount; plan-started carries StepCount alone.
+	Step      *ExecutionStep
+	StepIndex int
+	StepCount int
+	// StepID identifies the step an event happened in (see StepID); it is
+	// empty outside of steps.
+	StepID string
+	// Command is the command line of command events; command-finished also
+	// carries its exit code and (truncated) output.
+	Command  string
+	ExitCode int
+	Output   string
+	// Line is one line of command output, without its line ending.
+	Line string
+	// Message is the text of a warning.
+	Message  string
+	Progress *ProgressReport
+	// Duration is how long a step, or the whole apply, took.
+	Duration time.Duration
+	// Err is the failure of a step or of the apply, if any.
+	Err error
+}
+
+// eventSink delivers the events of one run to its handler. It also knows
+// the step the run is in, so that the events of the commands a step runs
+// carry its StepID.
+type eventSink struct {
+	handler func(Event)
+	// mu guards stepID; deliver serializes the calls to handler.
+	mu      sync.Mutex
+	stepID  string
+	deliver sync.Mutex
+}
+
+type eventSinkKey struct{}
+
+// WithEventHandler returns a copy of ctx whose run sends its events to h:
+// ApplyCheckpointed and the runners, hooks and commands given the returned
+// context send them there. Events are delivered one at a time, from the
+// goroutine that produced them, so h must return quickly.
+func WithEventHandler(ctx context.Context, h func(Event)) context.Context {
+	return context.WithValue(ctx, eventSinkKey{}, &eventSink{handler: h})
+}
+
+// eventsOf returns the event sink of the run ctx belongs to, or nil.
+func eventsOf(ctx context.Context) *eventSink {
+	if ctx == nil {
+		return nil
+	}
+	sink, _ := ctx.Value(eventSinkKey{}).(*eventSink)
+	return sink
+}
+
+// emit stamps e, writes it to the structured logger and hands it to the
+// event handler of ctx, if any.
+func emit(ctx context.Context, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	sink := eventsOf(ctx)
+	if e.StepID == "" && e.Kind != EventPlanStarted && e.Kind != EventApplyFinished {
+		e.StepID = sink.step()
+	}
+	if l := structuredLogger(); l != nil {
+		logRecord(l, e)
+	}
+	if sink != nil && sink.handler != nil {
+		sink.deliver.Lock()
+		defer sink.deliver.Unlock()
+		sink.handler(e)
+	}
+}
+
+// step returns the StepID of the running step.
+func (s *eventSink) step() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stepID
+}
+
+// enterStep makes id the StepID of the events of ctx that follow; ""
+// leaves the step.
+func enterStep(ctx context.Context, id string) {
+	s := eventsOf(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stepID = id
+}
+
+// logCommand logs a command about to run and sends it as an event. The
+// returned function must be called with the command's output and error once
+// it exits; it logs the output and sends command-finished. The lines of the
+// output are sent as they are printed, by a progressWriter given ctx.
+func logCommand(ctx context.Context, cmd string) func(output string, err error) {
+	if !structured() {
+		logSink.Printf("klon: EXEC: %s", cmd)
+	}
+	emit(ctx, Event{Kind: EventCommand, Command: cmd})
+	start := time.Now()
+	return func(output string, err error) {
+		logOutput(output)
+		emit(ctx, Event{Kind: EventCommandFinished, Command: cmd, ExitCode: exitCode(err), Output: truncateOutput(strings.TrimSpace(output)), Duration: time.Since(start), Err: err})
+	}
+}
+
+// logOutput logs the output of a command, if any.
+func logOutput(out string) {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return
+	}
+	if !structured() {
+		logSink.Printf("klon: OUTPUT: %s", out)
+	}
+}
+
+// logWarning logs a warning and sends it as an event of ctx.
+func logWarning(ctx context.Context, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if !structured() {
+		logSink.Printf("klon: WARNING: %s", msg)
+	}
+	emit(ctx, Event{Kind: EventWarning, Message: msg})
+}
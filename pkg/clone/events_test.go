@@ -0,0 +1,144 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordEvents returns a context whose events are collected.
+func recordEvents() (context.Context, *[]Event) {
+	var events []Event
+	ctx := WithEventHandler(context.Background(), func(e Event) { events = append(events, e) })
+	return ctx, &events
+}
+
+func TestApply_Events(t *testing.T) {
+	ctx, events := recordEvents()
+	plan := PlanResult{
+		DestinationDisk: "sda",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}},
+		},
+	}
+	if err := ApplyCheckpointed(ctx, plan, PlanOptions{Destination: "sda"}, &fakeRunner{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, e := range *events {
+		s := string(e.Kind)
+		if e.Step != nil {
+			s += fmt.Sprintf(" %d/%d %s", e.StepIndex, e.StepCount, e.Step.Mountpoint)
+		}
+		if e.Time.IsZero() {
+			t.Fatalf("event %s has no time", e.Kind)
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"plan-started",
+		"step-started 1/2 /boot",
+		"step-finished 1/2 /boot",
+		"step-started 2/2 /",
+		"step-finished 2/2 /",
+		"apply-finished",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected events:\n%s", strings.Join(got, "\n"))
+	}
+
+	// A failing step is reported by its step-finished and apply-finished
+	// events.
+	*events = nil
+	if err := ApplyCheckpointed(ctx, plan, PlanOptions{Destination: "sda"}, &fakeRunner{err: errors.New("rsync died")}, nil, nil); err == nil {
+		t.Fatalf("expected an error")
+	}
+	last := (*events)[len(*events)-1]
+	if n := len(*events); n != 4 || (*events)[2].Err == nil || last.Kind != EventApplyFinished || !strings.Contains(last.Err.Error(), "rsync died") {
+		t.Fatalf("unexpected events after a failure: %+v", *events)
+	}
+}
+
+func TestRunShellCommand_Events(t *testing.T) {
+	ctx, events := recordEvents()
+	if err := runShellCommand(ctx, "printf 'one\\ntwo\\n'"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logWarning(ctx, "disk %s is slow", "sda")
+
+	var got []string
+	for _, e := range *events {
+		got = append(got, fmt.Sprintf("%s: %s%s%s", e.Kind, e.Command, e.Line, e.Message))
+	}
+	want := []string{
+		`command: printf 'one\ntwo\n'`,
+		"output: one",
+		"output: two",
+		`command-finished: printf 'one\ntwo\n'`,
+		"warning: disk sda is slow",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected events:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestRunShellCommand_StreamsOutput(t *testing.T) {
+	// The command only goes on once the handler saw its first line.
+	seen := filepath.Join(t.TempDir(), "seen")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var lines []string
+	ctx = WithEventHandler(ctx, func(e Event) {
+		if e.Kind != EventOutput {
+			return
+		}
+		lines = append(lines, e.Line)
+		if e.Line == "waiting" {
+			os.WriteFile(seen, nil, 0o644)
+		}
+	})
+	cmd := fmt.Sprintf("echo waiting; while [ ! -e %s ]; do sleep 0.01; done; echo done >&2", seen)
+	if err := runShellCommand(ctx, cmd); err != nil {
+		t.Fatalf("expected the output to be sent while the command runs, got %v", err)
+	}
+	if strings.Join(lines, ",") != "waiting,done" {
+		t.Fatalf("unexpected output events %v", lines)
+	}
+}
+
+func TestWithEventHandler_PerRun(t *testing.T) {
+	first, firstEvents := recordEvents()
+	second, secondEvents := recordEvents()
+	runner := runnerFunc(func(step ExecutionStep) error {
+		logWarning(first, "in the first run")
+		logWarning(second, "in the second run")
+		return nil
+	})
+	plan := PlanResult{Partitions: []PartitionPlan{{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}}}}
+	if err := ApplyCheckpointed(first, plan, PlanOptions{Destination: "sda"}, runner, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var warnings []string
+	for _, e := range *firstEvents {
+		if e.Kind == EventWarning {
+			warnings = append(warnings, e.Message+" "+e.StepID)
+		}
+	}
+	if strings.Join(warnings, ",") != "in the first run 01-sync-filesystem-p2" {
+		t.Fatalf("unexpected warnings in the first run: %v", warnings)
+	}
+	if len(*secondEvents) != 1 || (*secondEvents)[0].StepID != "" {
+		t.Fatalf("expected the second run to only get its warning, got %+v", *secondEvents)
+	}
+}
+
+type runnerFunc func(step ExecutionStep) error
+
+func (f runnerFunc) Run(step ExecutionStep) error { return f(step) }
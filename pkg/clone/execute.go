@@ -1,18 +1,41 @@
 package clone
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // ExecutionStep is a high-level description of a concrete action that would be
 // taken to perform a clone. It is both structured (for automation) and has a
 // human-readable description.
 type ExecutionStep struct {
-	Operation       string // e.g. "sync-filesystem", "initialize-partition"
-	SourceDevice    string
-	DestinationDisk string
-	PartitionIndex  int
-	Mountpoint      string
-	Description     string
-	SizeBytes       int64
+	Operation       Operation `json:"operation"`
+	SourceDevice    string    `json:"source_device,omitempty"`
+	DestinationDisk string    `json:"destination_disk,omitempty"`
+	PartitionIndex  int       `json:"partition_index,omitempty"`
+	Mountpoint      string    `json:"mountpoint,omitempty"`
+	Description     string    `json:"description"`
+	SizeBytes       int64     `json:"size_bytes,omitempty"`
+	// Layout is the destination partition table for prepare-disk steps
+	// whose strategy computes it at plan time.
+	Layout *DiskLayout `json:"layout,omitempty"`
+	// FSType is the filesystem recorded for the source partition at plan
+	// time, if known, or the one requested by a layout file.
+	FSType string `json:"fs_type,omitempty"`
+	// Label is the filesystem label requested by a layout file.
+	Label string `json:"label,omitempty"`
+	// SourcePath and Excludes mirror the PartitionPlan fields for sync steps.
+	SourcePath string   `json:"source_path,omitempty"`
+	Excludes   []string `json:"excludes,omitempty"`
+	// Snapshot is how the source of a sync step is kept consistent.
+	Snapshot *SourceSnapshot `json:"snapshot,omitempty"`
+	// Pass is 2 for the sync steps of the second pass (see
+	// PlanOptions.TwoPass) and zero otherwise.
+	Pass int `json:"pass,omitempty"`
+	// Action is the typed plan decision this step was derived from. For
+	// prepare-disk it carries the partition strategy.
+	Action PartitionAction `json:"action"`
 }
 
 // Runner abstracts how execution steps are performed. The initial implementation
@@ -30,23 +53,26 @@ func BuildExecutionSteps(plan PlanResult, opts PlanOptions) []ExecutionStep {
 
 	// If initialization is requested, add a disk preparation step first.
 	if opts.Initialize {
-		strategy := opts.PartitionStrategy
-		if strategy == "" {
-			strategy = "clone-table"
-		}
+		strategy := opts.PartitionStrategy.orDefault()
 		desc := fmt.Sprintf("prepare destination %s (strategy=%s)", opts.Destination, strategy)
 		steps = append(steps, ExecutionStep{
-			Operation:       "prepare-disk",
+			Operation:       OpPrepareDisk,
 			SourceDevice:    plan.SourceDisk,
 			DestinationDisk: opts.Destination,
 			PartitionIndex:  0,
 			Mountpoint:      "",
 			SizeBytes:       opts.P1SizeBytes, // optional p1 resize happens immediately after cloning the table
 			Description:     desc,
+			Action:          PartitionAction{Strategy: strategy, Initialize: true},
+			Layout:          plan.DestinationLayout,
 		})
 	}
 
 	for _, part := range plan.Partitions {
+		if part.Action.Kind() == ActionSkip {
+			continue
+		}
+
 		src := part.Device
 		if src == "" {
 			src = plan.SourceDisk
@@ -63,48 +89,93 @@ func BuildExecutionSteps(plan PlanResult, opts PlanOptions) []ExecutionStep {
 			desc = fmt.Sprintf("%s mounted on %s", desc, part.Mountpoint)
 		}
 
-		if part.Action != "" && part.Action != "sync" {
+		fsType, label := part.FSType, ""
+		if plan.DestinationLayout != nil {
+			if lp, ok := plan.DestinationLayout.Partition(part.Index); ok && lp.FSType != "" {
+				fsType, label = lp.FSType, lp.Label
+			}
+		}
+		if part.SourcePath != "" {
+			desc = fmt.Sprintf("%s from %s", desc, part.SourcePath)
+		}
+
+		if part.Action.Block {
 			steps = append(steps, ExecutionStep{
-				Operation:       "initialize-partition",
+				Operation:       OpCopyBlocks,
+				SourceDevice:    src,
+				DestinationDisk: opts.Destination,
+				PartitionIndex:  part.Index,
+				Mountpoint:      part.Mountpoint,
+				Description:     desc,
+				SizeBytes:       part.SizeBytes,
+				FSType:          fsType,
+				Action:          part.Action,
+			})
+			continue
+		}
+
+		if part.Action.Initialize {
+			steps = append(steps, ExecutionStep{
+				Operation:       OpInitializePartition,
 				SourceDevice:    src,
 				DestinationDisk: opts.Destination,
 				PartitionIndex:  part.Index,
 				Mountpoint:      part.Mountpoint,
 				Description:     "initialize " + desc,
+				FSType:          fsType,
+				Label:           label,
+				Action:          part.Action,
 			})
 		}
 
+		if !part.Action.Sync {
+			continue
+		}
 		steps = append(steps, ExecutionStep{
-			Operation:       "sync-filesystem",
+			Operation:       OpSyncFilesystem,
 			SourceDevice:    src,
 			DestinationDisk: opts.Destination,
 			PartitionIndex:  part.Index,
 			Mountpoint:      part.Mountpoint,
 			Description:     "sync " + desc,
+			FSType:          fsType,
+			SourcePath:      part.SourcePath,
+			Excludes:        part.Excludes,
+			Snapshot:        part.Snapshot,
+			Action:          part.Action,
 		})
 	}
 
-	// Optionally grow the last data partition (usually root) to use all
-	// remaining space on the destination disk after all sync steps have
-	// completed.
-	if opts.Initialize && opts.ExpandLastPartition {
-		lastIdx := 0
-		for _, part := range plan.Partitions {
-			if part.Index > lastIdx && part.Action != "" && part.Action != "sync" {
-				lastIdx = part.Index
+	// A second pass re-syncs the mounted partitions, which changed while the
+	// first pass ran.
+	if opts.TwoPass {
+		for _, step := range steps {
+			if step.Operation != OpSyncFilesystem || step.Mountpoint == "" {
+				continue
 			}
+			step.Pass = 2
+			step.Description = "second pass: " + step.Description
+			steps = append(steps, step)
 		}
-		if lastIdx > 0 {
-			growDesc := fmt.Sprintf("grow destination partition %d on %s to fill remaining space", lastIdx, opts.Destination)
-			steps = append(steps, ExecutionStep{
-				Operation:       "grow-partition",
-				SourceDevice:    "",
-				DestinationDisk: opts.Destination,
-				PartitionIndex:  lastIdx,
-				Mountpoint:      "",
-				Description:     growDesc,
-			})
+	}
+
+	// Grow the partitions the planner marked for resizing (usually the last
+	// data partition, i.e. root) to use all remaining space on the
+	// destination disk after all sync steps have completed.
+	for _, part := range plan.Partitions {
+		if !part.Action.Resize || part.Action.Kind() == ActionSkip {
+			continue
 		}
+		growDesc := fmt.Sprintf("grow destination partition %d on %s to fill remaining space", part.Index, opts.Destination)
+		steps = append(steps, ExecutionStep{
+			Operation:       OpGrowPartition,
+			SourceDevice:    "",
+			DestinationDisk: opts.Destination,
+			PartitionIndex:  part.Index,
+			Mountpoint:      "",
+			Description:     growDesc,
+			Action:          part.Action,
+		})
 	}
 
 	return steps
@@ -115,12 +186,88 @@ func BuildExecutionSteps(plan PlanResult, opts PlanOptions) []ExecutionStep {
 // behind an interface. If a step fails, it returns an error that includes
 // contextual information about which step failed.
 func Apply(plan PlanResult, opts PlanOptions, runner Runner) error {
+	return ApplyQuiesced(plan, opts, runner, nil)
+}
+
+// ApplyQuiesced is Apply with the units of q quiesced from the first
+// sync-filesystem step to the last one, or only for the second pass with
+// PlanOptions.QuiesceSecondPass. They are resumed right after the last sync,
+// or as soon as a step fails or panics. A nil q quiesces nothing.
+func ApplyQuiesced(plan PlanResult, opts PlanOptions, runner Runner, q *Quiescer) error {
+	return ApplyCheckpointed(context.Background(), plan, opts, runner, q, nil)
+}
+
+// ApplyCheckpointed is ApplyQuiesced recording every step that completes in
+// cp. The prepare-disk and initialize-partition steps cp already holds, left
+// by an interrupted run, are skipped. A nil cp records nothing.
+//
+// It sends a plan-started event, step-started and step-finished events
+// around every step and an apply-finished event to the event handler of
+// ctx, see WithEventHandler.
+func ApplyCheckpointed(ctx context.Context, plan PlanResult, opts PlanOptions, runner Runner, q *Quiescer, cp *Checkpoint) (err error) {
 	steps := BuildExecutionSteps(plan, opts)
-	for _, step := range steps {
-		if err := runner.Run(step); err != nil {
+	start := time.Now()
+	emit(ctx, Event{Kind: EventPlanStarted, Time: start, StepCount: len(steps)})
+	defer func() {
+		emit(ctx, Event{Kind: EventApplyFinished, StepCount: len(steps), Duration: time.Since(start), Err: err})
+	}()
+	firstSync, lastSync := -1, -1
+	for i, step := range steps {
+		if step.Operation != OpSyncFilesystem || (opts.QuiesceSecondPass && step.Pass < 2) {
+			continue
+		}
+		if firstSync < 0 {
+			firstSync = i
+		}
+		lastSync = i
+	}
+	quiesced := false
+	defer func() {
+		if quiesced {
+			if resumeErr := q.Resume(ctx); resumeErr != nil && err == nil {
+				err = resumeErr
+			}
+		}
+	}()
+
+	for i, step := range steps {
+		if q != nil && i == firstSync {
+			if err := q.Quiesce(ctx); err != nil {
+				return err
+			}
+			quiesced = true
+		}
+		id := StepID(step, i+1)
+		if cp.Done(id) && skipOnResume(step) {
+			logSink.Printf("klon: skipping %s: it completed before the clone was interrupted", id)
+			continue
+		}
+		if err := runStep(ctx, runner, step, i+1, len(steps)); err != nil {
 			return fmt.Errorf("apply failed on operation %q (dest=%s, part=%d): %w",
 				step.Operation, step.DestinationDisk, step.PartitionIndex, err)
 		}
+		if err := cp.Complete(id); err != nil {
+			logWarning(ctx, "cannot update the checkpoint %s: %v", cp.Path(), err)
+		}
+		if quiesced && i == lastSync {
+			quiesced = false
+			if err := q.Resume(ctx); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
+
+// runStep runs step number index of count and sends its start and finish as
+// events. The events sent while it runs carry its StepID.
+func runStep(ctx context.Context, runner Runner, step ExecutionStep, index, count int) error {
+	id := StepID(step, index)
+	start := time.Now()
+	emit(ctx, Event{Kind: EventStepStarted, Time: start, Step: &step, StepIndex: index, StepCount: count, StepID: id})
+	enterStep(ctx, id)
+	defer enterStep(ctx, "")
+	err := runner.Run(step)
+	emit(ctx, Event{Kind: EventStepFinished, Step: &step, StepIndex: index, StepCount: count, StepID: id, Duration: time.Since(start), Err: err})
+	return err
+}
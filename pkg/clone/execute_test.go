@@ -7,8 +7,8 @@ func TestBuildExecutionSteps_BuildsOneStepPerPartition(t *testing.T) {
 		SourceDisk:      "/dev/mmcblk0",
 		DestinationDisk: "sda",
 		Partitions: []PartitionPlan{
-			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: "sync"},
-			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: "sync"},
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}},
 		},
 	}
 	opts := PlanOptions{Destination: "sda"}
@@ -34,8 +34,8 @@ func TestBuildExecutionSteps_AddsPrepareDiskWhenInitializing(t *testing.T) {
 		SourceDisk:      "/dev/mmcblk0",
 		DestinationDisk: "sda",
 		Partitions: []PartitionPlan{
-			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: "initialize+sync[clone-table]"},
-			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: "initialize+sync[clone-table]"},
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Strategy: StrategyCloneTable, Initialize: true, Sync: true}},
 		},
 	}
 	opts := PlanOptions{
@@ -72,8 +72,8 @@ func TestApply_DelegatesToRunner(t *testing.T) {
 		SourceDisk:      "/dev/mmcblk0",
 		DestinationDisk: "sda",
 		Partitions: []PartitionPlan{
-			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: "sync"},
-			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: "sync"},
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}},
 		},
 	}
 	opts := PlanOptions{Destination: "sda"}
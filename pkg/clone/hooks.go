@@ -0,0 +1,234 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultHooksDir is where Klon looks for hook executables.
+const DefaultHooksDir = "/etc/klon/hooks.d"
+
+// hookWaitDelay is how long a hook's output is read after the run was
+// cancelled and the hook killed.
+const hookWaitDelay = 2 * time.Second
+
+// HookEvent names a point of a run where hooks are executed. The hooks of
+// an event are <hooks dir>/<event> if it is an executable file, or every
+// executable in the directory <hooks dir>/<event>, in name order. Hooks run
+// as root, so they and the directories they are read from must be owned by
+// root and writable by nobody else.
+type HookEvent string
+
+const (
+	HookPrePlan    HookEvent = "pre-plan"
+	HookPreApply   HookEvent = "pre-apply"
+	HookPreStep    HookEvent = "pre-step"
+	HookPostStep   HookEvent = "post-step"
+	HookPostSync   HookEvent = "post-sync"
+	HookPostAdjust HookEvent = "post-adjust"
+	HookPostVerify HookEvent = "post-verify"
+	HookOnFailure  HookEvent = "on-failure"
+)
+
+// HookEnv describes what a hook runs for. It is passed to hooks as KLON_*
+// environment variables; empty fields are passed as empty variables.
+type HookEnv struct {
+	Operation       string // KLON_OPERATION: a step operation, or "plan", "apply", ...
+	SourceDevice    string // KLON_SOURCE_DEVICE
+	DestinationDisk string // KLON_DESTINATION_DISK
+	PartitionIndex  int    // KLON_PARTITION_INDEX
+	Mountpoint      string // KLON_MOUNTPOINT
+	DestRoot        string // KLON_DEST_ROOT
+	Result          string // KLON_RESULT: "success" or "failure" after the fact
+	Error           string // KLON_ERROR: the failure, if any
+}
+
+// StepHookEnv returns the environment describing an execution step.
+func StepHookEnv(step ExecutionStep, destRoot string) HookEnv {
+	return HookEnv{
+		Operation:       string(step.Operation),
+		SourceDevice:    step.SourceDevice,
+		DestinationDisk: step.DestinationDisk,
+		PartitionIndex:  step.PartitionIndex,
+		Mountpoint:      step.Mountpoint,
+		DestRoot:        destRoot,
+	}
+}
+
+// WithResult returns env with Result and Error set from err.
+func (env HookEnv) WithResult(err error) HookEnv {
+	env.Result, env.Error = "success", ""
+	if err != nil {
+		env.Result, env.Error = "failure", err.Error()
+	}
+	return env
+}
+
+func (env HookEnv) environ(event HookEvent) []string {
+	index := ""
+	if env.PartitionIndex > 0 {
+		index = strconv.Itoa(env.PartitionIndex)
+	}
+	return []string{
+		"KLON_HOOK=" + string(event),
+		"KLON_OPERATION=" + env.Operation,
+		"KLON_SOURCE_DEVICE=" + env.SourceDevice,
+		"KLON_DESTINATION_DISK=" + env.DestinationDisk,
+		"KLON_PARTITION_INDEX=" + index,
+		"KLON_MOUNTPOINT=" + env.Mountpoint,
+		"KLON_DEST_ROOT=" + env.DestRoot,
+		"KLON_RESULT=" + env.Result,
+		"KLON_ERROR=" + env.Error,
+	}
+}
+
+// HookError is returned when a hook fails; it aborts the run.
+type HookError struct {
+	Event HookEvent
+	Path  string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook %s failed: %v", e.Event, e.Path, e.Err)
+}
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// Hooks runs the hook executables found in Dir. The zero value, with an
+// empty Dir, runs nothing.
+type Hooks struct {
+	Dir string
+}
+
+// Paths returns the executables to run for event, in order.
+func (h Hooks) Paths(event HookEvent) ([]string, error) {
+	return h.paths(context.Background(), event)
+}
+
+// paths is Paths sending its warnings as events of ctx.
+func (h Hooks) paths(ctx context.Context, event HookEvent) ([]string, error) {
+	if h.Dir == "" {
+		return nil, nil
+	}
+	path := filepath.Join(h.Dir, string(event))
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dirInfo, err := os.Stat(h.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHookOwner(h.Dir, dirInfo); err != nil {
+		return nil, err
+	}
+	if err := checkHookOwner(path, info); err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if info.Mode()&0o111 == 0 {
+			logWarning(ctx, "ignoring hook %s, which is not executable", path)
+			return nil, nil
+		}
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if info.Mode()&0o111 == 0 {
+			logWarning(ctx, "ignoring hook %s, which is not executable", p)
+			continue
+		}
+		if err := checkHookOwner(p, info); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// checkHookOwner refuses a hook, or a directory hooks are read from, that
+// someone other than root could have changed. Files of the user Klon runs
+// as, which is root outside of tests, are accepted too.
+func checkHookOwner(path string, info os.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("refusing to run hooks from %s: it is owned by uid %d, not root", path, st.Uid)
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("refusing to run hooks from %s: it is writable by group or others (%s)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Run executes the hooks of event with env and stops at the first one that
+// fails, returning a *HookError.
+func (h Hooks) Run(ctx context.Context, event HookEvent, env HookEnv) error {
+	paths, err := h.paths(ctx, event)
+	if err != nil {
+		return &HookError{Event: event, Path: filepath.Join(h.Dir, string(event)), Err: err}
+	}
+	for _, p := range paths {
+		done := logCommand(ctx, p)
+		cmd := exec.CommandContext(ctx, p)
+		cmd.Env = append(os.Environ(), env.environ(event)...)
+		// Children of a killed hook may keep its output open; do not wait
+		// for them.
+		cmd.WaitDelay = hookWaitDelay
+		w := &progressWriter{ctx: ctx}
+		cmd.Stdout, cmd.Stderr = w, w
+		err := cmd.Run()
+		done(w.Output(), err)
+		if err != nil {
+			return &HookError{Event: event, Path: p, Err: err}
+		}
+	}
+	return nil
+}
+
+// HookRunner wraps a Runner with the pre-step and post-step hooks. A failing
+// pre-step hook skips the step; post-step hooks see the step's result, and
+// their failure fails an otherwise successful step.
+type HookRunner struct {
+	Runner   Runner
+	Hooks    Hooks
+	DestRoot string
+	Ctx      context.Context
+}
+
+func (r HookRunner) Run(step ExecutionStep) error {
+	ctx := r.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	env := StepHookEnv(step, r.DestRoot)
+	if err := r.Hooks.Run(ctx, HookPreStep, env); err != nil {
+		return err
+	}
+	err := r.Runner.Run(step)
+	if hookErr := r.Hooks.Run(ctx, HookPostStep, env.WithResult(err)); hookErr != nil && err == nil {
+		return hookErr
+	}
+	return err
+}
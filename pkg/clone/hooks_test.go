@@ -0,0 +1,164 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHook(t *testing.T, path, script string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHooks_Paths(t *testing.T) {
+	dir := t.TempDir()
+	writeHook(t, filepath.Join(dir, "pre-apply"), "true", 0o755)
+	writeHook(t, filepath.Join(dir, "post-step", "20-second"), "true", 0o755)
+	writeHook(t, filepath.Join(dir, "post-step", "10-first"), "true", 0o755)
+	writeHook(t, filepath.Join(dir, "post-step", "README"), "", 0o644)
+	writeHook(t, filepath.Join(dir, "post-step", ".hidden"), "true", 0o755)
+	h := Hooks{Dir: dir}
+
+	got, err := h.Paths(HookPreApply)
+	if err != nil || len(got) != 1 || got[0] != filepath.Join(dir, "pre-apply") {
+		t.Fatalf("unexpected pre-apply hooks %v, %v", got, err)
+	}
+	got, err = h.Paths(HookPostStep)
+	want := []string{filepath.Join(dir, "post-step", "10-first"), filepath.Join(dir, "post-step", "20-second")}
+	if err != nil || strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected post-step hooks %v, %v", got, err)
+	}
+	if got, err := h.Paths(HookOnFailure); err != nil || len(got) != 0 {
+		t.Fatalf("expected no on-failure hooks, got %v, %v", got, err)
+	}
+	if got, err := (Hooks{}).Paths(HookPreApply); err != nil || len(got) != 0 {
+		t.Fatalf("expected an empty dir to disable hooks, got %v, %v", got, err)
+	}
+}
+
+func TestHooks_RefusesHooksOthersCanChange(t *testing.T) {
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "post-step", "10-notify")
+	writeHook(t, hook, "true", 0o755)
+	if err := os.Chmod(hook, 0o775); err != nil {
+		t.Fatal(err)
+	}
+	h := Hooks{Dir: dir}
+	if _, err := h.Paths(HookPostStep); err == nil || !strings.Contains(err.Error(), "writable by group or others") {
+		t.Fatalf("expected a group-writable hook to be refused, got %v", err)
+	}
+
+	if err := os.Chmod(hook, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "post-step"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Paths(HookPostStep); err == nil || !strings.Contains(err.Error(), "post-step: it is writable") {
+		t.Fatalf("expected a world-writable hook directory to be refused, got %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "post-step"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a hook needs root")
+	}
+	if err := os.Chown(hook, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Paths(HookPostStep); err == nil || !strings.Contains(err.Error(), "owned by uid 65534, not root") {
+		t.Fatalf("expected a hook of another user to be refused, got %v", err)
+	}
+}
+
+func TestHooks_Run(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	writeHook(t, filepath.Join(dir, "post-step"), "env | grep ^KLON_ | sort > "+out, 0o755)
+	writeHook(t, filepath.Join(dir, "pre-step"), "echo refusing; exit 3", 0o755)
+	h := Hooks{Dir: dir}
+
+	step := ExecutionStep{Operation: OpSyncFilesystem, SourceDevice: "/dev/mmcblk0p2", DestinationDisk: "sda", PartitionIndex: 2, Mountpoint: "/"}
+	env := StepHookEnv(step, "/mnt/clone").WithResult(errors.New("rsync died"))
+	if err := h.Run(context.Background(), HookPostStep, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"KLON_DESTINATION_DISK=sda",
+		"KLON_DEST_ROOT=/mnt/clone",
+		"KLON_ERROR=rsync died",
+		"KLON_HOOK=post-step",
+		"KLON_MOUNTPOINT=/",
+		"KLON_OPERATION=sync-filesystem",
+		"KLON_PARTITION_INDEX=2",
+		"KLON_RESULT=failure",
+		"KLON_SOURCE_DEVICE=/dev/mmcblk0p2",
+	}
+	if strings.TrimSpace(string(data)) != strings.Join(want, "\n") {
+		t.Fatalf("unexpected hook environment:\n%s", data)
+	}
+
+	err = h.Run(context.Background(), HookPreStep, env)
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) || hookErr.Event != HookPreStep || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("expected a pre-step hook error, got %v", err)
+	}
+}
+
+func TestHookRunner(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	writeHook(t, filepath.Join(dir, "pre-step"), `echo "pre $KLON_PARTITION_INDEX" >> `+log+`; [ "$KLON_PARTITION_INDEX" != 3 ]`, 0o755)
+	writeHook(t, filepath.Join(dir, "post-step"), `echo "post $KLON_PARTITION_INDEX $KLON_RESULT" >> `+log+`; [ "$KLON_PARTITION_INDEX" != 2 ]`, 0o755)
+
+	inner := &fakeRunner{}
+	r := HookRunner{Runner: inner, Hooks: Hooks{Dir: dir}, DestRoot: "/mnt/clone"}
+	if err := r.Run(ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Run(ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 2}); err == nil || !strings.Contains(err.Error(), "post-step hook") {
+		t.Fatalf("expected the post-step hook to fail the step, got %v", err)
+	}
+	if err := r.Run(ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 3}); err == nil || !strings.Contains(err.Error(), "pre-step hook") {
+		t.Fatalf("expected the pre-step hook to abort the step, got %v", err)
+	}
+	inner.err = errors.New("mkfs failed")
+	if err := r.Run(ExecutionStep{Operation: OpInitializePartition, PartitionIndex: 4}); err == nil || err.Error() != "mkfs failed" {
+		t.Fatalf("expected the step error, got %v", err)
+	}
+	if len(inner.steps) != 3 {
+		t.Fatalf("expected the step refused by its pre-step hook to be skipped, ran %d steps", len(inner.steps))
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pre 1\npost 1 success\npre 2\npost 2 success\npre 3\npre 4\npost 4 failure\n"
+	if string(data) != want {
+		t.Fatalf("unexpected hook calls:\n%s", data)
+	}
+
+	file := filepath.Join(dir, "kln.state")
+	hookErr := r.Run(ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 3})
+	if err := AppendStateLog(file, PlanResult{}, PlanOptions{}, nil, "APPLY_FAILED", hookErr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "failed hook: pre-step "+filepath.Join(dir, "pre-step")+"\nresult: FAILED") {
+		t.Fatalf("expected the failed hook in the state log:\n%s", data)
+	}
+}
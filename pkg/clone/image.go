@@ -0,0 +1,193 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// imageAlign is the granularity image sizes are rounded up to.
+const imageAlign = 1 << 20
+
+// IsImageDestination reports whether a destination names a disk image file
+// rather than a block device: a path outside /dev that contains a slash, or
+// any name ending in ".img" or a compressed image suffix (see ImageFormat).
+func IsImageDestination(dest string) bool {
+	if dest == "" || strings.HasPrefix(dest, "/dev/") {
+		return false
+	}
+	return strings.Contains(dest, "/") || strings.HasSuffix(dest, ".img") || ImageFormatOf(dest).Compressed()
+}
+
+// imageDestinationSize returns the size of the image file a plan writes to:
+// the requested size, the size of an existing image that is only synced, or
+// enough to hold every source partition at its current offset.
+func imageDestinationSize(sys System, srcDisk string, result PlanResult, opts PlanOptions) (int64, error) {
+	if opts.ImageSizeBytes > 0 {
+		return alignUp(opts.ImageSizeBytes, imageAlign), nil
+	}
+	if !opts.Initialize && !ImageFormatOf(opts.Destination).Compressed() {
+		st, err := os.Stat(opts.Destination)
+		if err != nil {
+			return 0, fmt.Errorf("image %s cannot be updated (use -f to create it): %w", opts.Destination, err)
+		}
+		return st.Size(), nil
+	}
+
+	var end int64
+	for _, p := range sourcePartitionGeometry(sys, srcDisk, result.Partitions) {
+		if e := p.StartBytes + p.SizeBytes; e > end {
+			end = e
+		}
+	}
+	if end == 0 {
+		return result.SourceSizeBytes, nil
+	}
+	// Leave room for a backup GPT after the last partition.
+	return alignUp(end+gptBackupBytes, imageAlign), nil
+}
+
+// validateImageDestination is the image file counterpart of the block device
+// checks in ValidateCloneSafety.
+func validateImageDestination(plan PlanResult, opts PlanOptions) error {
+	path := opts.Destination
+	dir := filepath.Dir(path)
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		return fmt.Errorf("directory %s for image %s does not exist; mount the backup share or USB disk first", dir, path)
+	}
+	if st, err := os.Stat(path); err == nil && !st.Mode().IsRegular() {
+		return fmt.Errorf("image destination %s exists and is not a regular file", path)
+	}
+	if opts.Source != "" {
+		if src, err := os.Stat(opts.Source); err == nil {
+			if dst, err := os.Stat(path); err == nil && os.SameFile(src, dst) {
+				return fmt.Errorf("refusing to write image %s: it is the source image", path)
+			}
+		}
+	}
+	if plan.DestinationSizeBytes <= 0 {
+		return fmt.Errorf("cannot size image %s: the source partition layout is unknown; pass --image-size", path)
+	}
+
+	// An image written onto the source disk would be copied into itself.
+	sys := localSystem{}
+	if mounts, err := sys.Mounts(); err == nil {
+		if dev, err := sys.resolvePathDevice(mounts, dir, 0); err == nil && hostDevices.sameDisk(dev, plan.SourceDisk) {
+			return fmt.Errorf("refusing to write image %s: %s is on the source disk %s. Use a USB disk or network share", path, dir, plan.SourceDisk)
+		}
+	}
+
+	format := ImageFormatOf(path)
+	if format.Compressed() {
+		if _, err := exec.LookPath(format.Tool()); err != nil {
+			return fmt.Errorf("writing %s images needs %s; please install it", format, format.Tool())
+		}
+	}
+
+	var needed int64
+	for _, p := range plan.Partitions {
+		if p.Action.Sync {
+			needed += p.UsedBytes
+		}
+	}
+	what := ""
+	if format.Compressed() {
+		// The raw image is only removed once it has been compressed, and
+		// some data (photos, videos, archives) does not compress at all.
+		needed *= 2
+		what = " for the raw clone and its compressed copy"
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil {
+		avail := int64(st.Bavail) * int64(st.Bsize)
+		if existing, err := os.Stat(path); err == nil && opts.Initialize && !format.Compressed() {
+			// The old image is replaced; its blocks become free.
+			avail += existing.Sys().(*syscall.Stat_t).Blocks * 512
+		}
+		if needed > avail && !opts.ForceSync {
+			return fmt.Errorf("image %s needs about %s%s but only %s are free in %s. Free some space or rerun with -F to force", path, formatBytes(needed), what, formatBytes(avail), dir)
+		}
+	}
+	return nil
+}
+
+// AttachedImage is a disk image file attached to a loop device with
+// partition scanning, so the normal pipeline can treat it as a disk.
+type AttachedImage struct {
+	Path       string
+	LoopDevice string
+}
+
+// AttachImage attaches the image at path to a free loop device. With create
+// set, any existing file is replaced by a sparse file of sizeBytes first, so
+// only the blocks the clone writes take up space.
+func AttachImage(ctx context.Context, path string, sizeBytes int64, create bool) (*AttachedImage, error) {
+	if create {
+		if sizeBytes <= 0 {
+			return nil, fmt.Errorf("cannot create image %s without a size", path)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create image %s: %w", path, err)
+		}
+		if err := f.Truncate(sizeBytes); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot size image %s: %w", path, err)
+		}
+		if err := f.Close(); err != nil {
+			return nil, fmt.Errorf("cannot create image %s: %w", path, err)
+		}
+		logSink.Printf("klon: created sparse image %s (%s)", path, formatBytes(sizeBytes))
+	}
+
+	return attachLoop(ctx, path, false)
+}
+
+// attachLoop attaches an image file to a free loop device with partition
+// scanning, read-only if requested.
+func attachLoop(ctx context.Context, path string, readOnly bool) (*AttachedImage, error) {
+	cmd := "losetup --find --show --partscan "
+	if readOnly {
+		cmd += "--read-only "
+	}
+	out, err := shellOutput(ctx, cmd+shellQuote(path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot attach image %s: %w", path, err)
+	}
+	loop := strings.TrimSpace(out)
+	if !strings.HasPrefix(loop, "/dev/") {
+		return nil, fmt.Errorf("losetup returned unexpected device %q for %s", loop, path)
+	}
+	logSink.Printf("klon: attached image %s to %s", path, loop)
+	return &AttachedImage{Path: path, LoopDevice: loop}, nil
+}
+
+// Target points a plan and its options at the loop device, so steps,
+// adjustments and verification address the image like any other disk.
+func (img *AttachedImage) Target(plan PlanResult, opts PlanOptions) (PlanResult, PlanOptions) {
+	plan.DestinationDisk = img.LoopDevice
+	opts.Destination = img.LoopDevice
+	return plan, opts
+}
+
+// Detach flushes and releases the loop device.
+func (img *AttachedImage) Detach(ctx context.Context) error {
+	var errs []error
+	if err := shellExec(ctx, "blockdev --flushbufs "+img.LoopDevice); err != nil {
+		errs = append(errs, err)
+	}
+	if err := shellExec(ctx, "losetup --detach "+img.LoopDevice); err != nil {
+		errs = append(errs, fmt.Errorf("cannot detach %s from image %s: %w", img.LoopDevice, img.Path, err))
+	}
+	return errors.Join(errs...)
+}
+
+// shellQuote quotes s for use as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
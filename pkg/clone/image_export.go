@@ -0,0 +1,252 @@
+package clone
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ImageFormat is the format of an image file: a raw disk image or one
+// compressed as a whole for archiving.
+type ImageFormat string
+
+const (
+	FormatRaw  ImageFormat = "img"
+	FormatZstd ImageFormat = "img.zst"
+	FormatGzip ImageFormat = "img.gz"
+	FormatXz   ImageFormat = "img.xz"
+)
+
+// compressedFormats maps each compressed format to its compress and
+// decompress commands, which read stdin and write stdout.
+var compressedFormats = map[ImageFormat][2][]string{
+	FormatZstd: {{"zstd", "-T0", "-q", "-c"}, {"zstd", "-d", "-q", "-c"}},
+	FormatGzip: {{"gzip", "-c"}, {"gzip", "-d", "-c"}},
+	FormatXz:   {{"xz", "-T0", "-c"}, {"xz", "-d", "-c"}},
+}
+
+// ParseImageFormat validates a --format value.
+func ParseImageFormat(s string) (ImageFormat, error) {
+	f := ImageFormat(s)
+	if _, ok := compressedFormats[f]; ok || f == FormatRaw {
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown image format %q (use img, img.zst, img.gz or img.xz)", s)
+}
+
+// ImageFormatOf returns the format implied by an image file name; names
+// without a compressed suffix are raw images.
+func ImageFormatOf(path string) ImageFormat {
+	for f := range compressedFormats {
+		if strings.HasSuffix(path, "."+string(f)) {
+			return f
+		}
+	}
+	return FormatRaw
+}
+
+// Compressed reports whether the format is compressed.
+func (f ImageFormat) Compressed() bool {
+	_, ok := compressedFormats[f]
+	return ok
+}
+
+// Tool returns the program that compresses and decompresses the format.
+func (f ImageFormat) Tool() string {
+	if cmds, ok := compressedFormats[f]; ok {
+		return cmds[0][0]
+	}
+	return ""
+}
+
+// WithImageFormat returns the image file name for dest in format f,
+// appending the format's suffix when dest has none. Bare names like sdb
+// are disks, so dest must look like an image file (see IsImageDestination).
+func WithImageFormat(dest string, f ImageFormat) (string, error) {
+	if !IsImageDestination(dest) {
+		return "", fmt.Errorf("--format %s needs an image file destination, not %s", f, dest)
+	}
+	current := ImageFormatOf(dest)
+	hasSuffix := current.Compressed() || strings.HasSuffix(dest, ".img")
+	switch {
+	case hasSuffix && current == f:
+		return dest, nil
+	case hasSuffix:
+		return "", fmt.Errorf("destination %s does not match --format %s", dest, f)
+	}
+	return dest + "." + string(f), nil
+}
+
+// ExportImagePath returns the raw image a compressed export is cloned into
+// before it is compressed. It lives next to the destination so it is on the
+// backup disk, not in a RAM-backed /tmp.
+func ExportImagePath(dest string) string {
+	return filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".klon-tmp.img")
+}
+
+// DiscardFreeBlocks runs fstrim on every filesystem cloned into an image, so
+// blocks freed during the clone become holes in the image file and compress
+// to nothing. Partitions fstrim cannot handle are only logged.
+func DiscardFreeBlocks(ctx context.Context, plan PlanResult, destRoot string) error {
+	for _, p := range plan.Partitions {
+		if p.Action.Skip || p.FSType == "swap" {
+			continue
+		}
+		part := hostDevices.partition(plan.DestinationDisk, p.Index)
+		if err := mountFS(ctx, "", part, destRoot, false); err != nil {
+			return fmt.Errorf("cannot mount %s to discard its free blocks: %w", part, err)
+		}
+		if err := shellExec(ctx, "fstrim -v "+destRoot); err != nil {
+			logWarning(ctx, "cannot discard free blocks of %s: %v", part, err)
+		}
+		if err := unmountFS(ctx, destRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportImage compresses the raw image at rawPath into dest and writes a
+// sha256 sidecar, dest + ".sha256", that `sha256sum -c` accepts. dest is
+// only replaced once the compressed image is complete. It returns the
+// checksum of the compressed file.
+func ExportImage(ctx context.Context, rawPath, dest string, format ImageFormat) (string, error) {
+	cmds, ok := compressedFormats[format]
+	if !ok {
+		return "", fmt.Errorf("image format %q is not compressed", format)
+	}
+	in, err := os.Open(rawPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	partial := dest + ".partial"
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("cannot create %s: %w", partial, err)
+	}
+	defer os.Remove(partial)
+
+	sum := sha256.New()
+	done := logCommand(ctx, fmt.Sprintf("%s < %s > %s", strings.Join(cmds[0], " "), rawPath, dest))
+	err = runFilter(ctx, cmds[0], in, io.MultiWriter(out, sum))
+	done("", err)
+	if err != nil {
+		out.Close()
+		return "", fmt.Errorf("cannot compress %s: %w", rawPath, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return "", err
+	}
+
+	hexSum := hex.EncodeToString(sum.Sum(nil))
+	sidecar := fmt.Sprintf("%s  %s\n", hexSum, filepath.Base(dest))
+	if err := os.WriteFile(dest+".sha256", []byte(sidecar), 0o644); err != nil {
+		return "", fmt.Errorf("cannot write checksum file: %w", err)
+	}
+	logSink.Printf("klon: wrote %s (sha256 %s)", dest, hexSum)
+	return hexSum, nil
+}
+
+// VerifyImageChecksum checks a compressed image against its sha256 sidecar.
+// Images without a sidecar are accepted.
+func VerifyImageChecksum(path string) error {
+	data, err := os.ReadFile(path + ".sha256")
+	if errors.Is(err, os.ErrNotExist) {
+		logSink.Printf("klon: no %s.sha256; the image cannot be verified", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("checksum file %s.sha256 is empty", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); !strings.EqualFold(got, fields[0]) {
+		return fmt.Errorf("image %s is corrupt: sha256 is %s, %s.sha256 expects %s", path, got, path, fields[0])
+	}
+	return nil
+}
+
+// RestoreImage decompresses an image onto a whole disk as it is read, then
+// asks the kernel to re-read the partition table. The disk is opened
+// exclusively, so this fails if any of its partitions is mounted.
+func RestoreImage(ctx context.Context, image, disk string) error {
+	format := ImageFormatOf(image)
+	cmds, ok := compressedFormats[format]
+	if !ok {
+		return fmt.Errorf("%s is not a compressed image (.img.zst, .img.gz or .img.xz)", image)
+	}
+	in, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if !strings.HasPrefix(disk, "/") {
+		disk = ensureDevPrefix(disk)
+	}
+	out, err := os.OpenFile(disk, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open %s for writing: %w", disk, err)
+	}
+	done := logCommand(ctx, fmt.Sprintf("%s < %s > %s", strings.Join(cmds[1], " "), image, disk))
+	err = runFilter(ctx, cmds[1], in, out)
+	done("", err)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("cannot restore %s to %s: %w", image, disk, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("cannot flush %s: %w", disk, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := shellExec(ctx, "partprobe "+disk); err != nil {
+		return fmt.Errorf("image restored, but the kernel did not re-read the partition table of %s: %w", disk, err)
+	}
+	return nil
+}
+
+// runFilter runs a compressor or decompressor between r and w.
+func runFilter(ctx context.Context, argv []string, r io.Reader, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", argv[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", argv[0], err)
+	}
+	return nil
+}
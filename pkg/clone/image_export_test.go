@@ -0,0 +1,175 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseImageFormat(t *testing.T) {
+	for _, s := range []string{"img", "img.zst", "img.gz", "img.xz"} {
+		if f, err := ParseImageFormat(s); err != nil || string(f) != s {
+			t.Fatalf("ParseImageFormat(%q) = %q, %v", s, f, err)
+		}
+	}
+	if _, err := ParseImageFormat("zip"); err == nil {
+		t.Fatalf("expected an unknown format to fail")
+	}
+}
+
+func TestImageFormatOf(t *testing.T) {
+	cases := map[string]ImageFormat{
+		"/mnt/nas/pi.img":     FormatRaw,
+		"/mnt/nas/pi":         FormatRaw,
+		"/mnt/nas/pi.img.zst": FormatZstd,
+		"pi.img.gz":           FormatGzip,
+		"pi.img.xz":           FormatXz,
+		"pi.tar.gz":           FormatRaw,
+	}
+	for path, want := range cases {
+		if got := ImageFormatOf(path); got != want {
+			t.Fatalf("ImageFormatOf(%q) = %q, want %q", path, got, want)
+		}
+	}
+	if !IsImageDestination("pi.img.zst") {
+		t.Fatalf("expected a compressed image name to be an image destination")
+	}
+}
+
+func TestWithImageFormat(t *testing.T) {
+	cases := []struct {
+		dest    string
+		format  ImageFormat
+		want    string
+		wantErr string
+	}{
+		{dest: "/mnt/nas/pi", format: FormatZstd, want: "/mnt/nas/pi.img.zst"},
+		{dest: "/mnt/nas/pi.img.xz", format: FormatXz, want: "/mnt/nas/pi.img.xz"},
+		{dest: "/mnt/nas/pi.img", format: FormatRaw, want: "/mnt/nas/pi.img"},
+		{dest: "/mnt/nas/pi.img", format: FormatGzip, wantErr: "does not match"},
+		{dest: "/mnt/nas/pi.img.gz", format: FormatZstd, wantErr: "does not match"},
+		{dest: "/dev/sda", format: FormatZstd, wantErr: "image file destination"},
+	}
+	for _, tc := range cases {
+		got, err := WithImageFormat(tc.dest, tc.format)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("WithImageFormat(%q, %q): expected error containing %q, got %v", tc.dest, tc.format, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("WithImageFormat(%q, %q) = %q, %v, want %q", tc.dest, tc.format, got, err, tc.want)
+		}
+	}
+	if got := ExportImagePath("/mnt/nas/pi.img.zst"); got != "/mnt/nas/.pi.img.zst.klon-tmp.img" {
+		t.Fatalf("unexpected export path %q", got)
+	}
+}
+
+func TestExportAndRestoreImage(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip not installed")
+	}
+	origShell := shellExec
+	defer func() { shellExec = origShell }()
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		return nil
+	}
+
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw.img")
+	data := bytes.Repeat([]byte("klon"), 64<<10)
+	if err := os.WriteFile(raw, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "pi.img.gz")
+	sum, err := ExportImage(context.Background(), raw, dest, FormatGzip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sidecar, err := os.ReadFile(dest + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sidecar) != sum+"  pi.img.gz\n" {
+		t.Fatalf("unexpected checksum file %q", sidecar)
+	}
+	if _, err := os.Stat(dest + ".partial"); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial file to be gone, got %v", err)
+	}
+	if err := VerifyImageChecksum(dest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	disk := filepath.Join(dir, "disk")
+	if err := os.WriteFile(disk, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreImage(context.Background(), dest, disk); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("restored %d bytes that do not match the %d byte image", len(got), len(data))
+	}
+	if len(cmds) != 1 || cmds[0] != "partprobe "+disk {
+		t.Fatalf("unexpected commands: %q", cmds)
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+	if err := VerifyImageChecksum(dest); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("expected a modified image to fail verification, got %v", err)
+	}
+	if err := RestoreImage(context.Background(), raw, disk); err == nil || !strings.Contains(err.Error(), "not a compressed image") {
+		t.Fatalf("expected a raw image to be refused, got %v", err)
+	}
+}
+
+func TestDiscardFreeBlocks(t *testing.T) {
+	origShell := shellExec
+	defer func() { shellExec = origShell }()
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		return nil
+	}
+
+	plan := PlanResult{
+		DestinationDisk: "/dev/loop3",
+		Partitions: []PartitionPlan{
+			{Index: 1, PartitionDetails: PartitionDetails{FSType: "vfat"}},
+			{Index: 2, PartitionDetails: PartitionDetails{FSType: "ext4"}},
+			{Index: 3, PartitionDetails: PartitionDetails{FSType: "swap"}},
+			{Index: 4, PartitionDetails: PartitionDetails{FSType: "ext4"}, Action: PartitionAction{Skip: true}},
+		},
+	}
+	if err := DiscardFreeBlocks(context.Background(), plan, "/mnt/clone"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"mount /dev/loop3p1 /mnt/clone",
+		"fstrim -v /mnt/clone",
+		"umount /mnt/clone",
+		"mount /dev/loop3p2 /mnt/clone",
+		"fstrim -v /mnt/clone",
+		"umount /mnt/clone",
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(cmds, "\n"))
+	}
+}
@@ -0,0 +1,183 @@
+package clone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIsImageDestination(t *testing.T) {
+	cases := map[string]bool{
+		"":                         false,
+		"sda":                      false,
+		"/dev/sda":                 false,
+		"/dev/disk/by-id/usb-x":    false,
+		"/mnt/nas/pi.img":          true,
+		"./backup.img":             true,
+		"backup.img":               true,
+		"/media/usb/backups/pi-01": true,
+	}
+	for dest, want := range cases {
+		if got := IsImageDestination(dest); got != want {
+			t.Fatalf("IsImageDestination(%q) = %v, want %v", dest, got, want)
+		}
+	}
+}
+
+func TestImageDestinationSize(t *testing.T) {
+	sys := fakeSystem{bootDisk: "/dev/mmcblk0p2"}
+	result := PlanResult{
+		SourceSizeBytes: 32 << 30,
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", PartitionDetails: PartitionDetails{StartBytes: 4 << 20, SizeBytes: 256 << 20}},
+			{Index: 2, Device: "/dev/mmcblk0p2", PartitionDetails: PartitionDetails{StartBytes: 260 << 20, SizeBytes: 3<<30 + 12345}},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "pi.img")
+
+	got, err := imageDestinationSize(sys, "/dev/mmcblk0", result, PlanOptions{Destination: dest, Initialize: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := int64(260<<20 + 3<<30 + 1<<20); got != want {
+		t.Fatalf("expected size %d from the partition layout, got %d", want, got)
+	}
+
+	got, err = imageDestinationSize(sys, "/dev/mmcblk0", result, PlanOptions{Destination: dest, Initialize: true, ImageSizeBytes: 8<<30 + 1})
+	if err != nil || got != 8<<30+1<<20 {
+		t.Fatalf("expected --image-size rounded up to 1 MiB, got %d, %v", got, err)
+	}
+
+	if _, err := imageDestinationSize(sys, "/dev/mmcblk0", result, PlanOptions{Destination: dest}); err == nil || !strings.Contains(err.Error(), "use -f") {
+		t.Fatalf("expected a missing image without -f to fail, got %v", err)
+	}
+
+	if err := os.WriteFile(dest, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dest, 5<<30); err != nil {
+		t.Fatal(err)
+	}
+	got, err = imageDestinationSize(sys, "/dev/mmcblk0", result, PlanOptions{Destination: dest})
+	if err != nil || got != 5<<30 {
+		t.Fatalf("expected the existing image size, got %d, %v", got, err)
+	}
+
+	got, err = imageDestinationSize(sys, "/dev/mmcblk0", PlanResult{SourceSizeBytes: 16 << 30}, PlanOptions{Destination: dest, Initialize: true})
+	if err != nil || got != 16<<30 {
+		t.Fatalf("expected the source disk size without a layout, got %d, %v", got, err)
+	}
+}
+
+func TestValidateImageDestination(t *testing.T) {
+	dir := t.TempDir()
+	plan := PlanResult{SourceDisk: "/dev/nonexistent-klon-disk", DestinationSizeBytes: 1 << 30}
+
+	if err := validateImageDestination(plan, PlanOptions{Destination: filepath.Join(dir, "missing", "pi.img")}); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected a missing directory to fail, got %v", err)
+	}
+	if err := validateImageDestination(plan, PlanOptions{Destination: dir}); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Fatalf("expected a directory destination to fail, got %v", err)
+	}
+	if err := validateImageDestination(PlanResult{}, PlanOptions{Destination: filepath.Join(dir, "pi.img")}); err == nil || !strings.Contains(err.Error(), "--image-size") {
+		t.Fatalf("expected an unsized image to fail, got %v", err)
+	}
+	if err := validateImageDestination(plan, PlanOptions{Destination: filepath.Join(dir, "pi.img"), Initialize: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	huge := PlanResult{
+		SourceDisk:           plan.SourceDisk,
+		DestinationSizeBytes: 1 << 30,
+		Partitions: []PartitionPlan{{
+			Index: 2, Action: PartitionAction{Sync: true},
+			PartitionDetails: PartitionDetails{UsedBytes: int64(st.Bavail)*int64(st.Bsize) + 1<<30},
+		}},
+	}
+	opts := PlanOptions{Destination: filepath.Join(dir, "pi.img"), Initialize: true}
+	if err := validateImageDestination(huge, opts); err == nil || !strings.Contains(err.Error(), "-F") {
+		t.Fatalf("expected insufficient space to fail, got %v", err)
+	}
+	opts.ForceSync = true
+	if err := validateImageDestination(huge, opts); err != nil {
+		t.Fatalf("expected -F to skip the space check, got %v", err)
+	}
+}
+
+func TestAttachImage(t *testing.T) {
+	origOutput, origShell := shellOutput, shellExec
+	defer func() { shellOutput, shellExec = origOutput, origShell }()
+
+	var cmds []string
+	shellOutput = func(ctx context.Context, cmdStr string) (string, error) {
+		cmds = append(cmds, cmdStr)
+		return "/dev/loop3\n", nil
+	}
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "it's.img")
+	if err := os.WriteFile(path, []byte("old contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	img, err := AttachImage(context.Background(), path, 64<<20, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if img.LoopDevice != "/dev/loop3" {
+		t.Fatalf("expected /dev/loop3, got %q", img.LoopDevice)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != 64<<20 {
+		t.Fatalf("expected a 64 MiB image, got %d bytes", st.Size)
+	}
+	if st.Blocks*512 >= st.Size {
+		t.Fatalf("expected a sparse image, %d bytes allocated", st.Blocks*512)
+	}
+
+	plan, opts := img.Target(PlanResult{SourceDisk: "/dev/mmcblk0", DestinationDisk: path}, PlanOptions{Destination: path})
+	if plan.DestinationDisk != "/dev/loop3" || opts.Destination != "/dev/loop3" || plan.SourceDisk != "/dev/mmcblk0" {
+		t.Fatalf("expected the plan to target the loop device, got %+v %+v", plan, opts)
+	}
+
+	if err := img.Detach(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		`losetup --find --show --partscan '` + strings.ReplaceAll(path, "'", `'\''`) + `'`,
+		"blockdev --flushbufs /dev/loop3",
+		"losetup --detach /dev/loop3",
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(cmds, "\n"))
+	}
+}
+
+func TestAttachImage_Errors(t *testing.T) {
+	origOutput := shellOutput
+	defer func() { shellOutput = origOutput }()
+	shellOutput = func(ctx context.Context, cmdStr string) (string, error) {
+		return "losetup: cannot find an unused loop device\n", nil
+	}
+
+	path := filepath.Join(t.TempDir(), "pi.img")
+	if _, err := AttachImage(context.Background(), path, 0, true); err == nil {
+		t.Fatalf("expected creating an image without a size to fail")
+	}
+	if _, err := AttachImage(context.Background(), path, 1<<20, true); err == nil || !strings.Contains(err.Error(), "unexpected device") {
+		t.Fatalf("expected unexpected losetup output to fail, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package clone
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalPath is where Klon keeps its state journal.
+const DefaultJournalPath = "/var/lib/klon/journal.jsonl"
+
+// Journal phases, in the order a run goes through them. PLAN, PLAN_FAILED,
+// APPLY_SUCCESS and APPLY_FAILED match the phases of the kln.state log.
+const (
+	PhasePlan         = "PLAN"
+	PhasePlanFailed   = "PLAN_FAILED"
+	PhaseApplyStarted = "APPLY_STARTED"
+	PhaseStep         = "STEP"
+	PhaseApplySuccess = "APPLY_SUCCESS"
+	PhaseApplyFailed  = "APPLY_FAILED"
+)
+
+// JournalRecord is one line of the state journal. A run writes a record when
+// it plans, when it starts applying, after every step and when it is done;
+// all of them carry the run's ID.
+type JournalRecord struct {
+	RunID       string      `json:"run_id"`
+	Time        time.Time   `json:"time"`
+	Phase       string      `json:"phase"`
+	Source      string      `json:"source,omitempty"`
+	Destination string      `json:"destination,omitempty"`
+	Strategy    string      `json:"strategy,omitempty"`
+	Initialize  bool        `json:"initialize,omitempty"`
+	Steps       int         `json:"steps,omitempty"`
+	Step        *StepResult `json:"step,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// StepResult is the outcome of one execution step.
+type StepResult struct {
+	ID             string    `json:"id"`
+	Operation      Operation `json:"operation"`
+	PartitionIndex int       `json:"partition_index,omitempty"`
+	Description    string    `json:"description"`
+	Started        time.Time `json:"started"`
+	DurationMS     int64     `json:"duration_ms"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Journal appends the records of one run to a JSONL file. The zero Path
+// disables it.
+type Journal struct {
+	Path  string
+	RunID string
+	mu    sync.Mutex
+}
+
+// Record appends a record for phase, describing the plan, its steps and
+// err, the failure if any.
+func (j *Journal) Record(plan PlanResult, opts PlanOptions, steps []ExecutionStep, phase string, err error) error {
+	rec := JournalRecord{
+		Phase:       phase,
+		Source:      plan.SourceDisk,
+		Destination: opts.Destination,
+		Strategy:    string(opts.PartitionStrategy),
+		Initialize:  opts.Initialize,
+		Steps:       len(steps),
+	}
+	if opts.Source != "" {
+		rec.Source = opts.Source
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return j.Append(rec)
+}
+
+// Append stamps rec with the run's ID and the time, if unset, and appends
+// it, creating the journal and its directory when needed.
+func (j *Journal) Append(rec JournalRecord) error {
+	if j == nil || j.Path == "" {
+		return nil
+	}
+	rec.RunID = j.RunID
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Event records the step-finished events of Apply as STEP records; pass it
+// to WithEventHandler (or call it from a handler). Write errors are logged,
+// not returned.
+func (j *Journal) Event(e Event) {
+	if e.Kind != EventStepFinished || e.Step == nil {
+		return
+	}
+	res := &StepResult{
+		ID:             e.StepID,
+		Operation:      e.Step.Operation,
+		PartitionIndex: e.Step.PartitionIndex,
+		Description:    e.Step.Description,
+		Started:        e.Time.Add(-e.Duration).UTC(),
+		DurationMS:     e.Duration.Milliseconds(),
+	}
+	if e.Err != nil {
+		res.Error = e.Err.Error()
+	}
+	if err := j.Append(JournalRecord{Phase: PhaseStep, Time: e.Time.UTC(), Step: res}); err != nil {
+		// Event handlers must not send events, so no logWarning here.
+		logSink.Printf("klon: WARNING: cannot write the state journal %s: %v", j.Path, err)
+	}
+}
+
+// ReadJournal reads the records of a journal. A missing journal has no
+// records; lines that cannot be parsed, such as one cut short by a crash,
+// are skipped.
+func ReadJournal(path string) ([]JournalRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []JournalRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var rec JournalRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil && rec.RunID != "" {
+			records = append(records, rec)
+		}
+	}
+	return records, sc.Err()
+}
+
+// RunSummary gathers the records of one run.
+type RunSummary struct {
+	RunID       string
+	Started     time.Time
+	Finished    time.Time
+	Source      string
+	Destination string
+	Strategy    string
+	Initialize  bool
+	// Phase is the last phase the run reached.
+	Phase string
+	Error string
+	Steps []StepResult
+	// Planned is the number of steps of the plan.
+	Planned int
+}
+
+// Result describes how the run ended: "success", "failed", "planned" for
+// plan-only runs, or "interrupted" when it stopped while applying without
+// recording an outcome.
+func (r RunSummary) Result() string {
+	switch r.Phase {
+	case PhaseApplySuccess:
+		return "success"
+	case PhaseApplyFailed, PhasePlanFailed:
+		return "failed"
+	case PhasePlan:
+		return "planned"
+	default:
+		return "interrupted"
+	}
+}
+
+// Duration is the time between the first and the last record of the run.
+func (r RunSummary) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// SummarizeRuns groups records by run, in the order the runs started.
+func SummarizeRuns(records []JournalRecord) []RunSummary {
+	var runs []RunSummary
+	index := map[string]int{}
+	for _, rec := range records {
+		i, ok := index[rec.RunID]
+		if !ok {
+			i = len(runs)
+			index[rec.RunID] = i
+			runs = append(runs, RunSummary{RunID: rec.RunID, Started: rec.Time})
+		}
+		r := &runs[i]
+		r.Finished = rec.Time
+		if rec.Phase == PhaseStep {
+			if rec.Step != nil {
+				r.Steps = append(r.Steps, *rec.Step)
+			}
+			continue
+		}
+		r.Phase, r.Error = rec.Phase, rec.Error
+		if rec.Source != "" {
+			r.Source = rec.Source
+		}
+		if rec.Destination != "" {
+			r.Destination = rec.Destination
+		}
+		if rec.Strategy != "" {
+			r.Strategy = rec.Strategy
+		}
+		r.Initialize = r.Initialize || rec.Initialize
+		if rec.Steps > 0 {
+			r.Planned = rec.Steps
+		}
+	}
+	return runs
+}
+
+// FindRun returns the run whose ID is id or starts with it; a prefix must
+// match a single run.
+func FindRun(runs []RunSummary, id string) (RunSummary, error) {
+	var found []RunSummary
+	for _, r := range runs {
+		if r.RunID == id {
+			return r, nil
+		}
+		if id != "" && strings.HasPrefix(r.RunID, id) {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return RunSummary{}, fmt.Errorf("no run %q in the journal", id)
+	case 1:
+		return found[0], nil
+	default:
+		return RunSummary{}, fmt.Errorf("%d runs start with %q; give more of the ID", len(found), id)
+	}
+}
+
+// LastSuccess returns the last run that cloned onto disk successfully.
+func LastSuccess(runs []RunSummary, disk string) (RunSummary, bool) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		if r.Phase == PhaseApplySuccess && sameDisk(r.Destination, disk) {
+			return r, true
+		}
+	}
+	return RunSummary{}, false
+}
+
+// sameDisk compares disk names with or without /dev/.
+func sameDisk(a, b string) bool {
+	if IsImageDestination(a) || IsImageDestination(b) {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return ensureDevPrefix(a) == ensureDevPrefix(b)
+}
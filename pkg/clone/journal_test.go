@@ -0,0 +1,91 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "klon", "journal.jsonl")
+	plan := PlanResult{
+		SourceDisk:      "/dev/mmcblk0",
+		DestinationDisk: "sdb",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}},
+		},
+	}
+	opts := PlanOptions{Destination: "sdb", PartitionStrategy: StrategyCloneTable}
+	steps := BuildExecutionSteps(plan, opts)
+
+	// A successful run, a failed one and one that never finished.
+	ok := &Journal{Path: path, RunID: "aaaa1111"}
+	if err := ok.Record(plan, opts, steps, PhaseApplyStarted, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := ApplyCheckpointed(WithEventHandler(context.Background(), ok.Event), plan, opts, &fakeRunner{}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ok.Record(plan, opts, steps, PhaseApplySuccess, nil)
+
+	failed := &Journal{Path: path, RunID: "aaaa2222"}
+	failed.Record(plan, opts, steps, PhaseApplyStarted, nil)
+	err = ApplyCheckpointed(WithEventHandler(context.Background(), failed.Event), plan, opts, &fakeRunner{err: errors.New("rsync died")}, nil, nil)
+	failed.Record(plan, opts, steps, PhaseApplyFailed, err)
+
+	(&Journal{Path: path, RunID: "bbbb3333"}).Record(plan, PlanOptions{Destination: "/dev/sdb"}, steps, PhaseApplyStarted, nil)
+
+	// A line cut short by a crash is skipped.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"run_id":"cccc","pha`)
+	f.Close()
+
+	records, err := ReadJournal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	runs := SummarizeRuns(records)
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 runs, got %+v", runs)
+	}
+	var results []string
+	for _, r := range runs {
+		results = append(results, r.Result())
+	}
+	if strings.Join(results, ",") != "success,failed,interrupted" {
+		t.Fatalf("unexpected results %v", results)
+	}
+	r := runs[0]
+	if len(r.Steps) != 2 || r.Planned != 2 || r.Steps[1].ID != "02-sync-filesystem-p2" || r.Source != "/dev/mmcblk0" || r.Steps[0].Started.After(r.Finished) {
+		t.Fatalf("unexpected run %+v", r)
+	}
+	if f := runs[1]; len(f.Steps) != 1 || f.Steps[0].Error != "rsync died" || !strings.Contains(f.Error, "rsync died") {
+		t.Fatalf("unexpected failed run %+v", f)
+	}
+
+	if got, err := FindRun(runs, "aaaa2"); err != nil || got.RunID != "aaaa2222" {
+		t.Fatalf("FindRun by prefix = %v, %v", got.RunID, err)
+	}
+	if _, err := FindRun(runs, "aaaa"); err == nil {
+		t.Fatalf("expected an ambiguous prefix to fail")
+	}
+	if last, ok := LastSuccess(runs, "/dev/sdb"); !ok || last.RunID != "aaaa1111" {
+		t.Fatalf("unexpected last success %+v", last)
+	}
+	if _, ok := LastSuccess(runs, "sdc"); ok {
+		t.Fatalf("expected no successful clone onto sdc")
+	}
+
+	if records, err := ReadJournal(filepath.Join(t.TempDir(), "missing.jsonl")); err != nil || records != nil {
+		t.Fatalf("expected a missing journal to be empty, got %v, %v", records, err)
+	}
+	if r.Duration() < 0 || r.Duration() > time.Minute {
+		t.Fatalf("unexpected duration %s", r.Duration())
+	}
+}
@@ -0,0 +1,237 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+const sectorSize = 512
+
+// gptBackupBytes is the space reserved at the end of a GPT disk for the
+// backup partition entries (32 sectors) and the backup header (1 sector).
+const gptBackupBytes = 33 * sectorSize
+
+// linuxFilesystemGUID is the GPT partition type of Linux data partitions.
+const linuxFilesystemGUID = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+
+// efiSystemGUID is the GPT partition type of EFI system partitions.
+const efiSystemGUID = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+
+// DiskLayout is an explicit description of the partition table Klon will
+// write on the destination, used by strategies that compute the layout at
+// plan time instead of copying or hard-coding it.
+type DiskLayout struct {
+	// Table is "dos" or "gpt".
+	Table      string            `json:"table"`
+	Partitions []LayoutPartition `json:"partitions"`
+}
+
+// LayoutPartition is one partition of a DiskLayout. Offsets and sizes are in
+// bytes and sector aligned. Type is an MBR type byte in hex (e.g. "c", "83")
+// for DOS tables or a partition type GUID for GPT.
+type LayoutPartition struct {
+	Index      int    `json:"index"`
+	StartBytes int64  `json:"start_bytes"`
+	SizeBytes  int64  `json:"size_bytes"`
+	Type       string `json:"type,omitempty"`
+	// Bootable is the MBR active flag, kept when a table is cloned.
+	Bootable bool `json:"bootable,omitempty"`
+	// FSType, Label and Mountpoint are only set for layouts read from a
+	// layout file; other strategies keep the source filesystems.
+	FSType     string `json:"fs_type,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+}
+
+// Partition returns the partition with the given index.
+func (l DiskLayout) Partition(index int) (LayoutPartition, bool) {
+	for _, p := range l.Partitions {
+		if p.Index == index {
+			return p, true
+		}
+	}
+	return LayoutPartition{}, false
+}
+
+// String renders the layout on a single line per partition for plan output.
+func (l DiskLayout) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "destination layout (%s):\n", l.Table)
+	for _, p := range l.Partitions {
+		fmt.Fprintf(&b, "  - partition %d: %s at %s", p.Index, formatBytes(p.SizeBytes), formatBytes(p.StartBytes))
+		if p.Type != "" {
+			fmt.Fprintf(&b, ", type=%s", p.Type)
+		}
+		if p.Bootable {
+			b.WriteString(", bootable")
+		}
+		if p.FSType != "" {
+			fmt.Fprintf(&b, ", %s", p.FSType)
+		}
+		if p.Label != "" {
+			fmt.Fprintf(&b, ", label=%s", p.Label)
+		}
+		if p.Mountpoint != "" {
+			fmt.Fprintf(&b, ", mounted on %s", p.Mountpoint)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// partitionTable converts the layout into a table for package parttable.
+// Partitions without a type get the Linux filesystem type, as with sfdisk.
+func (l DiskLayout) partitionTable() (*parttable.Table, error) {
+	if l.Table != parttable.DOS && l.Table != parttable.GPT {
+		return nil, fmt.Errorf("unknown partition table type %q", l.Table)
+	}
+	t := &parttable.Table{Type: l.Table}
+	for _, p := range l.Partitions {
+		if p.StartBytes%sectorSize != 0 || p.SizeBytes%sectorSize != 0 {
+			return nil, fmt.Errorf("partition %d is not sector aligned", p.Index)
+		}
+		partType := p.Type
+		if partType == "" {
+			partType = "83"
+			if l.Table == parttable.GPT {
+				partType = linuxFilesystemGUID
+			}
+		}
+		t.Partitions = append(t.Partitions, parttable.Partition{
+			Index:    p.Index,
+			StartLBA: uint64(p.StartBytes / sectorSize),
+			Sectors:  uint64(p.SizeBytes / sectorSize),
+			Type:     partType,
+			Bootable: p.Bootable,
+		})
+	}
+	return t, nil
+}
+
+// tableLayout describes an existing partition table, for StrategyCloneTable.
+// Disk and partition identifiers are not part of a layout: the copy gets new
+// ones, so it can be attached next to its source.
+func tableLayout(t *parttable.Table) *DiskLayout {
+	l := &DiskLayout{Table: t.Type}
+	for _, p := range t.Partitions {
+		l.Partitions = append(l.Partitions, LayoutPartition{
+			Index:      p.Index,
+			StartBytes: p.StartBytes(),
+			SizeBytes:  p.SizeBytes(),
+			Type:       p.Type,
+			Bootable:   p.Bootable,
+		})
+	}
+	return l
+}
+
+// newLayout computes the layout of the new-layout strategies on a disk of
+// diskSize bytes: a FAT boot partition of bootSize bytes (defaultBootSizeBytes
+// when zero) at 1MiB, and a Linux root partition filling the rest.
+func newLayout(table string, bootSize, diskSize int64) (*DiskLayout, error) {
+	if bootSize <= 0 {
+		bootSize = defaultBootSizeBytes
+	}
+	bootSize = alignUp(bootSize, layoutAlignBytes)
+	end := diskSize
+	bootType, rootType := "c", "83"
+	if table == parttable.GPT {
+		end -= gptBackupBytes
+		bootType, rootType = efiSystemGUID, linuxFilesystemGUID
+	}
+	rootStart := layoutAlignBytes + bootSize
+	if end-rootStart < layoutAlignBytes {
+		return nil, fmt.Errorf("a disk of %s has no room for a root partition after a %s boot partition", formatBytes(diskSize), formatBytes(bootSize))
+	}
+	return &DiskLayout{Table: table, Partitions: []LayoutPartition{
+		{Index: 1, StartBytes: layoutAlignBytes, SizeBytes: bootSize, Type: bootType},
+		{Index: 2, StartBytes: rootStart, SizeBytes: alignDown(end-rootStart, sectorSize), Type: rootType},
+	}}, nil
+}
+
+// resizePartition sets the size of partition index of t to sizeBytes,
+// rounded up to whole sectors.
+func resizePartition(t *parttable.Table, index int, sizeBytes int64) error {
+	p := partitionEntry(t, index)
+	if p == nil {
+		return fmt.Errorf("there is no partition %d", index)
+	}
+	sectors := uint64(alignUp(sizeBytes, sectorSize) / sectorSize)
+	if next := nextPartitionStart(t, p); next > 0 && p.StartLBA+sectors > next {
+		return fmt.Errorf("partition %d cannot grow to %s: the next partition starts at %s", index, formatBytes(sizeBytes), formatBytes(int64(next)*sectorSize))
+	}
+	p.Sectors = sectors
+	return nil
+}
+
+// growPartition extends partition index of t, on a disk of diskSize bytes,
+// up to the next partition or the end of the space a table of its type can
+// use.
+func growPartition(t *parttable.Table, index int, diskSize int64) error {
+	p := partitionEntry(t, index)
+	if p == nil {
+		return fmt.Errorf("there is no partition %d", index)
+	}
+	end := uint64(diskSize / sectorSize)
+	switch t.Type {
+	case parttable.GPT:
+		end -= gptBackupBytes / sectorSize
+	case parttable.DOS:
+		// MBR entries count sectors in 32 bits.
+		end = min(end, 1<<32)
+	}
+	if next := nextPartitionStart(t, p); next > 0 {
+		end = min(end, next)
+	}
+	if end < p.StartLBA+p.Sectors {
+		return fmt.Errorf("partition %d already extends beyond sector %d", index, end)
+	}
+	p.Sectors = end - p.StartLBA
+	return nil
+}
+
+func partitionEntry(t *parttable.Table, index int) *parttable.Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Index == index {
+			return &t.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// nextPartitionStart returns the first sector of the partition following p
+// on the disk, or 0 when p is the last one.
+func nextPartitionStart(t *parttable.Table, p *parttable.Partition) uint64 {
+	var next uint64
+	for _, q := range t.Partitions {
+		if q.StartLBA > p.StartLBA && (next == 0 || q.StartLBA < next) {
+			next = q.StartLBA
+		}
+	}
+	return next
+}
+
+// tableTypeFromPartType guesses the partition table type from a partition
+// type as recorded in PartitionDetails: GUIDs mean GPT, hex bytes mean DOS.
+func tableTypeFromPartType(partType string) string {
+	if strings.Contains(partType, "-") {
+		return "gpt"
+	}
+	return "dos"
+}
+
+// sfdiskPartType converts a PartType ("0x83" or a GUID) to the form
+// sfdisk scripts expect ("83" or the GUID).
+func sfdiskPartType(partType string) string {
+	return strings.TrimPrefix(strings.ToLower(partType), "0x")
+}
+
+func alignDown(n, align int64) int64 {
+	return n / align * align
+}
+
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,207 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// planLayoutFile replaces the planned source partitions with the partitions
+// of opts.LayoutSpec and computes the destination layout for
+// StrategyLayoutFile. sources are the planned source partitions; each of
+// them (except swap) must be copied into some layout partition, otherwise
+// its data would silently be left behind.
+func planLayoutFile(sys System, sources []PartitionPlan, destSize int64, opts PlanOptions) ([]PartitionPlan, *DiskLayout, error) {
+	spec := opts.LayoutSpec
+	if spec == nil {
+		return nil, nil, fmt.Errorf("strategy %s needs a layout file", StrategyLayoutFile)
+	}
+	if opts.P1SizeBytes > 0 {
+		return nil, nil, fmt.Errorf("-p1-size cannot be combined with a layout file; set the size of partition 1 in the file")
+	}
+	layout, err := resolveLayoutSpec(spec, destSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, src := range sources {
+		if src.Mountpoint == "" || src.FSType == "swap" {
+			continue
+		}
+		covered := false
+		for _, sp := range spec.Partitions {
+			if sp.source() == src.Mountpoint {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return nil, nil, fmt.Errorf("source partition %s mounted on %s is not copied into any partition of the layout (add one with source: %s)", src.Device, src.Mountpoint, src.Mountpoint)
+		}
+	}
+
+	em, _ := sys.(excludeMeasurer)
+	parts := make([]PartitionPlan, 0, len(spec.Partitions))
+	lastData := -1
+	for i, sp := range spec.Partitions {
+		src := sp.source()
+		pp := PartitionPlan{
+			Index:      i + 1,
+			Mountpoint: sp.Mount,
+			Action:     PartitionAction{Strategy: StrategyLayoutFile, Initialize: true, Sync: src != ""},
+		}
+		if sp.FSType != "swap" {
+			lastData = i
+		}
+		if src == "" {
+			parts = append(parts, pp)
+			continue
+		}
+		if src != sp.Mount {
+			pp.SourcePath = src
+		}
+
+		if mapped, ok := sourceMountedOn(sources, src); ok {
+			pp.Device = mapped.Device
+			pp.PartitionDetails = mapped.PartitionDetails
+		} else {
+			parent, ok := sourceContaining(sources, src)
+			if !ok {
+				return nil, nil, fmt.Errorf("source %s of partition %d is not on any source partition being cloned", src, pp.Index)
+			}
+			if em != nil {
+				pp.UsedBytes = em.ExcludedBytes(parent.Mountpoint, []string{relativeToMount(parent.Mountpoint, src)})
+			}
+		}
+		parts = append(parts, pp)
+	}
+
+	// Data that goes to another partition is excluded from the sync of the
+	// directory that contains it.
+	for i := range parts {
+		outer := spec.Partitions[i].source()
+		if outer == "" {
+			continue
+		}
+		for j, sp := range spec.Partitions {
+			inner := sp.source()
+			if i == j || inner == "" || !pathUnder(inner, outer) {
+				continue
+			}
+			parts[i].Excludes = append(parts[i].Excludes, relativeToMount(outer, inner)+"/**")
+		}
+	}
+
+	if opts.ExpandLastPartition && lastData != -1 {
+		parts[lastData].Action.Resize = true
+	}
+	return parts, layout, nil
+}
+
+// resolveLayoutSpec turns the sizes of spec into a DiskLayout for a
+// destination of destSize bytes. Partitions are placed in order from 1MiB,
+// each aligned to 1MiB.
+func resolveLayoutSpec(spec *LayoutSpec, destSize int64) (*DiskLayout, error) {
+	if destSize <= 0 {
+		return nil, fmt.Errorf("destination size is unknown")
+	}
+	table := spec.Table
+	if table == "" {
+		table = "dos"
+	}
+	usableEnd := destSize
+	if table == "gpt" {
+		usableEnd -= gptBackupBytes
+	}
+	usable := alignDown(usableEnd, layoutAlignBytes) - layoutAlignBytes
+
+	sizes := make([]int64, len(spec.Partitions))
+	restIdx := -1
+	var total int64
+	for i, sp := range spec.Partitions {
+		size, percent, rest, err := parseLayoutSize(sp.Size)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", i+1, err)
+		}
+		switch {
+		case rest:
+			restIdx = i
+			continue
+		case percent > 0:
+			sizes[i] = alignDown(usable*int64(percent)/100, layoutAlignBytes)
+		default:
+			sizes[i] = alignUp(size, layoutAlignBytes)
+		}
+		if sizes[i] <= 0 {
+			return nil, fmt.Errorf("partition %d: size %s is empty on this destination", i+1, sp.Size)
+		}
+		total += sizes[i]
+	}
+	if total > usable {
+		return nil, fmt.Errorf("the layout needs %s but only %s are usable on the destination", formatBytes(total), formatBytes(max(usable, 0)))
+	}
+	if restIdx != -1 {
+		sizes[restIdx] = usable - total
+		if sizes[restIdx] < layoutAlignBytes {
+			return nil, fmt.Errorf("partition %d: no space left for size rest", restIdx+1)
+		}
+	}
+
+	layout := &DiskLayout{Table: table}
+	start := int64(layoutAlignBytes)
+	for i, sp := range spec.Partitions {
+		layout.Partitions = append(layout.Partitions, LayoutPartition{
+			Index:      i + 1,
+			StartBytes: start,
+			SizeBytes:  sizes[i],
+			Type:       sp.partType(table),
+			FSType:     sp.FSType,
+			Label:      sp.Label,
+			Mountpoint: sp.Mount,
+		})
+		start += sizes[i]
+	}
+	return layout, nil
+}
+
+// sourceMountedOn returns the source partition mounted exactly on path.
+func sourceMountedOn(sources []PartitionPlan, path string) (PartitionPlan, bool) {
+	for _, s := range sources {
+		if s.Mountpoint == path {
+			return s, true
+		}
+	}
+	return PartitionPlan{}, false
+}
+
+// sourceContaining returns the source partition with the longest mountpoint
+// that contains path.
+func sourceContaining(sources []PartitionPlan, path string) (PartitionPlan, bool) {
+	var best PartitionPlan
+	found := false
+	for _, s := range sources {
+		if s.Mountpoint == "" || s.FSType == "swap" || !pathUnder(path, s.Mountpoint) {
+			continue
+		}
+		if !found || len(s.Mountpoint) > len(best.Mountpoint) {
+			best, found = s, true
+		}
+	}
+	return best, found
+}
+
+// pathUnder reports whether path is strictly below dir.
+func pathUnder(path, dir string) bool {
+	if dir == "/" {
+		return path != "/" && strings.HasPrefix(path, "/")
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// relativeToMount returns path relative to mount as an anchored pattern,
+// e.g. ("/var", "/var/lib/docker") -> "/lib/docker".
+func relativeToMount(mount, path string) string {
+	if mount == "/" {
+		return path
+	}
+	return strings.TrimPrefix(path, mount)
+}
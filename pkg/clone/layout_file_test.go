@@ -0,0 +1,146 @@
+package clone
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// layoutFakeSystem measures excluded bytes per mountpoint and pattern list.
+type layoutFakeSystem struct {
+	capacityFakeSystem
+	measured map[string]int64
+}
+
+func (f layoutFakeSystem) ExcludedBytes(mountpoint string, patterns []string) int64 {
+	return f.measured[mountpoint+" "+strings.Join(patterns, ",")]
+}
+
+func newLayoutFakeSystem(destSize int64) layoutFakeSystem {
+	return layoutFakeSystem{
+		capacityFakeSystem: newCapacityFakeSystem(destSize),
+		measured: map[string]int64{
+			"/ /var/lib/docker": 4 << 30,
+		},
+	}
+}
+
+func TestPlanWithSystem_LayoutFileSplitsDirectoryIntoPartition(t *testing.T) {
+	spec, err := ParseLayoutSpec([]byte(exampleLayoutYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sys := newLayoutFakeSystem(64 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyLayoutFile, LayoutSpec: spec}
+
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plan.Partitions) != 4 || plan.DestinationLayout == nil {
+		t.Fatalf("expected 4 planned partitions and a layout, got %+v", plan)
+	}
+
+	root := plan.Partitions[1]
+	if root.Device != "/dev/mmcblk0p2" || root.Mountpoint != "/" {
+		t.Fatalf("expected root to come from /dev/mmcblk0p2, got %+v", root)
+	}
+	if !reflect.DeepEqual(root.Excludes, []string{"/boot/**", "/var/lib/docker/**"}) {
+		t.Fatalf("unexpected root excludes: %v", root.Excludes)
+	}
+
+	docker := plan.Partitions[2]
+	if docker.Device != "" || docker.Mountpoint != "/var/lib/docker" || !docker.Action.Sync {
+		t.Fatalf("unexpected docker partition: %+v", docker)
+	}
+	if docker.UsedBytes != 4<<30 {
+		t.Fatalf("expected docker used bytes measured inside /, got %d", docker.UsedBytes)
+	}
+
+	swap := plan.Partitions[3]
+	if swap.Action.Kind() != ActionInitialize {
+		t.Fatalf("expected swap to be initialized only, got %s", swap.Action)
+	}
+
+	l := plan.DestinationLayout
+	p1, _ := l.Partition(1)
+	p4, _ := l.Partition(4)
+	if p1.StartBytes != 1<<20 || p1.SizeBytes != 512<<20 || p1.Type != "c12a7328-f81f-11d2-ba4b-00a0c93ec93b" {
+		t.Fatalf("unexpected partition 1: %+v", p1)
+	}
+	if end := p4.StartBytes + p4.SizeBytes; end > 64<<30-gptBackupBytes {
+		t.Fatalf("layout overlaps the backup GPT: ends at %d", end)
+	}
+
+	steps := BuildExecutionSteps(plan, opts)
+	var sawDockerSync, sawSwapInit bool
+	for _, s := range steps {
+		if s.Operation == OpSyncFilesystem && s.Mountpoint == "/var/lib/docker" {
+			sawDockerSync = true
+		}
+		if s.Operation == OpInitializePartition && s.PartitionIndex == 4 {
+			sawSwapInit = s.FSType == "swap"
+		}
+		if s.Operation == OpInitializePartition && s.PartitionIndex == 2 && s.Label != "rootfs" {
+			t.Fatalf("expected root initialize step to carry the label, got %+v", s)
+		}
+	}
+	if !sawDockerSync || !sawSwapInit {
+		t.Fatalf("missing docker sync or swap initialize step: %+v", steps)
+	}
+}
+
+func TestPlanWithSystem_LayoutFileRequiresEverySourceMount(t *testing.T) {
+	spec, err := ParseLayoutSpec([]byte("partitions:\n  - size: rest\n    fs: ext4\n    mount: /\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sys := newLayoutFakeSystem(64 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyLayoutFile, LayoutSpec: spec}
+
+	_, err = PlanWithSystem(sys, opts)
+	if err == nil || !strings.Contains(err.Error(), "mounted on /boot is not copied") {
+		t.Fatalf("expected uncovered /boot error, got %v", err)
+	}
+}
+
+func TestPlanWithSystem_LayoutFileLargerThanDestination(t *testing.T) {
+	spec, err := ParseLayoutSpec([]byte("partitions:\n  - size: 1G\n    fs: vfat\n    mount: /boot\n  - size: 40G\n    fs: ext4\n    mount: /\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sys := newLayoutFakeSystem(32 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyLayoutFile, LayoutSpec: spec}
+
+	_, err = PlanWithSystem(sys, opts)
+	if err == nil || !strings.Contains(err.Error(), "the layout needs") {
+		t.Fatalf("expected layout size error, got %v", err)
+	}
+}
+
+func TestLayoutFstab_MovesAndAppendsEntries(t *testing.T) {
+	plan := PlanResult{
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", SourcePath: "/boot/firmware"},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+			{Index: 3, Mountpoint: "/var/lib/docker"},
+		},
+		DestinationLayout: &DiskLayout{Table: "dos", Partitions: []LayoutPartition{
+			{Index: 1, FSType: "vfat", Mountpoint: "/boot"},
+			{Index: 2, FSType: "ext4", Mountpoint: "/"},
+			{Index: 3, FSType: "ext4", Mountpoint: "/var/lib/docker"},
+			{Index: 4, FSType: "swap"},
+		}},
+	}
+	fstab := "proc /proc proc defaults 0 0\n/dev/sda1 /boot/firmware vfat defaults 0 2\n/dev/sda2 / ext4 defaults,noatime 0 1\n"
+
+	got := layoutFstab(fstab, plan, func(i int) string { return deviceNames{}.partition("sda", i) })
+	want := "proc /proc proc defaults 0 0\n" +
+		"/dev/sda1 /boot vfat defaults 0 2\n" +
+		"/dev/sda2 / ext4 defaults,noatime 0 1\n" +
+		"/dev/sda3 /var/lib/docker ext4 defaults 0 2\n" +
+		"/dev/sda4 none swap sw 0 0\n"
+	if got != want {
+		t.Fatalf("unexpected fstab.\n got: %q\nwant: %q", got, want)
+	}
+}
@@ -0,0 +1,184 @@
+package clone
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// defaultShrinkMarginPercent is the free space kept on a shrunken partition
+// on top of its used bytes when PlanOptions.ShrinkMarginPercent is not set.
+const defaultShrinkMarginPercent = 10
+
+// shrinkMarginPercent returns the shrink margin of o, or the default when it
+// is not set.
+func (o PlanOptions) shrinkMarginPercent() int {
+	if o.ShrinkMarginPercent == nil {
+		return defaultShrinkMarginPercent
+	}
+	return *o.ShrinkMarginPercent
+}
+
+// tableInspector is implemented by System values that can read the
+// partition table of a disk directly.
+type tableInspector interface {
+	PartitionTable(disk string) (*parttable.Table, error)
+}
+
+// sourcePartitionGeometry returns the geometry of every partition on the
+// source disk: the planned partitions plus, when the System can list them,
+// unmounted partitions that are not part of the plan (they still need a slot
+// in the destination table, exactly as with clone-table). When the System
+// can read the source partition table, its starts, sizes and types take
+// precedence over what was recorded in the plan.
+func sourcePartitionGeometry(sys System, srcDisk string, planned []PartitionPlan) []PartitionPlan {
+	all := append([]PartitionPlan{}, planned...)
+	names := namesFor(sys)
+	if ti, ok := sys.(tableInspector); ok {
+		if table, err := ti.PartitionTable(srcDisk); err == nil {
+			all = mergePartitionTable(all, names, srcDisk, table)
+		}
+	}
+	lister, ok := sys.(interface {
+		AllParts(string) []MountedPartition
+	})
+	if !ok {
+		return all
+	}
+	pi, _ := sys.(partitionInspector)
+	known := make(map[int]bool)
+	for _, p := range planned {
+		known[p.Index] = true
+	}
+	for _, mp := range lister.AllParts(srcDisk) {
+		idx := names.partitionIndex(mp.Device)
+		if idx <= 0 || known[idx] {
+			continue
+		}
+		known[idx] = true
+		extra := PartitionPlan{Index: idx, Device: mp.Device, Mountpoint: mp.Mountpoint}
+		if pi != nil {
+			extra.PartitionDetails, _ = pi.PartitionDetails(mp.Device, mp.Mountpoint)
+		}
+		all = append(all, extra)
+	}
+	return all
+}
+
+// mergePartitionTable overwrites the geometry and type of parts with the
+// entries of table and appends the table entries parts does not know yet.
+func mergePartitionTable(parts []PartitionPlan, names deviceNames, srcDisk string, table *parttable.Table) []PartitionPlan {
+	for _, tp := range table.Partitions {
+		partType := tp.Type
+		if table.Type == parttable.DOS {
+			partType = "0x" + partType
+		}
+		found := false
+		for i := range parts {
+			if parts[i].Index != tp.Index {
+				continue
+			}
+			parts[i].StartBytes = tp.StartBytes()
+			parts[i].SizeBytes = tp.SizeBytes()
+			parts[i].PartType = partType
+			found = true
+		}
+		if !found {
+			extra := PartitionPlan{Index: tp.Index, Device: names.partition(srcDisk, tp.Index)}
+			extra.StartBytes = tp.StartBytes()
+			extra.SizeBytes = tp.SizeBytes()
+			extra.PartType = partType
+			parts = append(parts, extra)
+		}
+	}
+	return parts
+}
+
+// shrinkLayout computes the destination layout for StrategyShrinkTable. It
+// keeps the order, types, starts and sizes of the source partitions, except
+// that the last synced data partition is shrunk (and the partitions after it
+// are moved) when the source layout does not fit on a destination of
+// destSize bytes. The shrunken partition must still hold its used bytes plus
+// marginPercent percent.
+func shrinkLayout(parts []PartitionPlan, destSize int64, marginPercent int) (*DiskLayout, error) {
+	if destSize <= 0 {
+		return nil, fmt.Errorf("destination size is unknown")
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no source partitions to lay out")
+	}
+	if marginPercent < 0 {
+		return nil, fmt.Errorf("invalid shrink margin %d%%", marginPercent)
+	}
+
+	sorted := append([]PartitionPlan{}, parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartBytes < sorted[j].StartBytes })
+
+	table := tableTypeFromPartType(sorted[0].PartType)
+	for _, p := range sorted {
+		if p.StartBytes <= 0 || p.SizeBytes <= 0 {
+			return nil, fmt.Errorf("partition %d has unknown start or size", p.Index)
+		}
+		if table == "dos" && p.Index > 4 {
+			return nil, fmt.Errorf("partition %d is a logical partition; shrink-table only supports primary partitions", p.Index)
+		}
+	}
+
+	usableEnd := destSize
+	if table == "gpt" {
+		usableEnd -= gptBackupBytes
+	}
+	usableEnd = alignDown(usableEnd, layoutAlignBytes)
+
+	layout := &DiskLayout{Table: table}
+	for _, p := range sorted {
+		layout.Partitions = append(layout.Partitions, LayoutPartition{
+			Index:      p.Index,
+			StartBytes: p.StartBytes,
+			SizeBytes:  p.SizeBytes,
+			Type:       sfdiskPartType(p.PartType),
+		})
+	}
+
+	last := sorted[len(sorted)-1]
+	if last.StartBytes+last.SizeBytes <= usableEnd {
+		// The source layout fits as-is.
+		return layout, nil
+	}
+
+	// Find the last data partition that is synced; it is the one we shrink.
+	shrinkPos := -1
+	for i, p := range sorted {
+		if p.Action.Sync && p.FSType != "swap" {
+			shrinkPos = i
+		}
+	}
+	if shrinkPos == -1 {
+		return nil, fmt.Errorf("no synced data partition that could be shrunk")
+	}
+	target := sorted[shrinkPos]
+	if target.UsedBytes <= 0 {
+		return nil, fmt.Errorf("used bytes of partition %d are unknown; cannot size it safely", target.Index)
+	}
+
+	var tailBytes int64
+	for _, p := range sorted[shrinkPos+1:] {
+		tailBytes += alignUp(p.SizeBytes, layoutAlignBytes)
+	}
+	newSize := alignDown(usableEnd-tailBytes-target.StartBytes, layoutAlignBytes)
+	minSize := target.UsedBytes + target.UsedBytes*int64(marginPercent)/100
+	if newSize < minSize {
+		return nil, fmt.Errorf("partition %d needs at least %s (%s used + %d%% margin) but only %s fit on the destination",
+			target.Index, formatBytes(minSize), formatBytes(target.UsedBytes), marginPercent, formatBytes(max(newSize, 0)))
+	}
+
+	layout.Partitions[shrinkPos].SizeBytes = newSize
+	next := target.StartBytes + newSize
+	for i := shrinkPos + 1; i < len(layout.Partitions); i++ {
+		next = alignUp(next, layoutAlignBytes)
+		layout.Partitions[i].StartBytes = next
+		next += layout.Partitions[i].SizeBytes
+	}
+	return layout, nil
+}
@@ -0,0 +1,177 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+func shrinkTestParts() []PartitionPlan {
+	return []PartitionPlan{
+		{Index: 1, Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{FSType: "vfat", StartBytes: 4 << 20, SizeBytes: 512 << 20, UsedBytes: 64 << 20, PartType: "0xc"}},
+		{Index: 2, Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{FSType: "ext4", StartBytes: 516 << 20, SizeBytes: 60 << 30, UsedBytes: 10 << 30, PartType: "0x83"}},
+	}
+}
+
+func TestShrinkLayout_KeepsSourceLayoutWhenItFits(t *testing.T) {
+	layout, err := shrinkLayout(shrinkTestParts(), 128<<30, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if layout.Table != "dos" {
+		t.Fatalf("expected dos table, got %q", layout.Table)
+	}
+	p2, _ := layout.Partition(2)
+	if p2.StartBytes != 516<<20 || p2.SizeBytes != 60<<30 || p2.Type != "83" {
+		t.Fatalf("expected partition 2 unchanged, got %+v", p2)
+	}
+}
+
+func TestShrinkLayout_ShrinksLastDataPartitionAndMovesTail(t *testing.T) {
+	parts := append(shrinkTestParts(), PartitionPlan{
+		Index:            3,
+		PartitionDetails: PartitionDetails{FSType: "swap", StartBytes: (516 << 20) + (60 << 30), SizeBytes: 1 << 30, PartType: "0x82"},
+	})
+
+	layout, err := shrinkLayout(parts, 32<<30, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p2, _ := layout.Partition(2)
+	p3, _ := layout.Partition(3)
+	if want := int64(32<<30) - (1 << 30) - (516 << 20); p2.SizeBytes != want {
+		t.Fatalf("expected root to shrink to %d bytes, got %d", want, p2.SizeBytes)
+	}
+	if p3.StartBytes != p2.StartBytes+p2.SizeBytes || p3.SizeBytes != 1<<30 {
+		t.Fatalf("expected swap to move right after root, got %+v", p3)
+	}
+	if p3.StartBytes+p3.SizeBytes > 32<<30 {
+		t.Fatalf("layout does not fit on the destination: %+v", layout)
+	}
+}
+
+func TestShrinkLayout_ErrorsWhenUsedDataDoesNotFit(t *testing.T) {
+	_, err := shrinkLayout(shrinkTestParts(), 8<<30, 10)
+	if err == nil {
+		t.Fatalf("expected error for destination smaller than used data")
+	}
+	if !strings.Contains(err.Error(), "partition 2 needs at least") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestShrinkLayout_HonoursZeroMargin(t *testing.T) {
+	// 10.5GiB are left for partition 2, which holds 10GiB.
+	layout, err := shrinkLayout(shrinkTestParts(), 11<<30, 0)
+	if err != nil {
+		t.Fatalf("unexpected error with a zero margin: %v", err)
+	}
+	if p2, _ := layout.Partition(2); p2.SizeBytes != 11<<30-516<<20 {
+		t.Fatalf("expected partition 2 to fill the destination, got %+v", p2)
+	}
+
+	margin := 0
+	if got := (PlanOptions{ShrinkMarginPercent: &margin}).shrinkMarginPercent(); got != 0 {
+		t.Fatalf("expected an explicit zero margin to be kept, got %d", got)
+	}
+	if got := (PlanOptions{}).shrinkMarginPercent(); got != defaultShrinkMarginPercent {
+		t.Fatalf("expected the default margin when unset, got %d", got)
+	}
+	if _, err := shrinkLayout(shrinkTestParts(), 11<<30, defaultShrinkMarginPercent); err == nil {
+		t.Fatalf("expected the default margin not to fit")
+	}
+}
+
+func TestShrinkLayout_ReservesGPTBackupHeader(t *testing.T) {
+	parts := shrinkTestParts()
+	parts[0].PartType = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	parts[1].PartType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+
+	layout, err := shrinkLayout(parts, 32<<30, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if layout.Table != "gpt" {
+		t.Fatalf("expected gpt table, got %q", layout.Table)
+	}
+	p2, _ := layout.Partition(2)
+	if end := p2.StartBytes + p2.SizeBytes; end > 32<<30-gptBackupBytes {
+		t.Fatalf("partition 2 overlaps the backup GPT: ends at %d", end)
+	}
+}
+
+func TestPlanWithSystem_ShrinkTableComputesLayout(t *testing.T) {
+	sys := newCapacityFakeSystem(32 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyShrinkTable}
+
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.DestinationLayout == nil {
+		t.Fatalf("expected a destination layout")
+	}
+	root := plan.Partitions[1]
+	if root.Capacity == nil || !root.Capacity.Fits() {
+		t.Fatalf("expected root to fit the shrunken layout, got %+v", root.Capacity)
+	}
+	if !strings.Contains(plan.String(), "destination layout (dos):") {
+		t.Fatalf("expected layout in plan output, got:\n%s", plan.String())
+	}
+
+	steps := BuildExecutionSteps(plan, opts)
+	if steps[0].Operation != OpPrepareDisk || steps[0].Layout == nil {
+		t.Fatalf("expected prepare-disk step to carry the layout, got %+v", steps[0])
+	}
+}
+
+func TestPlanWithSystem_ShrinkTableRefusesTooSmallDestination(t *testing.T) {
+	sys := newCapacityFakeSystem(8 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyShrinkTable}
+
+	_, err := PlanWithSystem(sys, opts)
+	if err == nil || !strings.Contains(err.Error(), "cannot compute shrunken layout") {
+		t.Fatalf("expected shrunken layout error, got %v", err)
+	}
+}
+
+// tableFakeSystem reports a source partition table, including a partition
+// that is neither mounted nor listed by lsblk.
+type tableFakeSystem struct {
+	capacityFakeSystem
+	table *parttable.Table
+}
+
+func (f tableFakeSystem) PartitionTable(disk string) (*parttable.Table, error) {
+	return f.table, nil
+}
+
+func TestPlanWithSystem_ShrinkTableUsesSourcePartitionTable(t *testing.T) {
+	sys := tableFakeSystem{
+		capacityFakeSystem: newCapacityFakeSystem(32 << 30),
+		table: &parttable.Table{Type: parttable.DOS, Partitions: []parttable.Partition{
+			{Index: 1, StartLBA: 8192, Sectors: 1 << 20, Type: "c"},
+			{Index: 2, StartLBA: 8192 + 1<<20, Sectors: 60 << 21, Type: "83"},
+			{Index: 3, StartLBA: 8192 + 1<<20 + 60<<21, Sectors: 1 << 21, Type: "82"},
+		}},
+	}
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyShrinkTable}
+
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := plan.DestinationLayout
+	if len(l.Partitions) != 3 {
+		t.Fatalf("expected the unlisted partition 3 to be kept, got %+v", l)
+	}
+	p1, _ := l.Partition(1)
+	p3, _ := l.Partition(3)
+	if p1.Type != "c" || p3.Type != "82" {
+		t.Fatalf("expected types from the partition table, got %q and %q", p1.Type, p3.Type)
+	}
+	if end := p3.StartBytes + p3.SizeBytes; end > 32<<30 {
+		t.Fatalf("partition 3 was not moved into the destination: ends at %d", end)
+	}
+}
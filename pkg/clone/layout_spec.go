@@ -0,0 +1,375 @@
+package clone
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// LayoutSpec is the declarative destination layout read from a layout file
+// (`--layout layout.yaml`). Partitions are created in order, starting at 1MiB.
+type LayoutSpec struct {
+	// Table is "dos" or "gpt"; empty means "dos".
+	Table      string                `json:"table,omitempty"`
+	Partitions []LayoutSpecPartition `json:"partitions"`
+}
+
+// LayoutSpecPartition describes one destination partition of a LayoutSpec.
+//
+// Size is an absolute size ("512MiB", "20G", "1048576"), a percentage of the
+// usable destination space ("25%") or "rest" for whatever is left (at most
+// one partition). FSType is one of ext4, vfat or swap. Type is an MBR type
+// byte in hex or a GPT type GUID; it defaults from FSType. Mount is the
+// mountpoint on the clone and Source the path on the running system whose
+// files are copied into it: it defaults to Mount and "none" creates an empty
+// filesystem. A Source that is not a source mountpoint must be a directory
+// inside one, which is then excluded from the sync of its parent.
+type LayoutSpecPartition struct {
+	Size   string `json:"size"`
+	FSType string `json:"fs"`
+	Label  string `json:"label,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Mount  string `json:"mount,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// layoutSourceNone is the LayoutSpecPartition.Source value for partitions
+// that are formatted but not synced.
+const layoutSourceNone = "none"
+
+// ReadLayoutSpec reads and validates a layout file.
+func ReadLayoutSpec(path string) (*LayoutSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read layout file %s: %w", path, err)
+	}
+	spec, err := ParseLayoutSpec(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout file %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// ParseLayoutSpec parses a layout document and validates everything that
+// does not depend on the source system or the destination size. It accepts
+// JSON or the small YAML subset shown in the README: top-level "key: value"
+// pairs and a "partitions:" list of "- key: value" mappings.
+func ParseLayoutSpec(data []byte) (*LayoutSpec, error) {
+	var spec LayoutSpec
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			return nil, err
+		}
+	} else if err := parseLayoutYAML(data, &spec); err != nil {
+		return nil, err
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+func (s *LayoutSpec) validate() error {
+	if s.Table == "" {
+		s.Table = "dos"
+	}
+	if s.Table != "dos" && s.Table != "gpt" {
+		return fmt.Errorf("table must be dos or gpt, got %q", s.Table)
+	}
+	if len(s.Partitions) == 0 {
+		return fmt.Errorf("no partitions")
+	}
+	if s.Table == "dos" && len(s.Partitions) > 4 {
+		return fmt.Errorf("a dos table holds at most 4 primary partitions, got %d", len(s.Partitions))
+	}
+
+	rest := 0
+	mounts := make(map[string]bool)
+	for i, p := range s.Partitions {
+		n := i + 1
+		if _, _, isRest, err := parseLayoutSize(p.Size); err != nil {
+			return fmt.Errorf("partition %d: %w", n, err)
+		} else if isRest {
+			rest++
+		}
+		switch p.FSType {
+		case "ext4", "vfat", "swap":
+		default:
+			return fmt.Errorf("partition %d: unsupported fs %q (use ext4, vfat or swap)", n, p.FSType)
+		}
+		if err := validateFSLabel(p.FSType, p.Label); err != nil {
+			return fmt.Errorf("partition %d: %w", n, err)
+		}
+		if err := validatePartType(s.Table, p.Type); err != nil {
+			return fmt.Errorf("partition %d: %w", n, err)
+		}
+		if p.FSType == "swap" {
+			if p.Mount != "" || (p.Source != "" && p.Source != layoutSourceNone) {
+				return fmt.Errorf("partition %d: swap cannot have a mount or source", n)
+			}
+			continue
+		}
+		if !strings.HasPrefix(p.Mount, "/") {
+			return fmt.Errorf("partition %d: mount must be an absolute path, got %q", n, p.Mount)
+		}
+		if mounts[p.Mount] {
+			return fmt.Errorf("partition %d: mount %s is used twice", n, p.Mount)
+		}
+		mounts[p.Mount] = true
+		if p.Source != "" && p.Source != layoutSourceNone && !strings.HasPrefix(p.Source, "/") {
+			return fmt.Errorf("partition %d: source must be an absolute path or %q, got %q", n, layoutSourceNone, p.Source)
+		}
+		if p.Mount == "/" && p.Source != "" && p.Source != "/" {
+			return fmt.Errorf("partition %d: the root partition must be synced from /", n)
+		}
+	}
+	if rest > 1 {
+		return fmt.Errorf("only one partition can use size \"rest\"")
+	}
+	if !mounts["/"] {
+		return fmt.Errorf("no partition is mounted on /")
+	}
+	return nil
+}
+
+// source returns the path copied into the partition, or "" for none.
+func (p LayoutSpecPartition) source() string {
+	switch {
+	case p.FSType == "swap" || p.Source == layoutSourceNone:
+		return ""
+	case p.Source != "":
+		return strings.TrimSuffix(p.Source, "/")
+	default:
+		return p.Mount
+	}
+}
+
+// partType returns the partition type for the given table, defaulting from
+// the filesystem.
+func (p LayoutSpecPartition) partType(table string) string {
+	if p.Type != "" {
+		return sfdiskPartType(p.Type)
+	}
+	if table == "gpt" {
+		switch p.FSType {
+		case "vfat":
+			return efiSystemGUID
+		case "swap":
+			return "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f"
+		default:
+			return linuxFilesystemGUID
+		}
+	}
+	switch p.FSType {
+	case "vfat":
+		return "c"
+	case "swap":
+		return "82"
+	default:
+		return "83"
+	}
+}
+
+// validateFSLabel checks a label against the limits of the mkfs tools.
+func validateFSLabel(fsType, label string) error {
+	if label == "" {
+		return nil
+	}
+	if strings.ContainsAny(label, " \t'\"\\$`") {
+		return fmt.Errorf("label %q contains spaces, quotes or shell characters", label)
+	}
+	limit := 16
+	if fsType == "vfat" {
+		limit = 11
+	}
+	if len(label) > limit {
+		return fmt.Errorf("label %q is longer than %d characters allowed for %s", label, limit, fsType)
+	}
+	return nil
+}
+
+// validatePartType checks that an explicit partition type can be written to
+// a table of the given type: a GUID for gpt, a non-zero hex byte for dos.
+func validatePartType(table, partType string) error {
+	if partType == "" {
+		return nil
+	}
+	if table == parttable.GPT {
+		if _, err := parttable.ParseGUID(partType); err != nil {
+			return fmt.Errorf("type must be a partition type GUID on gpt: %w", err)
+		}
+		return nil
+	}
+	if n, err := strconv.ParseUint(sfdiskPartType(partType), 16, 8); err != nil || n == 0 {
+		return fmt.Errorf("type must be an MBR type byte in hex on dos, got %q", partType)
+	}
+	return nil
+}
+
+// parseLayoutSize parses a LayoutSpecPartition.Size. Exactly one of size,
+// percent or rest is set on success. Unit suffixes are binary: "M", "MB" and
+// "MiB" all mean 1024*1024 bytes, as with sfdisk and parted.
+func parseLayoutSize(s string) (size int64, percent int, rest bool, err error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return 0, 0, false, fmt.Errorf("size is required")
+	case strings.EqualFold(s, "rest"):
+		return 0, 0, true, nil
+	case strings.HasSuffix(s, "%"):
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(s, "%")))
+		if err != nil || n <= 0 || n > 100 {
+			return 0, 0, false, fmt.Errorf("invalid percentage %q", s)
+		}
+		return 0, n, false, nil
+	}
+
+	end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end == -1 {
+		end = len(s)
+	}
+	num := s[:end]
+	unit := strings.ToUpper(strings.TrimSpace(s[end:]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	mult := int64(1)
+	switch unit {
+	case "":
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	default:
+		return 0, 0, false, fmt.Errorf("invalid size %q", s)
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f <= 0 {
+		return 0, 0, false, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(mult)), 0, false, nil
+}
+
+// parseLayoutYAML fills spec from the YAML subset documented on
+// ParseLayoutSpec. Anything outside that subset is reported with its line
+// number rather than guessed at.
+func parseLayoutYAML(data []byte, spec *LayoutSpec) error {
+	var cur *LayoutSpecPartition
+	inPartitions := false
+	itemIndent := -1
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := stripYAMLComment(sc.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "\t") {
+			return fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		text := strings.TrimSpace(line)
+
+		if indent == 0 {
+			cur, inPartitions = nil, false
+			key, value, err := splitYAMLPair(text)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			switch key {
+			case "table":
+				spec.Table = value
+			case "partitions":
+				if value != "" {
+					return fmt.Errorf("line %d: partitions must be a list of mappings", lineNo)
+				}
+				inPartitions = true
+			default:
+				return fmt.Errorf("line %d: unknown key %q", lineNo, key)
+			}
+			continue
+		}
+
+		if !inPartitions {
+			return fmt.Errorf("line %d: unexpected indentation", lineNo)
+		}
+		if strings.HasPrefix(text, "-") {
+			if itemIndent != -1 && indent != itemIndent {
+				return fmt.Errorf("line %d: inconsistent list indentation", lineNo)
+			}
+			itemIndent = indent
+			spec.Partitions = append(spec.Partitions, LayoutSpecPartition{})
+			cur = &spec.Partitions[len(spec.Partitions)-1]
+			text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if text == "" {
+				continue
+			}
+		} else if cur == nil || indent <= itemIndent {
+			return fmt.Errorf("line %d: expected a list item starting with \"-\"", lineNo)
+		}
+
+		key, value, err := splitYAMLPair(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch key {
+		case "size":
+			cur.Size = value
+		case "fs":
+			cur.FSType = value
+		case "label":
+			cur.Label = value
+		case "type":
+			cur.Type = value
+		case "mount":
+			cur.Mount = value
+		case "source":
+			cur.Source = value
+		default:
+			return fmt.Errorf("line %d: unknown partition key %q", lineNo, key)
+		}
+	}
+	return sc.Err()
+}
+
+func splitYAMLPair(text string) (string, string, error) {
+	key, value, ok := strings.Cut(text, ":")
+	if !ok {
+		return "", "", fmt.Errorf("expected \"key: value\", got %q", text)
+	}
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" that is not inside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,96 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+)
+
+const exampleLayoutYAML = `# Pi with a separate Docker partition
+table: gpt
+partitions:
+  - size: 512MiB
+    fs: vfat
+    label: BOOT
+    mount: /boot
+  - size: 75%
+    fs: ext4
+    label: rootfs   # the OS
+    mount: /
+  - size: rest
+    fs: ext4
+    mount: /var/lib/docker
+  - size: 2G
+    fs: swap
+`
+
+func TestParseLayoutSpec_YAML(t *testing.T) {
+	spec, err := ParseLayoutSpec([]byte(exampleLayoutYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.Table != "gpt" || len(spec.Partitions) != 4 {
+		t.Fatalf("unexpected spec: %+v", spec)
+	}
+	want := LayoutSpecPartition{Size: "75%", FSType: "ext4", Label: "rootfs", Mount: "/"}
+	if spec.Partitions[1] != want {
+		t.Fatalf("unexpected partition 2.\n got: %+v\nwant: %+v", spec.Partitions[1], want)
+	}
+	if spec.Partitions[3].FSType != "swap" {
+		t.Fatalf("expected swap as partition 4, got %+v", spec.Partitions[3])
+	}
+}
+
+func TestParseLayoutSpec_JSON(t *testing.T) {
+	spec, err := ParseLayoutSpec([]byte(`{"partitions": [{"size": "256M", "fs": "vfat", "mount": "/boot"}, {"size": "rest", "fs": "ext4", "mount": "/"}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.Table != "dos" {
+		t.Fatalf("expected table to default to dos, got %q", spec.Table)
+	}
+}
+
+func TestParseLayoutSpec_Errors(t *testing.T) {
+	cases := map[string]string{
+		"unknown key":    "table: dos\npartitions:\n  - size: rest\n    fs: ext4\n    mount: /\n    color: red\n",
+		"bad fs":         "partitions:\n  - size: rest\n    fs: xfs\n    mount: /\n",
+		"no root":        "partitions:\n  - size: rest\n    fs: ext4\n    mount: /data\n",
+		"two rest":       "partitions:\n  - size: rest\n    fs: ext4\n    mount: /\n  - size: rest\n    fs: ext4\n    mount: /data\n",
+		"bad size":       "partitions:\n  - size: lots\n    fs: ext4\n    mount: /\n",
+		"long fat label": "partitions:\n  - size: 1G\n    fs: vfat\n    label: MUCHTOOLONGLABEL\n    mount: /boot\n  - size: rest\n    fs: ext4\n    mount: /\n",
+		"root source":    "partitions:\n  - size: rest\n    fs: ext4\n    mount: /\n    source: /srv\n",
+	}
+	for name, doc := range cases {
+		if _, err := ParseLayoutSpec([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseLayoutSize(t *testing.T) {
+	cases := []struct {
+		in      string
+		size    int64
+		percent int
+		rest    bool
+	}{
+		{"512MiB", 512 << 20, 0, false},
+		{"512M", 512 << 20, 0, false},
+		{"1.5G", 3 << 29, 0, false},
+		{"4096", 4096, 0, false},
+		{"25%", 0, 25, false},
+		{"rest", 0, 0, true},
+	}
+	for _, c := range cases {
+		size, percent, rest, err := parseLayoutSize(c.in)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.in, err)
+		}
+		if size != c.size || percent != c.percent || rest != c.rest {
+			t.Fatalf("%s: got (%d, %d, %v)", c.in, size, percent, rest)
+		}
+	}
+	if _, _, _, err := parseLayoutSize("120%"); err == nil || !strings.Contains(err.Error(), "percentage") {
+		t.Fatalf("expected percentage error, got %v", err)
+	}
+}
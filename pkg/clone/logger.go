@@ -1,6 +1,17 @@
 package clone
 
-import "log"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+)
 
 // Logger is a minimal logging interface used throughout the clone package.
 // It matches the stdlib log Logger for Printf/Println.
@@ -20,3 +31,115 @@ func SetLogger(l Logger) {
 	}
 	logSink = l
 }
+
+// structuredLog receives the events of a run as structured records; it is
+// guarded by structuredMu.
+var (
+	structuredMu  sync.Mutex
+	structuredLog *slog.Logger
+)
+
+// SetStructuredLogger makes Klon write every command (with its exit code,
+// duration and truncated output), every step and every warning as a record
+// to l, in place of the "klon: EXEC:" style lines. Give l the run's ID, e.g.
+// l.With("run_id", NewRunID()). Passing nil goes back to the plain lines.
+func SetStructuredLogger(l *slog.Logger) {
+	structuredMu.Lock()
+	defer structuredMu.Unlock()
+	structuredLog = l
+}
+
+// structuredLogger returns the logger set with SetStructuredLogger, or nil.
+func structuredLogger() *slog.Logger {
+	structuredMu.Lock()
+	defer structuredMu.Unlock()
+	return structuredLog
+}
+
+func structured() bool {
+	return structuredLogger() != nil
+}
+
+// NewRunID returns a random identifier for a run, e.g. "5f0c2a9e41d7b3c8".
+func NewRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// StepID identifies step number index (from 1) of a plan, e.g.
+// "03-sync-filesystem-p2". The same plan always gives the same IDs, so
+// together with the run ID they name one step of one run.
+func StepID(step ExecutionStep, index int) string {
+	id := fmt.Sprintf("%02d-%s", index, step.Operation)
+	if step.PartitionIndex > 0 {
+		id += fmt.Sprintf("-p%d", step.PartitionIndex)
+	}
+	return id
+}
+
+// maxLoggedOutput bounds the command output kept in a record.
+const maxLoggedOutput = 4096
+
+// truncateOutput keeps the end of long output, where errors are reported.
+func truncateOutput(s string) string {
+	if len(s) <= maxLoggedOutput {
+		return s
+	}
+	return "..." + s[len(s)-maxLoggedOutput:]
+}
+
+// exitCode returns the exit status carried by err: 0 without an error and
+// -1 when the command did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// logRecord writes e to l. Output lines and progress are left out: the
+// command-finished record carries the output.
+func logRecord(l *slog.Logger, e Event) {
+	level, msg := slog.LevelInfo, ""
+	var attrs []slog.Attr
+	if e.StepID != "" {
+		attrs = append(attrs, slog.String("step_id", e.StepID))
+	}
+	switch e.Kind {
+	case EventPlanStarted:
+		msg = "apply started"
+		attrs = append(attrs, slog.Int("steps", e.StepCount))
+	case EventStepStarted:
+		msg = "step started"
+		attrs = append(attrs, slog.String("operation", string(e.Step.Operation)), slog.Int("partition", e.Step.PartitionIndex), slog.String("description", e.Step.Description))
+	case EventCommandFinished:
+		msg = "command"
+		attrs = append(attrs, slog.String("command", e.Command), slog.Int("exit_code", e.ExitCode), slog.Int64("duration_ms", e.Duration.Milliseconds()))
+		if e.Output != "" {
+			attrs = append(attrs, slog.String("output", e.Output))
+		}
+	case EventWarning:
+		level, msg = slog.LevelWarn, "warning"
+		attrs = append(attrs, slog.String("message", e.Message))
+	case EventStepFinished:
+		msg = "step finished"
+		attrs = append(attrs, slog.String("operation", string(e.Step.Operation)), slog.Int64("duration_ms", e.Duration.Milliseconds()))
+	case EventApplyFinished:
+		msg = "apply finished"
+		attrs = append(attrs, slog.Int64("duration_ms", e.Duration.Milliseconds()))
+	default:
+		return
+	}
+	if e.Err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	}
+	l.LogAttrs(context.Background(), level, msg, attrs...)
+}
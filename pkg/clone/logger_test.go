@@ -0,0 +1,79 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// shellRunner runs every step as the shell command in its description.
+type shellRunner struct {
+	ctx context.Context
+}
+
+func (r shellRunner) Run(step ExecutionStep) error {
+	return shellExec(r.ctx, step.Description)
+}
+
+func TestSetStructuredLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetStructuredLogger(slog.New(slog.NewJSONHandler(&buf, nil)).With("run_id", "r1"))
+	t.Cleanup(func() { SetStructuredLogger(nil) })
+	var plain bytes.Buffer
+	SetLogger(log.New(&plain, "", 0))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	plan := PlanResult{
+		DestinationDisk: "sda",
+		Partitions: []PartitionPlan{
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true}},
+		},
+	}
+	steps := BuildExecutionSteps(plan, PlanOptions{Destination: "sda"})
+	steps[0].Description = "echo copying; exit 3"
+	// The step's commands get its StepID from the run's context.
+	ctx := WithEventHandler(context.Background(), nil)
+	if err := runStep(ctx, shellRunner{ctx: ctx}, steps[0], 1, 1); err == nil {
+		t.Fatalf("expected the command to fail")
+	}
+	if plain.Len() > 0 {
+		t.Fatalf("expected no plain log lines, got %q", plain.String())
+	}
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		if r["run_id"] != "r1" || r["step_id"] != "01-sync-filesystem-p2" {
+			t.Fatalf("record without run or step ID: %v", r)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 || records[0]["msg"] != "step started" || records[2]["msg"] != "step finished" {
+		t.Fatalf("unexpected records:\n%s", buf.String())
+	}
+	cmd := records[1]
+	if cmd["msg"] != "command" || cmd["level"] != "ERROR" || cmd["exit_code"] != 3.0 || cmd["output"] != "copying" || cmd["command"] != "echo copying; exit 3" {
+		t.Fatalf("unexpected command record %v", cmd)
+	}
+	if _, ok := cmd["duration_ms"]; !ok {
+		t.Fatalf("command record without duration: %v", cmd)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	long := strings.Repeat("x", maxLoggedOutput) + "error: disk full"
+	got := truncateOutput(long)
+	if len(got) != maxLoggedOutput+3 || !strings.HasSuffix(got, "error: disk full") || !strings.HasPrefix(got, "...") {
+		t.Fatalf("unexpected truncation %q", got[:20])
+	}
+	if truncateOutput("short") != "short" {
+		t.Fatalf("short output must be kept")
+	}
+}
@@ -0,0 +1,415 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// DefaultMountRegistryDir is where every Klon process records the mounts and
+// snapshots it holds and the systemd units it quiesced, so that `klon
+// cleanup` can tear down those of a run that crashed.
+const DefaultMountRegistryDir = "/var/lib/klon/mounts"
+
+// MountRecord is a filesystem Klon mounted.
+type MountRecord struct {
+	Device string `json:"device"`
+	Target string `json:"target"`
+	// TempDir is set when Target is a temporary directory created for the
+	// mount, which is removed once it is unmounted.
+	TempDir bool `json:"temp_dir,omitempty"`
+}
+
+// SnapshotRecord is a source snapshot Klon took, or a source filesystem it
+// froze or remounted read-only, for a sync (see SourceSnapshot).
+type SnapshotRecord struct {
+	Method SnapshotMethod `json:"method"`
+	// Target is the snapshot ("vg/lv" for SnapshotLVM, the subvolume for
+	// SnapshotBtrfs) or the mountpoint that was frozen or remounted.
+	Target string `json:"target"`
+}
+
+func (s SnapshotRecord) String() string {
+	switch s.Method {
+	case SnapshotLVM:
+		return "LVM snapshot " + s.Target
+	case SnapshotBtrfs:
+		return "btrfs snapshot " + s.Target
+	case SnapshotFreeze:
+		return "frozen filesystem " + s.Target
+	case SnapshotRemountRO:
+		return "read-only filesystem " + s.Target
+	}
+	return string(s.Method) + " " + s.Target
+}
+
+// releaseCommand deletes the snapshot, thaws the filesystem or remounts it
+// read-write.
+func (s SnapshotRecord) releaseCommand() string {
+	switch s.Method {
+	case SnapshotLVM:
+		return "lvremove -f " + s.Target
+	case SnapshotBtrfs:
+		return "btrfs subvolume delete " + shellQuote(s.Target)
+	case SnapshotFreeze:
+		return "fsfreeze --unfreeze " + shellQuote(s.Target)
+	}
+	return "mount -o remount,rw " + shellQuote(s.Target)
+}
+
+// mountRegistry is the file a process keeps in the registry directory while
+// it holds mounts or snapshots, or has units stopped or frozen.
+type mountRegistry struct {
+	PID       int              `json:"pid"`
+	Mounts    []MountRecord    `json:"mounts"`
+	Snapshots []SnapshotRecord `json:"snapshots,omitempty"`
+	Units     []QuiesceUnit    `json:"units,omitempty"`
+}
+
+// mountManager records every mount, snapshot and quiesced unit of this
+// process, in order, so they can be unwound in reverse order however the
+// run ends.
+type mountManager struct {
+	mu        sync.Mutex
+	dir       string
+	mounted   []MountRecord
+	snapshots []SnapshotRecord
+	units     []QuiesceUnit
+}
+
+// mounts holds the mounts of this process.
+var mounts = &mountManager{}
+
+// SetMountRegistry makes Klon record its mounts, snapshots and quiesced
+// units in a file of dir, removed once they are all released; see
+// CleanupMounts. The empty dir (the
+// default) keeps them in memory only.
+func SetMountRegistry(dir string) {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	mounts.dir = dir
+}
+
+// UnmountAll unmounts, in reverse order, whatever Klon still has mounted,
+// and then releases the snapshots it still holds. Steps unmount and release
+// what they take themselves, so this only finds something to do after an
+// error, a panic or an interrupt; the CLI defers it for the whole run.
+func UnmountAll() error {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	var errs []error
+	for i := len(mounts.mounted) - 1; i >= 0; i-- {
+		rec := mounts.mounted[i]
+		logWarning(context.Background(), "%s is still mounted on %s; unmounting it", rec.Device, rec.Target)
+		if err := unmountRecord(context.Background(), rec); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		mounts.mounted = append(mounts.mounted[:i], mounts.mounted[i+1:]...)
+	}
+	for i := len(mounts.snapshots) - 1; i >= 0; i-- {
+		rec := mounts.snapshots[i]
+		logWarning(context.Background(), "the %s was not released; releasing it", rec)
+		if err := shellExec(context.Background(), rec.releaseCommand()); err != nil {
+			errs = append(errs, fmt.Errorf("cannot release the %s: %w", rec, err))
+			continue
+		}
+		mounts.snapshots = append(mounts.snapshots[:i], mounts.snapshots[i+1:]...)
+	}
+	mounts.save()
+	return errors.Join(errs...)
+}
+
+// mountFS mounts device on target with the given mount options, if any,
+// and records the mount. With tempDir, target is a temporary directory that
+// is removed when it is unmounted.
+func mountFS(ctx context.Context, options, device, target string, tempDir bool) error {
+	cmd := "mount "
+	if options != "" {
+		cmd += "-o " + options + " "
+	}
+	if err := shellExec(ctx, cmd+device+" "+shellArg(target)); err != nil {
+		return err
+	}
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	mounts.mounted = append(mounts.mounted, MountRecord{Device: device, Target: target, TempDir: tempDir})
+	mounts.save()
+	return nil
+}
+
+// unmountFS unmounts target and everything mounted after it, in reverse
+// order. It does so even when ctx was cancelled: nothing may be left
+// mounted behind it.
+func unmountFS(ctx context.Context, target string) error {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	idx := -1
+	for i, rec := range mounts.mounted {
+		if rec.Target == target {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return unmountRecord(ctx, MountRecord{Target: target})
+	}
+	defer mounts.save()
+	for i := len(mounts.mounted) - 1; i >= idx; i-- {
+		if err := unmountRecord(ctx, mounts.mounted[i]); err != nil {
+			return err
+		}
+		mounts.mounted = mounts.mounted[:i]
+	}
+	return nil
+}
+
+// unmountRecord unmounts one recorded filesystem and removes its temporary
+// directory, even when ctx was cancelled.
+func unmountRecord(ctx context.Context, rec MountRecord) error {
+	if err := shellExec(context.WithoutCancel(ctx), "umount "+shellArg(rec.Target)); err != nil {
+		return fmt.Errorf("cannot unmount %s: %w", rec.Target, err)
+	}
+	if rec.TempDir {
+		// Remove, not RemoveAll: never recurse into a directory that might
+		// still have a filesystem mounted.
+		_ = os.Remove(rec.Target)
+	}
+	return nil
+}
+
+// recordSnapshot adds a snapshot of this process to the registry.
+func recordSnapshot(rec SnapshotRecord) {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	mounts.snapshots = append(mounts.snapshots, rec)
+	mounts.save()
+}
+
+// forgetSnapshot removes a snapshot from the registry.
+func forgetSnapshot(rec SnapshotRecord) {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	for i := len(mounts.snapshots) - 1; i >= 0; i-- {
+		if mounts.snapshots[i] == rec {
+			mounts.snapshots = append(mounts.snapshots[:i], mounts.snapshots[i+1:]...)
+			break
+		}
+	}
+	mounts.save()
+}
+
+// recordUnit adds a systemd unit of this process to the registry before it
+// is stopped or frozen.
+func recordUnit(u QuiesceUnit) {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	mounts.units = append(mounts.units, u)
+	mounts.save()
+}
+
+// forgetUnit removes a unit from the registry once it runs again.
+func forgetUnit(u QuiesceUnit) {
+	mounts.mu.Lock()
+	defer mounts.mu.Unlock()
+	for i := len(mounts.units) - 1; i >= 0; i-- {
+		if mounts.units[i] == u {
+			mounts.units = append(mounts.units[:i], mounts.units[i+1:]...)
+			break
+		}
+	}
+	mounts.save()
+}
+
+// releaseSnapshot deletes, thaws or remounts read-write a recorded
+// snapshot, even when ctx was cancelled: a frozen filesystem must never be
+// left behind.
+func releaseSnapshot(ctx context.Context, rec SnapshotRecord) error {
+	if err := shellExec(context.WithoutCancel(ctx), rec.releaseCommand()); err != nil {
+		return fmt.Errorf("cannot release the %s: %w", rec, err)
+	}
+	forgetSnapshot(rec)
+	return nil
+}
+
+// save writes the mounts, snapshots and units of this process to the
+// registry, or removes its file once none are left. The caller holds mu.
+func (m *mountManager) save() {
+	if m.dir == "" {
+		return
+	}
+	path := filepath.Join(m.dir, strconv.Itoa(os.Getpid())+".json")
+	if len(m.mounted) == 0 && len(m.snapshots) == 0 && len(m.units) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logWarning(context.Background(), "cannot update the mount registry %s: %v", path, err)
+		}
+		return
+	}
+	if err := writeMountRegistry(path, mountRegistry{PID: os.Getpid(), Mounts: m.mounted, Snapshots: m.snapshots, Units: m.units}); err != nil {
+		logWarning(context.Background(), "cannot update the mount registry %s: %v", path, err)
+	}
+}
+
+func writeMountRegistry(path string, reg mountRegistry) error {
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// CleanupMounts tears down the mounts recorded in the registry dir by Klon
+// processes that are no longer running, for example after a crash or a
+// power loss, in the reverse order they were made, then releases their
+// snapshots and starts or thaws the units they quiesced. Mounts and
+// snapshots that are already gone are only forgotten. It returns the
+// filesystems it unmounted, the snapshots it released and the units it
+// brought back.
+func CleanupMounts(dir string) ([]MountRecord, []SnapshotRecord, []QuiesceUnit, error) {
+	return localSystem{}.cleanupMounts(dir)
+}
+
+func (s localSystem) cleanupMounts(dir string) ([]MountRecord, []SnapshotRecord, []QuiesceUnit, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var unmounted []MountRecord
+	var released []SnapshotRecord
+	var resumed []QuiesceUnit
+	var errs []error
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var reg mountRegistry
+		if err := json.Unmarshal(data, &reg); err != nil {
+			errs = append(errs, fmt.Errorf("cannot parse mount registry %s: %w", path, err))
+			continue
+		}
+		if reg.PID != os.Getpid() && processAlive(reg.PID) {
+			logWarning(context.Background(), "Klon process %d is still running; leaving its mounts alone", reg.PID)
+			continue
+		}
+		current, err := s.Mounts()
+		if err != nil {
+			return unmounted, released, resumed, err
+		}
+		for len(reg.Mounts) > 0 {
+			rec := reg.Mounts[len(reg.Mounts)-1]
+			if isMountpoint(current, rec.Target) {
+				if err := unmountRecord(context.Background(), rec); err != nil {
+					errs = append(errs, err)
+					break
+				}
+				unmounted = append(unmounted, rec)
+			} else if rec.TempDir {
+				_ = os.Remove(rec.Target)
+			}
+			reg.Mounts = reg.Mounts[:len(reg.Mounts)-1]
+		}
+		// A snapshot is only released once nothing is mounted from it.
+		for len(reg.Mounts) == 0 && len(reg.Snapshots) > 0 {
+			rec := reg.Snapshots[len(reg.Snapshots)-1]
+			if s.snapshotHeld(current, rec) {
+				err := shellExec(context.Background(), rec.releaseCommand())
+				if err != nil && rec.Method != SnapshotFreeze {
+					errs = append(errs, fmt.Errorf("cannot release the %s: %w", rec, err))
+					break
+				}
+				if err != nil {
+					// fsfreeze fails on a filesystem that is not frozen,
+					// for example after a reboot.
+					logWarning(context.Background(), "cannot thaw %s: %v", rec.Target, err)
+				} else {
+					released = append(released, rec)
+				}
+			}
+			reg.Snapshots = reg.Snapshots[:len(reg.Snapshots)-1]
+		}
+		// Units come back once the filesystems they write to are thawed.
+		for len(reg.Snapshots) == 0 && len(reg.Units) > 0 {
+			u := reg.Units[len(reg.Units)-1]
+			err := shellExec(context.Background(), u.resumeCommand())
+			if err != nil && u.Mode != QuiesceFreeze {
+				errs = append(errs, fmt.Errorf("cannot %s %s: %w", u.resumeVerb(), u.Unit, err))
+				break
+			}
+			if err != nil {
+				// systemctl thaw fails on a unit that is not frozen, for
+				// example after a reboot.
+				logWarning(context.Background(), "cannot thaw %s: %v", u.Unit, err)
+			} else {
+				resumed = append(resumed, u)
+			}
+			reg.Units = reg.Units[:len(reg.Units)-1]
+		}
+		if len(reg.Mounts) == 0 && len(reg.Snapshots) == 0 && len(reg.Units) == 0 {
+			err = os.Remove(path)
+		} else {
+			err = writeMountRegistry(path, reg)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return unmounted, released, resumed, errors.Join(errs...)
+}
+
+// snapshotHeld reports whether a recorded snapshot may still be there: an
+// LVM or btrfs snapshot that exists, or a frozen or read-only filesystem
+// that is still mounted.
+func (s localSystem) snapshotHeld(current []MountInfo, rec SnapshotRecord) bool {
+	switch rec.Method {
+	case SnapshotLVM:
+		_, err := os.Stat(s.hostPath("/dev/" + rec.Target))
+		return err == nil
+	case SnapshotBtrfs:
+		_, err := os.Stat(s.hostPath(rec.Target))
+		return err == nil
+	}
+	return isMountpoint(current, rec.Target)
+}
+
+// isMountpoint reports whether something is mounted on target.
+func isMountpoint(mounts []MountInfo, target string) bool {
+	for _, m := range mounts {
+		if m.Mountpoint == filepath.Clean(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// shellArg quotes s for the shell unless it is a plain path, so the mount
+// commands in the log stay readable.
+func shellArg(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+,:=@") == "" {
+		return s
+	}
+	return shellQuote(s)
+}
@@ -0,0 +1,177 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeMountCommands records the commands run instead of mount(8),
+// umount(8), the snapshot tools and systemctl, failing those in fail, and
+// forgets the mounts, snapshots and units of the test when it ends.
+func fakeMountCommands(t *testing.T, fail ...string) *[]string {
+	t.Helper()
+	orig := shellExec
+	mounts.mounted, mounts.snapshots, mounts.units = nil, nil, nil
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		for _, f := range fail {
+			if cmdStr == f {
+				return errors.New("target is busy")
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		shellExec = orig
+		mounts.mounted, mounts.snapshots, mounts.units = nil, nil, nil
+		SetMountRegistry("")
+	})
+	return &cmds
+}
+
+func TestMountManager(t *testing.T) {
+	cmds := fakeMountCommands(t, "umount /mnt/clone")
+	registry := t.TempDir()
+	SetMountRegistry(registry)
+	tmp, err := os.MkdirTemp("", "klon-src-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmp) })
+
+	for _, m := range []struct{ device, target string }{
+		{"/dev/sdb2", "/mnt/clone"},
+		{"/dev/sdb1", "/mnt/clone/boot"},
+	} {
+		if err := mountFS(context.Background(), "", m.device, m.target, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mountFS(context.Background(), "ro", "/dev/mmcblk0p3", tmp, true); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(registry, strconv.Itoa(os.Getpid())+".json")
+	if data, err := os.ReadFile(path); err != nil || strings.Count(string(data), `"target"`) != 3 {
+		t.Fatalf("expected the registry to list 3 mounts, got %s, %v", data, err)
+	}
+
+	// Unmounting the boot partition unmounts what was mounted after it
+	// first; the temporary mountpoint goes away with its mount.
+	if err := unmountFS(context.Background(), "/mnt/clone/boot"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", tmp, err)
+	}
+
+	// A mount that cannot be unmounted stays recorded.
+	if err := UnmountAll(); err == nil || !strings.Contains(err.Error(), "target is busy") {
+		t.Fatalf("expected the busy mount to fail, got %v", err)
+	}
+	if len(mounts.mounted) != 1 || mounts.mounted[0].Target != "/mnt/clone" {
+		t.Fatalf("unexpected mounts %+v", mounts.mounted)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the registry to be kept: %v", err)
+	}
+
+	want := []string{
+		"mount /dev/sdb2 /mnt/clone",
+		"mount /dev/sdb1 /mnt/clone/boot",
+		"mount -o ro /dev/mmcblk0p3 " + tmp,
+		"umount " + tmp,
+		"umount /mnt/clone/boot",
+		"umount /mnt/clone",
+	}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(*cmds, "\n"))
+	}
+
+	mounts.mounted = nil
+	mounts.save()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the registry to be removed once nothing is mounted, got %v", err)
+	}
+}
+
+func TestCleanupMounts(t *testing.T) {
+	cmds := fakeMountCommands(t, "systemctl thaw 'docker'")
+	f := newFakeSysfs(t)
+	f.write("/proc/self/mountinfo", "21 1 179:2 / / rw - ext4 /dev/root rw\n"+
+		"40 21 8:18 / /mnt/clone rw - ext4 /dev/sdb2 rw\n"+
+		"41 40 8:17 / /mnt/clone/boot rw - vfat /dev/sdb1 rw\n"+
+		"42 21 179:1 / /boot ro - vfat /dev/mmcblk0p1 rw\n")
+	f.write("/dev/vg0/root-klon-snap-1", "")
+	registry := t.TempDir()
+
+	// A run that was killed, and one that is still running.
+	done := exec.Command("true")
+	if err := done.Run(); err != nil {
+		t.Skipf("cannot start a process: %v", err)
+	}
+	gone := filepath.Join(t.TempDir(), "klon-src-1")
+	if err := os.Mkdir(gone, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	crashed := mountRegistry{PID: done.Process.Pid, Mounts: []MountRecord{
+		{Device: "/dev/sdb2", Target: "/mnt/clone"},
+		{Device: "/dev/sdb1", Target: "/mnt/clone/boot"},
+		{Device: "/dev/mmcblk0p3", Target: gone, TempDir: true},
+	}, Snapshots: []SnapshotRecord{
+		{Method: SnapshotLVM, Target: "vg0/root-klon-snap-1"},
+		{Method: SnapshotBtrfs, Target: "/srv/.klon-snapshot-1"},
+		{Method: SnapshotRemountRO, Target: "/boot"},
+		{Method: SnapshotFreeze, Target: "/var/lib"},
+	}, Units: []QuiesceUnit{
+		{Unit: "postgresql", Mode: QuiesceStop},
+		{Unit: "docker", Mode: QuiesceFreeze},
+	}}
+	running := mountRegistry{PID: os.Getppid(), Mounts: []MountRecord{{Device: "/dev/sdc2", Target: "/mnt/other"}}}
+	for _, reg := range []mountRegistry{crashed, running} {
+		if err := writeMountRegistry(filepath.Join(registry, strconv.Itoa(reg.PID)+".json"), reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Snapshots that are gone, and filesystems no longer mounted, are
+	// only forgotten.
+	unmounted, released, resumed, err := f.system().cleanupMounts(registry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unmounted) != 2 || unmounted[0].Target != "/mnt/clone/boot" || unmounted[1].Target != "/mnt/clone" {
+		t.Fatalf("unexpected unmounted %+v", unmounted)
+	}
+	if len(released) != 2 || released[0].String() != "read-only filesystem /boot" || released[1].String() != "LVM snapshot vg0/root-klon-snap-1" {
+		t.Fatalf("unexpected released %+v", released)
+	}
+	// A unit that is no longer frozen cannot be thawed and is forgotten.
+	if len(resumed) != 1 || resumed[0].Unit != "postgresql" {
+		t.Fatalf("unexpected resumed units %+v", resumed)
+	}
+	want := []string{
+		"umount /mnt/clone/boot",
+		"umount /mnt/clone",
+		"mount -o remount,rw '/boot'",
+		"lvremove -f vg0/root-klon-snap-1",
+		"systemctl thaw 'docker'",
+		"systemctl start 'postgresql'",
+	}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(*cmds, "\n"))
+	}
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary mountpoint to be removed, got %v", err)
+	}
+	left, _ := filepath.Glob(filepath.Join(registry, "*.json"))
+	if len(left) != 1 || filepath.Base(left[0]) != strconv.Itoa(os.Getppid())+".json" {
+		t.Fatalf("expected only the running process's registry to be left, got %v", left)
+	}
+}
@@ -1,14 +1,21 @@
 package clone
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
 
-// BuildPartitionCommand builds the command that will prepare the destination
-// disk partition table for a clone operation. It does not execute anything.
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// BuildPartitionCommand describes how the destination disk partition table
+// will be prepared for a clone operation. It does not execute anything: the
+// CommandRunner writes the table itself with package parttable, and logs
+// this description before it does.
 //
 // The strategy is typically the PartitionStrategy from PlanOptions (e.g.
-// "clone-table" or "new-layout").
-func BuildPartitionCommand(step ExecutionStep, strategy string) (string, error) {
-	if step.Operation != "prepare-disk" {
+// StrategyCloneTable or StrategyNewLayout).
+func BuildPartitionCommand(step ExecutionStep, strategy PartitionStrategy) (string, error) {
+	if step.Operation != OpPrepareDisk {
 		return "", fmt.Errorf("BuildPartitionCommand: unsupported operation %q", step.Operation)
 	}
 	if step.DestinationDisk == "" {
@@ -17,29 +24,40 @@ func BuildPartitionCommand(step ExecutionStep, strategy string) (string, error)
 
 	src := ensureDevPrefix(step.SourceDevice)
 	target := ensureDevPrefix(step.DestinationDisk)
-	switch strategy {
-	case "", "clone-table":
-		return fmt.Sprintf("sfdisk -d %s | sfdisk %s", src, target), nil
-	case "new-layout":
-		// Minimal new layout (DOS): FAT32 boot + ext root.
-		sizeBytes := step.SizeBytes
-		if sizeBytes <= 0 {
-			sizeBytes = 256 * 1024 * 1024 // 256MiB default boot
+	var desc string
+	switch {
+	case step.Layout != nil:
+		desc = fmt.Sprintf("write %s partition table to %s:", step.Layout.Table, target)
+		for _, p := range step.Layout.Partitions {
+			desc += fmt.Sprintf(" partition %d of %s at %s", p.Index, formatBytes(p.SizeBytes), formatBytes(p.StartBytes))
+			if p.Type != "" {
+				desc += fmt.Sprintf(" (type %s)", p.Type)
+			}
+			desc += ","
+		}
+		desc = strings.TrimSuffix(desc, ",")
+	case strategy == "" || strategy == StrategyCloneTable:
+		desc = fmt.Sprintf("write a copy of the partition table of %s to %s", src, target)
+	case strategy == StrategyNewLayout || strategy == StrategyNewLayoutGPT:
+		table := parttable.DOS
+		if strategy == StrategyNewLayoutGPT {
+			table = parttable.GPT
 		}
-		sizeMB := (sizeBytes + 1024*1024 - 1) / (1024 * 1024)
-		script := fmt.Sprintf(",%dM,c\n,,L\n", sizeMB)
-		return fmt.Sprintf("sfdisk %s <<'EOF'\nlabel: dos\n%sEOF", target, script), nil
-	case "new-layout-gpt":
-		// Simple GPT layout: FAT32 boot + ext root. Uses parted for clarity.
-		sizeBytes := step.SizeBytes
-		if sizeBytes <= 0 {
-			sizeBytes = 256 * 1024 * 1024 // 256MiB default boot
+		bootSize := step.SizeBytes
+		if bootSize <= 0 {
+			bootSize = defaultBootSizeBytes
 		}
-		sizeMB := (sizeBytes + 1024*1024 - 1) / (1024 * 1024)
-		return fmt.Sprintf("parted -s %s mklabel gpt mkpart primary fat32 1MiB %dMiB set 1 boot on mkpart primary ext4 %dMiB 100%%", target, sizeMB, sizeMB+1), nil
+		// The boot partition is created with the -p1-size, not resized.
+		return fmt.Sprintf("write %s partition table to %s: FAT boot partition 1 of %s at 1.0 MiB, Linux root partition 2 filling the rest of the disk", table, target, formatBytes(alignUp(bootSize, layoutAlignBytes))), nil
+	case strategy == StrategyShrinkTable || strategy == StrategyLayoutFile:
+		return "", fmt.Errorf("BuildPartitionCommand: strategy %q needs a layout computed at plan time", strategy)
 	default:
 		return "", fmt.Errorf("BuildPartitionCommand: unknown strategy %q", strategy)
 	}
+	if step.SizeBytes > 0 {
+		desc += fmt.Sprintf(", with partition 1 resized to %s", formatBytes(step.SizeBytes))
+	}
+	return desc, nil
 }
 
 func ensureDevPrefix(name string) string {
@@ -16,7 +16,7 @@ func TestBuildPartitionCommand_CloneTable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := "sfdisk -d /dev/mmcblk0 | sfdisk /dev/sda"
+	expected := "write a copy of the partition table of /dev/mmcblk0 to /dev/sda"
 	if cmd != expected {
 		t.Fatalf("unexpected command.\n got: %q\nwant: %q", cmd, expected)
 	}
@@ -34,10 +34,10 @@ func TestBuildPartitionCommand_NewLayout(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !strings.Contains(cmd, "sfdisk /dev/sda") {
+	if !strings.Contains(cmd, "write dos partition table to /dev/sda") {
 		t.Fatalf("expected command to target /dev/sda, got %q", cmd)
 	}
-	if !strings.Contains(cmd, ",300M,c") {
+	if !strings.Contains(cmd, "boot partition 1 of 300.0 MiB") {
 		t.Fatalf("expected boot size to reflect provided SizeBytes, got %q", cmd)
 	}
 }
@@ -54,13 +54,39 @@ func TestBuildPartitionCommand_NewLayoutGPT(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !strings.Contains(cmd, "mklabel gpt") {
+	if !strings.Contains(cmd, "write gpt partition table") {
 		t.Fatalf("expected gpt label, got %q", cmd)
 	}
-	if !strings.Contains(cmd, "fat32") || !strings.Contains(cmd, "ext4") {
-		t.Fatalf("expected fat32 and ext4 parts, got %q", cmd)
+	if !strings.Contains(cmd, "FAT boot partition 1") || !strings.Contains(cmd, "Linux root partition 2") {
+		t.Fatalf("expected boot and root parts, got %q", cmd)
 	}
-	if !strings.Contains(cmd, "512MiB") && !strings.Contains(cmd, "512M") {
+	if !strings.Contains(cmd, "512.0 MiB") {
 		t.Fatalf("expected boot size to reflect provided SizeBytes, got %q", cmd)
 	}
 }
+
+func TestBuildPartitionCommand_ShrinkTable(t *testing.T) {
+	step := ExecutionStep{
+		Operation:       OpPrepareDisk,
+		SourceDevice:    "/dev/mmcblk0",
+		DestinationDisk: "sda",
+		Layout: &DiskLayout{Table: "dos", Partitions: []LayoutPartition{
+			{Index: 1, StartBytes: 4 << 20, SizeBytes: 512 << 20, Type: "c"},
+			{Index: 2, StartBytes: 516 << 20, SizeBytes: 20 << 30, Type: "83"},
+		}},
+	}
+
+	cmd, err := BuildPartitionCommand(step, StrategyShrinkTable)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "write dos partition table to /dev/sda: partition 1 of 512.0 MiB at 4.0 MiB (type c), partition 2 of 20.0 GiB at 516.0 MiB (type 83)"
+	if cmd != expected {
+		t.Fatalf("unexpected command.\n got: %q\nwant: %q", cmd, expected)
+	}
+
+	step.Layout = nil
+	if _, err := BuildPartitionCommand(step, StrategyShrinkTable); err == nil {
+		t.Fatalf("expected error without a layout")
+	}
+}
@@ -2,46 +2,72 @@ package clone
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 )
 
 // PlanOptions represents the inputs required to compute a clone plan.
 // It mirrors, at a high level, the user-facing options parsed by the CLI.
 type PlanOptions struct {
-	Destination         string
-	Initialize          bool
-	ForceTwoPartitions  bool
-	ExpandLastPartition bool
-	DeleteDest          bool
-	ForceSync           bool
-	P1SizeBytes         int64
-	SetupArgs           []string
-	EditFstabName       string
-	LeaveSDUSB          bool
-	AllSync             bool
-	ConvertToPartuuid   bool
-	LabelPartitions     string
-	MountDirs           []string
-	Quiet               bool
-	Unattended          bool
-	UnattendedInit      bool
-	Verbose             bool
+	Destination         string   `json:"destination,omitempty"`
+	Initialize          bool     `json:"initialize,omitempty"`
+	ForceTwoPartitions  bool     `json:"force_two_partitions,omitempty"`
+	ExpandLastPartition bool     `json:"expand_last_partition,omitempty"`
+	DeleteDest          bool     `json:"delete_dest,omitempty"`
+	ForceSync           bool     `json:"force_sync,omitempty"`
+	P1SizeBytes         int64    `json:"p1_size_bytes,omitempty"`
+	SetupArgs           []string `json:"setup_args,omitempty"`
+	EditFstabName       string   `json:"edit_fstab_name,omitempty"`
+	LeaveSDUSB          bool     `json:"leave_sd_usb,omitempty"`
+	AllSync             bool     `json:"all_sync,omitempty"`
+	ConvertToPartuuid   bool     `json:"convert_to_partuuid,omitempty"`
+	LabelPartitions     string   `json:"label_partitions,omitempty"`
+	MountDirs           []string `json:"mount_dirs,omitempty"`
+	Quiet               bool     `json:"quiet,omitempty"`
+	Unattended          bool     `json:"unattended,omitempty"`
+	UnattendedInit      bool     `json:"unattended_init,omitempty"`
+	Verbose             bool     `json:"verbose,omitempty"`
 	// PartitionStrategy describes how the destination partition table should
-	// be prepared when Initialize is true. For now it is descriptive only.
-	// Examples: "clone-table", "new-layout".
-	PartitionStrategy string
-	ExcludePatterns   []string
-	ExcludeFromFiles  []string
-	Hostname          string
-	DeleteRoot        bool
-	SetupNoChroot     bool
-	GrubAuto          bool
+	// be prepared when Initialize is true. Defaults to StrategyCloneTable.
+	PartitionStrategy PartitionStrategy `json:"partition_strategy,omitempty"`
+	ExcludePatterns   []string          `json:"exclude_patterns,omitempty"`
+	ExcludeFromFiles  []string          `json:"exclude_from_files,omitempty"`
+	Hostname          string            `json:"hostname,omitempty"`
+	DeleteRoot        bool              `json:"delete_root,omitempty"`
+	SetupNoChroot     bool              `json:"setup_no_chroot,omitempty"`
+	GrubAuto          bool              `json:"grub_auto,omitempty"`
+	// ShrinkMarginPercent is the free space, as a percentage of the used
+	// bytes, that StrategyShrinkTable keeps on the shrunken partition. Nil
+	// selects the default of 10%; zero keeps no margin.
+	ShrinkMarginPercent *int `json:"shrink_margin_percent,omitempty"`
+	// LayoutSpec is the destination layout used by StrategyLayoutFile. It is
+	// stored in the options so a saved plan does not depend on the file.
+	LayoutSpec *LayoutSpec `json:"layout_spec,omitempty"`
+	// ImageSizeBytes overrides the size of a new image file destination (see
+	// IsImageDestination). Zero sizes it to hold the source partitions.
+	ImageSizeBytes int64 `json:"image_size_bytes,omitempty"`
+	// Source is a disk or image file to clone instead of the running system
+	// (see OpenSource). Planning must then use the System of the mounted
+	// source.
+	Source string `json:"source,omitempty"`
+	// CopyMode selects rsync (the default) or block copies for partitions
+	// that are initialized; see planBlockCopies.
+	CopyMode CopyMode `json:"copy_mode,omitempty"`
+	// Snapshot syncs mounted source partitions from snapshots, or freezes
+	// them, so the copy is crash-consistent; see planSnapshots.
+	Snapshot bool `json:"snapshot,omitempty"`
+	// Quiesce lists systemd units to stop or freeze while the source is
+	// synced (see ApplyQuiesced).
+	Quiesce []QuiesceUnit `json:"quiesce,omitempty"`
+	// TwoPass adds a second sync pass over the mounted partitions, which
+	// catches the files that changed during the first one. With
+	// QuiesceSecondPass, the Quiesce units are only stopped for that pass.
+	TwoPass           bool `json:"two_pass,omitempty"`
+	QuiesceSecondPass bool `json:"quiesce_second_pass,omitempty"`
 }
 
 // System abstracts how we discover information about disks and partitions
 // from the underlying OS. This allows tests to provide a fake implementation
-// while the real implementation can use tools like lsblk, findmnt, etc.
+// while the real implementation reads sysfs and procfs (see DeviceSystem).
 type System interface {
 	BootDisk() (string, error)
 	MountedPartitions(disk string) ([]MountedPartition, error)
@@ -50,20 +76,116 @@ type System interface {
 // DefaultSystem is used by Plan. It can be replaced in tests if needed.
 var DefaultSystem System = NewLocalSystem()
 
+// diskSizer is implemented by System values that can report the size of a
+// whole disk in bytes. Sizes are recorded in the plan so that a saved plan can
+// detect when a different disk is plugged in before it is applied.
+type diskSizer interface {
+	DiskSize(disk string) (int64, error)
+}
+
+// imageSource is implemented by System values that plan from an image file
+// attached to a loop device, see PlanResult.SourceImage.
+type imageSource interface {
+	sourceImage() string
+}
+
+// diskIdentifier is implemented by System values that can tell which disk a
+// destination is, so that a saved plan is not applied to another disk of the
+// same size.
+type diskIdentifier interface {
+	DiskIdentity(dest string) (DiskIdentity, error)
+}
+
 // PlanResult is a high-level description of what will be cloned.
 // This is intentionally simple for the first TDD step.
 type PlanResult struct {
-	SourceDisk      string
-	DestinationDisk string
-	Partitions      []PartitionPlan
+	SourceDisk      string          `json:"source_disk"`
+	DestinationDisk string          `json:"destination_disk"`
+	Partitions      []PartitionPlan `json:"partitions"`
+	// SourceImage is the absolute path of a --source image file. Its loop
+	// device, SourceDisk, changes every time the image is attached, so the
+	// image identifies the source instead.
+	SourceImage string `json:"source_image,omitempty"`
+	// SourceSizeBytes and DestinationSizeBytes are the whole-disk sizes seen
+	// while planning. They are zero when the System cannot report sizes.
+	SourceSizeBytes      int64 `json:"source_size_bytes,omitempty"`
+	DestinationSizeBytes int64 `json:"destination_size_bytes,omitempty"`
+	// DestinationSerial and DestinationTableID identify the destination seen
+	// while planning, see DiskIdentity. They are empty when the System
+	// cannot read them or the destination has none.
+	DestinationSerial  string `json:"destination_serial,omitempty"`
+	DestinationTableID string `json:"destination_table_id,omitempty"`
+	// DestinationLayout is the partition table computed at plan time for
+	// strategies that do not simply copy the source table.
+	DestinationLayout *DiskLayout `json:"destination_layout,omitempty"`
+	// Warnings lists problems that were accepted because of -F (ForceSync),
+	// such as partitions that will not fit on the destination.
+	Warnings []string `json:"warnings,omitempty"`
+	// Quiesce is the state of the PlanOptions.Quiesce units when planning;
+	// after applying, Touched marks the units that were quiesced.
+	Quiesce []QuiesceState `json:"quiesce,omitempty"`
+	// SecondPass is filled after applying a two-pass plan with the files
+	// each partition's second pass changed.
+	SecondPass []SyncChanges `json:"second_pass,omitempty"`
+}
+
+// partitionInspector is implemented by System values that can describe a
+// source partition in detail (filesystem, geometry and identifiers).
+type partitionInspector interface {
+	PartitionDetails(device, mountpoint string) (PartitionDetails, error)
+}
+
+// PartitionDetails describes what is stored on a source partition. Sizes are
+// in bytes; UsedBytes is zero when usage cannot be determined (for example on
+// an unmounted filesystem).
+type PartitionDetails struct {
+	FSType     string `json:"fs_type,omitempty"`
+	StartBytes int64  `json:"start_bytes,omitempty"`
+	SizeBytes  int64  `json:"size_bytes,omitempty"`
+	UsedBytes  int64  `json:"used_bytes,omitempty"`
+	FSUUID     string `json:"fs_uuid,omitempty"`
+	PartUUID   string `json:"partuuid,omitempty"`
+	Label      string `json:"label,omitempty"`
+	PartType   string `json:"part_type,omitempty"`
 }
 
 type PartitionPlan struct {
-	Index      int
-	Device     string
-	Mountpoint string
-	// For now only basic labels; later we can add FS type, sizes, etc.
-	Action string
+	Index      int    `json:"index"`
+	Device     string `json:"device,omitempty"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+	// Mapper is the LVM logical volume the partition holds and Mountpoint
+	// is mounted from (see MountedPartition); the clone gets its filesystem
+	// on a plain partition.
+	Mapper string `json:"mapper,omitempty"`
+	// SourcePath is the directory copied into the partition when it is not
+	// Mountpoint itself (layout files can move or split source data).
+	SourcePath string `json:"source_path,omitempty"`
+	// Excludes are rsync patterns, anchored at the synced directory, for
+	// data that is copied into other destination partitions instead.
+	Excludes []string        `json:"excludes,omitempty"`
+	Action   PartitionAction `json:"action"`
+	// CopyNote explains why a partition is synced with rsync although block
+	// copies were requested.
+	CopyNote string `json:"copy_note,omitempty"`
+	// Destination is the existing destination partition a sync-only plan
+	// updates (see checkSyncDestination).
+	Destination *DestinationPartition `json:"destination,omitempty"`
+	// Snapshot is how the source is kept consistent while it is synced, and
+	// SnapshotNote why it is synced live although snapshots were requested.
+	Snapshot     *SourceSnapshot `json:"snapshot,omitempty"`
+	SnapshotNote string          `json:"snapshot_note,omitempty"`
+	PartitionDetails
+	// Capacity is filled for synced partitions whose used bytes are known.
+	Capacity *PartitionCapacity `json:"capacity,omitempty"`
+}
+
+// syncSource returns the directory whose files are copied into the
+// partition: SourcePath when set, otherwise Mountpoint.
+func (p PartitionPlan) syncSource() string {
+	if p.SourcePath != "" {
+		return p.SourcePath
+	}
+	return p.Mountpoint
 }
 
 // Plan inspects the current system and the given options and builds a
@@ -88,7 +210,8 @@ func PlanWithSystem(sys System, opts PlanOptions) (PlanResult, error) {
 		return PlanResult{}, fmt.Errorf("failed to detect boot disk: %w", err)
 	}
 
-	srcDisk := baseDiskFromDevice(srcDev)
+	names := namesFor(sys)
+	srcDisk := names.disk(srcDev)
 
 	parts, err := sys.MountedPartitions(srcDisk)
 	if err != nil {
@@ -98,9 +221,9 @@ func PlanWithSystem(sys System, opts PlanOptions) (PlanResult, error) {
 		if ls, ok := sys.(interface {
 			AllParts(string) []MountedPartition
 		}); ok {
-			parts = append(parts, ls.AllParts(srcDisk)...)
+			parts = appendUnlisted(parts, ls.AllParts(srcDisk))
 		} else {
-			parts = append(parts, allPartitionsIncludingUnmounted(srcDisk)...)
+			parts = appendUnlisted(parts, allPartitionsIncludingUnmounted(srcDisk))
 		}
 	}
 
@@ -108,7 +231,7 @@ func PlanWithSystem(sys System, opts PlanOptions) (PlanResult, error) {
 	for idx, p := range parts {
 		index := idx + 1
 		if p.Device != "" {
-			if n := partitionIndexFromDevice(p.Device); n > 0 {
+			if n := names.partitionIndex(p.Device); n > 0 {
 				index = n
 			}
 		}
@@ -116,15 +239,38 @@ func PlanWithSystem(sys System, opts PlanOptions) (PlanResult, error) {
 			Index:      index,
 			Device:     p.Device,
 			Mountpoint: p.Mountpoint,
-			Action:     "sync",
+			Mapper:     p.Mapper,
+			Action:     PartitionAction{Sync: true},
 		})
 	}
 
+	if pi, ok := sys.(partitionInspector); ok {
+		for i := range planParts {
+			if planParts[i].Device == "" {
+				continue
+			}
+			details, err := pi.PartitionDetails(planParts[i].Device, planParts[i].Mountpoint)
+			if err != nil {
+				return PlanResult{}, fmt.Errorf("failed to inspect partition %s: %w", planParts[i].Device, err)
+			}
+			if mapper := planParts[i].Mapper; mapper != "" {
+				// The filesystem is on the logical volume, the geometry and
+				// identifiers are the partition's.
+				fs, err := pi.PartitionDetails(mapper, planParts[i].Mountpoint)
+				if err != nil {
+					return PlanResult{}, fmt.Errorf("failed to inspect %s: %w", mapper, err)
+				}
+				details.FSType, details.FSUUID, details.Label, details.UsedBytes = fs.FSType, fs.FSUUID, fs.Label, fs.UsedBytes
+			}
+			planParts[i].PartitionDetails = details
+		}
+	}
+
 	// If we couldn't detect any partitions, fall back to a minimal stub.
 	if len(planParts) == 0 {
 		planParts = []PartitionPlan{
-			{Index: 1, Action: "sync"},
-			{Index: 2, Action: "sync"},
+			{Index: 1, Action: PartitionAction{Sync: true}},
+			{Index: 2, Action: PartitionAction{Sync: true}},
 		}
 	}
 
@@ -148,39 +294,126 @@ func PlanWithSystem(sys System, opts PlanOptions) (PlanResult, error) {
 		}
 	}
 
-	// Apply high-level options to decide actions. This is still a simplified
-	// model, but it already reflects the intent of initialize vs. plain sync.
+	// Apply high-level options to decide actions: initialize vs. plain sync,
+	// and which data partition (never swap) grows to fill the destination.
 	if opts.Initialize {
-		mode := opts.PartitionStrategy
-		if mode == "" {
-			mode = "clone-table"
-		}
-		action := "initialize+sync"
-		if mode != "" {
-			action = fmt.Sprintf("%s[%s]", action, mode)
-		}
+		lastIdx := -1
 		for i := range planParts {
-			planParts[i].Action = action
-		}
-		if opts.ForceTwoPartitions {
-			for i := range planParts {
-				if planParts[i].Index > 2 {
-					planParts[i].Action = "sync"
-				}
+			if opts.ForceTwoPartitions && planParts[i].Index > 2 {
+				continue
+			}
+			planParts[i].Action.Initialize = true
+			planParts[i].Action.Strategy = opts.PartitionStrategy.orDefault()
+			if planParts[i].FSType == "swap" {
+				continue
+			}
+			if lastIdx == -1 || planParts[i].Index > planParts[lastIdx].Index {
+				lastIdx = i
 			}
 		}
+		if opts.ExpandLastPartition && lastIdx != -1 {
+			planParts[lastIdx].Action.Resize = true
+		}
 	}
 
-	return PlanResult{
+	// Swap has no files to copy: it is recreated when initializing and
+	// otherwise left alone.
+	for i := range planParts {
+		if planParts[i].FSType == "swap" {
+			planParts[i].Action.Sync = false
+			planParts[i].Action.Skip = !planParts[i].Action.Initialize
+		}
+	}
+
+	result := PlanResult{
 		SourceDisk:      srcDisk,
 		DestinationDisk: opts.Destination,
 		Partitions:      planParts,
-	}, nil
+	}
+	if is, ok := sys.(imageSource); ok {
+		result.SourceImage = is.sourceImage()
+	}
+	image := IsImageDestination(opts.Destination)
+	if ds, ok := sys.(diskSizer); ok {
+		result.SourceSizeBytes, _ = ds.DiskSize(srcDisk)
+		if !image {
+			result.DestinationSizeBytes, _ = ds.DiskSize(ensureDevPrefix(opts.Destination))
+		}
+	}
+	if di, ok := sys.(diskIdentifier); ok {
+		if id, err := di.DiskIdentity(opts.Destination); err == nil {
+			result.DestinationSerial, result.DestinationTableID = id.Serial, id.TableID
+		}
+	}
+	if image {
+		size, err := imageDestinationSize(sys, srcDisk, result, opts)
+		if err != nil {
+			return PlanResult{}, err
+		}
+		result.DestinationSizeBytes = size
+	}
+
+	if opts.Initialize && opts.PartitionStrategy == StrategyShrinkTable {
+		sources := sourcePartitionGeometry(sys, srcDisk, result.Partitions)
+		layout, err := shrinkLayout(sources, result.DestinationSizeBytes, opts.shrinkMarginPercent())
+		if err != nil {
+			return PlanResult{}, fmt.Errorf("cannot compute shrunken layout for %s: %w", opts.Destination, err)
+		}
+		result.DestinationLayout = layout
+	}
+	if opts.Initialize && opts.PartitionStrategy == StrategyLayoutFile {
+		parts, layout, err := planLayoutFile(sys, result.Partitions, result.DestinationSizeBytes, opts)
+		if err != nil {
+			return PlanResult{}, fmt.Errorf("layout file cannot be used for %s: %w", opts.Destination, err)
+		}
+		result.Partitions = parts
+		result.DestinationLayout = layout
+	}
+
+	planBlockCopies(sys, &result, opts)
+	planSnapshots(sys, &result, opts)
+	planQuiesce(&result, opts)
+	if err := checkSyncDestination(sys, &result, opts); err != nil {
+		return PlanResult{}, err
+	}
+
+	// Capacity preflight: refuse plans where a sync is guaranteed to run out
+	// of space, unless forced.
+	if problems := analyzeCapacity(sys, &result, opts); len(problems) > 0 {
+		if !opts.ForceSync {
+			return PlanResult{}, fmt.Errorf("destination %s is too small for the planned clone:\n  - %s\nUse a larger disk, exclude data, or rerun with -F to force (the sync will likely fail)", opts.Destination, strings.Join(problems, "\n  - "))
+		}
+		result.Warnings = append(result.Warnings, problems...)
+	}
+
+	return result, nil
+}
+
+// appendUnlisted appends the partitions of more whose device is not in
+// parts yet.
+func appendUnlisted(parts, more []MountedPartition) []MountedPartition {
+	seen := make(map[string]bool, len(parts))
+	for _, p := range parts {
+		seen[p.Device] = true
+	}
+	for _, p := range more {
+		if !seen[p.Device] {
+			seen[p.Device] = true
+			parts = append(parts, p)
+		}
+	}
+	return parts
 }
 
 // String renders a human-readable description of the plan.
 func (p PlanResult) String() string {
 	out := fmt.Sprintf("Clone plan: %s -> %s\n", p.SourceDisk, p.DestinationDisk)
+	if IsImageDestination(p.DestinationDisk) {
+		out = fmt.Sprintf("Clone plan: %s -> %s (image file, %s sparse)\n", p.SourceDisk, p.DestinationDisk, formatBytes(p.DestinationSizeBytes))
+		if f := ImageFormatOf(p.DestinationDisk); f.Compressed() {
+			out = fmt.Sprintf("Clone plan: %s -> %s (%s-compressed image of a %s sparse clone)\n", p.SourceDisk, p.DestinationDisk, f.Tool(), formatBytes(p.DestinationSizeBytes))
+		}
+	}
 	for _, part := range p.Partitions {
 		label := fmt.Sprintf("partition %d", part.Index)
 		if part.Device != "" {
@@ -188,44 +421,108 @@ func (p PlanResult) String() string {
 			if part.Mountpoint != "" {
 				label = fmt.Sprintf("%s mounted on %s", label, part.Mountpoint)
 			}
+			if part.Mapper != "" {
+				label = fmt.Sprintf("%s from LVM volume %s, cloned as a plain partition", label, part.Mapper)
+			}
 			label += ")"
 		}
+		if part.Device == "" && part.Mountpoint != "" {
+			label = fmt.Sprintf("%s (mounted on %s)", label, part.Mountpoint)
+		}
+		if part.SourcePath != "" {
+			label += " from " + part.SourcePath
+		}
 		if part.Mountpoint == "" {
 			label += " (unmounted source)"
 		}
 		out += fmt.Sprintf("  - %s: %s\n", label, part.Action)
+		if details := part.PartitionDetails.String(); details != "" {
+			out += fmt.Sprintf("      %s\n", details)
+		}
+		if part.Capacity != nil {
+			out += fmt.Sprintf("      capacity: %s\n", part.Capacity)
+		}
+		if d := part.Destination; d != nil {
+			out += fmt.Sprintf("      will update %s (%s)\n", d.Device, d.PartitionDetails)
+		}
+		if part.CopyNote != "" {
+			out += fmt.Sprintf("      rsync instead of block copy: %s\n", part.CopyNote)
+		}
+		if part.Snapshot != nil {
+			out += fmt.Sprintf("      source: %s\n", part.Snapshot)
+		}
+		if part.SnapshotNote != "" {
+			out += fmt.Sprintf("      live sync without snapshot: %s\n", part.SnapshotNote)
+		}
+	}
+	if p.DestinationLayout != nil {
+		out += p.DestinationLayout.String()
+	}
+	if len(p.Quiesce) > 0 {
+		out += "Services quiesced while syncing:\n"
+		for _, u := range p.Quiesce {
+			switch {
+			case u.Touched:
+				out += fmt.Sprintf("  - %s: %s (done)\n", u.Unit, u.Mode)
+			case u.Active:
+				out += fmt.Sprintf("  - %s: %s\n", u.Unit, u.Mode)
+			default:
+				out += fmt.Sprintf("  - %s: not running, left alone\n", u.Unit)
+			}
+		}
+	}
+	if len(p.SecondPass) > 0 {
+		out += fmt.Sprintf("Second pass: %s\n", SecondPassSummary(p.SecondPass))
+	}
+	for _, w := range p.Warnings {
+		out += fmt.Sprintf("WARNING: %s\n", w)
 	}
 	return out
 }
 
-// partitionIndexFromDevice extracts the numeric partition index from a device
-// path such as "/dev/mmcblk0p2" or "/dev/sda1". It returns 0 if it cannot
-// determine a partition number.
-func partitionIndexFromDevice(dev string) int {
-	name := strings.TrimPrefix(dev, "/dev/")
-	if name == "" {
-		return 0
+// String renders the known partition details on a single line, e.g.
+// "ext4, 29.5 GiB at 512.0 MiB, 3.1 GiB used, label=rootfs, partuuid=...".
+// It returns an empty string when nothing is known.
+func (d PartitionDetails) String() string {
+	var fields []string
+	if d.FSType != "" {
+		fields = append(fields, d.FSType)
 	}
-
-	// mmcblk0p2, nvme0n1p3 style: use the suffix after the last 'p'.
-	if idx := strings.LastIndex(name, "p"); idx != -1 && idx < len(name)-1 {
-		if n, err := strconv.Atoi(name[idx+1:]); err == nil {
-			return n
+	if d.SizeBytes > 0 {
+		geom := formatBytes(d.SizeBytes)
+		if d.StartBytes > 0 {
+			geom += " at " + formatBytes(d.StartBytes)
 		}
+		fields = append(fields, geom)
 	}
-
-	// sda1, sdb2 style: take trailing digits.
-	end := len(name) - 1
-	start := end
-	for start >= 0 && name[start] >= '0' && name[start] <= '9' {
-		start--
+	if d.UsedBytes > 0 {
+		fields = append(fields, formatBytes(d.UsedBytes)+" used")
+	}
+	if d.Label != "" {
+		fields = append(fields, "label="+d.Label)
 	}
-	if start == end {
-		return 0
+	if d.FSUUID != "" {
+		fields = append(fields, "uuid="+d.FSUUID)
+	}
+	if d.PartUUID != "" {
+		fields = append(fields, "partuuid="+d.PartUUID)
+	}
+	if d.PartType != "" {
+		fields = append(fields, "type="+d.PartType)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// formatBytes renders a byte count using binary units (KiB, MiB, GiB, ...).
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
-	part := name[start+1:]
-	if n, err := strconv.Atoi(part); err == nil {
-		return n
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
 	}
-	return 0
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
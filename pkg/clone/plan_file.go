@@ -0,0 +1,236 @@
+package clone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// PlanFileVersion is the version of the serialized plan document written by
+// WritePlanFile. ReadPlanFile refuses documents with a different version.
+const PlanFileVersion = 1
+
+// PlanFile is the versioned JSON document used to review a plan (for example
+// in a change ticket) and apply exactly that plan later with `klon apply`.
+type PlanFile struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Options   PlanOptions     `json:"options"`
+	Plan      PlanResult      `json:"plan"`
+	Steps     []ExecutionStep `json:"steps"`
+}
+
+// NewPlanFile bundles a plan, the options used to compute it and the derived
+// execution steps into a PlanFile ready to be written.
+func NewPlanFile(plan PlanResult, opts PlanOptions) PlanFile {
+	return PlanFile{
+		Version:   PlanFileVersion,
+		CreatedAt: time.Now().UTC(),
+		Options:   opts,
+		Plan:      plan,
+		Steps:     BuildExecutionSteps(plan, opts),
+	}
+}
+
+// WritePlanFile writes pf as indented JSON to path, replacing any existing
+// file.
+func WritePlanFile(path string, pf PlanFile) error {
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode plan: %w", err)
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("cannot write plan file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadPlanFile loads a plan previously written by WritePlanFile.
+func ReadPlanFile(path string) (PlanFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PlanFile{}, fmt.Errorf("cannot read plan file %s: %w", path, err)
+	}
+	var pf PlanFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return PlanFile{}, fmt.Errorf("cannot parse plan file %s: %w", path, err)
+	}
+	if pf.Version != PlanFileVersion {
+		return PlanFile{}, fmt.Errorf("plan file %s has version %d; this Klon understands version %d", path, pf.Version, PlanFileVersion)
+	}
+	if pf.Options.Destination == "" {
+		return PlanFile{}, fmt.Errorf("plan file %s has no destination disk", path)
+	}
+	return pf, nil
+}
+
+// CheckPlanFile re-inspects the system and returns an error if the source
+// disk, destination disk or partition set no longer match what was recorded
+// in pf, or if the steps in pf are not those of its plan. It returns the plan
+// file to apply: pf, the plan that was reviewed, with the devices of a source
+// image moved to the loop device the image is attached to now.
+func CheckPlanFile(sys System, pf PlanFile) (PlanFile, error) {
+	current, err := PlanWithSystem(sys, pf.Options)
+	if err != nil {
+		return PlanFile{}, err
+	}
+	if err := CheckPlanDrift(pf, current); err != nil {
+		return PlanFile{}, err
+	}
+	if current.SourceImage != "" {
+		pf = pf.withSourceDisk(current.SourceDisk)
+	}
+	return pf, nil
+}
+
+// CheckPlanDrift compares a recorded plan file against a plan computed now.
+// A source image is identified by its path and size, not by the loop device
+// it happens to be attached to.
+func CheckPlanDrift(pf PlanFile, current PlanResult) error {
+	if !reflect.DeepEqual(pf.Steps, BuildExecutionSteps(pf.Plan, pf.Options)) {
+		return fmt.Errorf("execution steps in plan file do not match its plan; recreate the plan")
+	}
+	if pf.Plan.SourceImage != "" || current.SourceImage != "" {
+		if pf.Plan.SourceImage != current.SourceImage {
+			return fmt.Errorf("source image changed: plan was made for %s, source is now %s", sourceOrNone(pf.Plan.SourceImage, pf.Plan.SourceDisk), sourceOrNone(current.SourceImage, current.SourceDisk))
+		}
+		pf = pf.withSourceDisk(current.SourceDisk)
+	}
+	recorded := pf.Plan
+	if recorded.SourceDisk != current.SourceDisk {
+		return fmt.Errorf("source disk changed: plan was made for %s, system now boots from %s", recorded.SourceDisk, current.SourceDisk)
+	}
+	if recorded.DestinationDisk != current.DestinationDisk {
+		return fmt.Errorf("destination disk changed: plan targets %s, options now resolve to %s", recorded.DestinationDisk, current.DestinationDisk)
+	}
+	if sizeDrifted(recorded.SourceSizeBytes, current.SourceSizeBytes) {
+		return fmt.Errorf("source disk %s changed size: %d bytes in plan, %d bytes now", current.SourceDisk, recorded.SourceSizeBytes, current.SourceSizeBytes)
+	}
+	// A destination of unknown size cannot be told apart from another disk.
+	if recorded.DestinationSizeBytes <= 0 || current.DestinationSizeBytes <= 0 {
+		return fmt.Errorf("cannot tell whether destination disk %s is the disk the plan was made for: its size is unknown", current.DestinationDisk)
+	}
+	if recorded.DestinationSizeBytes != current.DestinationSizeBytes {
+		return fmt.Errorf("destination disk %s changed size: %d bytes in plan, %d bytes now. Is it the same disk?", current.DestinationDisk, recorded.DestinationSizeBytes, current.DestinationSizeBytes)
+	}
+	if recorded.DestinationSerial != current.DestinationSerial {
+		return fmt.Errorf("destination disk %s has serial number %q but the plan was made for %q. Is it the same disk?", current.DestinationDisk, current.DestinationSerial, recorded.DestinationSerial)
+	}
+	if recorded.DestinationTableID != current.DestinationTableID {
+		return fmt.Errorf("the partition table of destination disk %s changed since the plan was made (%s, was %s)", current.DestinationDisk, tableIDOrNone(current.DestinationTableID), tableIDOrNone(recorded.DestinationTableID))
+	}
+	if len(recorded.Partitions) != len(current.Partitions) {
+		return fmt.Errorf("partition set changed: plan has %d partitions, system now has %d", len(recorded.Partitions), len(current.Partitions))
+	}
+	for i, want := range recorded.Partitions {
+		got := current.Partitions[i]
+		// Used bytes (and the capacity derived from them) change all the time
+		// on a live system; everything else identifies the partition.
+		want.UsedBytes, got.UsedBytes = 0, 0
+		want.Capacity, got.Capacity = nil, nil
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("partition %d changed: plan has %+v, system now has %+v", want.Index, want, got)
+		}
+	}
+	recordedSteps, currentSteps := pf.Steps, BuildExecutionSteps(current, pf.Options)
+	if pf.Options.PartitionStrategy == StrategyShrinkTable {
+		// The shrunken layout is sized from the used bytes at plan time.
+		// It is applied as recorded as long as the data still fits.
+		if err := checkRecordedLayout(pf, current); err != nil {
+			return err
+		}
+		recordedSteps, currentSteps = withoutLayout(recordedSteps), withoutLayout(currentSteps)
+	}
+	if !reflect.DeepEqual(recordedSteps, currentSteps) {
+		return fmt.Errorf("execution steps in plan file do not match the steps this Klon would run; recreate the plan")
+	}
+	return nil
+}
+
+// withSourceDisk returns pf with the source disk and its partitions renamed
+// to disk, e.g. /dev/loop4p2 to /dev/loop7p2, and its steps rebuilt.
+func (pf PlanFile) withSourceDisk(disk string) PlanFile {
+	old := pf.Plan.SourceDisk
+	if old == disk {
+		return pf
+	}
+	rename := func(dev string) string {
+		if dev == old {
+			return disk
+		}
+		if n, ok := strings.CutPrefix(dev, old+"p"); ok && n != "" && strings.Trim(n, "0123456789") == "" {
+			return disk + "p" + n
+		}
+		return dev
+	}
+	pf.Plan.SourceDisk = disk
+	pf.Plan.Partitions = append([]PartitionPlan{}, pf.Plan.Partitions...)
+	for i := range pf.Plan.Partitions {
+		pf.Plan.Partitions[i].Device = rename(pf.Plan.Partitions[i].Device)
+	}
+	pf.Steps = BuildExecutionSteps(pf.Plan, pf.Options)
+	return pf
+}
+
+// checkRecordedLayout makes sure the destination layout recorded in pf still
+// fits on the destination and still holds the data of every synced
+// partition.
+func checkRecordedLayout(pf PlanFile, current PlanResult) error {
+	var layout *DiskLayout
+	for _, step := range pf.Steps {
+		if step.Operation == OpPrepareDisk {
+			layout = step.Layout
+		}
+	}
+	if layout == nil {
+		return nil
+	}
+	for _, lp := range layout.Partitions {
+		if end := lp.StartBytes + lp.SizeBytes; current.DestinationSizeBytes > 0 && end > current.DestinationSizeBytes {
+			return fmt.Errorf("partition %d of the planned layout ends at %s but %s only has %s; recreate the plan",
+				lp.Index, formatBytes(end), current.DestinationDisk, formatBytes(current.DestinationSizeBytes))
+		}
+	}
+	for _, part := range current.Partitions {
+		if !part.Action.Sync {
+			continue
+		}
+		lp, ok := layout.Partition(part.Index)
+		if ok && part.UsedBytes > lp.SizeBytes {
+			return fmt.Errorf("partition %d now uses %s but the planned layout only gives it %s; recreate the plan",
+				part.Index, formatBytes(part.UsedBytes), formatBytes(lp.SizeBytes))
+		}
+	}
+	return nil
+}
+
+// withoutLayout returns a copy of steps without their destination layouts.
+func withoutLayout(steps []ExecutionStep) []ExecutionStep {
+	out := append([]ExecutionStep{}, steps...)
+	for i := range out {
+		out[i].Layout = nil
+	}
+	return out
+}
+
+func sizeDrifted(recorded, current int64) bool {
+	return recorded > 0 && current > 0 && recorded != current
+}
+
+func sourceOrNone(image, disk string) string {
+	if image == "" {
+		return "disk " + disk
+	}
+	return image
+}
+
+func tableIDOrNone(id string) string {
+	if id == "" {
+		return "no partition table"
+	}
+	return id
+}
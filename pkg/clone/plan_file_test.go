@@ -0,0 +1,236 @@
+package clone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type sizedFakeSystem struct {
+	fakeSystem
+	sizes map[string]int64
+}
+
+func (f sizedFakeSystem) DiskSize(disk string) (int64, error) {
+	return f.sizes[disk], nil
+}
+
+func TestPlanFile_RoundTrip(t *testing.T) {
+	sys := sizedFakeSystem{
+		fakeSystem: fakeSystem{
+			bootDisk: "/dev/mmcblk0p2",
+			mountedParts: []MountedPartition{
+				{Device: "/dev/mmcblk0p1", Mountpoint: "/boot"},
+				{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+			},
+		},
+		sizes: map[string]int64{"/dev/mmcblk0": 32 << 30, "/dev/sda": 64 << 30},
+	}
+	opts := PlanOptions{Destination: "sda", Initialize: true, ExcludePatterns: []string{"/srv/cache"}}
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.DestinationSizeBytes != 64<<30 {
+		t.Fatalf("expected destination size to be recorded, got %d", plan.DestinationSizeBytes)
+	}
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := WritePlanFile(path, NewPlanFile(plan, opts)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pf, err := ReadPlanFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if pf.Version != PlanFileVersion || pf.Options.Destination != "sda" || len(pf.Steps) == 0 {
+		t.Fatalf("unexpected plan file contents: %+v", pf)
+	}
+
+	if _, err := CheckPlanFile(sys, pf); err != nil {
+		t.Fatalf("expected unchanged system to pass drift check, got %v", err)
+	}
+}
+
+func TestCheckPlanFile_DetectsDrift(t *testing.T) {
+	base := fakeSystem{
+		bootDisk: "/dev/mmcblk0p2",
+		mountedParts: []MountedPartition{
+			{Device: "/dev/mmcblk0p1", Mountpoint: "/boot"},
+			{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+		},
+	}
+	sizes := map[string]int64{"/dev/mmcblk0": 32 << 30, "/dev/sda": 64 << 30}
+	opts := PlanOptions{Destination: "sda"}
+	plan, err := PlanWithSystem(sizedFakeSystem{fakeSystem: base, sizes: sizes}, opts)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	pf := NewPlanFile(plan, opts)
+
+	movedBoot := base
+	movedBoot.bootDisk = "/dev/sdb2"
+	if _, err := CheckPlanFile(movedBoot, pf); err == nil || !strings.Contains(err.Error(), "source disk changed") {
+		t.Fatalf("expected source drift error, got %v", err)
+	}
+
+	fewerParts := sizedFakeSystem{fakeSystem: base, sizes: sizes}
+	fewerParts.mountedParts = base.mountedParts[1:]
+	if _, err := CheckPlanFile(fewerParts, pf); err == nil || !strings.Contains(err.Error(), "partition set changed") {
+		t.Fatalf("expected partition drift error, got %v", err)
+	}
+
+	otherDisk := sizedFakeSystem{fakeSystem: base, sizes: map[string]int64{"/dev/mmcblk0": 32 << 30, "/dev/sda": 16 << 30}}
+	if _, err := CheckPlanFile(otherDisk, pf); err == nil || !strings.Contains(err.Error(), "destination disk sda changed size") {
+		t.Fatalf("expected destination size drift error, got %v", err)
+	}
+
+	if _, err := CheckPlanFile(base, pf); err == nil || !strings.Contains(err.Error(), "its size is unknown") {
+		t.Fatalf("expected an unknown destination size to be refused, got %v", err)
+	}
+}
+
+// identifiedFakeSystem also reports the identity of the destination.
+type identifiedFakeSystem struct {
+	sizedFakeSystem
+	id DiskIdentity
+}
+
+func (f identifiedFakeSystem) DiskIdentity(dest string) (DiskIdentity, error) {
+	return f.id, nil
+}
+
+func TestCheckPlanFile_DetectsOtherDestination(t *testing.T) {
+	sys := identifiedFakeSystem{
+		sizedFakeSystem: sizedFakeSystem{
+			fakeSystem: fakeSystem{
+				bootDisk:     "/dev/mmcblk0p2",
+				mountedParts: []MountedPartition{{Device: "/dev/mmcblk0p2", Mountpoint: "/"}},
+			},
+			sizes: map[string]int64{"/dev/mmcblk0": 32 << 30, "/dev/sda": 64 << 30},
+		},
+		id: DiskIdentity{Serial: "WD-1234", TableID: "dos:1a2b3c4d"},
+	}
+	opts := PlanOptions{Destination: "sda"}
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.DestinationSerial != "WD-1234" || plan.DestinationTableID != "dos:1a2b3c4d" {
+		t.Fatalf("expected the destination identity to be recorded, got %+v", plan)
+	}
+	pf := NewPlanFile(plan, opts)
+
+	other := sys
+	other.id.Serial = "WD-5678"
+	if _, err := CheckPlanFile(other, pf); err == nil || !strings.Contains(err.Error(), "serial number") {
+		t.Fatalf("expected another disk of the same size to be refused, got %v", err)
+	}
+
+	wiped := sys
+	wiped.id.TableID = ""
+	if _, err := CheckPlanFile(wiped, pf); err == nil || !strings.Contains(err.Error(), "no partition table, was dos:1a2b3c4d") {
+		t.Fatalf("expected a new partition table to be refused, got %v", err)
+	}
+}
+
+// imageFakeSystem plans from an image file attached to a loop device.
+type imageFakeSystem struct {
+	sizedFakeSystem
+	image string
+}
+
+func (f imageFakeSystem) sourceImage() string {
+	return f.image
+}
+
+func imageSourceSystem(loop, image string) imageFakeSystem {
+	return imageFakeSystem{
+		sizedFakeSystem: sizedFakeSystem{
+			fakeSystem: fakeSystem{
+				bootDisk: loop + "p2",
+				mountedParts: []MountedPartition{
+					{Device: loop + "p1", Mountpoint: "/boot"},
+					{Device: loop + "p2", Mountpoint: "/"},
+				},
+			},
+			sizes: map[string]int64{loop: 4 << 30, "/dev/sda": 64 << 30},
+		},
+		image: image,
+	}
+}
+
+func TestCheckPlanFile_SourceImageOnAnotherLoopDevice(t *testing.T) {
+	opts := PlanOptions{Destination: "sda", Initialize: true, Source: "pi.img"}
+	plan, err := PlanWithSystem(imageSourceSystem("/dev/loop4", "/srv/pi.img"), opts)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.SourceImage != "/srv/pi.img" {
+		t.Fatalf("expected the source image to be recorded, got %+v", plan)
+	}
+	pf := NewPlanFile(plan, opts)
+
+	// Attached again, the image gets another loop device; the plan to apply
+	// reads from that one.
+	got, err := CheckPlanFile(imageSourceSystem("/dev/loop7", "/srv/pi.img"), pf)
+	if err != nil {
+		t.Fatalf("expected the same image on another loop device to pass, got %v", err)
+	}
+	if got.Plan.SourceDisk != "/dev/loop7" || got.Plan.Partitions[1].Device != "/dev/loop7p2" {
+		t.Fatalf("expected the plan to move to /dev/loop7, got %+v", got.Plan)
+	}
+	for _, step := range got.Steps {
+		if strings.Contains(step.SourceDevice, "loop4") || strings.Contains(step.Description, "loop4") {
+			t.Fatalf("expected the steps to move to /dev/loop7, got %+v", step)
+		}
+	}
+	if pf.Plan.Partitions[1].Device != "/dev/loop4p2" {
+		t.Fatalf("expected the recorded plan to be left alone, got %+v", pf.Plan)
+	}
+
+	if _, err := CheckPlanFile(imageSourceSystem("/dev/loop4", "/home/pi.img"), pf); err == nil || !strings.Contains(err.Error(), "source image changed") {
+		t.Fatalf("expected another image to be refused, got %v", err)
+	}
+	if _, err := CheckPlanFile(imageSourceSystem("/dev/loop4", ""), pf); err == nil || !strings.Contains(err.Error(), "now disk /dev/loop4") {
+		t.Fatalf("expected a disk source to be refused, got %v", err)
+	}
+}
+
+func TestCheckPlanFile_ShrinkTableKeepsRecordedLayout(t *testing.T) {
+	sys := newCapacityFakeSystem(32 << 30)
+	opts := PlanOptions{Destination: "sda", Initialize: true, PartitionStrategy: StrategyShrinkTable}
+	plan, err := PlanWithSystem(sys, opts)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	pf := NewPlanFile(plan, opts)
+
+	// A layout sized from other used bytes is still applied as recorded.
+	pf.Steps[0].Layout.Partitions[1].SizeBytes = 20 << 30
+	if _, err := CheckPlanFile(sys, pf); err != nil {
+		t.Fatalf("expected the recorded layout to be accepted, got %v", err)
+	}
+
+	// Root uses 10 GiB, which no longer fits in the recorded partition.
+	pf.Steps[0].Layout.Partitions[1].SizeBytes = 8 << 30
+	if _, err := CheckPlanFile(sys, pf); err == nil || !strings.Contains(err.Error(), "partition 2 now uses") {
+		t.Fatalf("expected the used bytes to be refused, got %v", err)
+	}
+
+	pf.Steps[0].Layout.Partitions[1].SizeBytes = 40 << 30
+	if _, err := CheckPlanFile(sys, pf); err == nil || !strings.Contains(err.Error(), "only has") {
+		t.Fatalf("expected a layout larger than the destination to be refused, got %v", err)
+	}
+}
+
+func TestReadPlanFile_RejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99, "options": {"destination": "sda"}}`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := ReadPlanFile(path); err == nil {
+		t.Fatalf("expected error for unknown plan file version")
+	}
+}
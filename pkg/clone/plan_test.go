@@ -106,7 +106,7 @@ func TestPlanResult_StringIncludesDeviceAndMountpoint(t *testing.T) {
 				Index:      1,
 				Device:     "/dev/mmcblk0p1",
 				Mountpoint: "/boot",
-				Action:     "initialize+sync",
+				Action:     PartitionAction{Initialize: true, Sync: true},
 			},
 		},
 	}
@@ -142,8 +142,8 @@ func TestPlanWithSystem_InitializeMarksActions(t *testing.T) {
 	}
 
 	for _, part := range plan.Partitions {
-		if !strings.Contains(part.Action, "initialize+sync") {
-			t.Fatalf("expected action to contain 'initialize+sync', got %q for %+v", part.Action, part)
+		if part.Action.Kind() != ActionInitializeSync || part.Action.Strategy != StrategyCloneTable {
+			t.Fatalf("expected initialize+sync with clone-table, got %q for %+v", part.Action, part)
 		}
 	}
 }
@@ -172,12 +172,59 @@ func TestPlanWithSystem_ForceTwoPartitionsOnlyFirstTwoInitialized(t *testing.T)
 		t.Fatalf("expected 3 partitions, got %d", len(plan.Partitions))
 	}
 
-	if !strings.Contains(plan.Partitions[0].Action, "initialize+sync") ||
-		!strings.Contains(plan.Partitions[1].Action, "initialize+sync") {
+	if plan.Partitions[0].Action.Kind() != ActionInitializeSync ||
+		plan.Partitions[1].Action.Kind() != ActionInitializeSync {
 		t.Fatalf("expected first two partitions to contain 'initialize+sync', got %+v, %+v",
 			plan.Partitions[0], plan.Partitions[1])
 	}
-	if plan.Partitions[2].Action != "sync" {
+	if plan.Partitions[2].Action != (PartitionAction{Sync: true}) {
 		t.Fatalf("expected third partition to be 'sync', got %+v", plan.Partitions[2])
 	}
 }
+
+type detailedFakeSystem struct {
+	fakeSystem
+	details map[string]PartitionDetails
+}
+
+func (f detailedFakeSystem) PartitionDetails(device, mountpoint string) (PartitionDetails, error) {
+	return f.details[device], nil
+}
+
+func TestPlanWithSystem_RecordsPartitionDetails(t *testing.T) {
+	sys := detailedFakeSystem{
+		fakeSystem: fakeSystem{
+			bootDisk: "/dev/mmcblk0p2",
+			mountedParts: []MountedPartition{
+				{Device: "/dev/mmcblk0p1", Mountpoint: "/boot"},
+				{Device: "/dev/mmcblk0p2", Mountpoint: "/"},
+			},
+		},
+		details: map[string]PartitionDetails{
+			"/dev/mmcblk0p1": {FSType: "vfat", StartBytes: 4 << 20, SizeBytes: 512 << 20, UsedBytes: 60 << 20, Label: "bootfs", PartType: "0xc"},
+			"/dev/mmcblk0p2": {FSType: "ext4", StartBytes: 516 << 20, SizeBytes: 30 << 30, UsedBytes: 3 << 30, FSUUID: "1234-abcd", PartUUID: "deadbeef-02", Label: "rootfs", PartType: "0x83"},
+		},
+	}
+
+	plan, err := PlanWithSystem(sys, PlanOptions{Destination: "sda", Initialize: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.Partitions[1].FSType != "ext4" || plan.Partitions[1].PartUUID != "deadbeef-02" || plan.Partitions[1].UsedBytes != 3<<30 {
+		t.Fatalf("expected root details to be recorded, got %+v", plan.Partitions[1])
+	}
+
+	out := plan.String()
+	for _, want := range []string{"vfat, 512.0 MiB at 4.0 MiB, 60.0 MiB used, label=bootfs", "partuuid=deadbeef-02", "type=0x83"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected plan output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	steps := BuildExecutionSteps(plan, PlanOptions{Destination: "sda", Initialize: true})
+	for _, s := range steps {
+		if s.Operation == "initialize-partition" && s.PartitionIndex == 1 && s.FSType != "vfat" {
+			t.Fatalf("expected initialize step to carry the planned filesystem, got %+v", s)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package clone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FilesystemInfo is what a superblock probe found on a device. Type is empty
+// when no known signature was found.
+type FilesystemInfo struct {
+	Type  string
+	UUID  string
+	Label string
+}
+
+const (
+	extSuperblockOffset   = 1024
+	extMagic              = 0xef53
+	extCompatHasJournal   = 0x4
+	btrfsSuperblockOffset = 64 * 1024
+	// probeSize covers every superblock location probeFilesystem looks at,
+	// including swap signatures for pages up to 64KiB.
+	probeSize = 128 * 1024
+)
+
+// ext feature bits that ext2 and ext3 understand; anything else means the
+// filesystem needs an ext4 driver (the same rule blkid applies).
+const (
+	extIncompatExt3   = 0x2 | 0x4 | 0x10 // filetype, recover, meta_bg
+	extROCompatExt3   = 0x1 | 0x2 | 0x4  // sparse_super, large_file, btree_dir
+	extIncompatOffset = 96
+	extROCompatOffset = 100
+)
+
+// probeFilesystem identifies the filesystem on r by its superblock, the way
+// blkid does, for the filesystems Klon creates or commonly meets on a Linux
+// disk: ext2/3/4, vfat, swap, btrfs and xfs.
+func probeFilesystem(r io.ReaderAt) (FilesystemInfo, error) {
+	buf := make([]byte, probeSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return FilesystemInfo{}, err
+	}
+	buf = buf[:n]
+
+	for _, probe := range []func([]byte) (FilesystemInfo, bool){
+		probeExt, probeBtrfs, probeXFS, probeSwap, probeFAT,
+	} {
+		if info, ok := probe(buf); ok {
+			return info, nil
+		}
+	}
+	return FilesystemInfo{}, nil
+}
+
+func probeExt(b []byte) (FilesystemInfo, bool) {
+	if len(b) < extSuperblockOffset+1024 {
+		return FilesystemInfo{}, false
+	}
+	sb := b[extSuperblockOffset:]
+	if binary.LittleEndian.Uint16(sb[56:58]) != extMagic {
+		return FilesystemInfo{}, false
+	}
+	compat := binary.LittleEndian.Uint32(sb[92:96])
+	incompat := binary.LittleEndian.Uint32(sb[extIncompatOffset : extIncompatOffset+4])
+	roCompat := binary.LittleEndian.Uint32(sb[extROCompatOffset : extROCompatOffset+4])
+
+	info := FilesystemInfo{
+		Type:  "ext2",
+		UUID:  formatUUID(sb[104:120]),
+		Label: cString(sb[120:136]),
+	}
+	switch {
+	case incompat&^extIncompatExt3 != 0 || roCompat&^extROCompatExt3 != 0:
+		info.Type = "ext4"
+	case compat&extCompatHasJournal != 0:
+		info.Type = "ext3"
+	}
+	return info, true
+}
+
+func probeBtrfs(b []byte) (FilesystemInfo, bool) {
+	if len(b) < btrfsSuperblockOffset+0x22b {
+		return FilesystemInfo{}, false
+	}
+	sb := b[btrfsSuperblockOffset:]
+	if string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return FilesystemInfo{}, false
+	}
+	return FilesystemInfo{
+		Type:  "btrfs",
+		UUID:  formatUUID(sb[0x20:0x30]),
+		Label: cString(sb[0x12b:0x22b]),
+	}, true
+}
+
+func probeXFS(b []byte) (FilesystemInfo, bool) {
+	if len(b) < 120 || string(b[0:4]) != "XFSB" {
+		return FilesystemInfo{}, false
+	}
+	return FilesystemInfo{
+		Type:  "xfs",
+		UUID:  formatUUID(b[32:48]),
+		Label: cString(b[108:120]),
+	}, true
+}
+
+// probeSwap looks for the signature at the end of the first page; the page
+// size of the system that ran mkswap is not known, so common ones are tried.
+func probeSwap(b []byte) (FilesystemInfo, bool) {
+	for _, page := range []int{4096, 8192, 16384, 65536} {
+		if len(b) < page {
+			break
+		}
+		sig := string(b[page-10 : page])
+		if sig != "SWAPSPACE2" && sig != "SWAP-SPACE" {
+			continue
+		}
+		info := FilesystemInfo{Type: "swap"}
+		if sig == "SWAPSPACE2" {
+			// struct swap_header_v1_2: version, last_page, nr_badpages,
+			// uuid and volume name follow the 1KiB boot block.
+			info.UUID = formatUUID(b[1036:1052])
+			info.Label = cString(b[1052:1068])
+		}
+		return info, true
+	}
+	return FilesystemInfo{}, false
+}
+
+func probeFAT(b []byte) (FilesystemInfo, bool) {
+	if len(b) < 512 || b[510] != 0x55 || b[511] != 0xaa {
+		return FilesystemInfo{}, false
+	}
+	var id []byte
+	var label string
+	switch {
+	case string(b[82:87]) == "FAT32":
+		id, label = b[67:71], string(b[71:82])
+	case string(b[54:59]) == "FAT12" || string(b[54:59]) == "FAT16":
+		id, label = b[39:43], string(b[43:54])
+	default:
+		return FilesystemInfo{}, false
+	}
+	info := FilesystemInfo{Type: "vfat"}
+	serial := binary.LittleEndian.Uint32(id)
+	if serial != 0 {
+		info.UUID = fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+	}
+	if label = strings.TrimRight(label, " \x00"); label != "NO NAME" {
+		info.Label = label
+	}
+	return info, true
+}
+
+// formatUUID formats 16 bytes as a lowercase RFC 4122 UUID string. An all-zero
+// UUID is reported as empty.
+func formatUUID(b []byte) string {
+	if bytes.Count(b, []byte{0}) == len(b) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,80 @@
+package clone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestProbeFilesystem(t *testing.T) {
+	uuid := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	const uuidString = "12345678-9abc-def0-0123-456789abcdef"
+
+	image := func(parts map[int][]byte) []byte {
+		b := make([]byte, probeSize)
+		for off, data := range parts {
+			copy(b[off:], data)
+		}
+		return b
+	}
+	ext := func(compat, incompat, roCompat uint32) []byte {
+		sb := extSuperblock(compat, incompat, roCompat)
+		copy(sb[104:], uuid)
+		copy(sb[120:], "rootfs")
+		return image(map[int][]byte{extSuperblockOffset: sb})
+	}
+
+	fat32 := make([]byte, 512)
+	copy(fat32[82:], "FAT32   ")
+	binary.LittleEndian.PutUint32(fat32[67:], 0xa1b2c3d4)
+	copy(fat32[71:], "BOOT       ")
+	fat32[510], fat32[511] = 0x55, 0xaa
+
+	fat16 := make([]byte, 512)
+	copy(fat16[54:], "FAT16   ")
+	binary.LittleEndian.PutUint32(fat16[39:], 0x0000beef)
+	copy(fat16[43:], "NO NAME    ")
+	fat16[510], fat16[511] = 0x55, 0xaa
+
+	swap := make([]byte, 4096)
+	copy(swap[1036:], uuid)
+	copy(swap[1052:], "swap0")
+	copy(swap[4086:], "SWAPSPACE2")
+
+	btrfs := make([]byte, 0x300)
+	copy(btrfs[0x20:], uuid)
+	copy(btrfs[0x40:], "_BHRfS_M")
+	copy(btrfs[0x12b:], "pool")
+
+	xfs := make([]byte, 512)
+	copy(xfs, "XFSB")
+	copy(xfs[32:], uuid)
+	copy(xfs[108:], "data")
+
+	cases := []struct {
+		name string
+		data []byte
+		want FilesystemInfo
+	}{
+		{"ext2", ext(0, 0x2, 0x3), FilesystemInfo{"ext2", uuidString, "rootfs"}},
+		{"ext3", ext(extCompatHasJournal, 0x2, 0x3), FilesystemInfo{"ext3", uuidString, "rootfs"}},
+		{"ext4", ext(extCompatHasJournal, 0x2c2, 0x46b), FilesystemInfo{"ext4", uuidString, "rootfs"}},
+		{"vfat32", image(map[int][]byte{0: fat32}), FilesystemInfo{"vfat", "A1B2-C3D4", "BOOT"}},
+		{"vfat16", image(map[int][]byte{0: fat16}), FilesystemInfo{"vfat", "0000-BEEF", ""}},
+		{"swap", image(map[int][]byte{0: swap}), FilesystemInfo{"swap", uuidString, "swap0"}},
+		{"btrfs", image(map[int][]byte{btrfsSuperblockOffset: btrfs}), FilesystemInfo{"btrfs", uuidString, "pool"}},
+		{"xfs", image(map[int][]byte{0: xfs}), FilesystemInfo{"xfs", uuidString, "data"}},
+		{"empty", image(nil), FilesystemInfo{}},
+		// Devices smaller than the probe window must still be probed.
+		{"short", fat32, FilesystemInfo{"vfat", "A1B2-C3D4", "BOOT"}},
+	}
+	for _, tc := range cases {
+		got, err := probeFilesystem(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressReport is a snapshot of the data copied so far, for the running
+// step and for the whole run. Totals are the used bytes recorded in the
+// plan, so they are estimates; they are zero when unknown.
+type ProgressReport struct {
+	Step      string
+	StepDone  int64
+	StepTotal int64
+	Done      int64
+	Total     int64
+	// Rate is the copy rate of the running step in bytes per second, and
+	// ETA the time left for the whole run at that rate.
+	Rate float64
+	ETA  time.Duration
+	// Final is set on the last report of a step.
+	Final bool
+}
+
+// Percent returns the progress of the whole run, from 0 to 100, or -1 when
+// the total is unknown.
+func (p ProgressReport) Percent() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	return int(min(100, p.Done*100/p.Total))
+}
+
+// String renders the report on one line, e.g. "sync partition 2: 1.2 GiB
+// of 3.1 GiB, 38% overall, 12.5 MiB/s, ETA 2m31s".
+func (p ProgressReport) String() string {
+	s := fmt.Sprintf("%s: %s", p.Step, formatBytes(p.StepDone))
+	if p.StepTotal > 0 {
+		s += " of " + formatBytes(p.StepTotal)
+	}
+	if pct := p.Percent(); pct >= 0 {
+		s += fmt.Sprintf(", %d%% overall", pct)
+	}
+	if p.Rate > 0 {
+		s += fmt.Sprintf(", %s/s", formatBytes(int64(p.Rate)))
+	}
+	if p.ETA > 0 {
+		s += ", ETA " + p.ETA.Round(time.Second).String()
+	}
+	return s
+}
+
+// ProgressTracker follows the bytes copied by the sync and copy-blocks
+// steps of a plan and reports them to a render function, if any, and as
+// progress events. A nil tracker tracks nothing.
+type ProgressTracker struct {
+	mu     sync.Mutex
+	render func(ProgressReport)
+	totals map[int]int64
+	total  int64
+	done   int64
+	now    func() time.Time
+}
+
+// NewProgressTracker returns a tracker whose totals are the used bytes of
+// the partitions plan syncs or copies.
+func NewProgressTracker(plan PlanResult, render func(ProgressReport)) *ProgressTracker {
+	t := &ProgressTracker{render: render, totals: map[int]int64{}, now: time.Now}
+	for _, p := range plan.Partitions {
+		if p.Action.Sync && !p.Action.Skip && p.UsedBytes > 0 {
+			t.totals[p.Index] = p.UsedBytes
+			t.total += p.UsedBytes
+		}
+	}
+	return t
+}
+
+// StepProgress tracks one step. Its copies (e.g. the parallel rsyncs of the
+// root filesystem) each report their own byte count.
+type StepProgress struct {
+	t      *ProgressTracker
+	ctx    context.Context
+	name   string
+	total  int64
+	start  time.Time
+	copies map[int]int64
+	// second passes only copy what changed and do not count towards the
+	// run's total.
+	counted bool
+}
+
+// StartStep starts tracking step; its progress events are sent to the
+// event handler of ctx.
+func (t *ProgressTracker) StartStep(ctx context.Context, step ExecutionStep) *StepProgress {
+	if t == nil {
+		return nil
+	}
+	name := fmt.Sprintf("%s partition %d", step.Operation, step.PartitionIndex)
+	if step.Pass > 1 {
+		name = "second pass: " + name
+	}
+	return &StepProgress{
+		t:       t,
+		ctx:     ctx,
+		name:    name,
+		total:   t.totals[step.PartitionIndex],
+		start:   t.now(),
+		copies:  map[int]int64{},
+		counted: step.Pass < 2,
+	}
+}
+
+// Update records that copy has transferred n bytes so far.
+func (s *StepProgress) Update(copy int, n int64) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.copies[copy] = n
+	report := s.report(false)
+	s.t.mu.Unlock()
+	s.t.send(s.ctx, report)
+}
+
+// Finish ends the step, renders its last report and logs a summary.
+func (s *StepProgress) Finish() {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	report := s.report(true)
+	if s.counted {
+		s.t.done += report.StepDone
+	}
+	s.t.mu.Unlock()
+	s.t.send(s.ctx, report)
+	elapsed := s.t.now().Sub(s.start).Round(time.Second)
+	logSink.Printf("klon: PROGRESS: %s: copied %s in %s (%s/s)", s.name, formatBytes(report.StepDone), elapsed, formatBytes(int64(report.Rate)))
+}
+
+// send hands a report to the render function and sends it as an event.
+func (t *ProgressTracker) send(ctx context.Context, report ProgressReport) {
+	if t.render != nil {
+		t.render(report)
+	}
+	emit(ctx, Event{Kind: EventProgress, Progress: &report})
+}
+
+// report builds a report; the caller holds the tracker's lock.
+func (s *StepProgress) report(final bool) ProgressReport {
+	var done int64
+	for _, n := range s.copies {
+		done += n
+	}
+	r := ProgressReport{Step: s.name, StepDone: done, StepTotal: s.total, Done: s.t.done, Total: s.t.total, Final: final}
+	if s.counted {
+		r.Done += done
+		// Partitions can hold more than the plan measured.
+		r.Total = max(r.Total, r.Done)
+	}
+	if elapsed := s.t.now().Sub(s.start).Seconds(); elapsed > 0 {
+		r.Rate = float64(done) / elapsed
+	}
+	if r.Rate > 0 && r.Total > r.Done {
+		r.ETA = time.Duration(float64(r.Total-r.Done) / r.Rate * float64(time.Second))
+	}
+	return r
+}
+
+// progress2Line matches the totals rsync --info=progress2 prints, e.g.
+// "  1,234,567  12%   10.50MB/s    0:01:23 (xfr#12, to-chk=100/2000)".
+var progress2Line = regexp.MustCompile(`^\s*([\d,]+)\s+\d+%\s`)
+
+// e2imageLine matches the progress e2image -p prints, e.g. "Copying 1234 /
+// 5678 blocks (21%)".
+var e2imageLine = regexp.MustCompile(`(\d+) / (\d+) blocks`)
+
+// progressWriter collects the output of a command, passing the progress
+// lines to parse instead of keeping them. Lines end with "\n" or, for
+// progress updates, "\r". Every line it keeps is also sent as an output
+// event of ctx as soon as it is written.
+type progressWriter struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	parse   func(line string) bool
+	out     bytes.Buffer
+	partial []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) line(line string) {
+	if strings.TrimSpace(line) == "" || (w.parse != nil && w.parse(line)) {
+		return
+	}
+	w.out.WriteString(line)
+	w.out.WriteByte('\n')
+	emit(w.ctx, Event{Kind: EventOutput, Line: line})
+}
+
+// Output returns the output that was not progress, including an
+// unterminated last line.
+func (w *progressWriter) Output() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+	return w.out.String()
+}
+
+// rsyncProgress returns a parse function for progressWriter that reports
+// the bytes of rsync --info=progress2 lines as copy of s.
+func rsyncProgress(s *StepProgress, copy int) func(string) bool {
+	return func(line string) bool {
+		m := progress2Line.FindStringSubmatch(line)
+		if m == nil {
+			return false
+		}
+		if n, err := strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64); err == nil {
+			s.Update(copy, n)
+		}
+		return true
+	}
+}
+
+// e2imageProgress returns a parse function for progressWriter that turns
+// the block counts of e2image -p into bytes of the step's total.
+func e2imageProgress(s *StepProgress) func(string) bool {
+	return func(line string) bool {
+		m := e2imageLine.FindStringSubmatch(line)
+		if m == nil {
+			return false
+		}
+		done, _ := strconv.ParseInt(m[1], 10, 64)
+		total, _ := strconv.ParseInt(m[2], 10, 64)
+		if s != nil && total > 0 {
+			s.Update(0, s.total*done/total)
+		}
+		return true
+	}
+}
+
+// progressWriterAt counts the bytes written through it as the progress of
+// s.
+type progressWriterAt struct {
+	w io.WriterAt
+	s *StepProgress
+	n int64
+}
+
+func (p *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(b, off)
+	p.n += int64(n)
+	p.s.Update(0, p.n)
+	return n, err
+}
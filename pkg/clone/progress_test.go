@@ -0,0 +1,69 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var got []int64
+	s := &StepProgress{t: &ProgressTracker{render: func(p ProgressReport) { got = append(got, p.StepDone) }, now: time.Now}, copies: map[int]int64{}, counted: true}
+	w := &progressWriter{parse: rsyncProgress(s, 0)}
+	io.WriteString(w, "sending incremental file list\n      1,024   0%    0.00kB/s    0:00:00 (xfr#1, ir-chk=1000/1002)\r")
+	io.WriteString(w, "  1,234,5")
+	io.WriteString(w, "67  12%   10.50MB/s    0:01:23 (xfr#12, to-chk=100/2000)\r\n\nNumber of regular files transferred: 12")
+
+	if out := w.Output(); out != "sending incremental file list\nNumber of regular files transferred: 12\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if len(got) != 2 || got[0] != 1024 || got[1] != 1234567 {
+		t.Fatalf("unexpected progress %v", got)
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	plan := PlanResult{Partitions: []PartitionPlan{
+		{Index: 1, Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{UsedBytes: 100 << 20}},
+		{Index: 2, Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{UsedBytes: 300 << 20}},
+		{Index: 3, Action: PartitionAction{Sync: true, Skip: true}, PartitionDetails: PartitionDetails{UsedBytes: 1 << 30}},
+	}}
+	var last ProgressReport
+	tr := NewProgressTracker(plan, func(p ProgressReport) { last = p })
+	clock := time.Unix(0, 0)
+	tr.now = func() time.Time { return clock }
+
+	s := tr.StartStep(context.Background(), ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 1})
+	clock = clock.Add(10 * time.Second)
+	s.Update(0, 50<<20)
+	if last.Percent() != 12 || last.Rate != 5<<20 || last.ETA != 70*time.Second {
+		t.Fatalf("unexpected report %+v", last)
+	}
+	if want := "sync-filesystem partition 1: 50.0 MiB of 100.0 MiB, 12% overall, 5.0 MiB/s, ETA 1m10s"; last.String() != want {
+		t.Fatalf("unexpected line %q", last.String())
+	}
+	s.Update(0, 100<<20)
+	s.Finish()
+	if !last.Final || last.Done != 100<<20 {
+		t.Fatalf("unexpected final report %+v", last)
+	}
+
+	// Two copies of the root sync add up; a second pass does not count.
+	s = tr.StartStep(context.Background(), ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 2})
+	s.Update(0, 100<<20)
+	s.Update(1, 50<<20)
+	if last.StepDone != 150<<20 || last.Done != 250<<20 {
+		t.Fatalf("unexpected report %+v", last)
+	}
+	s.Finish()
+	s = tr.StartStep(context.Background(), ExecutionStep{Operation: OpSyncFilesystem, PartitionIndex: 1, Pass: 2})
+	s.Update(0, 1<<20)
+	if last.Done != 250<<20 || !strings.HasPrefix(last.Step, "second pass: ") {
+		t.Fatalf("unexpected second-pass report %+v", last)
+	}
+
+	var none *ProgressTracker
+	none.StartStep(context.Background(), ExecutionStep{}).Update(0, 1)
+}
@@ -0,0 +1,181 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// QuiesceMode is how a systemd unit is kept from writing while the source
+// is synced.
+type QuiesceMode string
+
+const (
+	// QuiesceStop stops the unit and starts it again after the sync.
+	QuiesceStop QuiesceMode = "stop"
+	// QuiesceFreeze freezes the unit's processes (systemctl freeze) and
+	// thaws them after the sync.
+	QuiesceFreeze QuiesceMode = "freeze"
+)
+
+// QuiesceUnit is a systemd unit to quiesce around the sync steps.
+type QuiesceUnit struct {
+	Unit string      `json:"unit"`
+	Mode QuiesceMode `json:"mode"`
+}
+
+func (u QuiesceUnit) String() string {
+	return fmt.Sprintf("%s (%s)", u.Unit, u.Mode)
+}
+
+// resumeVerb is the systemctl command that undoes the unit's mode.
+func (u QuiesceUnit) resumeVerb() string {
+	if u.Mode == QuiesceFreeze {
+		return "thaw"
+	}
+	return "start"
+}
+
+// resumeCommand starts or thaws the unit.
+func (u QuiesceUnit) resumeCommand() string {
+	return fmt.Sprintf("systemctl %s %s", u.resumeVerb(), shellQuote(u.Unit))
+}
+
+// QuiesceState is a configured unit together with what Klon saw and did.
+type QuiesceState struct {
+	QuiesceUnit
+	// Active is whether the unit was running when it was checked. Units that
+	// are not running are left alone.
+	Active bool `json:"active"`
+	// Touched is set once the unit has been stopped or frozen.
+	Touched bool `json:"touched,omitempty"`
+}
+
+// ParseQuiesceUnits parses a comma-separated list of systemd units, each
+// optionally followed by ":stop" (the default) or ":freeze", e.g.
+// "postgresql,mosquitto,docker.service:freeze".
+func ParseQuiesceUnits(list string) ([]QuiesceUnit, error) {
+	var units []QuiesceUnit
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, mode, _ := strings.Cut(item, ":")
+		u := QuiesceUnit{Unit: name, Mode: QuiesceMode(mode)}
+		switch u.Mode {
+		case "":
+			u.Mode = QuiesceStop
+		case QuiesceStop, QuiesceFreeze:
+		default:
+			return nil, fmt.Errorf("invalid quiesce mode %q for %s: use stop or freeze", mode, name)
+		}
+		if !validUnitName(name) {
+			return nil, fmt.Errorf("invalid systemd unit name %q", name)
+		}
+		units = append(units, u)
+	}
+	return units, nil
+}
+
+// validUnitName accepts the characters systemd allows in unit names.
+func validUnitName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "-") {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.\\@", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unitActive reports whether a systemd unit is running; tests can override
+// it.
+var unitActive = func(ctx context.Context, unit string) bool {
+	out, err := shellOutput(ctx, "systemctl is-active "+shellQuote(unit))
+	return err == nil && strings.TrimSpace(out) == "active"
+}
+
+// planQuiesce records the units to quiesce and whether they run now. A
+// --source disk is not running, so nothing is quiesced for it.
+func planQuiesce(result *PlanResult, opts PlanOptions) {
+	if opts.Source != "" {
+		return
+	}
+	for _, u := range opts.Quiesce {
+		result.Quiesce = append(result.Quiesce, QuiesceState{QuiesceUnit: u, Active: unitActive(context.Background(), u.Unit)})
+	}
+}
+
+// Quiescer stops or freezes systemd units while the source is synced and
+// brings them back afterwards. Only units that are running when Quiesce is
+// called are touched, so nothing is started that was not running before.
+type Quiescer struct {
+	units   []QuiesceState
+	pending []int
+}
+
+// NewQuiescer returns a Quiescer for the given units.
+func NewQuiescer(units []QuiesceUnit) *Quiescer {
+	q := &Quiescer{}
+	for _, u := range units {
+		q.units = append(q.units, QuiesceState{QuiesceUnit: u})
+	}
+	return q
+}
+
+// Quiesce stops or freezes the running units, in order. Each unit is
+// recorded in the mount registry before it is touched, so that `klon
+// cleanup` brings it back if the run dies. If one of them fails, the units
+// already quiesced are resumed and the error is returned.
+func (q *Quiescer) Quiesce(ctx context.Context) error {
+	for i := range q.units {
+		u := &q.units[i]
+		if u.Active = unitActive(ctx, u.Unit); !u.Active {
+			logSink.Printf("klon: %s is not running, leaving it alone", u.Unit)
+			continue
+		}
+		recordUnit(u.QuiesceUnit)
+		if err := shellExec(ctx, fmt.Sprintf("systemctl %s %s", u.Mode, shellQuote(u.Unit))); err != nil {
+			forgetUnit(u.QuiesceUnit)
+			_ = q.Resume(ctx)
+			return fmt.Errorf("cannot %s %s before syncing: %w", u.Mode, u.Unit, err)
+		}
+		u.Touched = true
+		q.pending = append(q.pending, i)
+	}
+	return nil
+}
+
+// Resume starts or thaws the units Quiesce touched, in reverse order. It is
+// safe to call more than once; every unit is attempted and the first error
+// is returned.
+func (q *Quiescer) Resume(ctx context.Context) error {
+	var first error
+	for len(q.pending) > 0 {
+		u := q.units[q.pending[len(q.pending)-1]]
+		q.pending = q.pending[:len(q.pending)-1]
+		verb := u.resumeVerb()
+		// Never bound by a cancelled run: the services must come back. A
+		// unit that does not stays in the registry for `klon cleanup`.
+		if err := shellExec(context.WithoutCancel(ctx), u.resumeCommand()); err != nil {
+			logWarning(ctx, "cannot %s %s: %v", verb, u.Unit, err)
+			if first == nil {
+				first = fmt.Errorf("cannot %s %s after syncing: %w", verb, u.Unit, err)
+			}
+			continue
+		}
+		forgetUnit(u.QuiesceUnit)
+	}
+	return first
+}
+
+// Units returns the configured units with their state.
+func (q *Quiescer) Units() []QuiesceState {
+	return append([]QuiesceState(nil), q.units...)
+}
@@ -0,0 +1,189 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseQuiesceUnits(t *testing.T) {
+	units, err := ParseQuiesceUnits("postgresql, mosquitto.service:stop,docker:freeze,,getty@tty1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []QuiesceUnit{
+		{Unit: "postgresql", Mode: QuiesceStop},
+		{Unit: "mosquitto.service", Mode: QuiesceStop},
+		{Unit: "docker", Mode: QuiesceFreeze},
+		{Unit: "getty@tty1", Mode: QuiesceStop},
+	}
+	if !reflect.DeepEqual(units, want) {
+		t.Fatalf("unexpected units %+v", units)
+	}
+	for _, bad := range []string{"docker:pause", "rm -rf", "$(reboot)", "-x"} {
+		if _, err := ParseQuiesceUnits(bad); err == nil {
+			t.Fatalf("expected %q to be refused", bad)
+		}
+	}
+}
+
+// quiesceLog records runner steps and shell commands in one sequence.
+type quiesceLog struct {
+	events  []string
+	failOn  Operation
+	running map[string]bool
+}
+
+func (l *quiesceLog) Run(step ExecutionStep) error {
+	l.events = append(l.events, string(step.Operation))
+	if step.Operation == l.failOn {
+		return errors.New("rsync died")
+	}
+	return nil
+}
+
+func stubQuiesce(t *testing.T, l *quiesceLog) {
+	origShell, origActive := shellExec, unitActive
+	t.Cleanup(func() { shellExec, unitActive = origShell, origActive })
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		l.events = append(l.events, cmdStr)
+		return nil
+	}
+	unitActive = func(ctx context.Context, unit string) bool { return l.running[unit] }
+}
+
+func TestQuiescer_RecordsUnits(t *testing.T) {
+	cmds := fakeMountCommands(t, "systemctl start 'postgresql'")
+	origActive := unitActive
+	t.Cleanup(func() { unitActive = origActive })
+	unitActive = func(ctx context.Context, unit string) bool { return true }
+	registry := t.TempDir()
+	SetMountRegistry(registry)
+	path := filepath.Join(registry, strconv.Itoa(os.Getpid())+".json")
+
+	q := NewQuiescer([]QuiesceUnit{{Unit: "postgresql", Mode: QuiesceStop}})
+	if err := q.Quiesce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.Contains(string(data), `"postgresql"`) {
+		t.Fatalf("expected the registry to list the stopped unit, got %s, %v", data, err)
+	}
+
+	// A unit that does not come back stays recorded for klon cleanup.
+	if err := q.Resume(context.Background()); err == nil {
+		t.Fatalf("expected the start to fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the registry to be kept: %v", err)
+	}
+	*cmds = nil
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		*cmds = append(*cmds, cmdStr)
+		return nil
+	}
+	f := newFakeSysfs(t)
+	f.write("/proc/self/mountinfo", "21 1 179:2 / / rw - ext4 /dev/root rw\n")
+	_, _, resumed, err := f.system().cleanupMounts(registry)
+	if err != nil || len(resumed) != 1 || resumed[0].Unit != "postgresql" {
+		t.Fatalf("expected cleanup to start postgresql, got %+v, %v", resumed, err)
+	}
+	if strings.Join(*cmds, "\n") != "systemctl start 'postgresql'" {
+		t.Fatalf("unexpected commands %v", *cmds)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the registry to be removed, got %v", err)
+	}
+}
+
+func TestApplyQuiesced(t *testing.T) {
+	plan := PlanResult{
+		DestinationDisk: "sda",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true, Resize: true}},
+		},
+	}
+	opts := PlanOptions{Destination: "sda"}
+	units := []QuiesceUnit{{Unit: "postgresql", Mode: QuiesceStop}, {Unit: "mosquitto", Mode: QuiesceStop}, {Unit: "docker", Mode: QuiesceFreeze}}
+
+	l := &quiesceLog{running: map[string]bool{"postgresql": true, "docker": true}}
+	stubQuiesce(t, l)
+	q := NewQuiescer(units)
+	if err := ApplyQuiesced(plan, opts, l, q); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"systemctl stop 'postgresql'",
+		"systemctl freeze 'docker'",
+		"sync-filesystem",
+		"sync-filesystem",
+		"systemctl thaw 'docker'",
+		"systemctl start 'postgresql'",
+		"grow-partition",
+	}
+	if strings.Join(l.events, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected sequence:\n%s", strings.Join(l.events, "\n"))
+	}
+	touched := q.Units()
+	if !touched[0].Touched || touched[1].Touched || touched[1].Active || !touched[2].Touched {
+		t.Fatalf("unexpected unit states %+v", touched)
+	}
+
+	// With QuiesceSecondPass the units are only stopped for the second pass.
+	l = &quiesceLog{running: map[string]bool{"postgresql": true}}
+	stubQuiesce(t, l)
+	opts.TwoPass, opts.QuiesceSecondPass = true, true
+	if err := ApplyQuiesced(plan, opts, l, NewQuiescer(units)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = []string{
+		"sync-filesystem",
+		"sync-filesystem",
+		"systemctl stop 'postgresql'",
+		"sync-filesystem",
+		"sync-filesystem",
+		"systemctl start 'postgresql'",
+		"grow-partition",
+	}
+	if strings.Join(l.events, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected second-pass sequence:\n%s", strings.Join(l.events, "\n"))
+	}
+	opts.TwoPass, opts.QuiesceSecondPass = false, false
+
+	// A failing sync still brings the services back.
+	l = &quiesceLog{running: map[string]bool{"postgresql": true}, failOn: OpSyncFilesystem}
+	stubQuiesce(t, l)
+	if err := ApplyQuiesced(plan, opts, l, NewQuiescer(units)); err == nil || !strings.Contains(err.Error(), "rsync died") {
+		t.Fatalf("expected the sync error, got %v", err)
+	}
+	want = []string{"systemctl stop 'postgresql'", "sync-filesystem", "systemctl start 'postgresql'"}
+	if strings.Join(l.events, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected sequence after a failure:\n%s", strings.Join(l.events, "\n"))
+	}
+}
+
+func TestAppendStateLog_QuiescedUnits(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kln.state")
+	plan := PlanResult{Quiesce: []QuiesceState{
+		{QuiesceUnit: QuiesceUnit{Unit: "postgresql", Mode: QuiesceStop}, Active: true, Touched: true},
+		{QuiesceUnit: QuiesceUnit{Unit: "mosquitto", Mode: QuiesceStop}},
+	}}
+	if err := AppendStateLog(file, plan, PlanOptions{Destination: "sda"}, nil, "APPLY_SUCCESS", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "quiesced units: postgresql (stop), mosquitto (not touched)\n") {
+		t.Fatalf("state file missing quiesced units:\n%s", data)
+	}
+	if out := plan.String(); !strings.Contains(out, "  - postgresql: stop (done)\n  - mosquitto: not running, left alone\n") {
+		t.Fatalf("expected the units in the plan output:\n%s", out)
+	}
+}
@@ -0,0 +1,239 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxRootHops bounds how many overlays, loop files and stacked devices are
+// followed while resolving the root device.
+const maxRootHops = 8
+
+// resolveRootDevice finds the block device holding the root filesystem.
+//
+//   - The "/" mount is looked up in /proc/self/mountinfo and its major:minor
+//     number in /sys/dev/block, so the "/dev/root" placeholder some kernels
+//     show as the source does not matter.
+//   - Overlay roots (read-only root setups) follow their first lowerdir to
+//     the mount below it; loop devices follow their backing file.
+//   - Device-mapper and md devices follow their slaves down to the
+//     partitions they are built on, as long as those are on a single disk.
+//   - If the root mount does not lead to a disk (e.g. an overlay over
+//     tmpfs), the root= parameter of the kernel command line is used
+//     (PARTUUID=, UUID= or a /dev path).
+func (s localSystem) resolveRootDevice() (string, error) {
+	mounts, err := s.Mounts()
+	if err != nil {
+		return "", fmt.Errorf("cannot read the mount table: %w", err)
+	}
+	dev, err := s.resolvePathDevice(mounts, "/", 0)
+	if err == nil {
+		return dev, nil
+	}
+	if spec := s.kernelRootParameter(); spec != "" {
+		if cdev, cerr := s.resolveDeviceSpec(spec); cerr == nil {
+			return cdev, nil
+		}
+	}
+	return "", fmt.Errorf("cannot determine which disk holds the root filesystem: %w", err)
+}
+
+// resolvePathDevice returns the block device behind the filesystem that
+// contains path.
+func (s localSystem) resolvePathDevice(mounts []MountInfo, path string, hops int) (string, error) {
+	if hops > maxRootHops {
+		return "", errors.New("too many nested overlays, loop files or stacked devices")
+	}
+	m, ok := mountContaining(mounts, path)
+	if !ok {
+		return "", fmt.Errorf("no mount contains %s", path)
+	}
+
+	if m.FSType == "overlay" {
+		lower := overlayLowerDir(m.SuperOptions)
+		if lower == "" {
+			return "", fmt.Errorf("overlay mounted on %s has no lowerdir", m.Mountpoint)
+		}
+		return s.resolvePathDevice(mounts, lower, hops+1)
+	}
+
+	var dev BlockDevice
+	var err error
+	if strings.HasPrefix(m.MajMin, "0:") {
+		// Anonymous device numbers: btrfs reports its real device only as
+		// the source, everything else (tmpfs, nfs, ...) has no disk.
+		if !strings.HasPrefix(m.Source, "/dev/") {
+			return "", fmt.Errorf("%s is a %s filesystem, which is not stored on a disk", m.Mountpoint, m.FSType)
+		}
+		dev, err = s.BlockDevice(m.Source)
+	} else {
+		dev, err = s.blockDeviceByNumber(m.MajMin)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot find the device mounted on %s: %w", m.Mountpoint, err)
+	}
+	return s.backingDevice(mounts, dev, hops+1)
+}
+
+// backingDevice follows loop devices and stacked devices down to the
+// partition or disk that stores their data.
+func (s localSystem) backingDevice(mounts []MountInfo, dev BlockDevice, hops int) (string, error) {
+	if hops > maxRootHops {
+		return "", errors.New("too many nested overlays, loop files or stacked devices")
+	}
+	if dev.Type == DeviceLoop && dev.BackingFile != "" {
+		return s.resolvePathDevice(mounts, dev.BackingFile, hops+1)
+	}
+	if len(dev.Slaves) == 0 {
+		if dev.Type == DeviceMapper {
+			return "", fmt.Errorf("%s is not built on any block device", dev.Path)
+		}
+		return dev.Path, nil
+	}
+
+	var first string
+	disks := map[string]bool{}
+	for _, name := range dev.Slaves {
+		slave, err := s.BlockDevice(name)
+		if err != nil {
+			return "", err
+		}
+		leaf, err := s.backingDevice(mounts, slave, hops+1)
+		if err != nil {
+			return "", err
+		}
+		if first == "" {
+			first = leaf
+		}
+		disks[s.diskOf(leaf)] = true
+	}
+	if len(disks) > 1 {
+		var names []string
+		for d := range disks {
+			names = append(names, d)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("%s spans several disks (%s)", dev.Path, strings.Join(names, ", "))
+	}
+	return first, nil
+}
+
+// blockDeviceByNumber looks up a "major:minor" device number in
+// /sys/dev/block.
+func (s localSystem) blockDeviceByNumber(majmin string) (BlockDevice, error) {
+	link, err := os.Readlink(s.hostPath(filepath.Join("/sys/dev/block", majmin)))
+	if err != nil {
+		return BlockDevice{}, fmt.Errorf("unknown block device %s: %w", majmin, err)
+	}
+	return s.BlockDevice(filepath.Base(link))
+}
+
+// diskOf returns the whole disk a device belongs to.
+func (s localSystem) diskOf(device string) string {
+	if dev, err := s.BlockDevice(device); err == nil && dev.Parent != "" {
+		return "/dev/" + dev.Parent
+	}
+	return device
+}
+
+// kernelRootParameter returns the root= value of /proc/cmdline.
+func (s localSystem) kernelRootParameter() string {
+	data, err := os.ReadFile(s.hostPath("/proc/cmdline"))
+	if err != nil {
+		return ""
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if v, ok := strings.CutPrefix(field, "root="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolveDeviceSpec resolves a PARTUUID=, UUID= or /dev/... device
+// specification, as used on the kernel command line and in fstab.
+func (s localSystem) resolveDeviceSpec(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "PARTUUID="):
+		// "/PARTNROFF=n" suffixes select a sibling partition; not supported.
+		want := strings.ToLower(strings.TrimPrefix(spec, "PARTUUID="))
+		if strings.Contains(want, "/") {
+			return "", fmt.Errorf("unsupported root specification %q", spec)
+		}
+		return s.findBlockDevice(spec, func(dev BlockDevice) bool {
+			id, _, err := s.partitionIdentity(dev.Name)
+			return err == nil && strings.ToLower(id) == want
+		})
+	case strings.HasPrefix(spec, "UUID="):
+		want := strings.ToLower(strings.TrimPrefix(spec, "UUID="))
+		return s.findBlockDevice(spec, func(dev BlockDevice) bool {
+			fs, err := s.ProbeFilesystem(dev.Path)
+			return err == nil && strings.ToLower(fs.UUID) == want
+		})
+	case strings.HasPrefix(spec, "/dev/"):
+		dev, err := s.BlockDevice(spec)
+		if err != nil {
+			return "", err
+		}
+		return s.backingDevice(nil, dev, 0)
+	}
+	return "", fmt.Errorf("unsupported root specification %q", spec)
+}
+
+// findBlockDevice returns the first device in /sys/class/block that matches.
+func (s localSystem) findBlockDevice(spec string, match func(BlockDevice) bool) (string, error) {
+	entries, err := os.ReadDir(s.hostPath("/sys/class/block"))
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		dev, err := s.BlockDevice(e.Name())
+		if err != nil {
+			continue
+		}
+		if match(dev) {
+			return dev.Path, nil
+		}
+	}
+	return "", fmt.Errorf("no block device matches %s", spec)
+}
+
+// mountContaining returns the mount whose mountpoint is the longest prefix
+// of path. Among mounts on the same directory the last one is visible.
+func mountContaining(mounts []MountInfo, path string) (MountInfo, bool) {
+	var best MountInfo
+	found := false
+	for _, m := range mounts {
+		if path != m.Mountpoint && !pathUnder(path, m.Mountpoint) {
+			continue
+		}
+		if !found || len(m.Mountpoint) >= len(best.Mountpoint) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// overlayLowerDir returns the uppermost lower directory of an overlay mount.
+func overlayLowerDir(superOptions string) string {
+	for _, opt := range strings.Split(superOptions, ",") {
+		if v, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+			// Layers are separated by ':'; a literal ':' is escaped.
+			for i := 0; i < len(v); i++ {
+				if v[i] == '\\' {
+					i++
+					continue
+				}
+				if v[i] == ':' {
+					return strings.ReplaceAll(v[:i], `\:`, ":")
+				}
+			}
+			return strings.ReplaceAll(v, `\:`, ":")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,185 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+func TestLocalSystemBootDisk(t *testing.T) {
+	cases := []struct {
+		name      string
+		mountinfo string
+		cmdline   string
+		// setup adds devices beyond standardTree.
+		setup func(f *fakeSysfs)
+		want  string
+	}{
+		{
+			name: "raspberry pi /dev/root",
+			mountinfo: `21 1 179:2 / / rw,noatime shared:1 - ext4 /dev/root rw
+22 21 179:1 / /boot/firmware rw,relatime shared:3 - vfat /dev/mmcblk0p1 rw
+`,
+			want: "/dev/mmcblk0p2",
+		},
+		{
+			name: "nvme",
+			mountinfo: `21 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+`,
+			want: "/dev/nvme0n1p2",
+		},
+		{
+			name: "lvm",
+			mountinfo: `21 1 253:0 / / rw,relatime shared:1 - ext4 /dev/mapper/vg0-root rw
+`,
+			want: "/dev/sda2",
+		},
+		{
+			name: "luks on lvm",
+			mountinfo: `21 1 253:1 / / rw,relatime shared:1 - ext4 /dev/mapper/cryptroot rw
+`,
+			setup: func(f *fakeSysfs) {
+				dm := f.disk("dm-1", "253:1", 20967424)
+				f.write(dm+"/dm/name", "cryptroot\n")
+				f.write(dm+"/slaves/dm-0/dev", "253:0\n")
+			},
+			want: "/dev/sda2",
+		},
+		{
+			name: "read-only root overlay",
+			mountinfo: `20 1 0:19 / / rw,relatime shared:1 - overlay overlay rw,lowerdir=/media/root-ro,upperdir=/media/root-rw/overlay,workdir=/media/root-rw/overlay-workdir
+21 20 179:2 / /media/root-ro ro,relatime shared:2 - ext4 /dev/mmcblk0p2 ro
+22 20 0:20 / /media/root-rw rw,relatime shared:3 - tmpfs root-rw rw
+`,
+			want: "/dev/mmcblk0p2",
+		},
+		{
+			name: "btrfs subvolume",
+			mountinfo: `21 1 0:33 /@ / rw,relatime shared:1 - btrfs /dev/nvme0n1p2 rw,subvol=/@
+`,
+			want: "/dev/nvme0n1p2",
+		},
+		{
+			name: "root over-mounted by a later mount",
+			mountinfo: `1 0 8:1 / / rw - ext4 /dev/sda1 rw
+21 1 179:2 / / rw,noatime shared:1 - ext4 /dev/root rw
+`,
+			want: "/dev/mmcblk0p2",
+		},
+		{
+			name: "tmpfs overlay falls back to PARTUUID on the command line",
+			mountinfo: `20 1 0:19 / / rw,relatime - overlay overlay rw,lowerdir=/run/lower,upperdir=/run/upper,workdir=/run/work
+21 20 0:20 / /run rw,relatime - tmpfs tmpfs rw
+`,
+			cmdline: "console=serial0,115200 root=PARTUUID=6c586e13-02 rootfstype=ext4 fsck.repair=yes rootwait",
+			setup: func(f *fakeSysfs) {
+				if err := parttable.WriteFile(f.device("mmcblk0", 64<<20), &parttable.Table{
+					Type:          parttable.DOS,
+					DiskSignature: 0x6c586e13,
+					Partitions: []parttable.Partition{
+						{Index: 1, StartLBA: 8192, Sectors: 8192, Type: "c"},
+						{Index: 2, StartLBA: 16384, Sectors: 65536, Type: "83"},
+					},
+				}); err != nil {
+					f.t.Fatal(err)
+				}
+			},
+			want: "/dev/mmcblk0p2",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := standardTree(t)
+			f.write("/proc/self/mountinfo", tc.mountinfo)
+			if tc.cmdline != "" {
+				f.write("/proc/cmdline", tc.cmdline+"\n")
+			}
+			if tc.setup != nil {
+				tc.setup(f)
+			}
+			got, err := f.system().BootDisk()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("BootDisk() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalSystemBootDisk_Errors(t *testing.T) {
+	cases := []struct {
+		name      string
+		mountinfo string
+		setup     func(f *fakeSysfs)
+		wantErr   string
+	}{
+		{
+			name:      "no mount table",
+			mountinfo: "",
+			wantErr:   "no mount contains /",
+		},
+		{
+			name: "root on tmpfs without root= parameter",
+			mountinfo: `21 1 0:20 / / rw - tmpfs tmpfs rw
+`,
+			wantErr: "not stored on a disk",
+		},
+		{
+			name: "unknown device number",
+			mountinfo: `21 1 8:48 / / rw - ext4 /dev/sdd rw
+`,
+			wantErr: "cannot find the device mounted on /",
+		},
+		{
+			name: "volume spanning two disks",
+			mountinfo: `21 1 253:2 / / rw - ext4 /dev/mapper/vg1-root rw
+`,
+			setup: func(f *fakeSysfs) {
+				dm := f.disk("dm-2", "253:2", 41943040)
+				f.write(dm+"/dm/name", "vg1-root\n")
+				f.write(dm+"/slaves/sda1/dev", "8:1\n")
+				f.write(dm+"/slaves/nvme0n1p2/dev", "259:2\n")
+			},
+			wantErr: "spans several disks (/dev/nvme0n1, /dev/sda)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := standardTree(t)
+			f.write("/proc/self/mountinfo", tc.mountinfo)
+			if tc.setup != nil {
+				tc.setup(f)
+			}
+			got, err := f.system().BootDisk()
+			if err == nil {
+				t.Fatalf("expected an error, got %q", got)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := newFakeSysfs(t).system().BootDisk(); err == nil || !strings.Contains(err.Error(), "cannot read the mount table") {
+		t.Fatalf("expected an error without /proc, got %v", err)
+	}
+}
+
+func TestOverlayLowerDir(t *testing.T) {
+	cases := map[string]string{
+		"rw,lowerdir=/media/root-ro,upperdir=/x,workdir=/y": "/media/root-ro",
+		"rw,lowerdir=/l1:/l2:/l3,upperdir=/x":               "/l1",
+		`rw,lowerdir=/odd\:name:/l2`:                        "/odd:name",
+		"rw,upperdir=/x":                                    "",
+	}
+	for opts, want := range cases {
+		if got := overlayLowerDir(opts); got != want {
+			t.Fatalf("overlayLowerDir(%q) = %q, want %q", opts, got, want)
+		}
+	}
+}
@@ -2,37 +2,84 @@ package clone
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
+
+	"github.com/woliveiras/klon/pkg/parttable"
 )
 
 // shellExec is a hookable command executor; tests can override it.
 var shellExec = runShellCommand
 
+// shellOutput runs a command and returns its standard output; tests can
+// override it.
+var shellOutput = runShellOutput
+
+// shellStream runs a command and writes its combined output to w as it is
+// produced; tests can override it.
+var shellStream = runShellStream
+
+// writePartitionTable writes a partition table to a disk; tests can override
+// it.
+var writePartitionTable = parttable.WriteFile
+
+// readDiskTable reads the partition table of a disk, nil when it has none,
+// and the size of the disk; tests can override it.
+var readDiskTable = func(disk string) (*parttable.Table, int64, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot determine size of %s: %w", disk, err)
+	}
+	table, err := parttable.Read(f, size)
+	if errors.Is(err, parttable.ErrNoTable) {
+		return nil, size, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", disk, err)
+	}
+	return table, size, nil
+}
+
 // CommandRunner executes ExecutionStep values by invoking system commands.
 // It uses BuildPartitionCommand and BuildSyncCommand to derive the concrete
 // command lines and then runs them with /bin/sh -c. All commands are logged
 // via the standard log package.
 type CommandRunner struct {
 	DestRoot          string
-	PartitionStrategy string
+	PartitionStrategy PartitionStrategy
 	ExcludePatterns   []string
 	ExcludeFromFiles  []string
 	DestDisk          string
 	DeleteDest        bool
 	DeleteRoot        bool
-	ctx               context.Context
+	// SourceRoot is where the source filesystems are mounted when cloning a
+	// SourceMount instead of the running system; empty means "/".
+	SourceRoot string
+	// SecondPass collects the files changed by each second-pass sync.
+	SecondPass []SyncChanges
+	// Progress, if set, is told the bytes copied by the sync and copy-blocks
+	// steps.
+	Progress *ProgressTracker
+	ctx      context.Context
 }
 
-func NewCommandRunner(destRoot, strategy string, excludePatterns, excludeFromFiles []string, destDisk string, deleteDest bool, deleteRoot bool) *CommandRunner {
+func NewCommandRunner(destRoot string, strategy PartitionStrategy, excludePatterns, excludeFromFiles []string, destDisk string, deleteDest bool, deleteRoot bool) *CommandRunner {
 	return NewCommandRunnerWithContext(context.Background(), destRoot, strategy, excludePatterns, excludeFromFiles, destDisk, deleteDest, deleteRoot)
 }
 
-func NewCommandRunnerWithContext(ctx context.Context, destRoot, strategy string, excludePatterns, excludeFromFiles []string, destDisk string, deleteDest bool, deleteRoot bool) *CommandRunner {
+func NewCommandRunnerWithContext(ctx context.Context, destRoot string, strategy PartitionStrategy, excludePatterns, excludeFromFiles []string, destDisk string, deleteDest bool, deleteRoot bool) *CommandRunner {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -58,16 +105,18 @@ func (r *CommandRunner) Run(step ExecutionStep) error {
 	}
 
 	switch step.Operation {
-	case "prepare-disk":
+	case OpPrepareDisk:
 		return r.runPrepareDisk(step)
-	case "grow-partition":
+	case OpGrowPartition:
 		return r.runGrowPartition(step)
-	case "initialize-partition":
+	case OpInitializePartition:
 		return r.runInitializePartition(step)
-	case "sync-filesystem":
+	case OpSyncFilesystem:
 		return r.runSyncFilesystem(step)
-	case "resize-p1":
+	case OpResizeP1:
 		return r.runResizeP1(step)
+	case OpCopyBlocks:
+		return r.runCopyBlocks(step)
 	default:
 		logSink.Printf("klon: ignoring unknown operation %q for step: %s", step.Operation, step.Description)
 		return nil
@@ -75,34 +124,118 @@ func (r *CommandRunner) Run(step ExecutionStep) error {
 }
 
 func (r *CommandRunner) runPrepareDisk(step ExecutionStep) error {
-	cmdStr, err := BuildPartitionCommand(step, r.PartitionStrategy)
+	// The step carries the planned strategy; the runner's own strategy is
+	// only a fallback for hand-built steps.
+	strategy := step.Action.Strategy
+	if strategy == "" {
+		strategy = r.PartitionStrategy
+	}
+	desc, err := BuildPartitionCommand(step, strategy)
 	if err != nil {
 		return fmt.Errorf("prepare-disk on %s: %w", step.DestinationDisk, err)
 	}
-	if err := shellExec(r.ctx, cmdStr); err != nil {
-		return err
+	table, err := destinationTable(step, strategy)
+	if err != nil {
+		return fmt.Errorf("prepare-disk on %s: %w", step.DestinationDisk, err)
 	}
-	if step.SizeBytes > 0 {
-		// Immediately resize partition 1 so subsequent mkfs/sync happen on the
-		// correct layout, instead of resizing later.
-		if err := r.runResizeP1(step); err != nil {
-			return err
+	logSink.Printf("klon: %s", desc)
+	return r.writeTable(step, OpPrepareDisk, table)
+}
+
+// destinationTable computes the partition table prepare-disk writes: the
+// layout computed at plan time, a copy of the source table for
+// StrategyCloneTable, or a boot and a root partition for the new-layout
+// strategies. Partition 1 is resized to step.SizeBytes (-p1-size) unless the
+// new layout was already made with it.
+func destinationTable(step ExecutionStep, strategy PartitionStrategy) (*parttable.Table, error) {
+	layout := step.Layout
+	resizeP1 := step.SizeBytes > 0
+	switch {
+	case layout != nil:
+	case strategy == "" || strategy == StrategyCloneTable:
+		src := ensureDevPrefix(step.SourceDevice)
+		table, _, err := readDiskTable(src)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the partition table of %s: %w", src, err)
+		}
+		if table == nil {
+			return nil, fmt.Errorf("%s has no partition table to clone", src)
+		}
+		layout = tableLayout(table)
+	case strategy == StrategyNewLayout || strategy == StrategyNewLayoutGPT:
+		disk := ensureDevPrefix(step.DestinationDisk)
+		_, size, err := readDiskTable(disk)
+		if err != nil {
+			return nil, fmt.Errorf("cannot size %s: %w", disk, err)
+		}
+		tableType := parttable.DOS
+		if strategy == StrategyNewLayoutGPT {
+			tableType = parttable.GPT
+		}
+		if layout, err = newLayout(tableType, step.SizeBytes, size); err != nil {
+			return nil, err
+		}
+		resizeP1 = false
+	default:
+		return nil, fmt.Errorf("no partition layout for strategy %q", strategy)
+	}
+
+	table, err := layout.partitionTable()
+	if err != nil {
+		return nil, err
+	}
+	if resizeP1 {
+		if err := resizePartition(table, 1, step.SizeBytes); err != nil {
+			return nil, err
 		}
 	}
+	return table, nil
+}
+
+// writeTable writes table to the destination disk of step and asks the
+// kernel to re-read it; op names the step in errors.
+func (r *CommandRunner) writeTable(step ExecutionStep, op Operation, table *parttable.Table) error {
+	disk := ensureDevPrefix(step.DestinationDisk)
+	logSink.Printf("klon: writing %s partition table with %d partitions to %s", table.Type, len(table.Partitions), disk)
+	if err := writePartitionTable(disk, table); err != nil {
+		return fmt.Errorf("%s on %s: cannot write partition table: %w", op, step.DestinationDisk, err)
+	}
+	if err := shellExec(r.ctx, fmt.Sprintf("partprobe %s", disk)); err != nil {
+		return fmt.Errorf("%s on %s: kernel did not re-read the new partition table: %w", op, step.DestinationDisk, err)
+	}
 	return nil
 }
 
+// editTable reads the partition table of the destination disk of step,
+// changes it with edit and writes it back. Identifiers are kept, so fstab
+// and cmdline.txt entries written for the clone stay valid.
+func (r *CommandRunner) editTable(step ExecutionStep, op Operation, edit func(table *parttable.Table, diskSize int64) error) error {
+	disk := ensureDevPrefix(step.DestinationDisk)
+	table, size, err := readDiskTable(disk)
+	if err != nil {
+		return fmt.Errorf("%s on %s: cannot read partition table: %w", op, step.DestinationDisk, err)
+	}
+	if table == nil {
+		return fmt.Errorf("%s on %s: the disk has no partition table", op, step.DestinationDisk)
+	}
+	if err := edit(table, size); err != nil {
+		return fmt.Errorf("%s on %s: %w", op, step.DestinationDisk, err)
+	}
+	return r.writeTable(step, op, table)
+}
+
 func (r *CommandRunner) runGrowPartition(step ExecutionStep) error {
 	if step.DestinationDisk == "" || step.PartitionIndex <= 0 {
 		return fmt.Errorf("grow-partition on %s: missing destination or partition index", step.DestinationDisk)
 	}
-	disk := ensureDevPrefix(step.DestinationDisk)
-	part := partitionDevice(step.DestinationDisk, step.PartitionIndex)
+	part := hostDevices.partition(step.DestinationDisk, step.PartitionIndex)
 
 	// First grow the partition to consume all remaining space.
-	cmdStr := fmt.Sprintf("parted -s %s resizepart %d 100%%", disk, step.PartitionIndex)
-	if err := shellExec(r.ctx, cmdStr); err != nil {
-		return fmt.Errorf("grow-partition on %s: parted failed; ensure no partitions are mounted and the disk is healthy: %w", step.DestinationDisk, err)
+	err := r.editTable(step, OpGrowPartition, func(table *parttable.Table, diskSize int64) error {
+		return growPartition(table, step.PartitionIndex, diskSize)
+	})
+	if err != nil {
+		return err
 	}
 
 	// Then grow the filesystem inside the partition. We currently support
@@ -121,12 +254,9 @@ func (r *CommandRunner) runResizeP1(step ExecutionStep) error {
 	if step.SizeBytes <= 0 {
 		return fmt.Errorf("resize-p1 on %s: missing target size", step.DestinationDisk)
 	}
-	disk := ensureDevPrefix(step.DestinationDisk)
-	cmdStr := fmt.Sprintf("parted -s %s resizepart 1 %dB", disk, step.SizeBytes)
-	if err := shellExec(r.ctx, cmdStr); err != nil {
-		return fmt.Errorf("resize-p1 on %s: parted failed: %w", step.DestinationDisk, err)
-	}
-	return nil
+	return r.editTable(step, OpResizeP1, func(table *parttable.Table, _ int64) error {
+		return resizePartition(table, 1, step.SizeBytes)
+	})
 }
 
 func (r *CommandRunner) runSyncFilesystem(step ExecutionStep) error {
@@ -149,15 +279,13 @@ func (r *CommandRunner) runSyncFilesystem(step ExecutionStep) error {
 		return fmt.Errorf("sync-filesystem on %s: cannot create destination dir %s: %w", step.DestinationDisk, destPath, err)
 	}
 
-	dstPart := partitionDevice(step.DestinationDisk, step.PartitionIndex)
-	mountCmd := fmt.Sprintf("mount %s %s", dstPart, destPath)
-	if err := shellExec(r.ctx, mountCmd); err != nil {
+	dstPart := hostDevices.partition(step.DestinationDisk, step.PartitionIndex)
+	if err := mountFS(r.ctx, "", dstPart, destPath, false); err != nil {
 		return fmt.Errorf("sync-filesystem on %s: failed to mount %s on %s: %w. Is the device busy or missing drivers?", step.DestinationDisk, dstPart, destPath, err)
 	}
 	defer func() {
-		umountCmd := fmt.Sprintf("umount %s", destPath)
-		if err := shellExec(r.ctx, umountCmd); err != nil {
-			logSink.Printf("klon: WARNING: failed to unmount %s: %v", destPath, err)
+		if err := unmountFS(r.ctx, destPath); err != nil {
+			logWarning(r.ctx, "failed to unmount %s: %v", destPath, err)
 		}
 	}()
 
@@ -165,6 +293,9 @@ func (r *CommandRunner) runSyncFilesystem(step ExecutionStep) error {
 	// progress (especially for large clones).
 	_ = shellExec(r.ctx, fmt.Sprintf("df -h %s", destPath))
 
+	sp := r.Progress.StartStep(r.ctx, step)
+	defer sp.Finish()
+
 	// If source is not mounted, mount it temporarily to sync.
 	srcMount := step.Mountpoint
 	tempSrc := ""
@@ -174,45 +305,75 @@ func (r *CommandRunner) runSyncFilesystem(step ExecutionStep) error {
 			return fmt.Errorf("sync-filesystem on %s: cannot create temp dir to mount source: %w", step.DestinationDisk, err)
 		}
 		tempSrc = tmpDir
-		mntCmd := fmt.Sprintf("mount -o ro %s %s", ensureDevPrefix(step.SourceDevice), tempSrc)
-		if err := shellExec(r.ctx, mntCmd); err != nil {
-			os.RemoveAll(tempSrc)
+		if err := mountFS(r.ctx, "ro", ensureDevPrefix(step.SourceDevice), tempSrc, true); err != nil {
+			os.Remove(tempSrc)
 			return fmt.Errorf("sync-filesystem on %s: failed to mount source %s on %s: %w", step.DestinationDisk, step.SourceDevice, tempSrc, err)
 		}
 		defer func() {
-			_ = shellExec(r.ctx, fmt.Sprintf("umount %s", tempSrc))
-			_ = os.RemoveAll(tempSrc)
+			if err := unmountFS(r.ctx, tempSrc); err != nil {
+				logWarning(r.ctx, "failed to unmount %s: %v", tempSrc, err)
+			}
 		}()
 		srcMount = tempSrc
 	}
 
+	// Sync from a snapshot of the mounted source, or freeze it meanwhile.
+	snapDir := ""
+	if step.Snapshot != nil && step.Mountpoint != "" && r.SourceRoot == "" {
+		dir, release, err := r.takeSnapshot(step)
+		if err != nil {
+			return fmt.Errorf("sync-filesystem on %s: %w", step.DestinationDisk, err)
+		}
+		defer release()
+		snapDir = dir
+	}
+
+	// Files deleted since the first pass are deleted from a destination
+	// that holds nothing but the first pass.
+	deleteFlag := r.DeleteDest
+	if step.Pass > 1 && step.Action.Initialize {
+		deleteFlag = true
+	}
+
+	var changed int64
 	if step.Mountpoint == "/" {
-		if err := r.runParallelRootSync(destPath); err != nil {
+		rootRunner := r
+		if snapDir != "" {
+			snapRunner := *r
+			snapRunner.SourceRoot = snapDir
+			rootRunner = &snapRunner
+		}
+		n, err := rootRunner.runParallelRootSync(destPath, step.Excludes, step.Pass, deleteFlag, sp)
+		if err != nil {
 			return err
 		}
+		changed = n
 	} else {
 		effectiveStep := step
 		if tempSrc != "" {
 			effectiveStep.Mountpoint = srcMount
-		}
-		deleteFlag := r.DeleteDest
-		if step.Mountpoint == "/" {
-			deleteFlag = r.DeleteRoot
+		} else if snapDir != "" {
+			effectiveStep.SourcePath = snapDir
+		} else if r.SourceRoot != "" {
+			src := step.SourcePath
+			if src == "" {
+				src = step.Mountpoint
+			}
+			effectiveStep.SourcePath = filepath.Join(r.SourceRoot, src)
 		}
 		cmdStr, err := BuildSyncCommand(effectiveStep, r.DestRoot, r.ExcludePatterns, r.ExcludeFromFiles, deleteFlag)
 		if err != nil {
 			return fmt.Errorf("sync-filesystem on %s: cannot build rsync command: %w", step.DestinationDisk, err)
 		}
 
-		logSink.Printf("klon: EXEC: %s", cmdStr)
-		cmd := exec.CommandContext(r.ctx, "sh", "-c", cmdStr)
-		out, err := cmd.CombinedOutput()
-		if len(out) > 0 {
-			logSink.Printf("klon: OUTPUT: %s", strings.TrimSpace(string(out)))
-		}
-		if err != nil {
+		w := &progressWriter{parse: rsyncProgress(sp, 0)}
+		if err := shellStream(r.ctx, cmdStr, w); err != nil {
 			return fmt.Errorf("command failed: %w", err)
 		}
+		changed = rsyncChangedFiles(w.Output())
+	}
+	if step.Pass > 1 {
+		r.SecondPass = append(r.SecondPass, SyncChanges{PartitionIndex: step.PartitionIndex, Mountpoint: step.Mountpoint, Files: changed})
 	}
 
 	// Show destination filesystem usage after syncing.
@@ -223,76 +384,85 @@ func (r *CommandRunner) runSyncFilesystem(step ExecutionStep) error {
 // runParallelRootSync performs the root filesystem synchronization using
 // multiple rsync processes in parallel for selected subtrees (like /usr, /var,
 // /home, /opt) plus a final pass for the remaining tree. This is an
-// optimization for large clones.
-func (r *CommandRunner) runParallelRootSync(destRoot string) error {
+// optimization for large clones. excludes are the step's extra patterns,
+// anchored at /; they are rebased for the subtree jobs. It returns the files
+// changed, as reported by the --stats of a second pass. Each rsync reports
+// its progress to sp as a copy of its own.
+func (r *CommandRunner) runParallelRootSync(destRoot string, excludes []string, pass int, deleteDest bool, sp *StepProgress) (int64, error) {
 	type job struct {
 		name string
-		src  string
+		dir  string // anchored at the root filesystem, e.g. "/usr/"
 		dst  string
 	}
 
 	subtrees := []job{
-		{name: "usr", src: "/usr/", dst: filepath.Join(destRoot, "usr") + "/"},
-		{name: "var", src: "/var/", dst: filepath.Join(destRoot, "var") + "/"},
-		{name: "home", src: "/home/", dst: filepath.Join(destRoot, "home") + "/"},
-		{name: "opt", src: "/opt/", dst: filepath.Join(destRoot, "opt") + "/"},
+		{name: "usr", dir: "/usr/", dst: filepath.Join(destRoot, "usr") + "/"},
+		{name: "var", dir: "/var/", dst: filepath.Join(destRoot, "var") + "/"},
+		{name: "home", dir: "/home/", dst: filepath.Join(destRoot, "home") + "/"},
+		{name: "opt", dir: "/opt/", dst: filepath.Join(destRoot, "opt") + "/"},
 	}
 
 	baseStep := ExecutionStep{
-		Operation:  "sync-filesystem",
+		Operation:  OpSyncFilesystem,
 		Mountpoint: "/",
+		Excludes:   excludes,
+		Pass:       pass,
 	}
 
 	// Build the base rsync command for root, then adapt it per subtree.
-	baseCmd, err := BuildSyncCommand(baseStep, r.DestRoot, r.ExcludePatterns, r.ExcludeFromFiles, r.DeleteDest)
+	baseCmd, err := BuildSyncCommand(baseStep, r.DestRoot, r.ExcludePatterns, r.ExcludeFromFiles, deleteDest)
 	if err != nil {
-		return fmt.Errorf("parallel root sync: cannot build base rsync command: %w", err)
+		return 0, fmt.Errorf("parallel root sync: cannot build base rsync command: %w", err)
 	}
 
 	// baseCmd looks like: rsync <args> / <destRoot>/
 	parts := strings.Fields(baseCmd)
 	if len(parts) < 4 {
-		return fmt.Errorf("parallel root sync: unexpected rsync command format: %q", baseCmd)
+		return 0, fmt.Errorf("parallel root sync: unexpected rsync command format: %q", baseCmd)
 	}
 	args := parts[1 : len(parts)-2] // drop "rsync" and the last two path args
 
 	// Exclude subtrees from the final "rest" pass so they are not copied twice.
 	for _, st := range subtrees {
-		args = append(args, "--exclude", st.src)
+		args = append(args, "--exclude", st.dir)
 	}
 
 	// rsync jobs for subtrees.
 	var cmds []*exec.Cmd
 	for _, st := range subtrees {
 		cmdArgs := append([]string{}, args...)
-		cmdArgs = append(cmdArgs, st.src, st.dst)
-		cmd := exec.CommandContext(r.ctx, "rsync", cmdArgs...)
-		cmds = append(cmds, cmd)
-		logSink.Printf("klon: EXEC: rsync %s", strings.Join(cmdArgs, " "))
+		for _, p := range rebaseExcludes(excludes, st.dir) {
+			cmdArgs = append(cmdArgs, "--exclude", p)
+		}
+		cmdArgs = append(cmdArgs, r.sourceDir(st.dir), st.dst)
+		cmds = append(cmds, exec.CommandContext(r.ctx, "rsync", cmdArgs...))
 	}
 
 	// Final job for the rest of the filesystem (/ → destRoot).
 	restArgs := append([]string{}, args...)
-	restArgs = append(restArgs, "/", destRoot+"/")
+	restArgs = append(restArgs, r.sourceDir("/"), destRoot+"/")
 	restCmd := exec.CommandContext(r.ctx, "rsync", restArgs...)
-	logSink.Printf("klon: EXEC: rsync %s", strings.Join(restArgs, " "))
 
 	// Run subtree jobs in parallel with a small concurrency limit to avoid
 	// overloading the SD card.
 	errCh := make(chan error, len(cmds)+1)
 	sem := make(chan struct{}, 2) // at most 2 rsyncs in parallel
+	var changed atomic.Int64
 
-	runCmd := func(cmd *exec.Cmd) {
+	runCmd := func(cmd *exec.Cmd, copy int) {
 		sem <- struct{}{}
 		defer func() { <-sem }()
-		out, err := cmd.CombinedOutput()
-		if len(out) > 0 {
-			logSink.Printf("klon: OUTPUT: %s", strings.TrimSpace(string(out)))
-		}
+		w := &progressWriter{ctx: r.ctx, parse: rsyncProgress(sp, copy)}
+		cmd.Stdout, cmd.Stderr = w, w
+		done := logCommand(r.ctx, "rsync "+strings.Join(cmd.Args[1:], " "))
+		err := cmd.Run()
+		out := w.Output()
+		done(out, err)
+		changed.Add(rsyncChangedFiles(out))
 		if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 23 {
-					logSink.Printf("klon: WARNING: rsync exited with code 23 for %q (partial transfer; volatile entries in /proc or /sys are expected). Continuing clone.", cmd.String())
+					logWarning(r.ctx, "rsync exited with code 23 for %q (partial transfer; volatile entries in /proc or /sys are expected). Continuing clone.", cmd.String())
 					errCh <- nil
 					return
 				}
@@ -303,18 +473,24 @@ func (r *CommandRunner) runParallelRootSync(destRoot string) error {
 		errCh <- nil
 	}
 
-	for _, c := range cmds {
-		go runCmd(c)
+	for i, c := range cmds {
+		go runCmd(c, i)
 	}
-	go runCmd(restCmd)
+	go runCmd(restCmd, len(cmds))
 
 	// Wait for all jobs.
 	for i := 0; i < len(cmds)+1; i++ {
 		if e := <-errCh; e != nil {
-			return e
+			return 0, e
 		}
 	}
-	return nil
+	return changed.Load(), nil
+}
+
+// sourceDir returns the host path of a source directory, with a trailing
+// slash so rsync copies its contents.
+func (r *CommandRunner) sourceDir(dir string) string {
+	return strings.TrimSuffix(filepath.Join("/", r.SourceRoot, dir), "/") + "/"
 }
 
 func (r *CommandRunner) runInitializePartition(step ExecutionStep) error {
@@ -322,24 +498,30 @@ func (r *CommandRunner) runInitializePartition(step ExecutionStep) error {
 		return fmt.Errorf("initialize-partition on %s: missing source, destination or partition index", step.DestinationDisk)
 	}
 
-	srcFs, err := detectFilesystem(step.SourceDevice)
-	if err != nil {
-		return fmt.Errorf("initialize-partition on %s: cannot detect filesystem for %s: %w", step.DestinationDisk, step.SourceDevice, err)
+	// Prefer the filesystem recorded in the plan and only probe the source
+	// device when the plan did not know it.
+	srcFs := step.FSType
+	if srcFs == "" {
+		detected, err := detectFilesystem(step.SourceDevice)
+		if err != nil {
+			return fmt.Errorf("initialize-partition on %s: cannot detect filesystem for %s: %w", step.DestinationDisk, step.SourceDevice, err)
+		}
+		srcFs = detected
 	}
 	if srcFs == "" {
 		return fmt.Errorf("initialize-partition on %s: empty filesystem type for %s", step.DestinationDisk, step.SourceDevice)
 	}
 
-	dstPart := partitionDevice(step.DestinationDisk, step.PartitionIndex)
+	dstPart := hostDevices.partition(step.DestinationDisk, step.PartitionIndex)
 
 	var cmdStr string
 	switch {
 	case strings.HasPrefix(srcFs, "ext"):
-		cmdStr = fmt.Sprintf("mkfs.ext4 -F %s", dstPart)
+		cmdStr = fmt.Sprintf("mkfs.ext4 -F %s%s", labelFlag("-L", step.Label), dstPart)
 	case srcFs == "vfat" || strings.HasPrefix(srcFs, "fat"):
-		cmdStr = fmt.Sprintf("mkfs.vfat %s", dstPart)
+		cmdStr = fmt.Sprintf("mkfs.vfat %s%s", labelFlag("-n", step.Label), dstPart)
 	case srcFs == "swap":
-		cmdStr = fmt.Sprintf("mkswap %s", dstPart)
+		cmdStr = fmt.Sprintf("mkswap %s%s", labelFlag("-L", step.Label), dstPart)
 	default:
 		return fmt.Errorf("initialize-partition: unsupported filesystem type %q", srcFs)
 	}
@@ -347,38 +529,65 @@ func (r *CommandRunner) runInitializePartition(step ExecutionStep) error {
 	return shellExec(r.ctx, cmdStr)
 }
 
+// labelFlag renders the mkfs label option followed by a space, or nothing
+// when no label is requested.
+func labelFlag(flag, label string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s ", flag, label)
+}
+
 func runShellCommand(ctx context.Context, cmdStr string) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	logSink.Printf("klon: EXEC: %s", cmdStr)
+	done := logCommand(ctx, cmdStr)
 	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
-	out, err := cmd.CombinedOutput()
-	if len(out) > 0 {
-		logSink.Printf("klon: OUTPUT: %s", strings.TrimSpace(string(out)))
-	}
+	w := &progressWriter{ctx: ctx}
+	cmd.Stdout, cmd.Stderr = w, w
+	err := cmd.Run()
+	done(w.Output(), err)
 	if err != nil {
 		return fmt.Errorf("command failed while running %q: %w", cmdStr, err)
 	}
 	return nil
 }
 
-func detectFilesystem(dev string) (string, error) {
-	dev = ensureDevPrefix(dev)
-	cmd := exec.Command("lsblk", "-no", "FSTYPE", dev)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("lsblk failed: %w", err)
+func runShellStream(ctx context.Context, cmdStr string, w *progressWriter) error {
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	return strings.TrimSpace(string(out)), nil
+	done := logCommand(ctx, cmdStr)
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	w.ctx = ctx
+	cmd.Stdout, cmd.Stderr = w, w
+	err := cmd.Run()
+	done(w.Output(), err)
+	return err
 }
 
-func partitionDevice(disk string, index int) string {
-	base := ensureDevPrefix(disk)
-	name := strings.TrimPrefix(base, "/dev/")
+func runShellOutput(ctx context.Context, cmdStr string) (string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	done := logCommand(ctx, cmdStr)
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	stderr := &progressWriter{ctx: ctx}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		done(stderr.Output(), err)
+		return "", fmt.Errorf("command failed while running %q: %w", cmdStr, err)
+	}
+	done("", nil)
+	return string(out), nil
+}
 
-	if strings.HasPrefix(name, "mmcblk") || strings.HasPrefix(name, "nvme") {
-		return fmt.Sprintf("/dev/%sp%d", name, index)
+func detectFilesystem(dev string) (string, error) {
+	info, err := localSystem{}.ProbeFilesystem(dev)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("/dev/%s%d", name, index)
+	return info.Type, nil
 }
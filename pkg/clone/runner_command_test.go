@@ -0,0 +1,207 @@
+package clone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+func TestCommandRunner_PrepareDiskWritesLayoutNatively(t *testing.T) {
+	origShell, origWrite := shellExec, writePartitionTable
+	defer func() { shellExec, writePartitionTable = origShell, origWrite }()
+
+	img := filepath.Join(t.TempDir(), "sda.img")
+	if err := os.WriteFile(img, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	var target string
+	writePartitionTable = func(disk string, table *parttable.Table) error {
+		target = disk
+		return parttable.WriteFile(img, table)
+	}
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		return nil
+	}
+
+	step := ExecutionStep{
+		Operation:       OpPrepareDisk,
+		DestinationDisk: "sda",
+		Action:          PartitionAction{Strategy: StrategyLayoutFile, Initialize: true},
+		Layout: &DiskLayout{Table: "gpt", Partitions: []LayoutPartition{
+			{Index: 1, StartBytes: 1 << 20, SizeBytes: 16 << 20, Type: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"},
+			{Index: 2, StartBytes: 17 << 20, SizeBytes: 40 << 20},
+		}},
+	}
+	r := NewCommandRunner("/mnt/clone", StrategyLayoutFile, nil, nil, "sda", false, false)
+	if err := r.Run(step); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if target != "/dev/sda" {
+		t.Fatalf("expected table to be written to /dev/sda, got %q", target)
+	}
+	if len(cmds) != 1 || cmds[0] != "partprobe /dev/sda" {
+		t.Fatalf("expected only partprobe to run, got %v", cmds)
+	}
+
+	table, err := parttable.ReadFile(img)
+	if err != nil {
+		t.Fatalf("cannot read written table: %v", err)
+	}
+	p2, ok := table.Partition(2)
+	if table.Type != "gpt" || !ok || p2.StartBytes() != 17<<20 || p2.SizeBytes() != 40<<20 || p2.Type != linuxFilesystemGUID {
+		t.Fatalf("unexpected table written: %+v", table)
+	}
+}
+
+// fakeDisks backs /dev/<name> with image files of the given sizes for the
+// partition table reads and writes of the CommandRunner, and records the
+// commands it runs.
+func fakeDisks(t *testing.T, sizes map[string]int64) (map[string]string, *[]string) {
+	t.Helper()
+	origShell, origRead, origWrite := shellExec, readDiskTable, writePartitionTable
+	t.Cleanup(func() { shellExec, readDiskTable, writePartitionTable = origShell, origRead, origWrite })
+
+	images := make(map[string]string)
+	dir := t.TempDir()
+	for name, size := range sizes {
+		img := filepath.Join(dir, name+".img")
+		if err := os.WriteFile(img, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(img, size); err != nil {
+			t.Fatal(err)
+		}
+		images["/dev/"+name] = img
+	}
+	readDiskTable = func(disk string) (*parttable.Table, int64, error) {
+		return origRead(images[disk])
+	}
+	writePartitionTable = func(disk string, table *parttable.Table) error {
+		return parttable.WriteFile(images[disk], table)
+	}
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		return nil
+	}
+	return images, &cmds
+}
+
+func TestCommandRunner_PrepareDiskClonesTable(t *testing.T) {
+	images, cmds := fakeDisks(t, map[string]int64{"mmcblk0": 64 << 20, "sda": 128 << 20})
+	src := &parttable.Table{Type: "dos", DiskSignature: 0x5e3da3da, Partitions: []parttable.Partition{
+		{Index: 1, StartLBA: 8192, Sectors: 32768, Type: "c", Bootable: true},
+		{Index: 2, StartLBA: 40960, Sectors: 65536, Type: "83"},
+	}}
+	if err := parttable.WriteFile(images["/dev/mmcblk0"], src); err != nil {
+		t.Fatal(err)
+	}
+
+	step := ExecutionStep{
+		Operation:       OpPrepareDisk,
+		SourceDevice:    "/dev/mmcblk0",
+		DestinationDisk: "sda",
+		SizeBytes:       8 << 20,
+		Action:          PartitionAction{Strategy: StrategyCloneTable, Initialize: true},
+	}
+	r := NewCommandRunner("/mnt/clone", StrategyCloneTable, nil, nil, "sda", false, false)
+	if err := r.Run(step); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*cmds) != 1 || (*cmds)[0] != "partprobe /dev/sda" {
+		t.Fatalf("expected only partprobe to run, got %v", *cmds)
+	}
+
+	table, err := parttable.ReadFile(images["/dev/sda"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, _ := table.Partition(1)
+	p2, _ := table.Partition(2)
+	if table.Type != "dos" || len(table.Partitions) != 2 || table.DiskSignature == src.DiskSignature {
+		t.Fatalf("expected a copy of the source table with a new disk identifier, got %+v", table)
+	}
+	if p1.StartLBA != 8192 || p1.SizeBytes() != 8<<20 || p1.Type != "c" || !p1.Bootable {
+		t.Fatalf("expected partition 1 resized to 8MiB, got %+v", p1)
+	}
+	if p2.StartLBA != 40960 || p2.Sectors != 65536 || p2.Type != "83" {
+		t.Fatalf("expected partition 2 to be copied, got %+v", p2)
+	}
+
+	// Partition 1 cannot grow into partition 2.
+	step.SizeBytes = 32 << 20
+	if err := r.Run(step); err == nil || !strings.Contains(err.Error(), "partition 1 cannot grow to 32.0 MiB") {
+		t.Fatalf("expected an error for an overlapping partition 1, got %v", err)
+	}
+}
+
+func TestCommandRunner_PrepareDiskNewLayoutGPT(t *testing.T) {
+	images, _ := fakeDisks(t, map[string]int64{"sda": 64 << 20})
+	step := ExecutionStep{
+		Operation:       OpPrepareDisk,
+		DestinationDisk: "sda",
+		SizeBytes:       16 << 20,
+		Action:          PartitionAction{Strategy: StrategyNewLayoutGPT, Initialize: true},
+	}
+	r := NewCommandRunner("/mnt/clone", StrategyNewLayoutGPT, nil, nil, "sda", false, false)
+	if err := r.Run(step); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	table, err := parttable.ReadFile(images["/dev/sda"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, _ := table.Partition(1)
+	p2, _ := table.Partition(2)
+	if table.Type != "gpt" || p1.StartBytes() != 1<<20 || p1.SizeBytes() != 16<<20 || p1.Type != efiSystemGUID {
+		t.Fatalf("unexpected boot partition in %+v", table)
+	}
+	if p2.StartBytes() != 17<<20 || p2.StartBytes()+p2.SizeBytes() != 64<<20-gptBackupBytes || p2.Type != linuxFilesystemGUID {
+		t.Fatalf("expected the root partition to fill the disk, got %+v", p2)
+	}
+}
+
+func TestCommandRunner_GrowPartition(t *testing.T) {
+	images, cmds := fakeDisks(t, map[string]int64{"sda": 64 << 20})
+	dest := &parttable.Table{Type: "dos", DiskSignature: 0x1234abcd, Partitions: []parttable.Partition{
+		{Index: 1, StartLBA: 2048, Sectors: 16384, Type: "c"},
+		{Index: 2, StartLBA: 18432, Sectors: 20480, Type: "83"},
+	}}
+	if err := parttable.WriteFile(images["/dev/sda"], dest); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewCommandRunner("/mnt/clone", StrategyCloneTable, nil, nil, "sda", false, false)
+	if err := r.Run(ExecutionStep{Operation: OpGrowPartition, DestinationDisk: "sda", PartitionIndex: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	table, err := parttable.ReadFile(images["/dev/sda"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, _ := table.Partition(2)
+	if table.DiskSignature != dest.DiskSignature || p2.StartLBA != 18432 || p2.StartBytes()+p2.SizeBytes() != 64<<20 {
+		t.Fatalf("expected partition 2 to fill the disk with the identifiers kept, got %+v", table)
+	}
+	want := []string{"partprobe /dev/sda", "e2fsck -f -p /dev/sda2 || true", "resize2fs /dev/sda2"}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands %v", *cmds)
+	}
+
+	// Partition 1 is followed by partition 2 and cannot grow.
+	if err := r.Run(ExecutionStep{Operation: OpGrowPartition, DestinationDisk: "sda", PartitionIndex: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if table, _ = parttable.ReadFile(images["/dev/sda"]); table.Partitions[0].Sectors != 16384 {
+		t.Fatalf("expected partition 1 to stay in place, got %+v", table)
+	}
+}
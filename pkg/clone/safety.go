@@ -4,24 +4,20 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 )
 
-// CheckPrerequisites ensures the required system commands are available
-// before we attempt any destructive operation.
-func CheckPrerequisites() error {
+// CheckPrerequisites ensures the system commands a run with opts needs are
+// available before we attempt any destructive operation. losetup is only
+// needed to attach image files, as source or destination.
+func CheckPrerequisites(opts PlanOptions) error {
 	if os.Geteuid() != 0 {
 		return fmt.Errorf("Klon must run as root (use sudo) because it manipulates disks and mounts")
 	}
 
 	required := []string{
 		"rsync",
-		"parted",
-		"sfdisk",
-		"fdisk",
-		"findmnt",
-		"lsblk",
+		"partprobe",
 		"mount",
 		"umount",
 		"mkfs.vfat",
@@ -29,7 +25,24 @@ func CheckPrerequisites() error {
 		"e2fsck",
 		"resize2fs",
 	}
+	if IsImageDestination(opts.Destination) || isImageSource(opts.Source) {
+		required = append(required, "losetup")
+	}
+	return checkCommands(required)
+}
+
+// CheckPlanPrerequisites ensures the commands only some plans need are
+// available: e2image for the ext partitions the plan copies block by block.
+func CheckPlanPrerequisites(plan PlanResult) error {
+	for _, p := range plan.Partitions {
+		if p.Action.Block && !p.Action.Skip && strings.HasPrefix(p.FSType, "ext") {
+			return checkCommands([]string{"e2image"})
+		}
+	}
+	return nil
+}
 
+func checkCommands(required []string) error {
 	var missing []string
 	for _, cmd := range required {
 		if _, err := exec.LookPath(cmd); err != nil {
@@ -38,141 +51,147 @@ func CheckPrerequisites() error {
 	}
 
 	if len(missing) > 0 {
-		return fmt.Errorf("missing required commands: %s. Please install them before running Klon (e.g., apt-get install rsync parted fdisk util-linux dosfstools e2fsprogs)", strings.Join(missing, ", "))
+		return fmt.Errorf("missing required commands: %s. Please install them before running Klon (e.g., apt-get install rsync parted util-linux dosfstools e2fsprogs)", strings.Join(missing, ", "))
 	}
 	return nil
 }
 
+// isImageSource reports whether the --source spec is an image file that is
+// attached to a loop device; compressed images are restored instead.
+func isImageSource(spec string) bool {
+	if spec == "" || ImageFormatOf(spec).Compressed() {
+		return false
+	}
+	st, err := os.Stat(spec)
+	return err == nil && st.Mode().IsRegular()
+}
+
 // ValidateCloneSafety performs safety checks before a destructive clone:
 // - destination must not be the same disk as the boot/source disk
+// - with --source, destination must not be the running system's disk either
 // - destination must look like a whole disk (not a partition)
 // - destination device must exist
 // - destination disk must not be smaller than the source disk
 // - destination disk must not be mounted
+//
+// Image file destinations get their own checks (see IsImageDestination).
 func ValidateCloneSafety(plan PlanResult, opts PlanOptions) error {
+	if IsImageDestination(opts.Destination) {
+		return validateImageDestination(plan, opts)
+	}
 	srcDisk := plan.SourceDisk
 	dstDisk := ensureDevPrefix(opts.Destination)
 
-	if sameDisk(srcDisk, dstDisk) {
+	if hostDevices.sameDisk(srcDisk, dstDisk) {
 		return fmt.Errorf("refusing to clone to %s: it is the boot/source disk. Pick another disk to avoid wiping your running system", dstDisk)
 	}
-
-	if looksLikePartition(dstDisk) {
-		return fmt.Errorf("destination %s looks like a partition; use a whole disk name (e.g. sda, nvme0n1) so Klon can recreate the partition table safely", dstDisk)
+	// With --source the running system is not the source, but must not be
+	// overwritten either.
+	if opts.Source != "" {
+		if boot, err := (localSystem{}).BootDisk(); err == nil && hostDevices.sameDisk(boot, dstDisk) {
+			return fmt.Errorf("refusing to clone to %s: the running system boots from it", dstDisk)
+		}
 	}
 
-	if _, err := os.Stat(dstDisk); err != nil {
-		return fmt.Errorf("destination disk %s does not exist or is not accessible. Check the cabling/USB adapter and permissions: %w", dstDisk, err)
+	if err := checkWholeDisk(dstDisk); err != nil {
+		return err
 	}
 
+	// A layout computed at plan time (e.g. shrink-table) was already checked
+	// against the destination size, so a smaller disk is expected there.
 	srcSize, _ := diskSizeBytes(srcDisk)
 	dstSize, _ := diskSizeBytes(dstDisk)
-	if srcSize > 0 && dstSize > 0 && dstSize < srcSize {
+	if plan.DestinationLayout == nil && srcSize > 0 && dstSize > 0 && dstSize < srcSize {
 		if !opts.ForceSync {
-			return fmt.Errorf("destination disk %s (%d bytes) is smaller than source disk %s (%d bytes). Use a larger disk or shrink the source first, or rerun with -F to force (may fail)", dstDisk, dstSize, srcDisk, srcSize)
+			return fmt.Errorf("destination disk %s (%d bytes) is smaller than source disk %s (%d bytes). Use a larger disk, the shrink-table strategy, or rerun with -F to force (may fail)", dstDisk, dstSize, srcDisk, srcSize)
 		}
 	}
 
-	if mountPoint, err := deviceMountpoint(dstDisk); err == nil && mountPoint != "" {
-		return fmt.Errorf("destination disk %s is mounted at %s; please unmount it before cloning", dstDisk, mountPoint)
-	}
-	if parts, err := mountedPartitionsOfDisk(dstDisk); err == nil && len(parts) > 0 {
-		return fmt.Errorf("destination disk %s has mounted partitions: %s; please unmount them before cloning", dstDisk, strings.Join(parts, ", "))
-	}
-
-	return nil
+	return checkUnmounted(dstDisk)
 }
 
-func sameDisk(a, b string) bool {
-	baseA := baseDiskFromDevice(ensureDevPrefix(a))
-	baseB := baseDiskFromDevice(ensureDevPrefix(b))
-	return baseA == baseB
+// ValidateRestoreSafety performs the checks of ValidateCloneSafety that
+// apply before a compressed image is written over a whole disk. The image
+// itself must not be stored on that disk.
+func ValidateRestoreSafety(image, dest string) error {
+	dstDisk := ensureDevPrefix(dest)
+	sys := localSystem{}
+	if boot, err := sys.BootDisk(); err == nil && hostDevices.sameDisk(boot, dstDisk) {
+		return fmt.Errorf("refusing to restore onto %s: the running system boots from it", dstDisk)
+	}
+	if err := checkWholeDisk(dstDisk); err != nil {
+		return err
+	}
+	if mounts, err := sys.Mounts(); err == nil {
+		if dev, err := sys.resolvePathDevice(mounts, image, 0); err == nil && hostDevices.sameDisk(dev, dstDisk) {
+			return fmt.Errorf("refusing to restore %s onto %s: the image is stored on that disk", image, dstDisk)
+		}
+	}
+	return checkUnmounted(dstDisk)
 }
 
-// looksLikePartition returns true if the given /dev name appears to be a
-// partition (e.g. /dev/sda1, /dev/mmcblk0p1).
-func looksLikePartition(dev string) bool {
-	name := strings.TrimPrefix(dev, "/dev/")
-
-	// mmcblk0p1, nvme0n1p2 style
-	if strings.HasPrefix(name, "mmcblk") || strings.HasPrefix(name, "nvme") {
-		if idx := strings.LastIndex(name, "p"); idx != -1 && idx < len(name)-1 {
-			part := name[idx+1:]
-			if _, err := strconv.Atoi(part); err == nil {
-				return true
-			}
-		}
-		return false
+// checkWholeDisk makes sure a destination is an existing whole disk.
+func checkWholeDisk(dstDisk string) error {
+	if hostDevices.isPartition(dstDisk) {
+		return fmt.Errorf("destination %s looks like a partition; use a whole disk name (e.g. sda, nvme0n1) so Klon can recreate the partition table safely", dstDisk)
 	}
 
-	// sda1, sdb2 style
-	if len(name) == 0 {
-		return false
+	if _, err := os.Stat(dstDisk); err != nil {
+		return fmt.Errorf("destination disk %s does not exist or is not accessible. Check the cabling/USB adapter and permissions: %w", dstDisk, err)
 	}
-	last := name[len(name)-1]
-	return last >= '0' && last <= '9'
+	return nil
 }
 
-func diskSizeBytes(dev string) (uint64, error) {
-	dev = ensureDevPrefix(dev)
-	cmd := exec.Command("lsblk", "-b", "-dn", "-o", "SIZE", dev)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, fmt.Errorf("lsblk failed for %s: %w", dev, err)
+// checkUnmounted makes sure neither a destination disk nor any of its
+// partitions is mounted.
+func checkUnmounted(dstDisk string) error {
+	if mountPoint, err := deviceMountpoint(dstDisk); err == nil && mountPoint != "" {
+		return fmt.Errorf("destination disk %s is mounted at %s; please unmount it before cloning", dstDisk, mountPoint)
 	}
-	text := strings.TrimSpace(string(out))
-	if text == "" {
-		return 0, fmt.Errorf("lsblk returned empty size for %s", dev)
+	if parts, err := mountedPartitionsOfDisk(dstDisk); err == nil && len(parts) > 0 {
+		return fmt.Errorf("destination disk %s has mounted partitions: %s; please unmount them before cloning", dstDisk, strings.Join(parts, ", "))
 	}
-	val, err := strconv.ParseUint(text, 10, 64)
+	return nil
+}
+
+func diskSizeBytes(dev string) (uint64, error) {
+	size, err := localSystem{}.DiskSize(dev)
 	if err != nil {
-		return 0, fmt.Errorf("cannot parse lsblk size %q for %s: %w", text, dev, err)
+		return 0, err
 	}
-	return val, nil
+	return uint64(size), nil
 }
 
 func partUUID(dev string) (string, error) {
-	dev = ensureDevPrefix(dev)
-	cmd := exec.Command("lsblk", "-no", "PARTUUID", dev)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("lsblk PARTUUID failed for %s: %w", dev, err)
-	}
-	return strings.TrimSpace(string(out)), nil
+	id, _, err := localSystem{}.partitionIdentity(ensureDevPrefix(dev))
+	return id, err
 }
 
+// deviceMountpoint returns where the device itself (not its partitions) is
+// mounted, or "" when it is not.
 func deviceMountpoint(dev string) (string, error) {
-	dev = ensureDevPrefix(dev)
-	cmd := exec.Command("findmnt", "-n", "-o", "TARGET", dev)
-	out, err := cmd.CombinedOutput()
+	sys := localSystem{}
+	bd, err := sys.BlockDevice(ensureDevPrefix(dev))
 	if err != nil {
-		// If the device is not mounted, findmnt returns non-zero; that's fine.
-		return "", nil
+		return "", err
 	}
-	return strings.TrimSpace(string(out)), nil
-}
-
-func mountedPartitionsOfDisk(dev string) ([]string, error) {
-	base := strings.TrimPrefix(ensureDevPrefix(dev), "/dev/")
-	cmd := exec.Command("lsblk", "-nr", "-o", "NAME,MOUNTPOINT")
-	out, err := cmd.CombinedOutput()
+	mounts, err := sys.Mounts()
 	if err != nil {
-		return nil, fmt.Errorf("lsblk mount scan failed: %w", err)
+		return "", err
 	}
+	for _, m := range mounts {
+		if m.MajMin == bd.MajMin {
+			return m.Mountpoint, nil
+		}
+	}
+	return "", nil
+}
 
+func mountedPartitionsOfDisk(dev string) ([]string, error) {
 	var mounted []string
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) != 2 {
-			continue
-		}
-		name, mnt := fields[0], fields[1]
-		if mnt == "" || mnt == "-" {
-			continue
-		}
-		if strings.HasPrefix(name, base) && name != base {
-			mounted = append(mounted, fmt.Sprintf("/dev/%s -> %s", name, mnt))
+	for _, p := range allPartitionsIncludingUnmounted(dev) {
+		if p.Mountpoint != "" {
+			mounted = append(mounted, fmt.Sprintf("%s -> %s", p.Device, p.Mountpoint))
 		}
 	}
 	return mounted, nil
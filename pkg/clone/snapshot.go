@@ -0,0 +1,284 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SnapshotMethod is how a mounted source filesystem is kept consistent while
+// it is synced (see PlanOptions.Snapshot).
+type SnapshotMethod string
+
+const (
+	// SnapshotLVM syncs from a read-only mount of an LVM snapshot of the
+	// source logical volume.
+	SnapshotLVM SnapshotMethod = "lvm"
+	// SnapshotBtrfs syncs from a read-only btrfs snapshot of the source
+	// subvolume.
+	SnapshotBtrfs SnapshotMethod = "btrfs"
+	// SnapshotFreeze freezes the source filesystem with fsfreeze for the
+	// duration of the sync.
+	SnapshotFreeze SnapshotMethod = "fsfreeze"
+	// SnapshotRemountRO remounts the source read-only for the duration of
+	// the sync; FAT does not support fsfreeze.
+	SnapshotRemountRO SnapshotMethod = "remount-ro"
+)
+
+// freezeMaxBytes is the most data a partition may hold to be frozen or
+// remounted read-only: writers block until the sync is done, so only small
+// boot partitions qualify (see bootMountpoint).
+const freezeMaxBytes = 1 << 30
+
+// lvmSnapshotMinBytes is the least room an LVM snapshot gets for the blocks
+// written to its origin while it is synced.
+const lvmSnapshotMinBytes = 256 << 20
+
+// SourceSnapshot records how a synced partition is snapshotted.
+type SourceSnapshot struct {
+	Method SnapshotMethod `json:"method"`
+	// Volume is the logical volume ("vg/lv") for SnapshotLVM.
+	Volume string `json:"volume,omitempty"`
+	// SizeBytes is the size of the LVM snapshot: how much may change on
+	// the volume while it is synced before the snapshot becomes invalid.
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+}
+
+func (s SourceSnapshot) String() string {
+	switch s.Method {
+	case SnapshotLVM:
+		return fmt.Sprintf("LVM snapshot of %s (room for %s of changes)", s.Volume, formatBytes(s.SizeBytes))
+	case SnapshotBtrfs:
+		return "read-only btrfs snapshot"
+	case SnapshotFreeze:
+		return "frozen with fsfreeze while syncing"
+	case SnapshotRemountRO:
+		return "remounted read-only while syncing"
+	}
+	return string(s.Method)
+}
+
+// mountInspector is implemented by System values that can resolve the
+// devices behind mounted filesystems.
+type mountInspector interface {
+	Mounts() ([]MountInfo, error)
+	blockDeviceByNumber(majmin string) (BlockDevice, error)
+}
+
+// planSnapshots decides, when opts.Snapshot is set, how every synced and
+// mounted source partition is kept consistent: LVM and btrfs sources are
+// snapshotted, small partitions are frozen, and the others are synced live
+// with the reason recorded in SnapshotNote.
+func planSnapshots(sys System, result *PlanResult, opts PlanOptions) {
+	if !opts.Snapshot || opts.Source != "" {
+		return
+	}
+	mi, ok := sys.(mountInspector)
+	var mounts []MountInfo
+	if ok {
+		mounts, _ = mi.Mounts()
+	}
+	for i := range result.Partitions {
+		p := &result.Partitions[i]
+		if !p.Action.Sync || p.Action.Skip || p.Action.Block || p.Mountpoint == "" {
+			continue
+		}
+		if !ok {
+			p.SnapshotNote = "the source mounts cannot be inspected"
+			continue
+		}
+		m, found := mountAt(mounts, p.Mountpoint)
+		if !found {
+			p.SnapshotNote = fmt.Sprintf("%s is not in the mount table", p.Mountpoint)
+			continue
+		}
+		var dev BlockDevice
+		if m.FSType != "btrfs" {
+			dev, _ = mi.blockDeviceByNumber(m.MajMin)
+		}
+		p.Snapshot, p.SnapshotNote = snapshotFor(*p, m, dev)
+		if p.Snapshot != nil && p.Snapshot.Method == SnapshotBtrfs {
+			// A btrfs snapshot stops at nested subvolumes, leaving empty
+			// directories in their place.
+			subs, err := nestedSubvolumes(context.Background(), p.Mountpoint)
+			switch {
+			case err != nil:
+				p.Snapshot, p.SnapshotNote = nil, fmt.Sprintf("cannot list the subvolumes of %s: %v", p.Mountpoint, err)
+			case len(subs) > 0:
+				p.Snapshot, p.SnapshotNote = nil, fmt.Sprintf("a btrfs snapshot leaves out the nested subvolumes %s", strings.Join(subs, ", "))
+			}
+		}
+	}
+}
+
+// nestedSubvolumes lists the btrfs subvolumes below the one mounted at
+// mountpoint; tests can override it.
+var nestedSubvolumes = func(ctx context.Context, mountpoint string) ([]string, error) {
+	out, err := shellOutput(ctx, "btrfs subvolume list -o "+shellQuote(mountpoint))
+	if err != nil {
+		return nil, err
+	}
+	var subs []string
+	for _, line := range strings.Split(out, "\n") {
+		// ID 258 gen 12 top level 256 path @/var/lib/docker
+		if _, path, ok := strings.Cut(line, " path "); ok {
+			subs = append(subs, strings.TrimSpace(path))
+		}
+	}
+	return subs, nil
+}
+
+// snapshotFor picks the snapshot method for partition p, mounted as m from
+// device dev, or returns why it is synced live.
+func snapshotFor(p PartitionPlan, m MountInfo, dev BlockDevice) (*SourceSnapshot, string) {
+	switch {
+	case p.SourcePath != "" || len(p.Excludes) > 0:
+		return nil, "the layout file splits or moves its data"
+	case m.FSType == "btrfs":
+		return &SourceSnapshot{Method: SnapshotBtrfs}, ""
+	case dev.Type == DeviceMapper && strings.HasPrefix(dev.DMUUID, "LVM-"):
+		vg, lv, ok := splitDMName(dev.DMName)
+		if !ok {
+			return nil, fmt.Sprintf("cannot tell the volume group of %s", dev.Path)
+		}
+		return &SourceSnapshot{Method: SnapshotLVM, Volume: vg + "/" + lv, SizeBytes: lvmSnapshotSize(p)}, ""
+	case p.Mountpoint == "/":
+		return nil, "the root filesystem is neither on LVM nor on btrfs and cannot be frozen while the system runs"
+	case !bootMountpoint(p.Mountpoint):
+		return nil, fmt.Sprintf("only boot partitions are frozen: writers to %s, such as logs, would block until it is synced", p.Mountpoint)
+	case p.UsedBytes <= 0 || p.UsedBytes > freezeMaxBytes:
+		return nil, fmt.Sprintf("only partitions holding up to %s are frozen", formatBytes(freezeMaxBytes))
+	case m.FSType == "vfat":
+		return &SourceSnapshot{Method: SnapshotRemountRO}, ""
+	case strings.HasPrefix(m.FSType, "ext") || m.FSType == "xfs":
+		return &SourceSnapshot{Method: SnapshotFreeze}, ""
+	}
+	return nil, fmt.Sprintf("%s cannot be frozen", m.FSType)
+}
+
+// bootMountpoint reports whether mountpoint is /boot or below it, such as
+// /boot/firmware or /boot/efi: the only filesystems frozen while they are
+// synced, as they are rarely written while the system runs. Freezing /var or
+// a filesystem holding Klon's own logs or state would block Klon itself.
+func bootMountpoint(mountpoint string) bool {
+	return mountpoint == "/boot" || strings.HasPrefix(mountpoint, "/boot/")
+}
+
+// lvmSnapshotSize sizes the LVM snapshot of partition p: a fifth of the
+// partition, at least lvmSnapshotMinBytes, and never more than the
+// partition itself, which is all a snapshot can ever need.
+func lvmSnapshotSize(p PartitionPlan) int64 {
+	size := max(p.SizeBytes/5, lvmSnapshotMinBytes)
+	if p.SizeBytes > 0 {
+		size = min(size, p.SizeBytes)
+	}
+	return size
+}
+
+// mountAt returns the mount that is visible at mountpoint: the last one
+// mounted there.
+func mountAt(mounts []MountInfo, mountpoint string) (MountInfo, bool) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Mountpoint == mountpoint {
+			return mounts[i], true
+		}
+	}
+	return MountInfo{}, false
+}
+
+// splitDMName splits the device-mapper name of an LVM logical volume into
+// the volume group and volume names. LVM joins them with "-" and doubles
+// the dashes inside each name.
+func splitDMName(name string) (vg, lv string, ok bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '-' {
+			i++
+			continue
+		}
+		vg = strings.ReplaceAll(name[:i], "--", "-")
+		lv = strings.ReplaceAll(name[i+1:], "--", "-")
+		return vg, lv, vg != "" && lv != ""
+	}
+	return "", "", false
+}
+
+// takeSnapshot makes the source of a sync step consistent according to
+// step.Snapshot. It returns the directory to sync from and a function that
+// releases the snapshot, thaws or remounts the source read-write. Snapshots
+// are named after the process and kept in the mount registry, so that
+// `klon cleanup` releases those of a run that crashed.
+func (r *CommandRunner) takeSnapshot(step ExecutionStep) (string, func(), error) {
+	mp := step.Mountpoint
+	release := func(rec SnapshotRecord) func() {
+		return func() {
+			if err := releaseSnapshot(r.ctx, rec); err != nil {
+				logWarning(r.ctx, "%v", err)
+			}
+		}
+	}
+	switch step.Snapshot.Method {
+	case SnapshotBtrfs:
+		dir := filepath.Join(mp, fmt.Sprintf(".klon-snapshot-%d", os.Getpid()))
+		if err := shellExec(r.ctx, fmt.Sprintf("btrfs subvolume snapshot -r %s %s", shellQuote(mp), shellQuote(dir))); err != nil {
+			return "", nil, fmt.Errorf("cannot snapshot %s: %w", mp, err)
+		}
+		rec := SnapshotRecord{Method: SnapshotBtrfs, Target: dir}
+		recordSnapshot(rec)
+		return dir, release(rec), nil
+
+	case SnapshotLVM:
+		vg, lv, _ := strings.Cut(step.Snapshot.Volume, "/")
+		name := fmt.Sprintf("%s-klon-snap-%d", lv, os.Getpid())
+		size := max(step.Snapshot.SizeBytes, lvmSnapshotMinBytes)
+		cmd := fmt.Sprintf("lvcreate --snapshot --size %dm --name %s %s", (size+1<<20-1)>>20, name, step.Snapshot.Volume)
+		if err := shellExec(r.ctx, cmd); err != nil {
+			return "", nil, fmt.Errorf("cannot snapshot %s: %w. Does volume group %s have %s free?", step.Snapshot.Volume, err, vg, formatBytes(size))
+		}
+		rec := SnapshotRecord{Method: SnapshotLVM, Target: vg + "/" + name}
+		recordSnapshot(rec)
+		removeSnap := release(rec)
+		dir, err := os.MkdirTemp("", "klon-snap-*")
+		if err != nil {
+			removeSnap()
+			return "", nil, err
+		}
+		// The snapshot may carry a dirty journal, which a read-only mount
+		// replays into the snapshot; xfs refuses the duplicate UUID unless
+		// told otherwise.
+		options := "ro"
+		if step.FSType == "xfs" {
+			options = "ro,nouuid"
+		}
+		if err := mountFS(r.ctx, options, "/dev/"+rec.Target, dir, true); err != nil {
+			os.Remove(dir)
+			removeSnap()
+			return "", nil, fmt.Errorf("cannot mount snapshot %s: %w", rec.Target, err)
+		}
+		return dir, func() {
+			if err := unmountFS(r.ctx, dir); err != nil {
+				logWarning(r.ctx, "%v", err)
+			}
+			removeSnap()
+		}, nil
+
+	case SnapshotFreeze, SnapshotRemountRO:
+		// Recorded before the source is frozen: the registry may be on it.
+		rec := SnapshotRecord{Method: step.Snapshot.Method, Target: mp}
+		recordSnapshot(rec)
+		cmd, failed := "fsfreeze --freeze "+shellQuote(mp), "cannot freeze %s: %w"
+		if rec.Method == SnapshotRemountRO {
+			cmd, failed = "mount -o remount,ro "+shellQuote(mp), "cannot remount %s read-only: %w"
+		}
+		if err := shellExec(r.ctx, cmd); err != nil {
+			forgetSnapshot(rec)
+			return "", nil, fmt.Errorf(failed, mp, err)
+		}
+		return mp, release(rec), nil
+	}
+	return "", nil, fmt.Errorf("unknown snapshot method %q", step.Snapshot.Method)
+}
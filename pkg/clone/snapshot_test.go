@@ -0,0 +1,190 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// usedBytesSystem reports fixed used bytes for the mounted filesystems of a
+// fake sysfs tree instead of asking statfs about the host's.
+type usedBytesSystem struct {
+	localSystem
+	used map[string]int64
+}
+
+func (s usedBytesSystem) PartitionDetails(device, mountpoint string) (PartitionDetails, error) {
+	d, err := s.localSystem.PartitionDetails(device, mountpoint)
+	d.UsedBytes = s.used[mountpoint]
+	return d, err
+}
+
+func TestPlanSnapshots(t *testing.T) {
+	f := lvmRootTree(t, "LVM-Zq0fDkX1")
+	f.partition("sda", "sda3", "8:3", 3, 22020096, 2048)
+	f.write("/proc/self/mountinfo", "21 1 253:0 / / rw,relatime - ext4 /dev/mapper/vg0-root rw\n"+
+		"22 21 8:1 / /boot rw,relatime - ext4 /dev/sda1 rw\n"+
+		"23 22 8:3 / /boot/firmware rw,relatime - vfat /dev/sda3 rw\n"+
+		"24 21 8:10 / /var/lib rw,relatime - ext4 /dev/sda10 rw\n")
+	sys := usedBytesSystem{localSystem: f.system(), used: map[string]int64{
+		"/": 4 << 30, "/boot": 200 << 20, "/boot/firmware": 60 << 20, "/var/lib": 200 << 20,
+	}}
+
+	plan, err := PlanWithSystem(sys, PlanOptions{Destination: "nvme0n1", Snapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range plan.Partitions {
+		s := p.Mountpoint + ": "
+		if p.Snapshot != nil {
+			s += p.Snapshot.String()
+		}
+		got = append(got, s+p.SnapshotNote)
+	}
+	want := []string{
+		"/boot: frozen with fsfreeze while syncing",
+		"/: LVM snapshot of vg0/root (room for 2.0 GiB of changes)",
+		"/boot/firmware: remounted read-only while syncing",
+		"/var/lib: only boot partitions are frozen: writers to /var/lib, such as logs, would block until it is synced",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected snapshots:\n%s", strings.Join(got, "\n"))
+	}
+	if out := plan.String(); !strings.Contains(out, "source: LVM snapshot of vg0/root (room for 2.0 GiB") || !strings.Contains(out, "live sync without snapshot: only boot partitions") {
+		t.Fatalf("expected snapshots in the plan output:\n%s", out)
+	}
+
+	// A root filesystem on a plain partition cannot be snapshotted, and a
+	// large boot partition is not frozen.
+	f.write("/proc/self/mountinfo", "21 1 8:2 / / rw - ext4 /dev/sda2 rw\n"+
+		"22 21 8:1 / /boot rw - ext4 /dev/sda1 rw\n")
+	sys.used["/boot"] = 2 << 30
+	if plan, err = PlanWithSystem(sys, PlanOptions{Destination: "nvme0n1", Snapshot: true}); err != nil {
+		t.Fatal(err)
+	}
+	notes := []string{"only partitions holding up to 1.0 GiB are frozen", "neither on LVM nor on btrfs"}
+	for i, p := range plan.Partitions {
+		if p.Snapshot != nil || !strings.Contains(p.SnapshotNote, notes[i]) {
+			t.Fatalf("unexpected snapshot for %s: %+v", p.Mountpoint, p)
+		}
+	}
+}
+
+func TestPlanSnapshots_NestedBtrfsSubvolumes(t *testing.T) {
+	orig := nestedSubvolumes
+	t.Cleanup(func() { nestedSubvolumes = orig })
+	nestedSubvolumes = func(ctx context.Context, mountpoint string) ([]string, error) {
+		switch mountpoint {
+		case "/home":
+			return []string{"@home/pi/.cache", "@home/pi/vms"}, nil
+		case "/data":
+			return nil, errors.New("btrfs: not found")
+		}
+		return nil, nil
+	}
+	f := standardTree(t)
+	f.write("/proc/self/mountinfo", "21 1 0:40 /@srv /srv rw - btrfs /dev/sda1 rw\n"+
+		"22 1 0:40 /@home /home rw - btrfs /dev/sda1 rw\n"+
+		"23 1 0:41 / /data rw - btrfs /dev/sda10 rw\n")
+	synced := func(mountpoint string) PartitionPlan {
+		return PartitionPlan{Mountpoint: mountpoint, Action: PartitionAction{Sync: true}, PartitionDetails: PartitionDetails{FSType: "btrfs"}}
+	}
+	plan := PlanResult{Partitions: []PartitionPlan{synced("/srv"), synced("/home"), synced("/data")}}
+	planSnapshots(f.system(), &plan, PlanOptions{Snapshot: true})
+
+	if p := plan.Partitions[0]; p.Snapshot == nil || p.Snapshot.Method != SnapshotBtrfs {
+		t.Fatalf("expected /srv to be snapshotted, got %+v", p)
+	}
+	if p := plan.Partitions[1]; p.Snapshot != nil || p.SnapshotNote != "a btrfs snapshot leaves out the nested subvolumes @home/pi/.cache, @home/pi/vms" {
+		t.Fatalf("expected /home to be synced live, got %+v", p)
+	}
+	if p := plan.Partitions[2]; p.Snapshot != nil || !strings.Contains(p.SnapshotNote, "cannot list the subvolumes of /data") {
+		t.Fatalf("expected /data to be synced live, got %+v", p)
+	}
+}
+
+func TestSplitDMName(t *testing.T) {
+	cases := map[string][2]string{
+		"vg0-root":          {"vg0", "root"},
+		"my--vg-home--data": {"my-vg", "home-data"},
+	}
+	for name, want := range cases {
+		vg, lv, ok := splitDMName(name)
+		if !ok || vg != want[0] || lv != want[1] {
+			t.Fatalf("splitDMName(%q) = %q, %q, %v", name, vg, lv, ok)
+		}
+	}
+	if _, _, ok := splitDMName("luks--root"); ok {
+		t.Fatalf("expected a name without a separator to fail")
+	}
+}
+
+func TestLVMSnapshotSize(t *testing.T) {
+	for size, want := range map[int64]int64{
+		0:         lvmSnapshotMinBytes,
+		100 << 20: 100 << 20,
+		1 << 30:   lvmSnapshotMinBytes,
+		20 << 30:  4 << 30,
+	} {
+		if got := lvmSnapshotSize(PartitionPlan{PartitionDetails: PartitionDetails{SizeBytes: size}}); got != want {
+			t.Errorf("lvmSnapshotSize(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestCommandRunner_SyncFromSnapshot(t *testing.T) {
+	cmds := fakeMountCommands(t)
+	registry := t.TempDir()
+	SetMountRegistry(registry)
+	pid := strconv.Itoa(os.Getpid())
+
+	r := NewCommandRunner(t.TempDir(), StrategyCloneTable, nil, nil, "sdb", false, false)
+	step := ExecutionStep{Operation: OpSyncFilesystem, Mountpoint: "/boot", Snapshot: &SourceSnapshot{Method: SnapshotFreeze}}
+	dir, release, err := r.takeSnapshot(step)
+	if err != nil || dir != "/boot" {
+		t.Fatalf("unexpected snapshot %q, %v", dir, err)
+	}
+	// The registry lists the frozen filesystem until it is thawed.
+	data, err := os.ReadFile(filepath.Join(registry, pid+".json"))
+	if err != nil || !strings.Contains(string(data), `"fsfreeze"`) {
+		t.Fatalf("expected the registry to list the frozen /boot, got %s, %v", data, err)
+	}
+	release()
+
+	step.Mountpoint, step.Snapshot = "/srv", &SourceSnapshot{Method: SnapshotBtrfs}
+	if dir, release, err = r.takeSnapshot(step); err != nil || dir != "/srv/.klon-snapshot-"+pid {
+		t.Fatalf("unexpected snapshot %q, %v", dir, err)
+	}
+	release()
+
+	step.Mountpoint, step.FSType, step.Snapshot = "/", "xfs", &SourceSnapshot{Method: SnapshotLVM, Volume: "vg0/root", SizeBytes: 1 << 30}
+	if dir, release, err = r.takeSnapshot(step); err != nil || !strings.Contains(dir, "klon-snap-") {
+		t.Fatalf("unexpected snapshot %q, %v", dir, err)
+	}
+	release()
+	if len(mounts.snapshots) != 0 {
+		t.Fatalf("expected every snapshot to be released, got %+v", mounts.snapshots)
+	}
+	if _, err := os.Stat(filepath.Join(registry, pid+".json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the registry to be removed, got %v", err)
+	}
+
+	want := []string{
+		"fsfreeze --freeze '/boot'",
+		"fsfreeze --unfreeze '/boot'",
+		"btrfs subvolume snapshot -r '/srv' '/srv/.klon-snapshot-" + pid + "'",
+		"btrfs subvolume delete '/srv/.klon-snapshot-" + pid + "'",
+		"lvcreate --snapshot --size 1024m --name root-klon-snap-" + pid + " vg0/root",
+		"mount -o ro,nouuid /dev/vg0/root-klon-snap-" + pid + " " + dir,
+		"umount " + dir,
+		"lvremove -f vg0/root-klon-snap-" + pid,
+	}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(*cmds, "\n"))
+	}
+}
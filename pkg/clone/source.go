@@ -0,0 +1,356 @@
+package clone
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceMount is a source that is not the running system: another disk or
+// card, or an image file attached to a loop device. Its filesystems are
+// mounted read-only under a temporary root, laid out as its own fstab
+// describes, so it can be planned and synced like the live root filesystem.
+type SourceMount struct {
+	// Spec is the device or image file the source was opened from.
+	Spec string
+	// Disk is the whole disk holding the source, e.g. /dev/sdb or
+	// /dev/loop4 for an image file.
+	Disk string
+	// Root is the temporary directory the source root filesystem is mounted
+	// on.
+	Root string
+	// Partitions are the mounted source partitions, in partition order, with
+	// the mountpoints they have on the source system ("/", "/boot", ...).
+	Partitions []MountedPartition
+
+	sys        localSystem
+	rootDevice string
+	image      *AttachedImage
+	// mounted lists the directories mounted under Root, in mount order.
+	mounted []string
+}
+
+// OpenSource attaches (for image files) and mounts a source read-only. The
+// partition holding /etc/fstab becomes the root; the other partitions of the
+// source disk listed in that fstab are mounted below it. Close must be
+// called to unmount and detach it again.
+func OpenSource(ctx context.Context, spec string) (*SourceMount, error) {
+	return localSystem{}.openSource(ctx, spec)
+}
+
+func (s localSystem) openSource(ctx context.Context, spec string) (_ *SourceMount, err error) {
+	m := &SourceMount{Spec: spec, sys: s}
+	defer func() {
+		if err != nil {
+			if cerr := m.Close(ctx); cerr != nil {
+				logWarning(ctx, "cannot release source %s: %v", spec, cerr)
+			}
+		}
+	}()
+
+	if ImageFormatOf(spec).Compressed() {
+		return nil, fmt.Errorf("%s is compressed and cannot be mounted; restore it onto a disk with: klon --source %s <disk>", spec, spec)
+	}
+	disk := ensureDevPrefix(spec)
+	if st, serr := os.Stat(spec); serr == nil && st.Mode().IsRegular() {
+		img, err := attachLoop(ctx, spec, true)
+		if err != nil {
+			return nil, err
+		}
+		m.image = img
+		disk = img.LoopDevice
+	}
+
+	names := deviceNames{sys: s}
+	if names.isPartition(disk) {
+		return nil, fmt.Errorf("source %s is a partition; give the whole disk (e.g. sdb) or an image file", spec)
+	}
+	dev, err := s.BlockDevice(disk)
+	if err != nil {
+		return nil, fmt.Errorf("source %s not found: %w", spec, err)
+	}
+	m.Disk = dev.Path
+	if boot, err := s.BootDisk(); err == nil && names.sameDisk(boot, m.Disk) {
+		return nil, fmt.Errorf("source %s is the disk the running system boots from; omit --source to clone the running system", spec)
+	}
+
+	parts, err := s.Partitions(m.Disk)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("source %s has no partitions", spec)
+	}
+	if mounts, err := s.Mounts(); err == nil {
+		mounted := mountpointsByDevice(mounts)
+		for _, p := range parts {
+			if mp := mounted[p.MajMin]; mp != "" {
+				return nil, fmt.Errorf("source partition %s is mounted on %s; unmount it so it can be copied consistently", p.Path, mp)
+			}
+		}
+	}
+
+	m.Root, err = os.MkdirTemp("", "klon-source-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a mountpoint for source %s: %w", spec, err)
+	}
+
+	fsInfo := make(map[string]FilesystemInfo, len(parts))
+	for _, p := range parts {
+		fsInfo[p.Path], _ = s.ProbeFilesystem(p.Path)
+	}
+
+	// The root is the first Linux filesystem that has an /etc/fstab.
+	var root BlockDevice
+	for _, p := range parts {
+		switch fsInfo[p.Path].Type {
+		case "ext2", "ext3", "ext4", "btrfs", "xfs":
+		default:
+			continue
+		}
+		if err := m.mount(ctx, p.Path, fsInfo[p.Path].Type, m.Root); err != nil {
+			logWarning(ctx, "cannot mount source partition %s: %v", p.Path, err)
+			continue
+		}
+		if fileExists(filepath.Join(m.Root, "etc", "fstab")) {
+			root = p
+			break
+		}
+		if err := m.unmountLast(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if root.Path == "" {
+		return nil, fmt.Errorf("no partition of source %s holds a root filesystem with /etc/fstab", spec)
+	}
+	m.rootDevice = root.Path
+	m.Partitions = []MountedPartition{{Device: root.Path, Mountpoint: "/"}}
+
+	data, err := os.ReadFile(filepath.Join(m.Root, "etc", "fstab"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read fstab of source %s: %w", spec, err)
+	}
+	var extra []MountedPartition
+	for _, e := range parseFstab(string(data)) {
+		if e.mountpoint == "/" || !strings.HasPrefix(e.mountpoint, "/") || e.fsType == "swap" {
+			continue
+		}
+		p, ok := s.matchFstabSpec(e.spec, parts, fsInfo)
+		if !ok || p.Path == root.Path {
+			continue
+		}
+		extra = append(extra, MountedPartition{Device: p.Path, Mountpoint: e.mountpoint})
+	}
+	// Parents before the directories mounted inside them.
+	sort.SliceStable(extra, func(i, j int) bool {
+		return strings.Count(extra[i].Mountpoint, "/") < strings.Count(extra[j].Mountpoint, "/")
+	})
+	for _, mp := range extra {
+		target := m.Path(mp.Mountpoint)
+		if st, err := os.Stat(target); err != nil || !st.IsDir() {
+			logWarning(ctx, "source fstab mounts %s on %s, which does not exist on the source root; skipping it", mp.Device, mp.Mountpoint)
+			continue
+		}
+		if err := m.mount(ctx, mp.Device, fsInfo[mp.Device].Type, target); err != nil {
+			return nil, fmt.Errorf("cannot mount source partition %s on %s: %w", mp.Device, mp.Mountpoint, err)
+		}
+		m.Partitions = append(m.Partitions, mp)
+	}
+
+	idx := func(i int) int { return names.partitionIndex(m.Partitions[i].Device) }
+	sort.SliceStable(m.Partitions, func(i, j int) bool { return idx(i) < idx(j) })
+	logSink.Printf("klon: source %s mounted read-only on %s", m.Disk, m.Root)
+	return m, nil
+}
+
+// Path maps a path of the source system to where it is visible on the host.
+func (m *SourceMount) Path(p string) string {
+	return filepath.Join(m.Root, p)
+}
+
+// System returns a System that plans from the mounted source instead of the
+// running system.
+func (m *SourceMount) System() System {
+	return sourceSystem{localSystem: m.sys, src: m}
+}
+
+// Close unmounts the source filesystems, removes the temporary root and
+// detaches the loop device of an image file.
+func (m *SourceMount) Close(ctx context.Context) error {
+	var errs []error
+	for len(m.mounted) > 0 {
+		if err := m.unmountLast(ctx); err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	if m.Root != "" && len(m.mounted) == 0 {
+		// Remove, not RemoveAll: never recurse into a directory that might
+		// still have a filesystem mounted.
+		_ = os.Remove(m.Root)
+	}
+	if m.image != nil && len(m.mounted) == 0 {
+		if err := m.image.Detach(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		m.image = nil
+	}
+	return errors.Join(errs...)
+}
+
+func (m *SourceMount) mount(ctx context.Context, device, fsType, target string) error {
+	if err := mountFS(ctx, readOnlyMountOptions(fsType), device, target, false); err != nil {
+		return err
+	}
+	m.mounted = append(m.mounted, target)
+	return nil
+}
+
+func (m *SourceMount) unmountLast(ctx context.Context) error {
+	target := m.mounted[len(m.mounted)-1]
+	if err := unmountFS(ctx, target); err != nil {
+		return fmt.Errorf("cannot unmount source: %w", err)
+	}
+	m.mounted = m.mounted[:len(m.mounted)-1]
+	return nil
+}
+
+// readOnlyMountOptions returns mount options that keep a filesystem
+// untouched: with plain "ro", ext3/ext4 and xfs still replay their journal.
+func readOnlyMountOptions(fsType string) string {
+	switch fsType {
+	case "ext3", "ext4":
+		return "ro,noload"
+	case "xfs":
+		return "ro,norecovery"
+	}
+	return "ro"
+}
+
+// matchFstabSpec finds the partition an fstab device specification refers
+// to. Plain device names were written for the machine the source came from,
+// so only their partition number is used.
+func (s localSystem) matchFstabSpec(spec string, parts []BlockDevice, fsInfo map[string]FilesystemInfo) (BlockDevice, bool) {
+	for prefix, key := range map[string]string{
+		"/dev/disk/by-partuuid/": "PARTUUID=",
+		"/dev/disk/by-uuid/":     "UUID=",
+		"/dev/disk/by-label/":    "LABEL=",
+	} {
+		if v, ok := strings.CutPrefix(spec, prefix); ok {
+			spec = key + v
+		}
+	}
+	for _, p := range parts {
+		var match bool
+		switch {
+		case strings.HasPrefix(spec, "PARTUUID="):
+			id, _, err := s.partitionIdentity(p.Path)
+			match = err == nil && strings.EqualFold(id, strings.TrimPrefix(spec, "PARTUUID="))
+		case strings.HasPrefix(spec, "UUID="):
+			match = fsInfo[p.Path].UUID != "" && strings.EqualFold(fsInfo[p.Path].UUID, strings.TrimPrefix(spec, "UUID="))
+		case strings.HasPrefix(spec, "LABEL="):
+			match = fsInfo[p.Path].Label != "" && fsInfo[p.Path].Label == strings.TrimPrefix(spec, "LABEL=")
+		case strings.HasPrefix(spec, "/dev/"):
+			match = deviceNames{}.partitionIndex(spec) == p.Partition
+		}
+		if match {
+			return p, true
+		}
+	}
+	return BlockDevice{}, false
+}
+
+// fstabEntry is the part of an /etc/fstab line needed to mount a source.
+type fstabEntry struct {
+	spec       string
+	mountpoint string
+	fsType     string
+}
+
+// parseFstab returns the entries of an fstab file, skipping comments and
+// malformed lines.
+func parseFstab(content string) []fstabEntry {
+	var entries []fstabEntry
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		entries = append(entries, fstabEntry{
+			spec:       unescapeMountPath(fields[0]),
+			mountpoint: unescapeMountPath(fields[1]),
+			fsType:     fields[2],
+		})
+	}
+	return entries
+}
+
+// sourceSystem plans from a SourceMount: its root partition stands in for
+// the boot disk and mountpoints are the source system's own, while usage is
+// measured where they are mounted on the host.
+type sourceSystem struct {
+	localSystem
+	src *SourceMount
+}
+
+func (s sourceSystem) BootDisk() (string, error) {
+	return s.src.rootDevice, nil
+}
+
+// sourceImage returns the absolute path of the image file the source was
+// opened from, or "" for a disk.
+func (s sourceSystem) sourceImage() string {
+	if s.src.image == nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(s.src.Spec); err == nil {
+		return abs
+	}
+	return s.src.Spec
+}
+
+func (s sourceSystem) MountedPartitions(disk string) ([]MountedPartition, error) {
+	if !namesFor(s).sameDisk(disk, s.src.Disk) {
+		return nil, nil
+	}
+	return append([]MountedPartition{}, s.src.Partitions...), nil
+}
+
+// AllParts lists every partition of the source disk, with its source
+// mountpoint when it is mounted.
+func (s sourceSystem) AllParts(disk string) []MountedPartition {
+	parts, err := s.Partitions(disk)
+	if err != nil {
+		return nil
+	}
+	mounted := make(map[string]string)
+	for _, p := range s.src.Partitions {
+		mounted[p.Device] = p.Mountpoint
+	}
+	res := make([]MountedPartition, 0, len(parts))
+	for _, p := range parts {
+		res = append(res, MountedPartition{Device: p.Path, Mountpoint: mounted[p.Path]})
+	}
+	return res
+}
+
+func (s sourceSystem) PartitionDetails(device, mountpoint string) (PartitionDetails, error) {
+	if mountpoint != "" {
+		mountpoint = s.src.Path(mountpoint)
+	}
+	return s.localSystem.PartitionDetails(device, mountpoint)
+}
+
+func (s sourceSystem) ExcludedBytes(mountpoint string, patterns []string) int64 {
+	return s.localSystem.ExcludedBytes(s.src.Path(mountpoint), patterns)
+}
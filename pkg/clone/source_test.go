@@ -0,0 +1,243 @@
+package clone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/woliveiras/klon/pkg/parttable"
+)
+
+// sourceTree extends standardTree with a spare disk, sda, holding a Raspberry
+// Pi OS style system: boot on sda1, root on sda2 and data on sda10.
+func sourceTree(t *testing.T) *fakeSysfs {
+	f := standardTree(t)
+	f.write("/proc/self/mountinfo", "21 1 179:2 / / rw,noatime shared:1 - ext4 /dev/root rw\n")
+	if err := parttable.WriteFile(f.device("sda", 120127488*512), &parttable.Table{
+		Type:          parttable.DOS,
+		DiskSignature: 0x5e3da3da,
+		Partitions: []parttable.Partition{
+			{Index: 1, StartLBA: 2048, Sectors: 1048576, Type: "83"},
+			{Index: 2, StartLBA: 1050624, Sectors: 20971520, Type: "83"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeFileAt(t, f.device("sda1", probeSize), extSuperblockOffset, extSuperblock(0, 0x2, 0))
+	writeFileAt(t, f.device("sda2", probeSize), extSuperblockOffset, extSuperblock(0x4, 0x2c2, 0x1))
+	data := extSuperblock(0x4, 0x2c2, 0x1)
+	copy(data[104:120], []byte{0xd1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10})
+	writeFileAt(t, f.device("sda10", probeSize), extSuperblockOffset, data)
+	return f
+}
+
+const sourceFstab = `proc            /proc           proc    defaults          0       0
+PARTUUID=5e3da3da-01  /boot  ext2  defaults  0  2
+# data disk
+UUID=d1000000-0000-0000-0000-000000000010 /srv ext4 defaults,noatime 0 2
+LABEL=usb-backup /mnt/backup ext4 nofail 0 2
+/dev/mmcblk0p3 none swap sw 0 0
+`
+
+// fakeMounts stands in for mount(8): mounting rootDev creates a root
+// filesystem with the given fstab in the target directory.
+func fakeMounts(t *testing.T, rootDev, fstab string) *[]string {
+	t.Helper()
+	orig := shellExec
+	t.Cleanup(func() {
+		shellExec = orig
+		mounts.mounted = nil
+	})
+	var cmds []string
+	shellExec = func(ctx context.Context, cmdStr string) error {
+		cmds = append(cmds, cmdStr)
+		fields := strings.Fields(cmdStr)
+		if fields[0] == "mount" && fields[3] == rootDev {
+			target := strings.Trim(fields[4], "'")
+			for _, dir := range []string{"etc", "boot", "srv"} {
+				if err := os.MkdirAll(filepath.Join(target, dir), 0o755); err != nil {
+					return err
+				}
+			}
+			return os.WriteFile(filepath.Join(target, "etc", "fstab"), []byte(fstab), 0o644)
+		}
+		return nil
+	}
+	return &cmds
+}
+
+func TestOpenSource(t *testing.T) {
+	f := sourceTree(t)
+	cmds := fakeMounts(t, "/dev/sda2", sourceFstab)
+
+	src, err := f.system().openSource(context.Background(), "sda")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Nothing is really mounted, so the fake root stays behind.
+	t.Cleanup(func() { os.RemoveAll(src.Root) })
+	if src.Disk != "/dev/sda" {
+		t.Fatalf("expected source disk /dev/sda, got %q", src.Disk)
+	}
+	wantParts := []MountedPartition{
+		{Device: "/dev/sda1", Mountpoint: "/boot"},
+		{Device: "/dev/sda2", Mountpoint: "/"},
+		{Device: "/dev/sda10", Mountpoint: "/srv"},
+	}
+	if !reflect.DeepEqual(src.Partitions, wantParts) {
+		t.Fatalf("Partitions = %+v, want %+v", src.Partitions, wantParts)
+	}
+
+	if err := src.Close(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root := src.Root
+	want := []string{
+		// sda1 is tried as the root first but has no /etc/fstab.
+		"mount -o ro /dev/sda1 " + root,
+		"umount " + root,
+		"mount -o ro,noload /dev/sda2 " + root,
+		"mount -o ro /dev/sda1 " + root + "/boot",
+		"mount -o ro,noload /dev/sda10 " + root + "/srv",
+		"umount " + root + "/srv",
+		"umount " + root + "/boot",
+		"umount " + root,
+	}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(*cmds, "\n"))
+	}
+}
+
+func TestOpenSource_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    string
+		setup   func(f *fakeSysfs)
+		wantErr string
+	}{
+		{name: "running system", spec: "/dev/mmcblk0", wantErr: "running system boots from"},
+		{name: "partition", spec: "sda2", wantErr: "is a partition"},
+		{name: "unknown disk", spec: "sdz", wantErr: "not found"},
+		{name: "no partitions", spec: "dm-0", wantErr: "has no partitions"},
+		{
+			name: "mounted partition",
+			spec: "sda",
+			setup: func(f *fakeSysfs) {
+				f.write("/proc/self/mountinfo", "21 1 179:2 / / rw - ext4 /dev/root rw\n30 21 8:10 / /srv rw - ext4 /dev/sda10 rw\n")
+			},
+			wantErr: "/dev/sda10 is mounted on /srv",
+		},
+		{name: "no root filesystem", spec: "sda", wantErr: "no partition of source sda holds a root filesystem"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := sourceTree(t)
+			if tc.setup != nil {
+				tc.setup(f)
+			}
+			cmds := fakeMounts(t, "none", "")
+			if _, err := f.system().openSource(context.Background(), tc.spec); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			mounts := 0
+			for _, c := range *cmds {
+				if strings.HasPrefix(c, "mount ") {
+					mounts++
+				} else {
+					mounts--
+				}
+			}
+			if mounts != 0 {
+				t.Fatalf("expected every mount to be undone, got:\n%s", strings.Join(*cmds, "\n"))
+			}
+		})
+	}
+}
+
+func TestOpenSource_ImageFile(t *testing.T) {
+	f := sourceTree(t)
+	cmds := fakeMounts(t, "none", "")
+	origOutput := shellOutput
+	defer func() { shellOutput = origOutput }()
+	shellOutput = func(ctx context.Context, cmdStr string) (string, error) {
+		*cmds = append(*cmds, cmdStr)
+		return "/dev/loop0\n", nil
+	}
+
+	img := filepath.Join(t.TempDir(), "golden.img")
+	if err := os.WriteFile(img, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// loop0p1 has no filesystem, so the image cannot be used; it must be
+	// detached again.
+	_, err := f.system().openSource(context.Background(), img)
+	if err == nil || !strings.Contains(err.Error(), "holds a root filesystem") {
+		t.Fatalf("expected missing root error, got %v", err)
+	}
+	want := []string{
+		"losetup --find --show --partscan --read-only '" + img + "'",
+		"blockdev --flushbufs /dev/loop0",
+		"losetup --detach /dev/loop0",
+	}
+	if strings.Join(*cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\n%s", strings.Join(*cmds, "\n"))
+	}
+}
+
+func TestSourceSystemPlan(t *testing.T) {
+	f := sourceTree(t)
+	fakeMounts(t, "/dev/sda2", sourceFstab)
+	src, err := f.system().openSource(context.Background(), "sda")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Nothing is really mounted, so the fake root stays behind.
+	t.Cleanup(func() { os.RemoveAll(src.Root) })
+
+	plan, err := PlanWithSystem(src.System(), PlanOptions{Destination: "nvme0n1", AllSync: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.SourceDisk != "/dev/sda" || plan.SourceSizeBytes != 120127488*512 {
+		t.Fatalf("expected the plan to clone /dev/sda, got %s (%d bytes)", plan.SourceDisk, plan.SourceSizeBytes)
+	}
+	var got []string
+	for _, p := range plan.Partitions {
+		got = append(got, p.Device+" "+p.Mountpoint+" "+p.FSType)
+	}
+	want := []string{"/dev/sda1 /boot ext2", "/dev/sda2 / ext4", "/dev/sda10 /srv ext4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected partitions: %q", got)
+	}
+	if plan.Partitions[0].PartUUID != "5e3da3da-01" {
+		t.Fatalf("expected PARTUUID of the source disk, got %q", plan.Partitions[0].PartUUID)
+	}
+}
+
+func TestCommandRunnerSourceDir(t *testing.T) {
+	cases := []struct {
+		root, dir, want string
+	}{
+		{"", "/", "/"},
+		{"", "/usr/", "/usr/"},
+		{"/tmp/klon-source-1", "/", "/tmp/klon-source-1/"},
+		{"/tmp/klon-source-1", "/usr/", "/tmp/klon-source-1/usr/"},
+	}
+	for _, tc := range cases {
+		r := &CommandRunner{SourceRoot: tc.root}
+		if got := r.sourceDir(tc.dir); got != tc.want {
+			t.Fatalf("sourceDir(%q) with root %q = %q, want %q", tc.dir, tc.root, got, tc.want)
+		}
+	}
+}
+
+func TestParseFstab(t *testing.T) {
+	got := parseFstab("# comment\n\nUUID=abc /mnt/my\\040disk ext4 defaults 0 2\nbroken line\n")
+	want := []fstabEntry{{spec: "UUID=abc", mountpoint: "/mnt/my disk", fsType: "ext4"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseFstab = %+v, want %+v", got, want)
+	}
+}
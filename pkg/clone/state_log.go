@@ -1,6 +1,7 @@
 package clone
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -9,7 +10,8 @@ import (
 
 // AppendStateLog appends a human-readable state entry to the given path,
 // describing the plan or apply phase, the source/destination, and the steps.
-// phase is typically "PLAN", "APPLY_SUCCESS" or "APPLY_FAILED".
+// phase is typically "PLAN", "APPLY_SUCCESS" or "APPLY_FAILED"; "PLAN_FAILED"
+// records a run that failed before it could plan, such as a pre-plan hook.
 func AppendStateLog(path string, plan PlanResult, opts PlanOptions, steps []ExecutionStep, phase string, err error) error {
 	f, openErr := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if openErr != nil {
@@ -35,14 +37,38 @@ func AppendStateLog(path string, plan PlanResult, opts PlanOptions, steps []Exec
 	fmt.Fprintf(&b, "force_two_partitions: %v\n", opts.ForceTwoPartitions)
 	fmt.Fprintf(&b, "strategy: %s\n", opts.PartitionStrategy)
 	fmt.Fprintf(&b, "hostname: %s\n", opts.Hostname)
+	if len(plan.Quiesce) > 0 {
+		var units []string
+		for _, u := range plan.Quiesce {
+			switch {
+			case u.Touched:
+				units = append(units, fmt.Sprintf("%s (%s)", u.Unit, u.Mode))
+			case phase != "PLAN":
+				units = append(units, fmt.Sprintf("%s (not touched)", u.Unit))
+			case u.Active:
+				units = append(units, fmt.Sprintf("%s (%s planned)", u.Unit, u.Mode))
+			default:
+				units = append(units, fmt.Sprintf("%s (not running)", u.Unit))
+			}
+		}
+		fmt.Fprintf(&b, "quiesced units: %s\n", strings.Join(units, ", "))
+	}
+	if len(plan.SecondPass) > 0 {
+		fmt.Fprintf(&b, "second pass: %s\n", SecondPassSummary(plan.SecondPass))
+	}
 	fmt.Fprintf(&b, "steps:\n")
 	for _, s := range steps {
 		fmt.Fprintf(&b, "- %s: %s\n", s.Operation, s.Description)
 	}
 
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		fmt.Fprintf(&b, "failed hook: %s %s\n", hookErr.Event, hookErr.Path)
+	}
+
 	if phase == "APPLY_SUCCESS" {
 		fmt.Fprintf(&b, "result: SUCCESS\n\n")
-	} else if phase == "APPLY_FAILED" {
+	} else if phase == "APPLY_FAILED" || phase == "PLAN_FAILED" {
 		fmt.Fprintf(&b, "result: FAILED: %v\n\n", err)
 	} else {
 		fmt.Fprintf(&b, "result: PENDING APPLY\n\n")
@@ -6,15 +6,42 @@ import (
 	"strings"
 )
 
+// rootPseudoExcludes are pseudo filesystems and mount directories that are
+// never copied when syncing the root filesystem.
+var rootPseudoExcludes = []string{
+	"/proc/**",
+	"/sys/**",
+	"/dev/**",
+	"/run/**",
+	"/tmp/**",
+	"/mnt/**",
+	"/media/**",
+}
+
+// rootCacheExcludes avoid copying large, mostly irrelevant runtime and cache
+// directories from the running system by default. Users can override this via
+// --exclude/--exclude-from flags.
+var rootCacheExcludes = []string{
+	"/var/cache/**",
+	"/var/tmp/**",
+	"/var/log/journal/**",
+	"/home/*/.cache/**",
+}
+
+// defaultRootExcludes is every pattern BuildSyncCommand always excludes from
+// the root filesystem sync (apart from the destination root itself).
+var defaultRootExcludes = append(append([]string{}, rootPseudoExcludes...), rootCacheExcludes...)
+
 // BuildSyncCommand builds a rsync command line for a sync-filesystem step.
 // It does not execute anything; it only returns the command string.
 //
 // destRoot is the directory where destination partitions are mounted
 // (for example, "/mnt/clone"). The destination path is derived by joining
 // destRoot with the source mountpoint, except for "/" which maps directly
-// to destRoot.
+// to destRoot. The source is step.SourcePath when set, and step.Excludes
+// are added to the exclude patterns.
 func BuildSyncCommand(step ExecutionStep, destRoot string, extraExcludes []string, extraExcludeFrom []string, deleteDest bool) (string, error) {
-	if step.Operation != "sync-filesystem" {
+	if step.Operation != OpSyncFilesystem {
 		return "", fmt.Errorf("BuildSyncCommand: unsupported operation %q", step.Operation)
 	}
 	if step.Mountpoint == "" {
@@ -25,6 +52,9 @@ func BuildSyncCommand(step ExecutionStep, destRoot string, extraExcludes []strin
 	}
 
 	srcPath := step.Mountpoint
+	if step.SourcePath != "" {
+		srcPath = step.SourcePath
+	}
 	dstPath := destRoot
 
 	if step.Mountpoint != "/" {
@@ -40,10 +70,17 @@ func BuildSyncCommand(step ExecutionStep, destRoot string, extraExcludes []strin
 	if deleteDest {
 		args = append(args, "--delete")
 	}
+	// The second pass reports how many files it changed.
+	if step.Pass > 1 {
+		args = append(args, "--stats")
+	}
 
 	for _, p := range extraExcludes {
 		args = append(args, "--exclude", p)
 	}
+	for _, p := range step.Excludes {
+		args = append(args, "--exclude", p)
+	}
 	for _, f := range extraExcludeFrom {
 		args = append(args, "--exclude-from", f)
 	}
@@ -55,35 +92,21 @@ func BuildSyncCommand(step ExecutionStep, destRoot string, extraExcludes []strin
 		// equivalent) is handled by a separate step.
 		args = append(args, "--one-file-system")
 
-		excludes := []string{
-			"/proc/**",
-			"/sys/**",
-			"/dev/**",
-			"/run/**",
-			"/tmp/**",
-			"/mnt/**",
-			"/media/**",
-		}
+		excludes := append([]string{}, rootPseudoExcludes...)
 		if destRoot != "" {
 			// Explicitly exclude the destination root mountpoint, which lives
 			// under / when mounted (for example, /mnt/clone).
 			excludes = append(excludes, destRoot+"/**")
 		}
-
-		// Avoid copying large, mostly irrelevant runtime and cache directories
-		// from the running system by default. Users can override this via
-		// --exclude/--exclude-from flags.
-		excludes = append(excludes,
-			"/var/cache/**",
-			"/var/tmp/**",
-			"/var/log/journal/**",
-			"/home/*/.cache/**",
-		)
+		excludes = append(excludes, rootCacheExcludes...)
 		for _, e := range excludes {
 			args = append(args, "--exclude", e)
 		}
 	}
 
+	// Report the overall transfer, which the runner parses for progress.
+	args = append(args, "--info=progress2")
+
 	var srcArg string
 	if step.Mountpoint == "/" {
 		// For the root filesystem, pass "/" without an extra trailing slash to
@@ -100,3 +123,16 @@ func BuildSyncCommand(step ExecutionStep, destRoot string, extraExcludes []strin
 	)
 	return cmd, nil
 }
+
+// rebaseExcludes returns the patterns anchored below dir (e.g. "/var/") so
+// that they are anchored at dir instead, for rsync runs whose transfer root
+// is dir. Other patterns are dropped.
+func rebaseExcludes(patterns []string, dir string) []string {
+	var res []string
+	for _, p := range patterns {
+		if strings.HasPrefix(p, dir) {
+			res = append(res, "/"+strings.TrimPrefix(p, dir))
+		}
+	}
+	return res
+}
@@ -19,7 +19,7 @@ func TestBuildSyncCommand_UsesMountpoints(t *testing.T) {
 	if !strings.HasPrefix(cmd, "rsync -aAXH --numeric-ids --whole-file --delete") {
 		t.Fatalf("expected rsync to include numeric-ids and whole-file, got: %q", cmd)
 	}
-	if !strings.HasSuffix(cmd, "/boot/ /mnt/clone/boot/") {
+	if !strings.HasSuffix(cmd, "--info=progress2 /boot/ /mnt/clone/boot/") {
 		t.Fatalf("unexpected rsync paths.\n got: %q", cmd)
 	}
 }
@@ -44,3 +44,29 @@ func TestBuildSyncCommand_RootMountpoint(t *testing.T) {
 		t.Fatalf("expected rsync command for root to contain core pseudo-filesystem excludes, got: %q", cmd)
 	}
 }
+
+func TestBuildSyncCommand_SourcePathAndStepExcludes(t *testing.T) {
+	step := ExecutionStep{
+		Operation:  OpSyncFilesystem,
+		Mountpoint: "/data",
+		SourcePath: "/srv/data",
+		Excludes:   []string{"/media/**"},
+	}
+	cmd, err := BuildSyncCommand(step, "/mnt/clone", nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(cmd, "--exclude /media/**") {
+		t.Fatalf("expected step excludes in command, got: %q", cmd)
+	}
+	if !strings.HasSuffix(cmd, "/srv/data/ /mnt/clone/data/") {
+		t.Fatalf("unexpected rsync paths.\n got: %q", cmd)
+	}
+}
+
+func TestRebaseExcludes(t *testing.T) {
+	got := rebaseExcludes([]string{"/var/lib/docker/**", "/home/**", "/var/**"}, "/var/")
+	if strings.Join(got, " ") != "/lib/docker/** /**" {
+		t.Fatalf("unexpected rebased excludes: %v", got)
+	}
+}
@@ -1,176 +1,274 @@
 package clone
 
 import (
-	"bufio"
 	"errors"
-	"os"
-	"os/exec"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+
+	"github.com/woliveiras/klon/pkg/parttable"
 )
 
 // localSystem is a System implementation that inspects the local OS to
-// discover information about disks. It is conservative and will fall back
-// to safe defaults if it cannot detect anything.
-type localSystem struct{}
+// discover information about disks. It reads sysfs, procfs and the devices
+// themselves rather than parsing command output, and is conservative: it
+// falls back to safe defaults if it cannot detect anything.
+type localSystem struct {
+	// root is prepended to /sys, /proc and /dev paths so tests can point the
+	// discovery at a fake tree. Empty means the running system.
+	root string
+}
 
-// NewLocalSystem creates a System backed by the local OS.
+// NewLocalSystem creates a System backed by the local OS. It also implements
+// DeviceSystem.
 func NewLocalSystem() System {
 	return localSystem{}
 }
 
 // AllParts exposes unmounted partitions for use with all-sync.
-func (localSystem) AllParts(disk string) []MountedPartition {
-	return allPartitionsIncludingUnmounted(disk)
+func (s localSystem) AllParts(disk string) []MountedPartition {
+	parts, _ := s.allPartitions(disk)
+	return parts
 }
 
-// BootDisk attempts to detect the device that backs the root filesystem.
-//
-// Implementation notes:
-//   - On Linux it reads /proc/self/mounts and looks for the line whose
-//     mountpoint is "/".
-//   - If anything fails, it falls back to a generic "booted-disk" string,
-//     to keep behaviour safe and predictable across platforms.
-func (localSystem) BootDisk() (string, error) {
-	data, err := os.ReadFile("/proc/self/mounts")
+// DiskSize reports the size of the given whole disk in bytes.
+func (s localSystem) DiskSize(disk string) (int64, error) {
+	dev, err := s.BlockDevice(ensureDevPrefix(disk))
 	if err != nil {
-		// Non-Linux or restricted environment: fall back.
-		return "booted-disk", nil
+		return 0, err
 	}
+	if dev.SizeBytes == 0 {
+		return 0, fmt.Errorf("sysfs reports no size for %s", disk)
+	}
+	return dev.SizeBytes, nil
+}
 
-	dev, err := parseRootDevice(string(data))
+// PartitionTable reads the partition table of a whole disk directly from the
+// device.
+func (s localSystem) PartitionTable(disk string) (*parttable.Table, error) {
+	return parttable.ReadFile(s.hostPath(ensureDevPrefix(disk)))
+}
+
+// PartitionDetails describes a source partition using sysfs for its
+// geometry, the superblock for filesystem metadata, the disk's partition
+// table for its identifiers and statfs for the used bytes of mounted
+// filesystems.
+func (s localSystem) PartitionDetails(device, mountpoint string) (PartitionDetails, error) {
+	part, err := s.BlockDevice(ensureDevPrefix(device))
 	if err != nil {
-		return "booted-disk", nil
+		return PartitionDetails{}, err
+	}
+	details := PartitionDetails{
+		StartBytes: part.StartBytes,
+		SizeBytes:  part.SizeBytes,
+	}
+	if fs, err := s.ProbeFilesystem(device); err == nil {
+		details.FSType, details.FSUUID, details.Label = fs.Type, fs.UUID, fs.Label
 	}
-	return dev, nil
+	if part.Type == DevicePartition {
+		details.PartUUID, details.PartType, _ = s.partitionIdentity(device)
+	}
+
+	if mountpoint != "" {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mountpoint, &st); err == nil {
+			details.UsedBytes = int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+		}
+	}
+	return details, nil
+}
+
+// ExcludedBytes returns how many bytes of the filesystem mounted at
+// mountpoint live under the given absolute paths (relative to mountpoint,
+// glob patterns allowed). Directories on other filesystems are not counted.
+func (localSystem) ExcludedBytes(mountpoint string, patterns []string) int64 {
+	var rootSt syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &rootSt); err != nil {
+		return 0
+	}
+
+	var roots []string
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(mountpoint, p))
+		roots = append(roots, matches...)
+	}
+	sort.Strings(roots)
+
+	var total int64
+	last := ""
+	for _, root := range roots {
+		// Skip paths nested below (or equal to) a path already measured.
+		if last != "" && (root == last || strings.HasPrefix(root, last+"/")) {
+			continue
+		}
+		last = root
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			var st syscall.Stat_t
+			if err := syscall.Lstat(path, &st); err != nil {
+				return nil
+			}
+			if uint64(st.Dev) != uint64(rootSt.Dev) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			total += int64(st.Blocks) * 512
+			return nil
+		})
+	}
+	return total
+}
+
+// BootDisk returns the block device that backs the root filesystem, e.g.
+// /dev/mmcblk0p2. It follows the root mount through its device number, so
+// /dev/root, device-mapper (LVM, LUKS) and overlay roots resolve to the
+// partition that actually holds the data; see resolveRootDevice. It fails
+// rather than guessing when it cannot decide.
+func (s localSystem) BootDisk() (string, error) {
+	return s.resolveRootDevice()
 }
 
 // MountedPartition represents a mounted partition belonging to a given disk.
 type MountedPartition struct {
 	Device     string
 	Mountpoint string
+	// Mapper is the LVM logical volume the filesystem is mounted from when
+	// the partition is its physical volume, e.g. /dev/mapper/vg0-root.
+	Mapper string
 }
 
 // MountedPartitions returns the list of mounted partitions that belong to the
-// given disk (e.g. "/dev/mmcblk0"). It uses the same /proc/self/mounts source
-// as BootDisk, and is intentionally conservative: on errors, it returns an
-// empty slice instead of failing hard.
-func (localSystem) MountedPartitions(disk string) ([]MountedPartition, error) {
-	data, err := os.ReadFile("/proc/self/mounts")
+// given disk (e.g. "/dev/mmcblk0"), in partition order. Mounts are matched to
+// partitions by device number, so sources such as /dev/root or by-uuid
+// symlinks are reported under their real device name, and filesystems on
+// an LVM logical volume under the partition holding it. It is intentionally
+// conservative: on errors, it returns an empty slice instead of failing hard.
+// It does fail when a filesystem of the disk is mounted from a
+// device-mapper device that cannot be cloned as a plain partition, rather
+// than leave that filesystem out of the clone.
+func (s localSystem) MountedPartitions(disk string) ([]MountedPartition, error) {
+	parts, err := s.allPartitions(disk)
+	if err != nil {
+		return nil, err
+	}
+	var result []MountedPartition
+	for _, p := range parts {
+		if p.Mountpoint != "" {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// allPartitions returns every partition of the disk with the place it is
+// mounted at. Mountpoint is empty when not mounted. The partitions are
+// returned even when the error of mappedMounts is.
+func (s localSystem) allPartitions(disk string) ([]MountedPartition, error) {
+	parts, err := s.Partitions(disk)
 	if err != nil {
 		// Non-Linux or restricted environment: just report no partitions.
 		return nil, nil
 	}
-	return parseMountedPartitionsForDisk(string(data), disk)
+	mounts, _ := s.Mounts()
+	mounted := mountpointsByDevice(mounts)
+	mapped, err := s.mappedMounts(mounts, parts)
+
+	res := make([]MountedPartition, 0, len(parts))
+	for _, p := range parts {
+		mp := MountedPartition{Device: p.Path, Mountpoint: mounted[p.MajMin]}
+		if m, ok := mapped[p.MajMin]; ok && mp.Mountpoint == "" {
+			mp.Mountpoint, mp.Mapper = m.Mountpoint, m.Mapper
+		}
+		res = append(res, mp)
+	}
+	return res, err
 }
 
-// allPartitionsIncludingUnmounted returns partitions of the disk using lsblk.
-// Mountpoint may be empty when not mounted.
-func allPartitionsIncludingUnmounted(disk string) []MountedPartition {
-	base := strings.TrimPrefix(baseDiskFromDevice(disk), "/dev/")
-	cmd := exec.Command("lsblk", "-nr", "-o", "NAME,MOUNTPOINT,TYPE")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil
+// mappedMounts finds the filesystems mounted from device-mapper devices
+// built on parts, keyed by the device number of the partition below them.
+// Klon clones partitions: an LVM logical volume that is the only one on its
+// physical volume, a partition, is cloned as a plain partition holding its
+// filesystem. Anything else (LUKS, several volumes on one partition, volumes
+// spanning partitions) cannot be recreated and is an error.
+func (s localSystem) mappedMounts(mounts []MountInfo, parts []BlockDevice) (map[string]MountedPartition, error) {
+	onDisk := make(map[string]bool, len(parts))
+	for _, p := range parts {
+		onDisk[p.Name] = true
 	}
-	var res []MountedPartition
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) < 3 {
+	res := make(map[string]MountedPartition)
+	var errs []error
+	for majmin, mountpoint := range mountpointsByDevice(mounts) {
+		dev, err := s.blockDeviceByNumber(majmin)
+		if err != nil || dev.Type != DeviceMapper || !s.builtOn(dev, onDisk, 0) {
 			continue
 		}
-		name, mnt, typ := fields[0], fields[1], fields[2]
-		if typ != "part" {
+		part, err := s.mappedPartition(dev)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot clone %s: %w", mountpoint, err))
 			continue
 		}
-		if !strings.HasPrefix(name, base) {
+		if other, ok := res[part.MajMin]; ok {
+			errs = append(errs, fmt.Errorf("cannot clone %s and %s: both are on %s", other.Mountpoint, mountpoint, part.Path))
 			continue
 		}
-		dev := "/dev/" + name
-		if mnt == "-" {
-			mnt = ""
-		}
-		res = append(res, MountedPartition{Device: dev, Mountpoint: mnt})
+		res[part.MajMin] = MountedPartition{Device: part.Path, Mountpoint: mountpoint, Mapper: dev.Path}
 	}
-	return res
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return res, errors.Join(errs...)
 }
 
-// parseRootDevice parses the content of /proc/self/mounts and returns the
-// device name that is mounted at "/".
-func parseRootDevice(mounts string) (string, error) {
-	scanner := bufio.NewScanner(strings.NewReader(mounts))
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+// builtOn reports whether the stacked device dev is built, directly or
+// through other stacked devices, on one of the named partitions.
+func (s localSystem) builtOn(dev BlockDevice, names map[string]bool, hops int) bool {
+	if hops > maxRootHops {
+		return false
+	}
+	for _, name := range dev.Slaves {
+		if names[name] {
+			return true
 		}
-		device := fields[0]
-		mountpoint := fields[1]
-		if mountpoint == "/" {
-			return device, nil
+		if slave, err := s.BlockDevice(name); err == nil && s.builtOn(slave, names, hops+1) {
+			return true
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-	return "", errors.New("root mount not found")
+	return false
 }
 
-// baseDiskFromDevice takes a device like "/dev/mmcblk0p2" or "/dev/sda1"
-// and returns the base disk device path ("/dev/mmcblk0" or "/dev/sda").
-func baseDiskFromDevice(dev string) string {
-	if !strings.HasPrefix(dev, "/dev/") {
-		return dev
-	}
-
-	name := strings.TrimPrefix(dev, "/dev/")
-
-	// mmcblk0p1 / nvme0n1p2 style: everything before the last 'p' is the base.
-	if strings.HasPrefix(name, "mmcblk") || strings.HasPrefix(name, "nvme") {
-		if idx := strings.LastIndex(name, "p"); idx != -1 {
-			return "/dev/" + name[:idx]
-		}
-		return "/dev/" + name
+// mappedPartition returns the partition the device-mapper device dev can be
+// cloned as: the physical volume of an LVM logical volume that is the only
+// volume on it.
+func (s localSystem) mappedPartition(dev BlockDevice) (BlockDevice, error) {
+	switch {
+	case strings.HasPrefix(dev.DMUUID, "CRYPT-"):
+		return BlockDevice{}, fmt.Errorf("%s is encrypted with LUKS, and Klon would write its data unencrypted to a plain partition", dev.Path)
+	case !strings.HasPrefix(dev.DMUUID, "LVM-"):
+		return BlockDevice{}, fmt.Errorf("%s is a device-mapper device that Klon cannot recreate on the destination", dev.Path)
+	case len(dev.Slaves) != 1:
+		return BlockDevice{}, fmt.Errorf("LVM volume %s spans %d physical volumes; Klon can only clone a volume on a single partition", dev.Path, len(dev.Slaves))
 	}
-
-	// Generic block devices: strip trailing digits (sda1 -> sda).
-	for len(name) > 0 {
-		last := name[len(name)-1]
-		if last < '0' || last > '9' {
-			break
-		}
-		name = name[:len(name)-1]
+	part, err := s.BlockDevice(dev.Slaves[0])
+	if err != nil {
+		return BlockDevice{}, err
 	}
-
-	return "/dev/" + name
-}
-
-// parseMountedPartitionsForDisk parses /proc/self/mounts contents and returns
-// the list of MountedPartition entries that belong to the given disk.
-func parseMountedPartitionsForDisk(mounts string, disk string) ([]MountedPartition, error) {
-	var result []MountedPartition
-
-	scanner := bufio.NewScanner(strings.NewReader(mounts))
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
-		}
-		device := fields[0]
-		mountpoint := fields[1]
-
-		if baseDiskFromDevice(device) == disk {
-			result = append(result, MountedPartition{
-				Device:     device,
-				Mountpoint: mountpoint,
-			})
-		}
+	if part.Type != DevicePartition {
+		return BlockDevice{}, fmt.Errorf("LVM volume %s is on %s, not directly on a partition", dev.Path, part.Path)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if len(part.Holders) > 1 {
+		return BlockDevice{}, fmt.Errorf("%s holds the LVM volumes %s; Klon clones a physical volume as a plain partition and only when it holds a single volume", part.Path, "/dev/"+strings.Join(part.Holders, ", /dev/"))
 	}
+	return part, nil
+}
 
-	return result, nil
+// allPartitionsIncludingUnmounted returns partitions of the local disk.
+// Mountpoint may be empty when not mounted.
+func allPartitionsIncludingUnmounted(disk string) []MountedPartition {
+	parts, _ := localSystem{}.allPartitions(disk)
+	return parts
 }
@@ -1,67 +1,37 @@
 package clone
 
-import "testing"
-
-func TestParseRootDevice_FindsRootLine(t *testing.T) {
-	mounts := `/dev/mmcblk0p1 /boot vfat rw,relatime 0 0
-/dev/mmcblk0p2 / ext4 rw,relatime 0 0
-tmpfs /run tmpfs rw,nosuid,noexec,relatime,size=327552k,mode=755 0 0
-`
-
-	dev, err := parseRootDevice(mounts)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if dev != "/dev/mmcblk0p2" {
-		t.Fatalf("expected /dev/mmcblk0p2, got %q", dev)
-	}
-}
-
-func TestParseRootDevice_NoRootLine(t *testing.T) {
-	mounts := `tmpfs /run tmpfs rw,nosuid,noexec,relatime,size=327552k,mode=755 0 0
-`
-
-	_, err := parseRootDevice(mounts)
-	if err == nil {
-		t.Fatalf("expected error when root mount is missing")
-	}
-}
-
-func TestBaseDiskFromDevice(t *testing.T) {
-	cases := map[string]string{
-		"/dev/mmcblk0p2": "/dev/mmcblk0",
-		"/dev/sda1":      "/dev/sda",
-		"/dev/sda":       "/dev/sda",
-		"/dev/nvme0n1p3": "/dev/nvme0n1",
-	}
-
-	for input, want := range cases {
-		got := baseDiskFromDevice(input)
-		if got != want {
-			t.Fatalf("baseDiskFromDevice(%q) = %q, want %q", input, got, want)
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalSystemExcludedBytes(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"var/cache/apt", "home/pi/.cache", "home/pi/docs"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
 		}
 	}
-}
-
-func TestParseMountedPartitionsForDisk(t *testing.T) {
-	mounts := `/dev/mmcblk0p1 /boot vfat rw,relatime 0 0
-/dev/mmcblk0p2 / ext4 rw,relatime 0 0
-/dev/sda1 /mnt/usb ext4 rw,relatime 0 0
-`
-
-	parts, err := parseMountedPartitionsForDisk(mounts, "/dev/mmcblk0")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	payload := make([]byte, 64*1024)
+	for _, f := range []string{"var/cache/apt/pkg.deb", "home/pi/.cache/blob", "home/pi/docs/keep.txt"} {
+		if err := os.WriteFile(filepath.Join(root, f), payload, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
 	}
 
-	if len(parts) != 2 {
-		t.Fatalf("expected 2 partitions for /dev/mmcblk0, got %d", len(parts))
+	sys := localSystem{}
+	one := sys.ExcludedBytes(root, []string{"/var/cache"})
+	if one < int64(len(payload)) {
+		t.Fatalf("expected at least %d excluded bytes, got %d", len(payload), one)
 	}
-	if parts[0].Device != "/dev/mmcblk0p1" || parts[0].Mountpoint != "/boot" {
-		t.Fatalf("unexpected first partition: %+v", parts[0])
+	cache := sys.ExcludedBytes(root, []string{"/home/*/.cache"})
+	if cache < int64(len(payload)) {
+		t.Fatalf("expected globbed pattern to be measured, got %d", cache)
 	}
-	if parts[1].Device != "/dev/mmcblk0p2" || parts[1].Mountpoint != "/" {
-		t.Fatalf("unexpected second partition: %+v", parts[1])
+	// Nested patterns must not be counted twice.
+	both := sys.ExcludedBytes(root, []string{"/var/cache", "/var/cache/apt", "/home/*/.cache"})
+	if both != one+cache {
+		t.Fatalf("expected %d excluded bytes for nested/globbed patterns, got %d", one+cache, both)
 	}
 }
-
@@ -0,0 +1,56 @@
+package clone
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SyncChanges counts the files a second-pass sync of a partition created,
+// updated or deleted on the destination.
+type SyncChanges struct {
+	PartitionIndex int    `json:"partition_index"`
+	Mountpoint     string `json:"mountpoint"`
+	Files          int64  `json:"files"`
+}
+
+// SecondPassSummary renders the total and per-partition changes, e.g.
+// "17 files changed since the first pass (/boot: 0, /: 17)".
+func SecondPassSummary(changes []SyncChanges) string {
+	var total int64
+	var parts []string
+	for _, c := range changes {
+		total += c.Files
+		parts = append(parts, fmt.Sprintf("%s: %d", c.Mountpoint, c.Files))
+	}
+	noun := "files"
+	if total == 1 {
+		noun = "file"
+	}
+	return fmt.Sprintf("%d %s changed since the first pass (%s)", total, noun, strings.Join(parts, ", "))
+}
+
+// rsyncChangedFiles adds up the transferred and deleted files reported by
+// rsync --stats.
+func rsyncChangedFiles(output string) int64 {
+	var n int64
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || !strings.HasPrefix(key, "Number of ") {
+			continue
+		}
+		// "Number of regular files transferred" since rsync 3.1, "Number
+		// of files transferred" before; "Number of deleted files: 3 (reg: 3)".
+		if !strings.HasSuffix(key, "files transferred") && key != "Number of deleted files" {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64); err == nil {
+			n += v
+		}
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildExecutionSteps_TwoPass(t *testing.T) {
+	plan := PlanResult{
+		DestinationDisk: "sda",
+		Partitions: []PartitionPlan{
+			{Index: 1, Device: "/dev/mmcblk0p1", Mountpoint: "/boot", Action: PartitionAction{Sync: true}},
+			{Index: 2, Device: "/dev/mmcblk0p2", Mountpoint: "/", Action: PartitionAction{Sync: true, Resize: true}},
+			{Index: 3, Device: "/dev/mmcblk0p3", Action: PartitionAction{Sync: true}},
+		},
+	}
+	var got []string
+	for _, s := range BuildExecutionSteps(plan, PlanOptions{Destination: "sda", TwoPass: true}) {
+		got = append(got, string(s.Operation)+" "+s.Mountpoint+" "+strings.Repeat("*", s.Pass))
+	}
+	want := []string{
+		"sync-filesystem /boot ",
+		"sync-filesystem / ",
+		"sync-filesystem  ",
+		"sync-filesystem /boot **",
+		"sync-filesystem / **",
+		"grow-partition  ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected steps:\n%s", strings.Join(got, "\n"))
+	}
+
+	cmd, err := BuildSyncCommand(ExecutionStep{Operation: OpSyncFilesystem, Mountpoint: "/boot", Pass: 2}, "/mnt/clone", nil, nil, false)
+	if err != nil || !strings.Contains(cmd, " --stats ") {
+		t.Fatalf("expected --stats on the second pass, got %q, %v", cmd, err)
+	}
+}
+
+func TestRsyncChangedFiles(t *testing.T) {
+	out := `
+Number of files: 45,123 (reg: 40,001, dir: 5,000, link: 122)
+Number of created files: 12 (reg: 12)
+Number of deleted files: 3 (reg: 3)
+Number of regular files transferred: 1,204
+Total file size: 2.10G bytes
+`
+	if got := rsyncChangedFiles(out); got != 1207 {
+		t.Fatalf("expected 1207 changed files, got %d", got)
+	}
+	if got := rsyncChangedFiles("Number of files transferred: 7\n"); got != 7 {
+		t.Fatalf("expected the pre-3.1 format to be read, got %d", got)
+	}
+
+	summary := SecondPassSummary([]SyncChanges{{Mountpoint: "/boot"}, {Mountpoint: "/", Files: 1207}})
+	if summary != "1207 files changed since the first pass (/boot: 0, /: 1207)" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+}
@@ -14,6 +14,12 @@ import (
 // runs fsck -n on the root and boot partitions, and runs a minimal chroot
 // check.
 func VerifyClone(plan PlanResult, opts PlanOptions, destRoot string) error {
+	return VerifyCloneWithContext(context.Background(), plan, opts, destRoot)
+}
+
+// VerifyCloneWithContext is VerifyClone with the commands it runs bound to
+// ctx: cancelling ctx stops them, and the destination is still unmounted.
+func VerifyCloneWithContext(ctx context.Context, plan PlanResult, opts PlanOptions, destRoot string) error {
 	if destRoot == "" {
 		return fmt.Errorf("VerifyClone: destRoot is empty")
 	}
@@ -41,13 +47,12 @@ func VerifyClone(plan PlanResult, opts PlanOptions, destRoot string) error {
 		return fmt.Errorf("VerifyClone: cannot create destRoot %s: %w", destRoot, err)
 	}
 
-	ctx := context.Background()
 	dstDisk := opts.Destination
-	rootPart := partitionDevice(dstDisk, rootIdx)
-	if err := shellExec(ctx, fmt.Sprintf("mount %s %s", rootPart, destRoot)); err != nil {
+	rootPart := hostDevices.partition(dstDisk, rootIdx)
+	if err := mountFS(ctx, "", rootPart, destRoot, false); err != nil {
 		return fmt.Errorf("VerifyClone: failed to mount root %s on %s: %w", rootPart, destRoot, err)
 	}
-	defer shellExec(ctx, fmt.Sprintf("umount %s", destRoot))
+	defer unmountFS(ctx, destRoot)
 
 	var bootDir string
 	var bootPart string
@@ -59,11 +64,10 @@ func VerifyClone(plan PlanResult, opts PlanOptions, destRoot string) error {
 		if err := os.MkdirAll(bootDir, 0o755); err != nil {
 			return fmt.Errorf("VerifyClone: cannot create boot dir %s: %w", bootDir, err)
 		}
-		bootPart = partitionDevice(dstDisk, bootIdx)
-		if err := shellExec(ctx, fmt.Sprintf("mount %s %s", bootPart, bootDir)); err != nil {
+		bootPart = hostDevices.partition(dstDisk, bootIdx)
+		if err := mountFS(ctx, "", bootPart, bootDir, false); err != nil {
 			return fmt.Errorf("VerifyClone: failed to mount boot %s on %s: %w", bootPart, bootDir, err)
 		}
-		defer shellExec(ctx, fmt.Sprintf("umount %s", bootDir))
 	}
 
 	// Basic filesystem structure checks.
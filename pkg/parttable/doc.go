@@ -0,0 +1,10 @@
+// Package parttable reads and writes MBR (DOS) and GPT partition tables
+// directly, without shelling out to sfdisk or parted. It works on anything
+// that can be read and written at offsets: block devices, disk image files,
+// or in-memory buffers in tests.
+//
+// GPT tables are written completely: protective MBR, primary header and
+// entries, and the backup entries and header at the end of the disk, with
+// the CRC32 checksums the UEFI specification requires. When reading, a
+// damaged primary GPT header falls back to the backup one.
+package parttable
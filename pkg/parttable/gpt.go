@@ -0,0 +1,253 @@
+package parttable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature      = "EFI PART"
+	gptRevision       = 0x00010000
+	gptHeaderSize     = 92
+	gptEntryCount     = 128
+	gptEntrySize      = 128
+	gptEntriesSectors = gptEntryCount * gptEntrySize / SectorSize
+	gptNameUnits      = 36
+)
+
+type gptHeader struct {
+	currentLBA  uint64
+	backupLBA   uint64
+	firstUsable uint64
+	lastUsable  uint64
+	diskGUID    GUID
+	entriesLBA  uint64
+	numEntries  uint32
+	entrySize   uint32
+	entriesCRC  uint32
+}
+
+func readGPT(r io.ReaderAt, diskSize int64) (*Table, error) {
+	lastLBA := uint64(diskSize/SectorSize) - 1
+	t, primaryErr := readGPTAt(r, 1)
+	if primaryErr == nil {
+		return t, nil
+	}
+	t, backupErr := readGPTAt(r, lastLBA)
+	if backupErr != nil {
+		return nil, fmt.Errorf("primary GPT is invalid (%v) and so is the backup (%v)", primaryErr, backupErr)
+	}
+	return t, nil
+}
+
+// readGPTAt parses the GPT header at lba and the entries it points to,
+// verifying both checksums.
+func readGPTAt(r io.ReaderAt, lba uint64) (*Table, error) {
+	sector := make([]byte, SectorSize)
+	if _, err := r.ReadAt(sector, int64(lba)*SectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read GPT header at sector %d: %w", lba, err)
+	}
+	h, err := parseGPTHeader(sector)
+	if err != nil {
+		return nil, err
+	}
+	if h.currentLBA != lba {
+		return nil, fmt.Errorf("GPT header at sector %d claims to be at sector %d", lba, h.currentLBA)
+	}
+	if h.entrySize < gptEntrySize || h.numEntries == 0 || h.numEntries > 1024 {
+		return nil, fmt.Errorf("unsupported GPT entry array (%d entries of %d bytes)", h.numEntries, h.entrySize)
+	}
+
+	entries := make([]byte, int(h.numEntries)*int(h.entrySize))
+	if _, err := r.ReadAt(entries, int64(h.entriesLBA)*SectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read GPT entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entries) != h.entriesCRC {
+		return nil, fmt.Errorf("GPT entries checksum mismatch")
+	}
+
+	t := &Table{Type: GPT, DiskGUID: h.diskGUID}
+	for i := 0; i < int(h.numEntries); i++ {
+		raw := entries[i*int(h.entrySize):]
+		var typeGUID, partGUID GUID
+		copy(typeGUID[:], raw[0:16])
+		if typeGUID.IsZero() {
+			continue
+		}
+		copy(partGUID[:], raw[16:32])
+		first := binary.LittleEndian.Uint64(raw[32:40])
+		last := binary.LittleEndian.Uint64(raw[40:48])
+		if last < first {
+			return nil, fmt.Errorf("GPT entry %d ends before it starts", i+1)
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Index:      i + 1,
+			StartLBA:   first,
+			Sectors:    last - first + 1,
+			Type:       typeGUID.String(),
+			GUID:       partGUID,
+			Name:       decodeGPTName(raw[56:128]),
+			Attributes: binary.LittleEndian.Uint64(raw[48:56]),
+		})
+	}
+	return t, nil
+}
+
+func parseGPTHeader(sector []byte) (gptHeader, error) {
+	if string(sector[:8]) != gptSignature {
+		return gptHeader{}, fmt.Errorf("no GPT signature")
+	}
+	size := binary.LittleEndian.Uint32(sector[12:16])
+	if size < gptHeaderSize || size > SectorSize {
+		return gptHeader{}, fmt.Errorf("invalid GPT header size %d", size)
+	}
+	want := binary.LittleEndian.Uint32(sector[16:20])
+	hdr := append([]byte{}, sector[:size]...)
+	binary.LittleEndian.PutUint32(hdr[16:20], 0)
+	if crc32.ChecksumIEEE(hdr) != want {
+		return gptHeader{}, fmt.Errorf("GPT header checksum mismatch")
+	}
+	h := gptHeader{
+		currentLBA:  binary.LittleEndian.Uint64(sector[24:32]),
+		backupLBA:   binary.LittleEndian.Uint64(sector[32:40]),
+		firstUsable: binary.LittleEndian.Uint64(sector[40:48]),
+		lastUsable:  binary.LittleEndian.Uint64(sector[48:56]),
+		entriesLBA:  binary.LittleEndian.Uint64(sector[72:80]),
+		numEntries:  binary.LittleEndian.Uint32(sector[80:84]),
+		entrySize:   binary.LittleEndian.Uint32(sector[84:88]),
+		entriesCRC:  binary.LittleEndian.Uint32(sector[88:92]),
+	}
+	copy(h.diskGUID[:], sector[56:72])
+	return h, nil
+}
+
+func (h gptHeader) marshal() []byte {
+	sector := make([]byte, SectorSize)
+	copy(sector[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(sector[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(sector[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(sector[24:32], h.currentLBA)
+	binary.LittleEndian.PutUint64(sector[32:40], h.backupLBA)
+	binary.LittleEndian.PutUint64(sector[40:48], h.firstUsable)
+	binary.LittleEndian.PutUint64(sector[48:56], h.lastUsable)
+	copy(sector[56:72], h.diskGUID[:])
+	binary.LittleEndian.PutUint64(sector[72:80], h.entriesLBA)
+	binary.LittleEndian.PutUint32(sector[80:84], h.numEntries)
+	binary.LittleEndian.PutUint32(sector[84:88], h.entrySize)
+	binary.LittleEndian.PutUint32(sector[88:92], h.entriesCRC)
+	binary.LittleEndian.PutUint32(sector[16:20], crc32.ChecksumIEEE(sector[:gptHeaderSize]))
+	return sector
+}
+
+func writeGPT(d ReadWriterAt, diskSize int64, t *Table) error {
+	diskSectors := uint64(diskSize / SectorSize)
+	lastLBA := diskSectors - 1
+	firstUsable, lastUsable := usableRange(GPT, diskSectors)
+
+	if t.DiskGUID.IsZero() {
+		g, err := NewGUID()
+		if err != nil {
+			return err
+		}
+		t.DiskGUID = g
+	}
+
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	for i := range t.Partitions {
+		p := &t.Partitions[i]
+		typeGUID, err := ParseGUID(p.Type)
+		if err != nil {
+			return fmt.Errorf("partition %d: invalid GPT partition type: %w", p.Index, err)
+		}
+		if p.GUID.IsZero() {
+			g, err := NewGUID()
+			if err != nil {
+				return err
+			}
+			p.GUID = g
+		}
+		raw := entries[(p.Index-1)*gptEntrySize:]
+		copy(raw[0:16], typeGUID[:])
+		copy(raw[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(raw[32:40], p.StartLBA)
+		binary.LittleEndian.PutUint64(raw[40:48], p.StartLBA+p.Sectors-1)
+		binary.LittleEndian.PutUint64(raw[48:56], p.Attributes)
+		if err := encodeGPTName(raw[56:128], p.Name); err != nil {
+			return fmt.Errorf("partition %d: %w", p.Index, err)
+		}
+	}
+
+	primary := gptHeader{
+		currentLBA:  1,
+		backupLBA:   lastLBA,
+		firstUsable: firstUsable,
+		lastUsable:  lastUsable,
+		diskGUID:    t.DiskGUID,
+		entriesLBA:  2,
+		numEntries:  gptEntryCount,
+		entrySize:   gptEntrySize,
+		entriesCRC:  crc32.ChecksumIEEE(entries),
+	}
+	backup := primary
+	backup.currentLBA, backup.backupLBA = lastLBA, 1
+	backup.entriesLBA = lastLBA - gptEntriesSectors
+
+	// Protective MBR covering the whole disk (capped at 2TiB), keeping any
+	// boot code.
+	sector0 := make([]byte, SectorSize)
+	if _, err := d.ReadAt(sector0, 0); err != nil {
+		return fmt.Errorf("cannot read MBR: %w", err)
+	}
+	for i := mbrBootCodeSize; i < SectorSize; i++ {
+		sector0[i] = 0
+	}
+	protective := diskSectors - 1
+	if protective > 0xffffffff {
+		protective = 0xffffffff
+	}
+	putMBREntry(sector0, 0, mbrEntry{kind: mbrTypeProtective, start: 1, sectors: uint32(protective)})
+	sector0[510], sector0[511] = 0x55, 0xaa
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, sector0},
+		{2, entries},
+		{1, primary.marshal()},
+		{backup.entriesLBA, entries},
+		{lastLBA, backup.marshal()},
+	}
+	for _, w := range writes {
+		if _, err := d.WriteAt(w.data, int64(w.lba)*SectorSize); err != nil {
+			return fmt.Errorf("cannot write GPT at sector %d: %w", w.lba, err)
+		}
+	}
+	return nil
+}
+
+func decodeGPTName(raw []byte) string {
+	units := make([]uint16, 0, gptNameUnits)
+	for i := 0; i+1 < len(raw); i += 2 {
+		u := binary.LittleEndian.Uint16(raw[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+func encodeGPTName(raw []byte, name string) error {
+	units := utf16.Encode([]rune(name))
+	if len(units) > gptNameUnits {
+		return fmt.Errorf("GPT partition name %q is longer than %d UTF-16 units", name, gptNameUnits)
+	}
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(raw[i*2:], u)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package parttable
+
+import (
+	"hash/crc32"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const (
+	linuxFSType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	efiType     = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+)
+
+func TestWriteReadGPT_RoundTrip(t *testing.T) {
+	const size = 64 << 20
+	img := newImage(t, size)
+	diskGUID, _ := ParseGUID("8e7f5a3c-1d2b-4c5d-9e8f-0a1b2c3d4e5f")
+	want := &Table{
+		Type:     GPT,
+		DiskGUID: diskGUID,
+		Partitions: []Partition{
+			{Index: 1, StartLBA: 2048, Sectors: 16 << 11, Type: efiType, Name: "EFI system"},
+			// Slot 2 stays empty; indices are preserved.
+			{Index: 3, StartLBA: 2048 + 16<<11, Sectors: 30 << 11, Type: linuxFSType, Name: "rootfs", Attributes: 1 << 2},
+		},
+	}
+	if err := WriteFile(img, want); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range want.Partitions {
+		if p.GUID.IsZero() {
+			t.Fatalf("expected Write to assign partition GUIDs")
+		}
+	}
+
+	got, err := ReadFile(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch.\n got: %+v\nwant: %+v", got, want)
+	}
+
+	data, _ := os.ReadFile(img)
+	if data[446+4] != mbrTypeProtective {
+		t.Fatalf("expected a protective MBR, got type %#x", data[446+4])
+	}
+	// Backup header and entries at the end of the disk mirror the primary.
+	lastLBA := uint64(size/SectorSize - 1)
+	backup, err := parseGPTHeader(data[lastLBA*SectorSize:])
+	if err != nil {
+		t.Fatalf("backup header invalid: %v", err)
+	}
+	if backup.currentLBA != lastLBA || backup.backupLBA != 1 || backup.entriesLBA != lastLBA-32 || backup.lastUsable != lastLBA-33 {
+		t.Fatalf("unexpected backup header: %+v", backup)
+	}
+	entries := data[backup.entriesLBA*SectorSize : backup.entriesLBA*SectorSize+gptEntryCount*gptEntrySize]
+	if crc32.ChecksumIEEE(entries) != backup.entriesCRC {
+		t.Fatalf("backup entries checksum mismatch")
+	}
+}
+
+func TestReadGPT_FallsBackToBackupHeader(t *testing.T) {
+	img := newImage(t, 32<<20)
+	table := &Table{Type: GPT, Partitions: []Partition{{Index: 1, StartLBA: 2048, Sectors: 8192, Type: linuxFSType}}}
+	if err := WriteFile(img, table); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Corrupt one byte of the primary header.
+	if err := writeAt(img, SectorSize+30, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadFile(img)
+	if err != nil {
+		t.Fatalf("expected backup header to be used, got error: %v", err)
+	}
+	if got.DiskGUID != table.DiskGUID || len(got.Partitions) != 1 || got.Partitions[0].GUID != table.Partitions[0].GUID {
+		t.Fatalf("unexpected table from backup: %+v", got)
+	}
+
+	// With both headers damaged the read fails.
+	if err := writeAt(img, 32<<20-SectorSize+30, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(img); err == nil {
+		t.Fatalf("expected error when both GPT headers are corrupt")
+	}
+}
+
+func TestRead_NoTable(t *testing.T) {
+	img := newImage(t, 8<<20)
+	if _, err := ReadFile(img); err == nil {
+		t.Fatalf("expected error for a blank disk")
+	}
+}
@@ -0,0 +1,60 @@
+package parttable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a GPT GUID in its on-disk byte order: the first three fields are
+// little-endian, the last two big-endian.
+type GUID [16]byte
+
+// ParseGUID parses the canonical "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx" form.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q: %w", s, err)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() (GUID, error) {
+	var g GUID
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, fmt.Errorf("cannot generate GUID: %w", err)
+	}
+	// Version 4 in the high nibble of the third (little-endian) field and the
+	// RFC 4122 variant in byte 8.
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g, nil
+}
+
+// IsZero reports whether g is the all-zero GUID, which marks unused GPT
+// entries.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// String renders g in lowercase canonical form.
+func (g GUID) String() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%s-%s",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		hex.EncodeToString(g[8:10]),
+		hex.EncodeToString(g[10:16]))
+}
@@ -0,0 +1,31 @@
+package parttable
+
+import "testing"
+
+func TestGUID_ParseAndStringRoundTrip(t *testing.T) {
+	const s = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	g, err := ParseGUID(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The first three fields are stored little-endian on disk.
+	if g[0] != 0x28 || g[3] != 0xc1 || g[4] != 0x1f || g[6] != 0xd2 || g[8] != 0xba {
+		t.Fatalf("unexpected on-disk bytes: % x", g[:])
+	}
+	if g.String() != s {
+		t.Fatalf("round trip mismatch: got %s", g)
+	}
+	if _, err := ParseGUID("not-a-guid"); err == nil {
+		t.Fatalf("expected error for invalid GUID")
+	}
+}
+
+func TestNewGUID_IsVersion4(t *testing.T) {
+	g, err := NewGUID()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := g.String(); s[14] != '4' {
+		t.Fatalf("expected a version 4 GUID, got %s", s)
+	}
+}
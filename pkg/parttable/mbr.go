@@ -0,0 +1,188 @@
+package parttable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	mbrTypeProtective = 0xee
+	// mbrBootCodeSize is the part of sector 0 before the disk signature.
+	mbrBootCodeSize  = 440
+	mbrEntriesOffset = 446
+	mbrEntrySize     = 16
+	// maxLogicalPartitions bounds the EBR chain walk so a looping chain on a
+	// corrupt disk cannot hang the reader.
+	maxLogicalPartitions = 128
+)
+
+type mbrEntry struct {
+	bootable bool
+	kind     byte
+	start    uint32
+	sectors  uint32
+}
+
+func parseMBREntries(sector []byte) []mbrEntry {
+	entries := make([]mbrEntry, 4)
+	for i := range entries {
+		raw := sector[mbrEntriesOffset+i*mbrEntrySize:]
+		entries[i] = mbrEntry{
+			bootable: raw[0] == 0x80,
+			kind:     raw[4],
+			start:    binary.LittleEndian.Uint32(raw[8:12]),
+			sectors:  binary.LittleEndian.Uint32(raw[12:16]),
+		}
+	}
+	return entries
+}
+
+func putMBREntry(sector []byte, slot int, e mbrEntry) {
+	raw := sector[mbrEntriesOffset+slot*mbrEntrySize : mbrEntriesOffset+(slot+1)*mbrEntrySize]
+	for i := range raw {
+		raw[i] = 0
+	}
+	if e.kind == 0 {
+		return
+	}
+	if e.bootable {
+		raw[0] = 0x80
+	}
+	// CHS addressing is obsolete; mark both ends as "beyond CHS range" the
+	// way modern partitioning tools do.
+	copy(raw[1:4], []byte{0xfe, 0xff, 0xff})
+	raw[4] = e.kind
+	copy(raw[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(raw[8:12], e.start)
+	binary.LittleEndian.PutUint32(raw[12:16], e.sectors)
+}
+
+func isExtended(kind byte) bool {
+	return kind == 0x05 || kind == 0x0f || kind == 0x85
+}
+
+func mbrTypeString(kind byte) string {
+	return strconv.FormatUint(uint64(kind), 16)
+}
+
+func parseMBRType(s string) (byte, error) {
+	n, err := strconv.ParseUint(s, 16, 8)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid MBR partition type %q", s)
+	}
+	return byte(n), nil
+}
+
+func readMBR(r io.ReaderAt, sector0 []byte) (*Table, error) {
+	t := &Table{
+		Type:          DOS,
+		DiskSignature: binary.LittleEndian.Uint32(sector0[mbrBootCodeSize:]),
+	}
+	var extended *mbrEntry
+	for i, e := range parseMBREntries(sector0) {
+		if e.kind == 0 {
+			continue
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Index:    i + 1,
+			StartLBA: uint64(e.start),
+			Sectors:  uint64(e.sectors),
+			Type:     mbrTypeString(e.kind),
+			Bootable: e.bootable,
+		})
+		if isExtended(e.kind) && extended == nil {
+			e := e
+			extended = &e
+		}
+	}
+	if extended == nil {
+		return t, nil
+	}
+
+	// Logical partitions: each EBR describes one partition relative to the
+	// EBR itself and links to the next EBR relative to the extended start.
+	ebr := make([]byte, SectorSize)
+	ebrLBA := uint64(extended.start)
+	for n := 0; n < maxLogicalPartitions; n++ {
+		if _, err := r.ReadAt(ebr, int64(ebrLBA)*SectorSize); err != nil {
+			return nil, fmt.Errorf("cannot read EBR at sector %d: %w", ebrLBA, err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, fmt.Errorf("invalid EBR signature at sector %d", ebrLBA)
+		}
+		entries := parseMBREntries(ebr)
+		if entries[0].kind != 0 {
+			t.Partitions = append(t.Partitions, Partition{
+				Index:    5 + n,
+				StartLBA: ebrLBA + uint64(entries[0].start),
+				Sectors:  uint64(entries[0].sectors),
+				Type:     mbrTypeString(entries[0].kind),
+				Bootable: entries[0].bootable,
+			})
+		}
+		if entries[1].kind == 0 || entries[1].start == 0 {
+			return t, nil
+		}
+		ebrLBA = uint64(extended.start) + uint64(entries[1].start)
+	}
+	return nil, fmt.Errorf("EBR chain longer than %d entries", maxLogicalPartitions)
+}
+
+func writeMBR(d ReadWriterAt, diskSize int64, t *Table) error {
+	sector0 := make([]byte, SectorSize)
+	if _, err := d.ReadAt(sector0, 0); err != nil {
+		return fmt.Errorf("cannot read MBR: %w", err)
+	}
+	if t.DiskSignature == 0 {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return fmt.Errorf("cannot generate disk signature: %w", err)
+		}
+		t.DiskSignature = binary.LittleEndian.Uint32(b[:])
+	}
+	binary.LittleEndian.PutUint32(sector0[mbrBootCodeSize:], t.DiskSignature)
+	sector0[444], sector0[445] = 0, 0
+	for slot := 0; slot < 4; slot++ {
+		putMBREntry(sector0, slot, mbrEntry{})
+	}
+	for _, p := range t.Partitions {
+		kind, err := parseMBRType(p.Type)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", p.Index, err)
+		}
+		putMBREntry(sector0, p.Index-1, mbrEntry{
+			bootable: p.Bootable,
+			kind:     kind,
+			start:    uint32(p.StartLBA),
+			sectors:  uint32(p.Sectors),
+		})
+	}
+	sector0[510], sector0[511] = 0x55, 0xaa
+	if _, err := d.WriteAt(sector0, 0); err != nil {
+		return fmt.Errorf("cannot write MBR: %w", err)
+	}
+
+	// A stale GPT would otherwise still be found by tools that look for it
+	// before the MBR (and by the kernel with gpt=1).
+	return eraseGPTHeaders(d, diskSize)
+}
+
+// eraseGPTHeaders zeroes the primary and backup GPT headers if present.
+func eraseGPTHeaders(d ReadWriterAt, diskSize int64) error {
+	sector := make([]byte, SectorSize)
+	for _, lba := range []int64{1, diskSize/SectorSize - 1} {
+		if _, err := d.ReadAt(sector, lba*SectorSize); err != nil {
+			return fmt.Errorf("cannot read sector %d: %w", lba, err)
+		}
+		if string(sector[:8]) != gptSignature {
+			continue
+		}
+		if _, err := d.WriteAt(make([]byte, SectorSize), lba*SectorSize); err != nil {
+			return fmt.Errorf("cannot erase GPT header at sector %d: %w", lba, err)
+		}
+	}
+	return nil
+}
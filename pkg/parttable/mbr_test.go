@@ -0,0 +1,149 @@
+package parttable
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newImage creates a sparse disk image of the given size in a temp dir.
+func newImage(t *testing.T, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("cannot create image: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("cannot size image: %v", err)
+	}
+	f.Close()
+	return path
+}
+
+func TestWriteReadMBR_RoundTrip(t *testing.T) {
+	img := newImage(t, 64<<20)
+	// Boot code must survive a table rewrite.
+	if err := writeAt(img, 0, []byte{0xeb, 0x63, 0x90}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Table{
+		Type:          DOS,
+		DiskSignature: 0x1234abcd,
+		Partitions: []Partition{
+			{Index: 1, StartLBA: 2048, Sectors: 16 << 11, Type: "c", Bootable: true},
+			{Index: 2, StartLBA: 2048 + 16<<11, Sectors: 40 << 11, Type: "83"},
+		},
+	}
+	if err := WriteFile(img, want); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := ReadFile(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch.\n got: %+v\nwant: %+v", got, want)
+	}
+
+	data, _ := os.ReadFile(img)
+	if data[0] != 0xeb || data[510] != 0x55 || data[511] != 0xaa {
+		t.Fatalf("boot code or signature not preserved: % x ... % x", data[:3], data[510:512])
+	}
+}
+
+func TestReadMBR_LogicalPartitions(t *testing.T) {
+	img := newImage(t, 64<<20)
+	sector := make([]byte, SectorSize)
+	putMBREntry(sector, 0, mbrEntry{kind: 0x0c, start: 2048, sectors: 8192})
+	putMBREntry(sector, 1, mbrEntry{kind: 0x05, start: 10240, sectors: 40960})
+	sector[510], sector[511] = 0x55, 0xaa
+	if err := writeAt(img, 0, sector); err != nil {
+		t.Fatal(err)
+	}
+	// First EBR: logical partition 5 plus a link to the second EBR.
+	ebr := make([]byte, SectorSize)
+	putMBREntry(ebr, 0, mbrEntry{kind: 0x83, start: 2048, sectors: 8192})
+	putMBREntry(ebr, 1, mbrEntry{kind: 0x05, start: 20480, sectors: 10240})
+	ebr[510], ebr[511] = 0x55, 0xaa
+	if err := writeAt(img, 10240*SectorSize, ebr); err != nil {
+		t.Fatal(err)
+	}
+	ebr2 := make([]byte, SectorSize)
+	putMBREntry(ebr2, 0, mbrEntry{kind: 0x82, start: 2048, sectors: 4096})
+	ebr2[510], ebr2[511] = 0x55, 0xaa
+	if err := writeAt(img, (10240+20480)*SectorSize, ebr2); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := ReadFile(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(table.Partitions) != 4 {
+		t.Fatalf("expected 2 primary and 2 logical partitions, got %+v", table.Partitions)
+	}
+	p5, _ := table.Partition(5)
+	p6, _ := table.Partition(6)
+	if p5.StartLBA != 12288 || p5.Type != "83" || p6.StartLBA != 32768 || p6.Type != "82" {
+		t.Fatalf("unexpected logical partitions: %+v %+v", p5, p6)
+	}
+}
+
+func TestWriteMBR_ErasesStaleGPT(t *testing.T) {
+	img := newImage(t, 64<<20)
+	gpt := &Table{Type: GPT, Partitions: []Partition{{Index: 1, StartLBA: 2048, Sectors: 2048, Type: linuxFSType}}}
+	if err := WriteFile(img, gpt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dos := &Table{Type: DOS, Partitions: []Partition{{Index: 1, StartLBA: 2048, Sectors: 2048, Type: "83"}}}
+	if err := WriteFile(img, dos); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := ReadFile(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Type != DOS {
+		t.Fatalf("expected dos table, got %s", got.Type)
+	}
+	data, _ := os.ReadFile(img)
+	if string(data[SectorSize:SectorSize+8]) == gptSignature || string(data[len(data)-SectorSize:len(data)-SectorSize+8]) == gptSignature {
+		t.Fatalf("stale GPT header left on disk")
+	}
+	if sig := binary.LittleEndian.Uint32(data[mbrBootCodeSize:]); sig == 0 || sig != got.DiskSignature {
+		t.Fatalf("expected a random disk signature to be written, got %#x", sig)
+	}
+}
+
+func TestWrite_RejectsInvalidTables(t *testing.T) {
+	img := newImage(t, 64<<20)
+	cases := map[string]*Table{
+		"overlap": {Type: DOS, Partitions: []Partition{
+			{Index: 1, StartLBA: 2048, Sectors: 4096, Type: "83"},
+			{Index: 2, StartLBA: 4096, Sectors: 4096, Type: "83"},
+		}},
+		"beyond end": {Type: DOS, Partitions: []Partition{{Index: 1, StartLBA: 2048, Sectors: 1 << 20, Type: "83"}}},
+		"logical":    {Type: DOS, Partitions: []Partition{{Index: 5, StartLBA: 2048, Sectors: 2048, Type: "83"}}},
+		"gpt area":   {Type: GPT, Partitions: []Partition{{Index: 1, StartLBA: 10, Sectors: 2048, Type: linuxFSType}}},
+		"bad type":   {Type: GPT, Partitions: []Partition{{Index: 1, StartLBA: 2048, Sectors: 2048, Type: "83"}}},
+	}
+	for name, table := range cases {
+		if err := WriteFile(img, table); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func writeAt(path string, off int64, data []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(data, off)
+	return err
+}
@@ -0,0 +1,206 @@
+package parttable
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// SectorSize is the logical sector size the tables are read and written
+// with. 4Kn disks are not supported.
+const SectorSize = 512
+
+// Table types, matching the "label" names used by sfdisk.
+const (
+	DOS = "dos"
+	GPT = "gpt"
+)
+
+// ErrNoTable is returned by Read when the disk has no MBR boot signature.
+var ErrNoTable = errors.New("no partition table found")
+
+// Table is a partition table.
+type Table struct {
+	// Type is DOS or GPT.
+	Type string
+	// DiskSignature is the MBR disk identifier of DOS tables. Write picks a
+	// random one when it is zero.
+	DiskSignature uint32
+	// DiskGUID identifies GPT disks. Write picks a random one when it is zero.
+	DiskGUID   GUID
+	Partitions []Partition
+}
+
+// Partition is one entry of a Table.
+type Partition struct {
+	// Index is the partition number as the kernel names it (sda1 is 1). For
+	// GPT it is the entry slot plus one; for DOS, 1-4 are primary entries and
+	// 5 and up are logical partitions inside the extended partition.
+	Index    int
+	StartLBA uint64
+	Sectors  uint64
+	// Type is the MBR type byte in lowercase hex without "0x" (e.g. "83",
+	// "c") for DOS, or the lowercase partition type GUID for GPT.
+	Type string
+	// GUID is the unique partition GUID (PARTUUID) of GPT partitions. Write
+	// picks a random one when it is zero.
+	GUID GUID
+	// Name is the GPT partition name.
+	Name string
+	// Bootable is the MBR active flag.
+	Bootable bool
+	// Attributes are the GPT attribute bits.
+	Attributes uint64
+}
+
+// StartBytes returns the offset of the partition in bytes.
+func (p Partition) StartBytes() int64 {
+	return int64(p.StartLBA) * SectorSize
+}
+
+// SizeBytes returns the size of the partition in bytes.
+func (p Partition) SizeBytes() int64 {
+	return int64(p.Sectors) * SectorSize
+}
+
+// Partition returns the partition with the given index.
+func (t Table) Partition(index int) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Index == index {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// Read parses the partition table of a disk of diskSize bytes.
+func Read(r io.ReaderAt, diskSize int64) (*Table, error) {
+	mbr := make([]byte, SectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("cannot read MBR: %w", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoTable
+	}
+	for _, e := range parseMBREntries(mbr) {
+		if e.kind == mbrTypeProtective {
+			return readGPT(r, diskSize)
+		}
+	}
+	return readMBR(r, mbr)
+}
+
+// ReadWriterAt is what Write needs from a disk: it reads the existing boot
+// code before writing the new table.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Write replaces the partition table of a disk of diskSize bytes with t.
+// Boot code in the first 440 bytes of the disk is preserved. Zero disk
+// identifiers and partition GUIDs in t are replaced with random ones.
+func Write(d ReadWriterAt, diskSize int64, t *Table) error {
+	if err := t.validate(diskSize); err != nil {
+		return err
+	}
+	switch t.Type {
+	case DOS:
+		return writeMBR(d, diskSize, t)
+	case GPT:
+		return writeGPT(d, diskSize, t)
+	default:
+		return fmt.Errorf("unknown table type %q", t.Type)
+	}
+}
+
+// ReadFile reads the partition table of a block device or disk image.
+func ReadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine size of %s: %w", path, err)
+	}
+	t, err := Read(f, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// WriteFile writes t to a block device or disk image and flushes it.
+func WriteFile(path string, t *Table) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot determine size of %s: %w", path, err)
+	}
+	if err := Write(f, size, t); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot flush %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// usableRange returns the first and last LBA partitions may use.
+func usableRange(tableType string, diskSectors uint64) (first, last uint64) {
+	if tableType == GPT {
+		return 2 + gptEntriesSectors, diskSectors - 2 - gptEntriesSectors
+	}
+	return 1, diskSectors - 1
+}
+
+func (t *Table) validate(diskSize int64) error {
+	diskSectors := uint64(diskSize / SectorSize)
+	if diskSectors < 2+2*(1+gptEntriesSectors) {
+		return fmt.Errorf("disk of %d bytes is too small for a partition table", diskSize)
+	}
+	first, last := usableRange(t.Type, diskSectors)
+
+	parts := append([]Partition{}, t.Partitions...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].StartLBA < parts[j].StartLBA })
+	seen := make(map[int]bool)
+	for i, p := range parts {
+		if p.Index <= 0 || seen[p.Index] {
+			return fmt.Errorf("partition index %d is invalid or used twice", p.Index)
+		}
+		seen[p.Index] = true
+		if t.Type == DOS && p.Index > 4 {
+			return fmt.Errorf("partition %d: writing logical partitions is not supported", p.Index)
+		}
+		if t.Type == GPT && p.Index > gptEntryCount {
+			return fmt.Errorf("partition %d: GPT holds at most %d partitions", p.Index, gptEntryCount)
+		}
+		if p.Sectors == 0 {
+			return fmt.Errorf("partition %d is empty", p.Index)
+		}
+		end := p.StartLBA + p.Sectors - 1
+		if p.StartLBA < first || end > last {
+			return fmt.Errorf("partition %d (sectors %d-%d) is outside the usable range %d-%d", p.Index, p.StartLBA, end, first, last)
+		}
+		if t.Type == DOS && end > 0xffffffff {
+			return fmt.Errorf("partition %d ends beyond 2TiB, which a dos table cannot address", p.Index)
+		}
+		if i > 0 {
+			prev := parts[i-1]
+			if prev.StartLBA+prev.Sectors > p.StartLBA {
+				return fmt.Errorf("partitions %d and %d overlap", prev.Index, p.Index)
+			}
+		}
+	}
+	return nil
+}